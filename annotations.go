@@ -0,0 +1,299 @@
+package vnc2video
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AnnotationConfig configures the annotations of the input sent by the
+// client, a zero duration, size or color takes the default
+type AnnotationConfig struct {
+	// Clicks draws a ripple around the pointer on every button press
+	Clicks        bool
+	ClickDuration time.Duration
+	ClickRadius   int
+	ClickColor    color.NRGBA
+	// Keys shows the last keys pressed as a caption at the bottom of the
+	// frame, each one for KeyDuration
+	Keys          bool
+	KeyDuration   time.Duration
+	MaxKeys       int
+	KeyScale      int
+	KeyColor      color.NRGBA
+	KeyBackground color.NRGBA
+	// Magnify draws the area around the pointer zoomed by Magnify next to
+	// it, 0 or 1 disables the magnifier
+	Magnify       int
+	MagnifyRadius int
+}
+
+func (cfg AnnotationConfig) withDefaults() AnnotationConfig {
+	if cfg.ClickDuration == 0 {
+		cfg.ClickDuration = 500 * time.Millisecond
+	}
+	if cfg.ClickRadius == 0 {
+		cfg.ClickRadius = 24
+	}
+	if cfg.ClickColor == (color.NRGBA{}) {
+		cfg.ClickColor = color.NRGBA{R: 0xff, G: 0xd0, A: 0xc0}
+	}
+	if cfg.KeyDuration == 0 {
+		cfg.KeyDuration = 2 * time.Second
+	}
+	if cfg.MaxKeys == 0 {
+		cfg.MaxKeys = 16
+	}
+	if cfg.KeyScale == 0 {
+		cfg.KeyScale = 3
+	}
+	if cfg.KeyColor == (color.NRGBA{}) {
+		cfg.KeyColor = color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	}
+	if cfg.KeyBackground == (color.NRGBA{}) {
+		cfg.KeyBackground = color.NRGBA{A: 0xa0}
+	}
+	if cfg.MagnifyRadius == 0 {
+		cfg.MagnifyRadius = 32
+	}
+	return cfg
+}
+
+type annotationClick struct {
+	pos image.Point
+	at  time.Time
+}
+
+type annotationKey struct {
+	label string
+	at    time.Time
+}
+
+// Annotations is a FrameOverlay highlighting the pointer and key events
+// sent to the server, which it gets through Tap
+type Annotations struct {
+	cfg AnnotationConfig
+	now func() time.Time
+
+	mu         sync.Mutex
+	pointer    image.Point
+	hasPointer bool
+	buttons    uint8
+	modifiers  map[Key]bool
+	clicks     []annotationClick
+	keys       []annotationKey
+}
+
+// NewAnnotations returns the annotations configured by cfg
+func NewAnnotations(cfg AnnotationConfig) *Annotations {
+	return &Annotations{cfg: cfg.withDefaults(), now: time.Now, modifiers: make(map[Key]bool)}
+}
+
+// Tap records the pointer and key events among the messages sent by the
+// client, the standard, QEMU extended and ATEN ones. Pointer events hold
+// absolute positions.
+func (a *Annotations) Tap(msg ClientMessage) {
+	a.tap(msg, false)
+}
+
+// TapRelative is Tap for a client in relative pointer mode, the pointer
+// events hold movements which are added to the last position
+func (a *Annotations) TapRelative(msg ClientMessage) {
+	a.tap(msg, true)
+}
+
+func (a *Annotations) tap(msg ClientMessage, relative bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch msg := msg.(type) {
+	case *PointerEvent:
+		a.pointerEvent(msg.Mask, msg.X, msg.Y, relative)
+	case *AteniKVMPointerEvent:
+		a.pointerEvent(msg.Mask, msg.X, msg.Y, relative)
+	case *KeyEvent:
+		a.keyEvent(msg.Key, msg.Down != 0)
+	case *QEMUExtendedKeyEvent:
+		a.keyEvent(msg.Key, msg.Down != 0)
+	case *AteniKVMKeyEvent:
+		a.keyEvent(msg.Key, msg.Down != 0)
+	}
+}
+
+func (a *Annotations) pointerEvent(mask uint8, x, y uint16, relative bool) {
+	if relative {
+		a.pointer.X += int(x) - relativePointerOrigin
+		a.pointer.Y += int(y) - relativePointerOrigin
+	} else {
+		a.pointer = image.Point{X: int(x), Y: int(y)}
+	}
+	a.hasPointer = true
+	if pressed := mask &^ a.buttons; pressed != 0 && a.cfg.Clicks {
+		a.clicks = append(a.clicks, annotationClick{pos: a.pointer, at: a.now()})
+	}
+	a.buttons = mask
+}
+
+func (a *Annotations) keyEvent(key Key, down bool) {
+	if name := modifierName(key); name != "" {
+		a.modifiers[key] = down
+		return
+	}
+	if !down || !a.cfg.Keys {
+		return
+	}
+	a.keys = append(a.keys, annotationKey{label: a.keyLabel(key), at: a.now()})
+	if len(a.keys) > a.cfg.MaxKeys {
+		a.keys = a.keys[len(a.keys)-a.cfg.MaxKeys:]
+	}
+}
+
+// modifierName returns the name of a modifier key, "" for other keys
+func modifierName(k Key) string {
+	switch k {
+	case ShiftLeft, ShiftRight:
+		return "Shift"
+	case ControlLeft, ControlRight:
+		return "Ctrl"
+	case AltLeft, AltRight:
+		return "Alt"
+	case MetaLeft, MetaRight:
+		return "Meta"
+	case SuperLeft, SuperRight:
+		return "Super"
+	}
+	return ""
+}
+
+// keyLabel returns the caption of k with the modifiers held, shift is only
+// shown for keys which aren't characters
+func (a *Annotations) keyLabel(k Key) string {
+	printable := k >= Space && k <= AsciiTilde
+	var label string
+	switch {
+	case printable:
+		label = string(rune(k))
+	case strings.HasPrefix(k.String(), "Key("):
+		label = fmt.Sprintf("0x%x", uint32(k))
+	default:
+		label = k.String()
+	}
+	var mods []string
+	for _, m := range []Key{ControlLeft, AltLeft, MetaLeft, SuperLeft, ShiftLeft} {
+		if !a.modifiers[m] && !a.modifiers[m+1] {
+			continue
+		}
+		if m == ShiftLeft && printable && k != Space {
+			continue
+		}
+		mods = append(mods, modifierName(m))
+	}
+	if k == Space && len(mods) > 0 {
+		label = "Space"
+	}
+	if len(mods) > 0 || len(label) > 1 {
+		return "[" + strings.Join(append(mods, label), "+") + "]"
+	}
+	return label
+}
+
+// DrawOverlay implements FrameOverlay
+func (a *Annotations) DrawOverlay(dst draw.Image, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cfg.Magnify > 1 && a.hasPointer {
+		a.drawMagnifier(dst)
+	}
+	a.drawClicks(dst, now)
+	a.drawKeys(dst, now)
+}
+
+// drawClicks draws a ring growing and fading out for every recent click
+func (a *Annotations) drawClicks(dst draw.Image, now time.Time) {
+	live := a.clicks[:0]
+	for _, click := range a.clicks {
+		age := now.Sub(click.at)
+		if age >= a.cfg.ClickDuration {
+			continue
+		}
+		live = append(live, click)
+		if age < 0 {
+			continue
+		}
+		progress := float64(age) / float64(a.cfg.ClickDuration)
+		col := a.cfg.ClickColor
+		col.A = uint8(float64(col.A) * (1 - progress))
+		radius := a.cfg.ClickRadius/3 + int(float64(a.cfg.ClickRadius)*progress*2/3)
+		drawRing(dst, click.pos, radius, 3, col)
+	}
+	a.clicks = live
+}
+
+// drawKeys draws the caption of the recent key presses
+func (a *Annotations) drawKeys(dst draw.Image, now time.Time) {
+	live := a.keys[:0]
+	for _, key := range a.keys {
+		if now.Sub(key.at) < a.cfg.KeyDuration {
+			live = append(live, key)
+		}
+	}
+	a.keys = live
+	if len(live) == 0 {
+		return
+	}
+	var text strings.Builder
+	for _, key := range live {
+		text.WriteString(key.label)
+	}
+	caption := text.String()
+	scale := a.cfg.KeyScale
+	b := dst.Bounds()
+	size := textSize(caption, scale)
+	// keep the end of captions too wide for the frame
+	for size.X > b.Dx()-4*scale && len(caption) > 1 {
+		caption = caption[1:]
+		size = textSize(caption, scale)
+	}
+	pad := 2 * scale
+	p := image.Point{X: b.Min.X + (b.Dx()-size.X)/2, Y: b.Max.Y - size.Y - 4*pad}
+	fillRectAlpha(dst, image.Rectangle{Min: p, Max: p.Add(size)}.Inset(-pad), a.cfg.KeyBackground)
+	drawText(dst, p, caption, scale, a.cfg.KeyColor)
+}
+
+// drawMagnifier draws the zoomed area around the pointer in a square next
+// to it, on the side with the most room
+func (a *Annotations) drawMagnifier(dst draw.Image) {
+	radius, zoom := a.cfg.MagnifyRadius, a.cfg.Magnify
+	src := image.Rect(a.pointer.X-radius, a.pointer.Y-radius, a.pointer.X+radius, a.pointer.Y+radius)
+	patch := NewRGBImage(src)
+	copyPixels(patch, dst, src.Intersect(dst.Bounds()))
+
+	b := dst.Bounds()
+	size := 2 * radius * zoom
+	offset := radius + 8
+	origin := image.Point{X: a.pointer.X + offset, Y: a.pointer.Y + offset}
+	if origin.X+size > b.Max.X {
+		origin.X = a.pointer.X - offset - size
+	}
+	if origin.Y+size > b.Max.Y {
+		origin.Y = a.pointer.Y - offset - size
+	}
+	// keep it inside the frame when there is no room on either side
+	if origin.X < b.Min.X {
+		origin.X = Min(b.Min.X, b.Max.X-size)
+	}
+	if origin.Y < b.Min.Y {
+		origin.Y = Min(b.Min.Y, b.Max.Y-size)
+	}
+	view := image.Rect(origin.X, origin.Y, origin.X+size, origin.Y+size)
+	fillRectAlpha(dst, view.Inset(-2), color.NRGBA{R: 0x40, G: 0x40, B: 0x40, A: 0xff})
+	r := view.Intersect(b)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			dst.Set(x, y, patch.At(src.Min.X+(x-origin.X)/zoom, src.Min.Y+(y-origin.Y)/zoom))
+		}
+	}
+}
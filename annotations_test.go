@@ -0,0 +1,88 @@
+package vnc2video
+
+import (
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+func changedPixels(img image.Image) int {
+	n := 0
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if rgbAt(img, x, y) != (color.RGBA{}) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestAnnotations(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := NewAnnotations(AnnotationConfig{Clicks: true, Keys: true})
+	a.now = func() time.Time { return start }
+
+	a.Tap(&PointerEvent{X: 50, Y: 20})
+	a.Tap(&PointerEvent{Mask: 1, X: 50, Y: 20})
+	a.Tap(&PointerEvent{Mask: 1, X: 52, Y: 20})
+	if len(a.clicks) != 1 {
+		t.Fatalf("%d clicks recorded, want only the press", len(a.clicks))
+	}
+	a.Tap(&KeyEvent{Down: 1, Key: ControlLeft})
+	a.Tap(&KeyEvent{Down: 1, Key: SmallC})
+	a.Tap(&KeyEvent{Down: 0, Key: ControlLeft})
+	a.Tap(&KeyEvent{Down: 1, Key: SmallA})
+	a.Tap(&KeyEvent{Down: 0, Key: SmallA})
+	a.Tap(&KeyEvent{Down: 1, Key: Return})
+	var labels []string
+	for _, k := range a.keys {
+		labels = append(labels, k.label)
+	}
+	if want := []string{"[Ctrl+c]", "a", "[Return]"}; len(labels) != len(want) || labels[0] != want[0] || labels[1] != want[1] || labels[2] != want[2] {
+		t.Errorf("key captions are %q, want %q", labels, want)
+	}
+
+	// the click ring and the caption are drawn over the frame only while
+	// they last
+	canvas := NewVncCanvas(200, 100)
+	canvas.AddOverlay(a)
+	frame := canvas.FrameAt(start.Add(100 * time.Millisecond))
+	if rgbAt(frame, 50, 20) != (color.RGBA{}) {
+		t.Error("ripple drawn over the click position")
+	}
+	if changedPixels(frame.(*RGBImage).SubImage(image.Rect(20, 0, 80, 50))) == 0 {
+		t.Error("no ripple around the click")
+	}
+	if changedPixels(frame.(*RGBImage).SubImage(image.Rect(0, 60, 200, 100))) == 0 {
+		t.Error("no key caption")
+	}
+	if changedPixels(canvas.Image) != 0 {
+		t.Error("annotations drawn into the framebuffer")
+	}
+	if changedPixels(canvas.FrameAt(start.Add(3*time.Second))) != 0 {
+		t.Error("annotations drawn after they expired")
+	}
+}
+
+func TestAnnotationsTapEvents(t *testing.T) {
+	a := NewAnnotations(AnnotationConfig{Clicks: true, Keys: true})
+	a.Tap(&QEMUExtendedKeyEvent{Down: 1, Key: SmallQ, Keycode: 0x10})
+	a.Tap(&AteniKVMKeyEvent{Down: 1, Key: SmallW})
+	a.Tap(&AteniKVMPointerEvent{Mask: 1, X: 30, Y: 40})
+	if len(a.keys) != 2 || a.keys[0].label != "q" || a.keys[1].label != "w" {
+		t.Errorf("keys are %v", a.keys)
+	}
+	if len(a.clicks) != 1 || a.pointer != (image.Point{30, 40}) {
+		t.Errorf("aten pointer event at %v, %d clicks", a.pointer, len(a.clicks))
+	}
+
+	// relative events move the pointer from its last position
+	a.TapRelative(NewRelativePointerEvent(1, 5, -10))
+	a.TapRelative(NewRelativePointerEvent(0, -2, 3))
+	if a.pointer != (image.Point{33, 33}) {
+		t.Errorf("pointer at %v after relative moves, want (33,33)", a.pointer)
+	}
+}
@@ -5,8 +5,12 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
+	"image"
+	"io"
 	"net"
+	"strconv"
 	"sync"
+	"time"
 	"github.com/amitbet/vnc2video/logger"
 )
 
@@ -25,7 +29,7 @@ var (
 func Connect(ctx context.Context, c net.Conn, cfg *ClientConfig) (*ClientConn, error) {
 	conn, err := NewClientConn(c, cfg)
 	if err != nil {
-		conn.Close()
+		c.Close()
 		cfg.ErrorCh <- err
 		return nil, err
 	}
@@ -36,19 +40,39 @@ func Connect(ctx context.Context, c net.Conn, cfg *ClientConfig) (*ClientConn, e
 
 	for _, h := range cfg.Handlers {
 		if err := h.Handle(conn); err != nil {
-			logger.Error("Handshake failed, check that server is running: ", err)
+			connLogger(conn).Error("Handshake failed, check that server is running: ", err)
 			conn.Close()
 			cfg.ErrorCh <- err
 			return nil, err
 		}
 	}
 
-	canvas := NewVncCanvas(int(conn.Width()), int(conn.Height()))
-	canvas.DrawCursor = cfg.DrawCursor
-	conn.Canvas = canvas
+	conn.initCanvas()
 	return conn, nil
 }
 
+// initCanvas creates the canvas once the framebuffer size is known, before
+// the message handler starts drawing into it, and makes it the target of
+// the renderers
+func (c *ClientConn) initCanvas() {
+	if c.Canvas != nil {
+		return
+	}
+	canvas := NewVncCanvas(int(c.Width()), int(c.Height()))
+	canvas.DrawCursor = c.cfg.DrawCursor
+	canvas.FrameCursor = c.cfg.FrameCursor
+	canvas.SetCrop(c.cfg.CaptureRegion)
+	if c.annotations != nil {
+		canvas.AddOverlay(c.annotations)
+	}
+	c.Canvas = canvas
+	for _, enc := range c.encodings {
+		if renderer, ok := enc.(Renderer); ok {
+			renderer.SetTargetImage(canvas)
+		}
+	}
+}
+
 var _ Conn = (*ClientConn)(nil)
 
 // Config returns connection config
@@ -72,6 +96,8 @@ func (c *ClientConn) Wait() {
 
 // Conn return underlining net.Conn
 func (c *ClientConn) Conn() net.Conn {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
 	return c.c
 }
 
@@ -80,15 +106,21 @@ func (c *ClientConn) SetProtoVersion(pv string) {
 	c.protocol = pv
 }
 
-// SetEncodings write SetEncodings message
+// SetEncodings write SetEncodings message, the pseudo-encodings of the
+// quality options are added to encs
 func (c *ClientConn) SetEncodings(encs []EncodingType) error {
+	c.encMu.Lock()
+	c.encTypes = append([]EncodingType{}, encs...)
+	quality := c.quality
+	c.encMu.Unlock()
+	encs = withQuality(encs, quality)
 
 	msg := &SetEncodings{
 		EncNum:    uint16(len(encs)),
 		Encodings: encs,
 	}
 
-	return msg.Write(c)
+	return c.SendMessage(msg)
 }
 
 // Flush flushes data to conn
@@ -98,6 +130,12 @@ func (c *ClientConn) Flush() error {
 
 // Close closing conn
 func (c *ClientConn) Close() error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
 	if c.quit != nil {
 		close(c.quit)
 		c.quit = nil
@@ -110,7 +148,22 @@ func (c *ClientConn) Close() error {
 
 // Read reads data from conn
 func (c *ClientConn) Read(buf []byte) (int, error) {
-	return c.br.Read(buf)
+	n, err := c.br.Read(buf)
+	c.readCount += int64(n)
+	if c.fbs != nil && n > 0 {
+		c.fbs.Write(buf[:n])
+	}
+	return n, err
+}
+
+func (c *ClientConn) secure(wrap func(r io.Reader, w io.Writer) io.ReadWriter) {
+	ch := wrap(c.br, c.bw)
+	c.br = bufio.NewReader(ch)
+	c.bw = bufio.NewWriter(ch)
+}
+
+func (c *ClientConn) bytesRead() int64 {
+	return c.readCount
 }
 
 // Write data to conn must be Flushed
@@ -197,6 +250,9 @@ type ClientConn struct {
 	bw       *bufio.Writer
 	cfg      *ClientConfig
 	protocol string
+	// serverVersion is the version announced by the server, protocol the
+	// one spoken
+	serverVersion string
 	// If the pixel format uses a color map, then this is the color
 	// map that is used. This should not be modified directly, since
 	// the data comes from the server.
@@ -226,6 +282,368 @@ type ClientConn struct {
 	quitCh  chan struct{}
 	quit    chan struct{}
 	errorCh chan error
+
+	// readCount is the number of bytes read, it locates decode errors
+	readCount int64
+
+	// capsMu guards the server capabilities announced through
+	// pseudo-encodings, which are set by the message reading goroutine.
+	capsMu            sync.RWMutex
+	serverCaps        map[EncodingType]bool
+	relativePointer   bool
+	continuousUpdates bool
+
+	// connMu guards the network connection, which a redirection replaces,
+	// against Close
+	connMu sync.Mutex
+	closed bool
+
+	// sendMu serializes messages written with SendMessage
+	sendMu    sync.Mutex
+	clipboard clipboardState
+
+	// updates paces FramebufferUpdateRequest messages, it is nil when
+	// ClientConfig.AutoUpdates is not set
+	updates *updatePacer
+
+	// encMu guards the last encodings set and the quality options added
+	// to them
+	encMu    sync.Mutex
+	encTypes []EncodingType
+	quality  QualityOptions
+
+	// annotations taps the input sent to the server, it is nil unless
+	// ClientConfig.Annotations is set
+	annotations *Annotations
+
+	// tightCaps are the capabilities sent by TightVNC servers, nil unless
+	// ClientAuthTight was negotiated
+	tightCaps *TightCapabilities
+
+	// fbs records what is read once the message handler started, it is
+	// nil unless ClientConfig.FbsRecorder is set
+	fbs *FbsWriter
+}
+
+// ServerVersion returns the protocol version announced by the server, such
+// as "RFB 003.889\n" for Apple servers, Protocol returns the version spoken
+func (c *ClientConn) ServerVersion() string {
+	return c.serverVersion
+}
+
+// TightCapabilities returns the server, client message and encoding
+// capabilities sent by a TightVNC server, nil for other servers
+func (c *ClientConn) TightCapabilities() *TightCapabilities {
+	return c.tightCaps
+}
+
+// SendMessage writes msg to the server, it is safe to call concurrently
+// with other SendMessage calls and with the message handler
+func (c *ClientConn) SendMessage(msg ClientMessage) error {
+	if c.annotations != nil {
+		if c.RelativePointer() {
+			c.annotations.TapRelative(msg)
+		} else {
+			c.annotations.Tap(msg)
+		}
+	}
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.protocol == "aten1" {
+		msg = atenInput(msg)
+	}
+	return msg.Write(c)
+}
+
+// ExtendedClipboard reports whether the server supports the extended
+// clipboard protocol
+func (c *ClientConn) ExtendedClipboard() bool {
+	return c.clipboard.Extended()
+}
+
+// SetClipboard sets the remote clipboard, using the extended clipboard
+// protocol when available and Latin-1 cut text otherwise
+func (c *ClientConn) SetClipboard(data *ClipboardData) error {
+	if ec := c.clipboard.set(data); ec != nil {
+		return c.SendMessage(&ClientCutText{Extended: ec})
+	}
+	return c.SendMessage(&ClientCutText{Text: clipboardDataToLatin1(data)})
+}
+
+// RequestClipboard asks the server for its clipboard contents, which are
+// delivered on ClientConfig.ClipboardCh. Servers without extended clipboard
+// support push their clipboard on every change instead.
+func (c *ClientConn) RequestClipboard() error {
+	if ec := c.clipboard.request(); ec != nil {
+		return c.SendMessage(&ClientCutText{Extended: ec})
+	}
+	return nil
+}
+
+// ContinuousUpdates reports whether the server is currently streaming
+// updates, in which case no FramebufferUpdateRequest is needed
+func (c *ClientConn) ContinuousUpdates() bool {
+	c.capsMu.RLock()
+	defer c.capsMu.RUnlock()
+	return c.continuousUpdates
+}
+
+// EnableContinuousUpdates asks the server to start or stop streaming
+// updates of the regions of interest
+func (c *ClientConn) EnableContinuousUpdates(enable bool) error {
+	area := c.updateArea()
+	msg := &EnableContinuousUpdates{
+		X:      uint16(area.Min.X),
+		Y:      uint16(area.Min.Y),
+		Width:  uint16(area.Dx()),
+		Height: uint16(area.Dy()),
+	}
+	if !msg.Supported(c) {
+		return fmt.Errorf("server does not support continuous updates")
+	}
+	if enable {
+		msg.Enable = 1
+	}
+	if err := c.SendMessage(msg); err != nil {
+		return err
+	}
+	// the server confirms disabling with an EndOfContinuousUpdates
+	if enable {
+		c.capsMu.Lock()
+		c.continuousUpdates = true
+		c.capsMu.Unlock()
+	}
+	return nil
+}
+
+// SendFence sends a fence request to the server, the answer is delivered
+// as a ServerFence message without the FenceFlagRequest bit
+func (c *ClientConn) SendFence(flags uint32, payload []byte) error {
+	msg := &ClientFence{Flags: flags | FenceFlagRequest, Payload: payload}
+	if !msg.Supported(c) {
+		return fmt.Errorf("server does not support fences")
+	}
+	return c.SendMessage(msg)
+}
+
+// SendXvp asks the server for a power operation, XvpShutdown, XvpReboot or
+// XvpReset, a failure is delivered as a ServerXvp message with XvpFail
+func (c *ClientConn) SendXvp(code XvpCode) error {
+	if code != XvpShutdown && code != XvpReboot && code != XvpReset {
+		return fmt.Errorf("not a xvp operation: %s", code)
+	}
+	msg := &ClientXvp{Version: xvpVersion, Code: code}
+	if !msg.Supported(c) {
+		return fmt.Errorf("server does not support xvp")
+	}
+	return c.SendMessage(msg)
+}
+
+// handleServerMessage performs the protocol bookkeeping for messages
+// received from the server, answering them where the protocol requires it
+func (c *ClientConn) handleServerMessage(msg ServerMessage) error {
+	switch msg := msg.(type) {
+	case *FramebufferUpdate:
+		if c.updates != nil {
+			c.updates.done(time.Now(), msg.Rects)
+			if err := c.flowControl(); err != nil {
+				return err
+			}
+		}
+		if r := clientRedirect(msg); r != nil {
+			return c.redirect(r)
+		}
+	case *ServerCutText:
+		return c.handleServerCutText(msg)
+	case *EndOfContinuousUpdates:
+		if !c.ServerSupports(EncContinuousUpdatesPseudo) {
+			// the first one only announces support
+			c.setServerSupports(EncContinuousUpdatesPseudo)
+			if c.cfg.ContinuousUpdates {
+				return c.EnableContinuousUpdates(true)
+			}
+			return nil
+		}
+		c.capsMu.Lock()
+		wasActive := c.continuousUpdates
+		c.continuousUpdates = false
+		c.capsMu.Unlock()
+		if c.updates != nil && c.updates.streamEnded() {
+			// the updates queued by a stream suspended by flow
+			// control have arrived
+			return c.EnableContinuousUpdates(true)
+		}
+		if wasActive {
+			// fall back to requesting updates
+			if c.updates != nil {
+				c.updates.notify()
+				return nil
+			}
+			return c.SendMessage(&FramebufferUpdateRequest{Inc: 1, Width: c.Width(), Height: c.Height()})
+		}
+	case *ServerFence:
+		c.setServerSupports(EncFencePseudo)
+		if msg.Flags&FenceFlagRequest != 0 {
+			return c.SendMessage(&ClientFence{Flags: fenceReplyFlags(msg.Flags), Payload: msg.Payload})
+		}
+		if c.updates != nil && isFlowFence(msg) {
+			c.updates.fenceAnswered()
+		}
+	case *ServerXvp:
+		if msg.Code == XvpInit {
+			c.setServerSupports(EncXvpPseudo)
+		}
+	case *AteniKVMKeepAliveEvent:
+		return c.SendMessage(&AteniKVMKeepAliveReply{})
+	}
+	return nil
+}
+
+// redirect replaces the connection with one to the server r points to,
+// the handshake is run again and the session goes on with the same
+// ClientConn, channels and canvas
+func (c *ClientConn) redirect(r *ClientRedirectPseudoEncoding) error {
+	addr := net.JoinHostPort(string(r.Host), strconv.Itoa(int(r.Port)))
+	if c.cfg.CheckRedirect != nil {
+		if err := c.cfg.CheckRedirect(string(r.Host), r.Port); err != nil {
+			return fmt.Errorf("redirect to %s refused: %v", addr, err)
+		}
+	}
+	connLogger(c).Infof("redirected to %s", addr)
+	dial := c.cfg.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+	err := c.reconnect(func() (net.Conn, error) { return dial("tcp", addr) })
+	if err != nil {
+		return fmt.Errorf("redirect to %s: %v", addr, err)
+	}
+	return nil
+}
+
+// reconnect replaces the connection with the one dial opens, runs the
+// handshake again, resets the encodings and requests a full refresh
+func (c *ClientConn) reconnect(dial func() (net.Conn, error)) error {
+	// the messages sent meanwhile wait for the new connection, servers
+	// taking a single client get the old one closed first
+	c.sendMu.Lock()
+	c.connMu.Lock()
+	c.c.Close()
+	c.connMu.Unlock()
+	nc, err := dial()
+	if err != nil {
+		c.sendMu.Unlock()
+		return err
+	}
+	c.connMu.Lock()
+	if c.closed {
+		c.connMu.Unlock()
+		c.sendMu.Unlock()
+		nc.Close()
+		return fmt.Errorf("connection closed")
+	}
+	// closing the connection from now on ends the new handshake
+	c.c = nc
+	c.connMu.Unlock()
+	c.br, c.bw = bufio.NewReader(nc), bufio.NewWriter(nc)
+	c.protocol, c.serverVersion, c.securityHandler, c.tightCaps = "", "", nil, nil
+	c.capsMu.Lock()
+	c.serverCaps, c.relativePointer, c.continuousUpdates = nil, false, false
+	c.capsMu.Unlock()
+	c.clipboard.mu.Lock()
+	c.clipboard.peerCaps = nil
+	c.clipboard.mu.Unlock()
+	// the new handshake is left out of the recording
+	fbs := c.fbs
+	c.fbs = nil
+	handlers := c.cfg.Handlers
+	if len(handlers) == 0 {
+		handlers = DefaultClientHandlers
+	}
+	for _, h := range handlers {
+		switch h.(type) {
+		case *DefaultClientMessageHandler, *ClientRepeaterHandler:
+			// this goroutine is the message handler, and the new
+			// connection reaches the server directly
+			continue
+		}
+		if err = h.Handle(c); err != nil {
+			break
+		}
+	}
+	c.fbs = fbs
+	c.sendMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if b := c.Canvas.Bounds(); b.Dx() != int(c.Width()) || b.Dy() != int(c.Height()) {
+		c.Canvas.Resize(int(c.Width()), int(c.Height()))
+	}
+	c.ResetAllEncodings()
+	c.encMu.Lock()
+	encs := c.encTypes
+	c.encMu.Unlock()
+	if err := c.SetEncodings(encs); err != nil {
+		return err
+	}
+	if c.updates != nil {
+		c.updates.restart()
+		return nil
+	}
+	return c.SendMessage(&FramebufferUpdateRequest{Width: c.Width(), Height: c.Height()})
+}
+
+// handleServerCutText answers extended clipboard messages and delivers
+// clipboard contents to ClientConfig.ClipboardCh
+func (c *ClientConn) handleServerCutText(msg *ServerCutText) error {
+	var data *ClipboardData
+	if msg.Extended != nil {
+		var reply *ExtendedClipboard
+		reply, data = c.clipboard.receive(msg.Extended, true)
+		if reply != nil {
+			if err := c.SendMessage(&ClientCutText{Extended: reply}); err != nil {
+				return err
+			}
+		}
+	} else {
+		data = latin1ToClipboardData(msg.Text)
+	}
+	if data != nil && c.cfg.ClipboardCh != nil {
+		c.cfg.ClipboardCh <- data
+	}
+	return nil
+}
+
+// ServerSupports reports whether the server has announced support for
+// the given pseudo-encoding by sending it in a FramebufferUpdate
+func (c *ClientConn) ServerSupports(typ EncodingType) bool {
+	c.capsMu.RLock()
+	defer c.capsMu.RUnlock()
+	return c.serverCaps[typ]
+}
+
+func (c *ClientConn) setServerSupports(typ EncodingType) {
+	c.capsMu.Lock()
+	defer c.capsMu.Unlock()
+	if c.serverCaps == nil {
+		c.serverCaps = make(map[EncodingType]bool)
+	}
+	c.serverCaps[typ] = true
+}
+
+// RelativePointer reports whether the server asked for relative pointer
+// events (see NewRelativePointerEvent)
+func (c *ClientConn) RelativePointer() bool {
+	c.capsMu.RLock()
+	defer c.capsMu.RUnlock()
+	return c.relativePointer
+}
+
+func (c *ClientConn) setRelativePointer(relative bool) {
+	c.capsMu.Lock()
+	defer c.capsMu.Unlock()
+	c.relativePointer = relative
 }
 
 func (cc *ClientConn) ResetAllEncodings() {
@@ -239,6 +657,17 @@ func NewClientConn(c net.Conn, cfg *ClientConfig) (*ClientConn, error) {
 	if len(cfg.Encodings) == 0 {
 		return nil, fmt.Errorf("client can't handle encodings")
 	}
+	if err := cfg.Quality.validate(); err != nil {
+		return nil, err
+	}
+	var updates *updatePacer
+	if cfg.AutoUpdates {
+		updates = newUpdatePacer(cfg)
+	}
+	var annotations *Annotations
+	if cfg.Annotations != nil {
+		annotations = NewAnnotations(*cfg.Annotations)
+	}
 	return &ClientConn{
 		c:           c,
 		cfg:         cfg,
@@ -249,6 +678,9 @@ func NewClientConn(c net.Conn, cfg *ClientConfig) (*ClientConn, error) {
 		errorCh:     cfg.ErrorCh,
 		pixelFormat: cfg.PixelFormat,
 		quit:        make(chan struct{}),
+		updates:     updates,
+		quality:     cfg.Quality,
+		annotations: annotations,
 	}, nil
 }
 
@@ -257,24 +689,36 @@ type DefaultClientMessageHandler struct{}
 
 // Handle handles server messages.
 func (*DefaultClientMessageHandler) Handle(c Conn) error {
-	logger.Trace("starting DefaultClientMessageHandler")
+	log := connLogger(c)
+	log.Trace("starting DefaultClientMessageHandler")
 	cfg := c.Config().(*ClientConfig)
-	var err error
 	var wg sync.WaitGroup
 	wg.Add(2)
 	//defer c.Close()
 
 	serverMessages := make(map[ServerMessageType]ServerMessage)
+	if c.Protocol() == "aten1" {
+		for _, m := range AtenServerMessages {
+			serverMessages[m.Type()] = m
+		}
+	}
 	for _, m := range cfg.Messages {
 		serverMessages[m.Type()] = m
 	}
+	c.(*ClientConn).initCanvas()
+	if cc := c.(*ClientConn); cfg.FbsRecorder != nil && cc.fbs == nil {
+		if err := cfg.FbsRecorder.WriteStartSession(c); err != nil {
+			return err
+		}
+		cc.fbs = cfg.FbsRecorder
+	}
 
 	go func() {
 		defer wg.Done()
 		for {
 			select {
 			case msg := <-cfg.ClientMessageCh:
-				if err = msg.Write(c); err != nil {
+				if err := c.(*ClientConn).SendMessage(msg); err != nil {
 					cfg.ErrorCh <- err
 					return
 				}
@@ -288,15 +732,14 @@ func (*DefaultClientMessageHandler) Handle(c Conn) error {
 			select {
 			default:
 				var messageType ServerMessageType
-				if err = binary.Read(c, binary.BigEndian, &messageType); err != nil {
+				if err := binary.Read(c, binary.BigEndian, &messageType); err != nil {
 					cfg.ErrorCh <- err
 					return
 				}
-				logger.Infof("========got server message, msgType=%d", messageType)
+				log.Infof("========got server message, msgType=%d", messageType)
 				msg, ok := serverMessages[messageType]
 				if !ok {
-					err = fmt.Errorf("unknown message-type: %v", messageType)
-					cfg.ErrorCh <- err
+					cfg.ErrorCh <- fmt.Errorf("unknown message-type: %v", messageType)
 					return
 				}
 				canvas := c.(*ClientConn).Canvas
@@ -304,9 +747,16 @@ func (*DefaultClientMessageHandler) Handle(c Conn) error {
 				parsedMsg, err := msg.Read(c)
 				canvas.PaintCursor()
 				//canvas.SwapBuffers()
-				logger.Debugf("============== End Message: type=%d ==============", messageType)
+				log.Debugf("============== End Message: type=%d ==============", messageType)
 
 				if err != nil {
+					if c.(*ClientConn).reconnectDecodeError(err) {
+						continue
+					}
+					cfg.ErrorCh <- err
+					return
+				}
+				if err := c.(*ClientConn).handleServerMessage(parsedMsg); err != nil {
 					cfg.ErrorCh <- err
 					return
 				}
@@ -314,23 +764,26 @@ func (*DefaultClientMessageHandler) Handle(c Conn) error {
 			}
 		}
 	}()
-	//encodings := c.Encodings()
-	encTypes := make(map[EncodingType]EncodingType)
+	// the encodings are sent in order of preference
+	encTypes := make(map[EncodingType]bool)
+	v := make([]EncodingType, 0, len(c.Encodings()))
 	for _, myEnc := range c.Encodings() {
-		encTypes[myEnc.Type()] = myEnc.Type()
-		//encTypes = append(encTypes, myEnc.Type())
-	}
-	v := make([]EncodingType, 0, len(encTypes))
-
-	for _, value := range encTypes {
-		v = append(v, value)
+		if !encTypes[myEnc.Type()] {
+			encTypes[myEnc.Type()] = true
+			v = append(v, myEnc.Type())
+		}
 	}
-	logger.Tracef("setting encodings: %v", v)
+	log.Tracef("setting encodings: %v", v)
 	c.SetEncodings(v)
 
-	firstMsg := FramebufferUpdateRequest{Inc: 0, X: 0, Y: 0, Width: c.Width(), Height: c.Height()}
-	logger.Tracef("sending initial req message: %v", firstMsg)
-	firstMsg.Write(c)
+	if cc := c.(*ClientConn); cc.updates != nil {
+		// the first round is a full refresh
+		go cc.requestUpdates(cc.quit)
+	} else {
+		firstMsg := FramebufferUpdateRequest{Inc: 0, X: 0, Y: 0, Width: c.Width(), Height: c.Height()}
+		log.Tracef("sending initial req message: %v", firstMsg)
+		c.(*ClientConn).SendMessage(&firstMsg)
+	}
 
 	//wg.Wait()
 	return nil
@@ -351,5 +804,75 @@ type ClientConfig struct {
 	Messages         []ServerMessage
 	QuitCh           chan struct{}
 	ErrorCh          chan error
-	quit             chan struct{}
+	// FrameCursor draws the cursor only into the frames returned by
+	// VncCanvas.Frame and never into the framebuffer, DrawCursor must be set
+	FrameCursor bool
+	// Annotations highlights the clicks and keys sent to the server on the
+	// frames returned by VncCanvas.Frame, it is optional
+	Annotations *AnnotationConfig
+	// ClipboardCh receives the server clipboard contents, it is optional
+	ClipboardCh chan *ClipboardData
+	// ContinuousUpdates enables continuous updates as soon as the server
+	// announces support, see ClientConn.ContinuousUpdates. When the server
+	// also supports fences and ClientConn requests the updates, the stream
+	// is suspended while the client falls behind. UpdateFPS and MaxInFlight
+	// don't apply to streamed updates.
+	ContinuousUpdates bool
+	// AutoUpdates has ClientConn send the FramebufferUpdateRequest
+	// messages itself, paced by UpdateFPS, MaxInFlight and Regions. By
+	// default the application requests updates after the first one.
+	AutoUpdates bool
+	// UpdateFPS limits the rate of update requests, 0 requests the next
+	// update as soon as the previous one arrived
+	UpdateFPS int
+	// MaxInFlight is the number of rounds of update requests sent ahead
+	// of the updates answering them, it defaults to 1
+	MaxInFlight int
+	// Regions limits update requests to regions of interest, by default
+	// the whole framebuffer is requested. A round holds one request per
+	// region.
+	Regions []image.Rectangle
+	// CaptureRegion crops the frames returned by VncCanvas.Frame, with
+	// AutoUpdates updates are only requested for it unless Regions is set
+	CaptureRegion image.Rectangle
+	// StrictDecoding stops the connection on the first decode error. By
+	// default a rect whose data was read entirely, like a corrupt JPEG
+	// image, is skipped and a full refresh is requested. Errors in zlib
+	// compressed data leave the stream out of sync, they stop the
+	// connection unless Redial is set.
+	StrictDecoding bool
+	// Redial opens a new connection to the server when a decode error left
+	// the stream out of sync. The handshake is run again, the encodings are
+	// Reset and a full refresh is requested, the session goes on with the
+	// same ClientConn and canvas. The connection must reach the server
+	// itself, past any repeater. FbsRecorder stops recording then, the
+	// data recorded up to the error can't be played back past it.
+	Redial func() (net.Conn, error)
+	// DecodeErrorCh receives the decode errors recovered from, it is
+	// optional. Errors are dropped while the channel is full, the
+	// connection never waits for it to be drained.
+	DecodeErrorCh chan *DecodeError
+	// Quality holds the JPEG quality, compression and subsampling settings
+	// asked from the server, see ClientConn.SetQuality
+	Quality QualityOptions
+	// Dial opens the connections to the servers a ClientRedirect points
+	// to, net.Dial is used when it is nil
+	Dial func(network, address string) (net.Conn, error)
+	// CheckRedirect decides whether to follow a ClientRedirect to host and
+	// port, an error ends the session instead. Every redirection is
+	// followed when it is nil, which lets the server send the client to
+	// any host it can reach.
+	CheckRedirect func(host string, port uint16) error
+	// MinVersion and MaxVersion bound the protocol version spoken with the
+	// server, one of ProtoVersion33, ProtoVersion37 and ProtoVersion38, 3.3
+	// and 3.8 when not set
+	MinVersion string
+	MaxVersion string
+	// Logger is the logger of the session, by default the logger package's
+	// default logger is used
+	Logger logger.Logger
+	// FbsRecorder records the server messages following the handshake,
+	// the recording plays back with FbsConn, it is optional
+	FbsRecorder *FbsWriter
+	quit        chan struct{}
 }
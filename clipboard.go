@@ -0,0 +1,384 @@
+package vnc2video
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// ClipboardFormat is a bit mask of the clipboard formats carried by an
+// extended clipboard message.
+type ClipboardFormat uint32
+
+// Extended clipboard formats
+const (
+	ClipboardFormatText  ClipboardFormat = 1 << 0
+	ClipboardFormatRTF   ClipboardFormat = 1 << 1
+	ClipboardFormatHTML  ClipboardFormat = 1 << 2
+	ClipboardFormatDIB   ClipboardFormat = 1 << 3
+	ClipboardFormatFiles ClipboardFormat = 1 << 4
+)
+
+// ClipboardAction is the action of an extended clipboard message, stored
+// in the high byte of the flags.
+type ClipboardAction uint32
+
+// Extended clipboard actions
+const (
+	ClipboardActionCaps    ClipboardAction = 1 << 24
+	ClipboardActionRequest ClipboardAction = 1 << 25
+	ClipboardActionPeek    ClipboardAction = 1 << 26
+	ClipboardActionNotify  ClipboardAction = 1 << 27
+	ClipboardActionProvide ClipboardAction = 1 << 28
+)
+
+const (
+	clipboardFormatMask = 0x0000FFFF
+	clipboardActionMask = 0xFF000000
+
+	// supported formats and actions of this implementation
+	clipboardFormats = ClipboardFormatText | ClipboardFormatRTF | ClipboardFormatHTML
+	clipboardActions = ClipboardActionRequest | ClipboardActionPeek | ClipboardActionNotify | ClipboardActionProvide
+
+	// clipboardMaxUnsolicited is the size announced in caps for the text
+	// format, below which the peer may provide data without a request
+	clipboardMaxUnsolicited = 20 * 1024 * 1024
+
+	// clipboardMaxSize bounds both the compressed payload and the
+	// uncompressed data of a message, larger messages are rejected
+	clipboardMaxSize = 32 * 1024 * 1024
+)
+
+// ExtendedClipboard is the payload of an extended ServerCutText or
+// ClientCutText message.
+type ExtendedClipboard struct {
+	Flags uint32
+	// Sizes holds one maximum size per format for caps messages
+	Sizes []uint32
+	// Data holds the uncompressed data per format for provide messages
+	Data map[ClipboardFormat][]byte
+}
+
+// Action returns the action bits of the message, caps messages also carry
+// the actions supported by the sender
+func (ec *ExtendedClipboard) Action() ClipboardAction {
+	return ClipboardAction(ec.Flags & clipboardActionMask)
+}
+
+// Is reports whether the action bit a is set
+func (ec *ExtendedClipboard) Is(a ClipboardAction) bool {
+	return ec.Action()&a != 0
+}
+
+// Formats returns the formats of the message
+func (ec *ExtendedClipboard) Formats() ClipboardFormat {
+	return ClipboardFormat(ec.Flags & clipboardFormatMask)
+}
+
+// String returns string
+func (ec *ExtendedClipboard) String() string {
+	return fmt.Sprintf("action: 0x%x, formats: 0x%x", uint32(ec.Action()), uint32(ec.Formats()))
+}
+
+func newExtendedClipboard(action ClipboardAction, formats ClipboardFormat) *ExtendedClipboard {
+	return &ExtendedClipboard{Flags: uint32(action) | uint32(formats)}
+}
+
+// eachFormat calls fn for every format bit set in formats, lowest bit first
+func eachFormat(formats ClipboardFormat, fn func(ClipboardFormat) error) error {
+	for i := uint(0); i < 16; i++ {
+		f := ClipboardFormat(1 << i)
+		if formats&f == 0 {
+			continue
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readExtendedClipboard unmarshals an extended clipboard payload of length bytes
+func readExtendedClipboard(r io.Reader, length uint32) (*ExtendedClipboard, error) {
+	if length < 4 {
+		return nil, fmt.Errorf("extended clipboard message too short: %d", length)
+	}
+	if length > clipboardMaxSize {
+		return nil, fmt.Errorf("extended clipboard message too long: %d", length)
+	}
+	payload, err := ReadBytes(int(length), r)
+	if err != nil {
+		return nil, err
+	}
+	ec := &ExtendedClipboard{Flags: binary.BigEndian.Uint32(payload)}
+	payload = payload[4:]
+
+	switch {
+	case ec.Is(ClipboardActionCaps):
+		err = eachFormat(ec.Formats(), func(ClipboardFormat) error {
+			if len(payload) < 4 {
+				return fmt.Errorf("extended clipboard caps too short")
+			}
+			ec.Sizes = append(ec.Sizes, binary.BigEndian.Uint32(payload))
+			payload = payload[4:]
+			return nil
+		})
+	case ec.Is(ClipboardActionProvide):
+		var zr io.ReadCloser
+		zr, err = zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		ec.Data = make(map[ClipboardFormat][]byte)
+		remaining := uint32(clipboardMaxSize)
+		err = eachFormat(ec.Formats(), func(f ClipboardFormat) error {
+			size, err := ReadUint32(zr)
+			if err != nil {
+				return err
+			}
+			if size > remaining {
+				return fmt.Errorf("extended clipboard provide data too long: %d", size)
+			}
+			remaining -= size
+			data, err := ioutil.ReadAll(io.LimitReader(zr, int64(size)))
+			if err != nil {
+				return err
+			}
+			if len(data) != int(size) {
+				return fmt.Errorf("extended clipboard provide data truncated")
+			}
+			ec.Data[f] = data
+			return nil
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ec, nil
+}
+
+// marshal returns the wire format payload of the message
+func (ec *ExtendedClipboard) marshal() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := binary.Write(buf, binary.BigEndian, ec.Flags); err != nil {
+		return nil, err
+	}
+	switch {
+	case ec.Is(ClipboardActionCaps):
+		for _, size := range ec.Sizes {
+			if err := binary.Write(buf, binary.BigEndian, size); err != nil {
+				return nil, err
+			}
+		}
+	case ec.Is(ClipboardActionProvide):
+		zw := zlib.NewWriter(buf)
+		err := eachFormat(ec.Formats(), func(f ClipboardFormat) error {
+			data := ec.Data[f]
+			if err := binary.Write(zw, binary.BigEndian, uint32(len(data))); err != nil {
+				return err
+			}
+			_, err := zw.Write(data)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// writeExtendedClipboard writes the length and payload of an extended cut
+// text message to conn and flushes it
+func writeExtendedClipboard(c Conn, ec *ExtendedClipboard) error {
+	payload, err := ec.marshal()
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, int32(-len(payload))); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, payload); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// ClipboardData holds clipboard contents exchanged with the remote side,
+// all strings are UTF-8 encoded and use "\n" line endings.
+type ClipboardData struct {
+	Text string
+	RTF  string
+	HTML string
+}
+
+// String returns string
+func (d *ClipboardData) String() string {
+	return fmt.Sprintf("text: %q, rtf: %d bytes, html: %d bytes", d.Text, len(d.RTF), len(d.HTML))
+}
+
+func (d *ClipboardData) formats() ClipboardFormat {
+	var formats ClipboardFormat
+	if d == nil {
+		return formats
+	}
+	if d.Text != "" {
+		formats |= ClipboardFormatText
+	}
+	if d.RTF != "" {
+		formats |= ClipboardFormatRTF
+	}
+	if d.HTML != "" {
+		formats |= ClipboardFormatHTML
+	}
+	return formats
+}
+
+// encode returns the wire representation of format f, strings are sent
+// with CRLF line endings and a terminating nul
+func (d *ClipboardData) encode(f ClipboardFormat) []byte {
+	var s string
+	switch f {
+	case ClipboardFormatText:
+		s = d.Text
+	case ClipboardFormatRTF:
+		s = d.RTF
+	case ClipboardFormatHTML:
+		s = d.HTML
+	}
+	s = strings.Replace(strings.Replace(s, "\r\n", "\n", -1), "\n", "\r\n", -1)
+	return append([]byte(s), 0)
+}
+
+func decodeClipboardString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.Replace(string(b), "\r\n", "\n", -1)
+}
+
+func newClipboardData(data map[ClipboardFormat][]byte) *ClipboardData {
+	return &ClipboardData{
+		Text: decodeClipboardString(data[ClipboardFormatText]),
+		RTF:  decodeClipboardString(data[ClipboardFormatRTF]),
+		HTML: decodeClipboardString(data[ClipboardFormatHTML]),
+	}
+}
+
+// latin1ToClipboardData converts legacy cut text to ClipboardData
+func latin1ToClipboardData(text []byte) *ClipboardData {
+	runes := make([]rune, len(text))
+	for i, b := range text {
+		runes[i] = rune(b)
+	}
+	return &ClipboardData{Text: strings.Replace(string(runes), "\r\n", "\n", -1)}
+}
+
+// clipboardDataToLatin1 converts text for legacy cut text messages,
+// characters outside of Latin-1 are replaced by '?'
+func clipboardDataToLatin1(d *ClipboardData) []byte {
+	text := make([]byte, 0, len(d.Text))
+	for _, r := range d.Text {
+		if r > 0xFF {
+			r = '?'
+		}
+		text = append(text, byte(r))
+	}
+	return text
+}
+
+// clipboardState holds the extended clipboard negotiation and the local
+// clipboard contents of a connection.
+type clipboardState struct {
+	mu       sync.Mutex
+	peerCaps *ExtendedClipboard
+	local    *ClipboardData
+}
+
+// Extended reports whether the peer announced extended clipboard support
+func (cs *clipboardState) Extended() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.peerCaps != nil
+}
+
+// caps returns the caps message announcing this implementation's support
+func (cs *clipboardState) caps() *ExtendedClipboard {
+	ec := newExtendedClipboard(ClipboardActionCaps|clipboardActions, clipboardFormats)
+	eachFormat(clipboardFormats, func(ClipboardFormat) error {
+		ec.Sizes = append(ec.Sizes, clipboardMaxUnsolicited)
+		return nil
+	})
+	return ec
+}
+
+// set stores data as the local clipboard and returns the extended message
+// to send to the peer, or nil if the peer only supports legacy cut text
+func (cs *clipboardState) set(data *ClipboardData) *ExtendedClipboard {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.local = data
+	if cs.peerCaps == nil {
+		return nil
+	}
+	formats := data.formats() & cs.peerCaps.Formats()
+	if cs.peerCaps.Is(ClipboardActionNotify) {
+		return newExtendedClipboard(ClipboardActionNotify, formats)
+	}
+	return cs.provide(formats)
+}
+
+// provide returns a provide message with the local data in formats
+func (cs *clipboardState) provide(formats ClipboardFormat) *ExtendedClipboard {
+	formats &= cs.local.formats()
+	ec := newExtendedClipboard(ClipboardActionProvide, formats)
+	ec.Data = make(map[ClipboardFormat][]byte)
+	eachFormat(formats, func(f ClipboardFormat) error {
+		ec.Data[f] = cs.local.encode(f)
+		return nil
+	})
+	return ec
+}
+
+// request returns the message asking the peer for its clipboard contents
+func (cs *clipboardState) request() *ExtendedClipboard {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.peerCaps == nil {
+		return nil
+	}
+	return newExtendedClipboard(ClipboardActionRequest, clipboardFormats&cs.peerCaps.Formats())
+}
+
+// receive processes an extended clipboard message from the peer, it returns
+// the reply to send (if any) and the clipboard data provided (if any)
+func (cs *clipboardState) receive(ec *ExtendedClipboard, replyCaps bool) (*ExtendedClipboard, *ClipboardData) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	switch {
+	case ec.Is(ClipboardActionCaps):
+		cs.peerCaps = ec
+		if replyCaps {
+			return cs.caps(), nil
+		}
+	case ec.Is(ClipboardActionRequest):
+		return cs.provide(ec.Formats()), nil
+	case ec.Is(ClipboardActionPeek):
+		return newExtendedClipboard(ClipboardActionNotify, cs.local.formats()), nil
+	case ec.Is(ClipboardActionNotify):
+		if formats := ec.Formats() & clipboardFormats; formats != 0 {
+			return newExtendedClipboard(ClipboardActionRequest, formats), nil
+		}
+	case ec.Is(ClipboardActionProvide):
+		return nil, newClipboardData(ec.Data)
+	}
+	return nil, nil
+}
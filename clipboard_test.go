@@ -0,0 +1,126 @@
+package vnc2video
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"testing"
+)
+
+// roundTrip marshals ec and reads it back
+func roundTrip(t *testing.T, ec *ExtendedClipboard) *ExtendedClipboard {
+	payload, err := ec.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readExtendedClipboard(bytes.NewReader(payload), uint32(len(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestExtendedClipboardExchange(t *testing.T) {
+	client, server := &clipboardState{}, &clipboardState{}
+	if client.request() != nil || client.set(&ClipboardData{Text: "legacy"}) != nil {
+		t.Fatal("extended messages without caps")
+	}
+
+	// caps exchange
+	reply, _ := server.receive(roundTrip(t, server.caps()), true)
+	if reply == nil || !reply.Is(ClipboardActionCaps) {
+		t.Fatalf("caps answered with %v", reply)
+	}
+	caps := roundTrip(t, reply)
+	if len(caps.Sizes) != 3 || caps.Sizes[0] != clipboardMaxUnsolicited {
+		t.Errorf("caps sizes %v", caps.Sizes)
+	}
+	if reply, _ = client.receive(caps, false); reply != nil {
+		t.Errorf("caps answered twice with %v", reply)
+	}
+	if !client.Extended() || !server.Extended() {
+		t.Fatal("extended clipboard not negotiated")
+	}
+
+	// the server notifies, the client requests and the server provides
+	notify := server.set(&ClipboardData{Text: "a\nb", HTML: "<b>a</b>"})
+	if notify == nil || !notify.Is(ClipboardActionNotify) || notify.Formats() != ClipboardFormatText|ClipboardFormatHTML {
+		t.Fatalf("set sent %v", notify)
+	}
+	request, _ := client.receive(roundTrip(t, notify), false)
+	if request == nil || !request.Is(ClipboardActionRequest) || request.Formats() != notify.Formats() {
+		t.Fatalf("notify answered with %v", request)
+	}
+	provide, _ := server.receive(roundTrip(t, request), false)
+	if provide == nil || !provide.Is(ClipboardActionProvide) {
+		t.Fatalf("request answered with %v", provide)
+	}
+	if text := provide.Data[ClipboardFormatText]; !bytes.Equal(text, []byte("a\r\nb\x00")) {
+		t.Errorf("provided text %q", text)
+	}
+	reply, data := client.receive(roundTrip(t, provide), false)
+	if reply != nil || data == nil || *data != (ClipboardData{Text: "a\nb", HTML: "<b>a</b>"}) {
+		t.Errorf("provide answered with %v, data %v", reply, data)
+	}
+
+	// peek
+	client.set(&ClipboardData{RTF: "{\\rtf1}"})
+	reply, _ = client.receive(roundTrip(t, newExtendedClipboard(ClipboardActionPeek, 0)), false)
+	if reply == nil || !reply.Is(ClipboardActionNotify) || reply.Formats() != ClipboardFormatRTF {
+		t.Errorf("peek answered with %v", reply)
+	}
+}
+
+func TestExtendedClipboardLimits(t *testing.T) {
+	if _, err := readExtendedClipboard(bytes.NewReader(nil), clipboardMaxSize+1); err == nil {
+		t.Error("oversized message accepted")
+	}
+	// what a negative length of math.MinInt32 turns into
+	if _, err := readExtendedClipboard(bytes.NewReader(nil), 0x80000000); err == nil {
+		t.Error("oversized message accepted")
+	}
+
+	// provide returns the compressed payload of a provide message holding
+	// the sizes and data
+	provide := func(formats ClipboardFormat, sizes []uint32, data []byte) []byte {
+		buf := &bytes.Buffer{}
+		binary.Write(buf, binary.BigEndian, uint32(ClipboardActionProvide)|uint32(formats))
+		zw := zlib.NewWriter(buf)
+		for _, size := range sizes {
+			binary.Write(zw, binary.BigEndian, size)
+			zw.Write(data[:size])
+		}
+		zw.Close()
+		return buf.Bytes()
+	}
+	zeros := make([]byte, clipboardMaxSize/2+1)
+	for _, test := range []struct {
+		name    string
+		formats ClipboardFormat
+		sizes   []uint32
+		ok      bool
+	}{
+		{"half", ClipboardFormatText, []uint32{clipboardMaxSize / 2}, true},
+		{"two halves", ClipboardFormatText | ClipboardFormatRTF, []uint32{clipboardMaxSize / 2, clipboardMaxSize / 2}, true},
+		{"over", ClipboardFormatText | ClipboardFormatRTF, []uint32{clipboardMaxSize / 2, clipboardMaxSize/2 + 1}, false},
+	} {
+		payload := provide(test.formats, test.sizes, zeros)
+		if len(payload) > 1024*1024 {
+			t.Fatalf("%s: %d bytes compressed", test.name, len(payload))
+		}
+		_, err := readExtendedClipboard(bytes.NewReader(payload), uint32(len(payload)))
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+
+	// a size beyond the limit is rejected before reading the data
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, uint32(ClipboardActionProvide)|uint32(ClipboardFormatText))
+	zw := zlib.NewWriter(buf)
+	binary.Write(zw, binary.BigEndian, uint32(0xFFFFFFFF))
+	zw.Close()
+	if _, err := readExtendedClipboard(bytes.NewReader(buf.Bytes()), uint32(buf.Len())); err == nil {
+		t.Error("oversized provide data accepted")
+	}
+}
@@ -3,6 +3,7 @@ package vnc2video
 import (
 	"io"
 	"net"
+	"github.com/amitbet/vnc2video/logger"
 )
 
 // Conn represents vnc conection
@@ -30,3 +31,26 @@ type Conn interface {
 	SecurityHandler() SecurityHandler
 	GetEncInstance(EncodingType) Encoding
 }
+
+// secureConn is implemented by the connections a security type can switch
+// to an encrypted channel, wrap gets the raw reader and writer and returns
+// the channel the traffic goes through from then on
+type secureConn interface {
+	secure(wrap func(r io.Reader, w io.Writer) io.ReadWriter)
+}
+
+// connLogger returns the logger of the session c belongs to, which is
+// ClientConfig.Logger or ServerConfig.Logger if set
+func connLogger(c Conn) logger.Logger {
+	switch c := c.(type) {
+	case *ClientConn:
+		if c.cfg.Logger != nil {
+			return c.cfg.Logger
+		}
+	case *ServerConn:
+		if c.cfg.Logger != nil {
+			return c.cfg.Logger
+		}
+	}
+	return logger.Default()
+}
@@ -0,0 +1,162 @@
+package vnc2video
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Cursor is a cursor shape sent by the server, pixels with a zero alpha are
+// transparent
+type Cursor struct {
+	Image *image.NRGBA
+	// Hotspot is the point of Image at the pointer position
+	Hotspot image.Point
+}
+
+// NewCursor returns an empty w x h cursor
+func NewCursor(w, h int, hotspot image.Point) *Cursor {
+	return &Cursor{Image: image.NewNRGBA(image.Rect(0, 0, w, h)), Hotspot: hotspot}
+}
+
+// bounds returns where the cursor covers the framebuffer with the pointer
+// at pos
+func (cur *Cursor) bounds(pos image.Point) image.Rectangle {
+	return cur.Image.Bounds().Add(pos.Sub(cur.Hotspot))
+}
+
+// draw composites the cursor with the pointer at pos over img, clipped to
+// the bounds of img
+func (cur *Cursor) draw(img draw.Image, pos image.Point) {
+	r := cur.bounds(pos).Intersect(img.Bounds())
+	offset := pos.Sub(cur.Hotspot)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			blendPixel(img, x, y, cur.Image.NRGBAAt(x-offset.X, y-offset.Y))
+		}
+	}
+}
+
+// SetCursor sets the cursor shape, nil hides the cursor
+func (c *VncCanvas) SetCursor(cur *Cursor) {
+	c.cursorMu.Lock()
+	defer c.cursorMu.Unlock()
+	c.cursor = cur
+	c.setDeprecatedCursor(cur)
+}
+
+// setDeprecatedCursor fills the deprecated exported cursor fields from cur
+func (c *VncCanvas) setDeprecatedCursor(cur *Cursor) {
+	if cur == nil {
+		c.Cursor, c.CursorMask, c.CursorBackup, c.CursorOffset = nil, nil, nil, nil
+		return
+	}
+	b := cur.Image.Bounds()
+	img := image.NewRGBA(b)
+	mask := make([][]bool, b.Dx())
+	for x := range mask {
+		mask[x] = make([]bool, b.Dy())
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			col := cur.Image.NRGBAAt(x, y)
+			img.Set(x, y, col)
+			mask[x-b.Min.X][y-b.Min.Y] = col.A != 0
+		}
+	}
+	hotspot := cur.Hotspot
+	c.Cursor = img
+	c.CursorMask = mask
+	c.CursorBackup = image.NewRGBA(b)
+	c.CursorOffset = &hotspot
+}
+
+// CursorShape returns the cursor shape, or nil if there is none
+func (c *VncCanvas) CursorShape() *Cursor {
+	c.cursorMu.Lock()
+	defer c.cursorMu.Unlock()
+	return c.cursor
+}
+
+// SetCursorPos moves the pointer, the cursor is only drawn once its
+// position is known
+func (c *VncCanvas) SetCursorPos(pos image.Point) {
+	c.cursorMu.Lock()
+	defer c.cursorMu.Unlock()
+	c.cursorPos = &pos
+	location := pos
+	c.CursorLocation = &location
+}
+
+// CursorPos returns the pointer position, ok is false until it is known
+func (c *VncCanvas) CursorPos() (pos image.Point, ok bool) {
+	c.cursorMu.Lock()
+	defer c.cursorMu.Unlock()
+	if c.cursorPos == nil {
+		return image.Point{}, false
+	}
+	return *c.cursorPos, true
+}
+
+// visibleCursor returns the cursor to draw and the pointer position, cur is
+// nil when there is nothing to draw
+func (c *VncCanvas) visibleCursor() (cur *Cursor, pos image.Point) {
+	c.cursorMu.Lock()
+	defer c.cursorMu.Unlock()
+	if !c.DrawCursor || c.cursor == nil || c.cursorPos == nil {
+		return nil, image.Point{}
+	}
+	return c.cursor, *c.cursorPos
+}
+
+// PaintCursor draws the cursor into the framebuffer, saving the pixels it
+// covers for RemoveCursor. It does nothing when the cursor is drawn into
+// the frames only.
+func (c *VncCanvas) PaintCursor() image.Image {
+	if c.FrameCursor {
+		return c.Image
+	}
+	cur, pos := c.visibleCursor()
+	if cur == nil {
+		return c.Image
+	}
+	r := cur.bounds(pos).Intersect(c.Image.Bounds())
+	if r.Empty() {
+		return c.Image
+	}
+	if c.cursorBackup == nil || !c.cursorBackup.Rect.Size().Eq(r.Size()) {
+		c.cursorBackup = NewRGBImage(r)
+	}
+	c.cursorBackup.Rect = r
+	copyPixels(c.cursorBackup, c.Image, r)
+	c.cursorPainted = r
+	cur.draw(c.Image, pos)
+	return c.Image
+}
+
+// RemoveCursor restores the framebuffer pixels painted over by PaintCursor
+func (c *VncCanvas) RemoveCursor() image.Image {
+	if c.cursorPainted.Empty() {
+		return c.Image
+	}
+	copyPixels(c.Image, c.cursorBackup, c.cursorPainted.Intersect(c.Image.Bounds()))
+	c.cursorPainted = image.Rectangle{}
+	return c.Image
+}
+
+// copyPixels copies the r part of src to dst
+func copyPixels(dst draw.Image, src image.Image, r image.Rectangle) {
+	d, dok := dst.(*RGBImage)
+	s, sok := src.(*RGBImage)
+	if dok && sok {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			di, si := d.PixOffset(r.Min.X, y), s.PixOffset(r.Min.X, y)
+			copy(d.Pix[di:di+r.Dx()*3], s.Pix[si:si+r.Dx()*3])
+		}
+		return
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			dst.Set(x, y, src.At(x, y))
+		}
+	}
+}
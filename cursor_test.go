@@ -0,0 +1,100 @@
+package vnc2video
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func testCursor() *Cursor {
+	cur := NewCursor(4, 4, image.Point{1, 1})
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			cur.Image.SetNRGBA(x, y, color.NRGBA{R: 0xff, A: 0xff})
+		}
+	}
+	// a half transparent pixel over the hotspot
+	cur.Image.SetNRGBA(1, 1, color.NRGBA{B: 0xff, A: 0x80})
+	return cur
+}
+
+func rgbAt(img image.Image, x, y int) color.RGBA {
+	c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+	c.A = 0
+	return c
+}
+
+func TestCursorPaintClipped(t *testing.T) {
+	canvas := NewVncCanvas(8, 8)
+	canvas.DrawCursor = true
+	canvas.SetCursor(testCursor())
+	// the cursor sticks out of every edge of the framebuffer
+	for _, pos := range []image.Point{{0, 0}, {7, 7}, {-1, 3}, {8, 8}, {100, 100}} {
+		canvas.SetCursorPos(pos)
+		canvas.PaintCursor()
+		canvas.RemoveCursor()
+	}
+	canvas.SetCursorPos(image.Point{7, 7})
+	canvas.PaintCursor()
+	if got := rgbAt(canvas.Image, 7, 7); got != (color.RGBA{R: 0, G: 0, B: 0x80}) {
+		t.Errorf("hotspot pixel is %v, want the blended cursor", got)
+	}
+	if got := rgbAt(canvas.Image, 6, 6); got != (color.RGBA{R: 0xff}) {
+		t.Errorf("pixel above the hotspot is %v, want the cursor", got)
+	}
+	canvas.RemoveCursor()
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if got := rgbAt(canvas.Image, x, y); got != (color.RGBA{}) {
+				t.Fatalf("pixel (%d,%d) is %v after RemoveCursor", x, y, got)
+			}
+		}
+	}
+}
+
+func TestFrameCursor(t *testing.T) {
+	canvas := NewVncCanvas(8, 8)
+	canvas.DrawCursor = true
+	canvas.FrameCursor = true
+	canvas.SetCursor(testCursor())
+	canvas.SetCursorPos(image.Point{2, 2})
+	canvas.SetCrop(image.Rect(2, 2, 6, 6))
+	canvas.PaintCursor()
+	if got := rgbAt(canvas.Image, 3, 3); got != (color.RGBA{}) {
+		t.Errorf("cursor painted into the framebuffer: %v", got)
+	}
+	frame := canvas.Frame()
+	if frame.Bounds() != image.Rect(2, 2, 6, 6) {
+		t.Errorf("frame bounds are %v", frame.Bounds())
+	}
+	if got := rgbAt(frame, 3, 3); got != (color.RGBA{R: 0xff}) {
+		t.Errorf("frame pixel is %v, want the cursor", got)
+	}
+}
+
+func TestDeprecatedCursorFields(t *testing.T) {
+	canvas := NewVncCanvas(8, 8)
+	cur := testCursor()
+	cur.Image.SetNRGBA(3, 0, color.NRGBA{})
+	canvas.SetCursor(cur)
+	canvas.SetCursorPos(image.Point{5, 6})
+	if canvas.CursorShape() != cur {
+		t.Error("CursorShape is not the cursor set")
+	}
+	if canvas.Cursor == nil || canvas.Cursor.Bounds() != image.Rect(0, 0, 4, 4) || canvas.CursorBackup == nil {
+		t.Fatal("cursor images not set")
+	}
+	if got := rgbAt(canvas.Cursor, 0, 0); got != (color.RGBA{R: 0xff}) {
+		t.Errorf("cursor pixel is %v", got)
+	}
+	if !canvas.CursorMask[0][0] || canvas.CursorMask[3][0] {
+		t.Errorf("cursor mask is %v", canvas.CursorMask)
+	}
+	if *canvas.CursorOffset != (image.Point{1, 1}) || *canvas.CursorLocation != (image.Point{5, 6}) {
+		t.Errorf("hotspot %v, location %v", *canvas.CursorOffset, *canvas.CursorLocation)
+	}
+	canvas.SetCursor(nil)
+	if canvas.Cursor != nil || canvas.CursorMask != nil {
+		t.Error("cursor fields kept after the cursor is hidden")
+	}
+}
@@ -0,0 +1,152 @@
+package vnc2video
+
+import (
+	"fmt"
+	"image"
+)
+
+// DecodeError reports a rectangle that could not be decoded.
+type DecodeError struct {
+	Encoding EncodingType
+	Rect     image.Rectangle
+	// Offset is the number of bytes of the rectangle's data read when the
+	// error occurred, or -1 if the connection does not count them
+	Offset int64
+	// Recoverable is set when the rectangle's data was read entirely and
+	// left the decoder state as the server expects it, like a corrupt JPEG
+	// image, so following rectangles can be decoded. Errors in data
+	// inflated from a zlib stream the server keeps compressing into are
+	// never recoverable.
+	Recoverable bool
+	Err         error
+}
+
+// Error implements the error interface
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decoding %s rect %v failed at offset %d: %v", e.Encoding, e.Rect, e.Offset, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// corruptDataError marks an error in rectangle data that was read
+// entirely from the connection without changing the decoder state, like a
+// failed JPEG decode
+type corruptDataError struct {
+	err error
+}
+
+func (e *corruptDataError) Error() string {
+	return e.err.Error()
+}
+
+// corrupt marks err as an error in data that was read entirely, it must
+// not be used for data inflated from a zlib stream
+func corrupt(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &corruptDataError{err: err}
+}
+
+// byteCounter is implemented by connections that count the bytes read
+type byteCounter interface {
+	bytesRead() int64
+}
+
+func bytesRead(c Conn) int64 {
+	if bc, ok := c.(byteCounter); ok {
+		return bc.bytesRead()
+	}
+	return -1
+}
+
+func newDecodeError(c Conn, rect *Rectangle, start int64, err error) *DecodeError {
+	if de, ok := err.(*DecodeError); ok {
+		return de
+	}
+	de := &DecodeError{
+		Encoding: rect.EncType,
+		Rect:     MakeRectFromVncRect(rect),
+		Offset:   -1,
+		Err:      err,
+	}
+	if start >= 0 {
+		de.Offset = bytesRead(c) - start
+	}
+	if cde, ok := err.(*corruptDataError); ok {
+		de.Recoverable = true
+		de.Err = cde.err
+	}
+	return de
+}
+
+// recoverDecodeError skips the rect of a recoverable DecodeError, client
+// connections also request a full refresh. It reports whether reading the
+// stream can continue.
+func recoverDecodeError(c Conn, err error) bool {
+	de, ok := err.(*DecodeError)
+	if !ok || !de.Recoverable {
+		return false
+	}
+	if cc, ok := c.(*ClientConn); ok {
+		return cc.recoverDecodeError(de)
+	}
+	connLogger(c).Errorf("recovering from decode error: %v", de)
+	return true
+}
+
+// recoverDecodeError applies the client recovery policy: unless
+// ClientConfig.StrictDecoding is set a full refresh is requested and the
+// error is reported on ClientConfig.DecodeErrorCh. The decoder state is
+// kept, the zlib streams of other rects are still in sync.
+func (c *ClientConn) recoverDecodeError(de *DecodeError) bool {
+	if c.cfg.StrictDecoding {
+		return false
+	}
+	connLogger(c).Errorf("recovering from decode error: %v", de)
+	if err := c.RequestRefresh(); err != nil {
+		return false
+	}
+	c.reportDecodeError(de)
+	return true
+}
+
+// reconnectDecodeError recovers from a decode error that left the stream
+// out of sync by opening a new connection with ClientConfig.Redial, the
+// encodings are Reset along with the new handshake. It reports whether
+// reading the stream can continue.
+func (c *ClientConn) reconnectDecodeError(err error) bool {
+	de, ok := err.(*DecodeError)
+	if !ok || c.cfg.StrictDecoding || c.cfg.Redial == nil {
+		return false
+	}
+	log := connLogger(c)
+	log.Errorf("reconnecting after decode error: %v", de)
+	// the recording can't go on past the data that failed
+	if c.fbs != nil {
+		c.fbs.Flush()
+		c.fbs = nil
+	}
+	if err := c.reconnect(c.cfg.Redial); err != nil {
+		log.Errorf("reconnecting: %v", err)
+		return false
+	}
+	c.reportDecodeError(de)
+	return true
+}
+
+// reportDecodeError sends de to ClientConfig.DecodeErrorCh, it is dropped
+// when the channel is full
+func (c *ClientConn) reportDecodeError(de *DecodeError) {
+	if c.cfg.DecodeErrorCh == nil {
+		return
+	}
+	select {
+	case c.cfg.DecodeErrorCh <- de:
+	default:
+		connLogger(c).Warnf("decode error dropped, DecodeErrorCh is full: %v", de)
+	}
+}
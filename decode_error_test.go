@@ -0,0 +1,247 @@
+package vnc2video
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"image/color"
+	"net"
+	"testing"
+	"time"
+)
+
+// decodeSession connects a client decoding Tight and ZRLE, errors recovered
+// from are delivered on the DecodeErrorCh of the returned config
+func decodeSession(t *testing.T) (*ServerConfig, *ClientConfig, *ClientConn, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scfg := &ServerConfig{
+		SecurityHandlers: []SecurityHandler{&ServerAuthNone{}},
+		Encodings:        []Encoding{&RawEncoding{}, &TightEncoding{}, &ZRLEEncoding{}},
+		PixelFormat:      PixelFormat32bit,
+		ClientMessageCh:  make(chan ClientMessage, 16),
+		ServerMessageCh:  make(chan ServerMessage, 16),
+		Messages:         DefaultClientMessages,
+		Width:            16,
+		Height:           16,
+		ErrorCh:          make(chan error, 4),
+	}
+	go Serve(context.Background(), ln, scfg)
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ccfg := &ClientConfig{
+		SecurityHandlers: []SecurityHandler{&ClientAuthNone{}},
+		PixelFormat:      PixelFormat32bit,
+		ClientMessageCh:  make(chan ClientMessage, 16),
+		ServerMessageCh:  make(chan ServerMessage, 16),
+		Messages:         DefaultServerMessages,
+		Encodings:        []Encoding{&RawEncoding{}, &TightEncoding{}, &ZRLEEncoding{}, &DesktopSizePseudoEncoding{}},
+		ErrorCh:          make(chan error, 4),
+		DecodeErrorCh:    make(chan *DecodeError, 4),
+	}
+	cc, err := Connect(context.Background(), nc, ccfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return scfg, ccfg, cc, func() {
+		cc.Close()
+		ln.Close()
+	}
+}
+
+// waitUpdate waits for the next framebuffer update, it fails the test on
+// errors
+func waitUpdate(t *testing.T, ccfg *ClientConfig) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-ccfg.ServerMessageCh:
+			if _, ok := msg.(*FramebufferUpdate); ok {
+				return
+			}
+		case err := <-ccfg.ErrorCh:
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatal("no update received")
+		}
+	}
+}
+
+func TestDecodeErrorRecovery(t *testing.T) {
+	scfg, ccfg, cc, stop := decodeSession(t)
+	defer stop()
+	zbuf := &bytes.Buffer{}
+	zw := zlib.NewWriter(zbuf)
+	check := func(want color.RGBA) {
+		t.Helper()
+		r, g, b, _ := cc.Canvas.At(8, 8).RGBA()
+		if uint8(r) != want.R || uint8(g) != want.G || uint8(b) != want.B {
+			t.Errorf("pixel is %d,%d,%d want %v", r, g, b, want)
+		}
+	}
+
+	scfg.ServerMessageCh <- tightUpdate(t, zw, zbuf, color.RGBA{R: 1, G: 2, B: 3})
+	waitUpdate(t, ccfg)
+	check(color.RGBA{R: 1, G: 2, B: 3})
+
+	// a corrupt JPEG image is skipped, the zlib stream of the following
+	// rect is still in sync
+	jpeg := []byte{TightCompressionJPEG << 4, 4, 0xde, 0xad, 0xbe, 0xef}
+	update := tightUpdate(t, zw, zbuf, color.RGBA{R: 4, G: 5, B: 6})
+	update.Rects[0] = &Rectangle{Width: 8, Height: 8, EncType: EncTight, Enc: &encodedRect{EncTight, jpeg}}
+	scfg.ServerMessageCh <- update
+	waitUpdate(t, ccfg)
+	select {
+	case de := <-ccfg.DecodeErrorCh:
+		if de.Encoding != EncTight || !de.Recoverable {
+			t.Errorf("decode error %v, recoverable %v", de, de.Recoverable)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no decode error reported")
+	}
+	check(color.RGBA{R: 4, G: 5, B: 6})
+
+	// the zlib streams outlive desktop size changes
+	scfg.ServerMessageCh <- &FramebufferUpdate{
+		NumRect: 1,
+		Rects:   []*Rectangle{{Width: 16, Height: 16, EncType: EncDesktopSizePseudo, Enc: &DesktopSizePseudoEncoding{}}},
+	}
+	waitUpdate(t, ccfg)
+	scfg.ServerMessageCh <- tightUpdate(t, zw, zbuf, color.RGBA{R: 7, G: 8, B: 9})
+	waitUpdate(t, ccfg)
+	check(color.RGBA{R: 7, G: 8, B: 9})
+}
+
+func TestDecodeErrorZlibFatal(t *testing.T) {
+	scfg, ccfg, _, stop := decodeSession(t)
+	defer stop()
+	// a ZRLE rect of a single tile with an unknown sub-encoding, the
+	// inflated data left unread desyncs the zlib stream
+	zbuf := &bytes.Buffer{}
+	zw := zlib.NewWriter(zbuf)
+	zw.Write([]byte{100, 0, 0, 0})
+	zw.Flush()
+	data := append([]byte{0, 0, 0, byte(zbuf.Len())}, zbuf.Bytes()...)
+	scfg.ServerMessageCh <- &FramebufferUpdate{
+		NumRect: 1,
+		Rects:   []*Rectangle{{Width: 8, Height: 8, EncType: EncZRLE, Enc: &encodedRect{EncZRLE, data}}},
+	}
+	select {
+	case err := <-ccfg.ErrorCh:
+		if de, ok := err.(*DecodeError); !ok || de.Recoverable || de.Encoding != EncZRLE {
+			t.Errorf("got %v, want a fatal ZRLE decode error", err)
+		}
+	case de := <-ccfg.DecodeErrorCh:
+		t.Fatalf("recovered from %v", de)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error reported")
+	}
+}
+
+func TestDecodeErrorReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conns := make(connHandler, 2)
+	scfg := testServerConfig(16, conns)
+	scfg.Encodings = []Encoding{&RawEncoding{}, &TightEncoding{}, &ZRLEEncoding{}}
+	go Serve(context.Background(), ln, scfg)
+	// next returns the server side of the next connection, once the
+	// client asked for an update on it
+	next := func() *ServerConn {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		var sc *ServerConn
+		for {
+			select {
+			case c := <-conns:
+				sc = c.(*ServerConn)
+			case msg := <-scfg.ClientMessageCh:
+				if _, ok := msg.(*FramebufferUpdateRequest); ok && sc != nil {
+					return sc
+				}
+			case <-timeout:
+				t.Fatal("no update request")
+			}
+		}
+	}
+
+	ccfg := testClientConfig()
+	ccfg.Encodings = []Encoding{&RawEncoding{}, &TightEncoding{}, &ZRLEEncoding{}}
+	ccfg.DecodeErrorCh = make(chan *DecodeError, 1)
+	redials := 0
+	ccfg.Redial = func() (net.Conn, error) {
+		redials++
+		return net.Dial("tcp", ln.Addr().String())
+	}
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := Connect(context.Background(), nc, ccfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	sc := next()
+
+	// the ZRLE stream is out of sync after the corrupt tile, the client
+	// connects again
+	zbuf := &bytes.Buffer{}
+	zw := zlib.NewWriter(zbuf)
+	zw.Write([]byte{100, 0, 0, 0})
+	zw.Flush()
+	data := append([]byte{0, 0, 0, byte(zbuf.Len())}, zbuf.Bytes()...)
+	if err := sc.SendMessage(&FramebufferUpdate{
+		NumRect: 1,
+		Rects:   []*Rectangle{{Width: 8, Height: 8, EncType: EncZRLE, Enc: &encodedRect{EncZRLE, data}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sc = next()
+	select {
+	case de := <-ccfg.DecodeErrorCh:
+		if de.Encoding != EncZRLE || de.Recoverable {
+			t.Errorf("decode error %v, recoverable %v", de, de.Recoverable)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no decode error reported")
+	}
+	if redials != 1 {
+		t.Errorf("redialed %d times", redials)
+	}
+
+	// the new connection starts new zlib streams
+	zbuf.Reset()
+	if err := sc.SendMessage(tightUpdate(t, zlib.NewWriter(zbuf), zbuf, color.RGBA{R: 1, G: 2, B: 3})); err != nil {
+		t.Fatal(err)
+	}
+	waitUpdate(t, ccfg)
+	if r, g, b, _ := cc.Canvas.At(8, 8).RGBA(); uint8(r) != 1 || uint8(g) != 2 || uint8(b) != 3 {
+		t.Errorf("pixel is %d,%d,%d after reconnecting", r, g, b)
+	}
+}
+
+func TestDecodeErrorChFull(t *testing.T) {
+	_, ccfg, cc, stop := decodeSession(t)
+	defer stop()
+	ccfg.DecodeErrorCh = make(chan *DecodeError)
+	done := make(chan bool)
+	go func() { done <- cc.recoverDecodeError(&DecodeError{Recoverable: true}) }()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("decode error not recovered from")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked on an undrained DecodeErrorCh")
+	}
+}
@@ -13,6 +13,7 @@ type VP8ImageEncoder struct {
 	cmd           *exec.Cmd
 	FFMpegBinPath string
 	input         io.WriteCloser
+	ppm           ppmWriter
 	closed        bool
 	Framerate     int
 }
@@ -102,7 +103,7 @@ func (enc *VP8ImageEncoder) Encode(img image.Image) {
 		return
 	}
 
-	err := encodePPM(enc.input, img)
+	err := enc.ppm.encodePPM(enc.input, img)
 	if err != nil {
 		logger.Error("error while encoding image:", err)
 	}
@@ -110,4 +111,8 @@ func (enc *VP8ImageEncoder) Encode(img image.Image) {
 
 func (enc *VP8ImageEncoder) Close() {
 	enc.closed = true
+	// ffmpeg finishes the video at the end of its input
+	if enc.input != nil {
+		enc.input.Close()
+	}
 }
@@ -13,6 +13,7 @@ type DV9ImageEncoder struct {
 	cmd           *exec.Cmd
 	FFMpegBinPath string
 	input         io.WriteCloser
+	ppm           ppmWriter
 	Framerate     int
 }
 
@@ -85,7 +86,7 @@ func (enc *DV9ImageEncoder) Run(videoFileName string) {
 	}
 }
 func (enc *DV9ImageEncoder) Encode(img image.Image) {
-	err := encodePPM(enc.input, img)
+	err := enc.ppm.encodePPM(enc.input, img)
 	if err != nil {
 		logger.Error("error while encoding image:", err)
 	}
@@ -15,6 +15,7 @@ type HuffYuvImageEncoder struct {
 	FFMpegBinPath string
 	cmd           *exec.Cmd
 	input         io.WriteCloser
+	ppm           ppmWriter
 	closed        bool
 	Framerate     int
 }
@@ -104,7 +105,7 @@ func (enc *HuffYuvImageEncoder) Encode(img image.Image) {
 		return
 	}
 
-	err := encodePPM(enc.input, img)
+	err := enc.ppm.encodePPM(enc.input, img)
 	if err != nil {
 		logger.Error("error while encoding image:", err)
 	}
@@ -112,5 +113,8 @@ func (enc *HuffYuvImageEncoder) Encode(img image.Image) {
 
 func (enc *HuffYuvImageEncoder) Close() {
 	enc.closed = true
-	//enc.cmd.Process.Kill()
+	// ffmpeg finishes the video at the end of its input
+	if enc.input != nil {
+		enc.input.Close()
+	}
 }
@@ -37,9 +37,13 @@ func encodePPMGeneric(w io.Writer, img image.Image) error {
 	return nil
 }
 
-var convImage []uint8
+// ppmWriter writes images in PPM format, it holds the conversion buffer
+// of a single encoder so encoders of different sessions share no state
+type ppmWriter struct {
+	convImage []uint8
+}
 
-func encodePPMforRGBA(w io.Writer, img *image.RGBA) error {
+func (p *ppmWriter) encodePPMforRGBA(w io.Writer, img *image.RGBA) error {
 	maxvalue := 255
 	size := img.Bounds()
 	// write ppm header
@@ -48,15 +52,20 @@ func encodePPMforRGBA(w io.Writer, img *image.RGBA) error {
 		return err
 	}
 
-	if convImage == nil {
-		convImage = make([]uint8, size.Dy()*size.Dx()*3)
+	if len(p.convImage) != size.Dy()*size.Dx()*3 {
+		p.convImage = make([]uint8, size.Dy()*size.Dx()*3)
 	}
+	convImage := p.convImage
 
+	// sub images share the pixels of a wider image, so copy row by row
 	rowCount := 0
-	for i := 0; i < len(img.Pix); i++ {
-		if (i % 4) != 3 {
-			convImage[rowCount] = img.Pix[i]
-			rowCount++
+	for y := 0; y < size.Dy(); y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+size.Dx()*4]
+		for i := 0; i < len(row); i++ {
+			if (i % 4) != 3 {
+				convImage[rowCount] = row[i]
+				rowCount++
+			}
 		}
 	}
 
@@ -67,7 +76,7 @@ func encodePPMforRGBA(w io.Writer, img *image.RGBA) error {
 	return nil
 }
 
-func encodePPM(w io.Writer, img image.Image) error {
+func (p *ppmWriter) encodePPM(w io.Writer, img image.Image) error {
 	if img == nil {
 		return errors.New("nil image")
 	}
@@ -76,7 +85,7 @@ func encodePPM(w io.Writer, img image.Image) error {
 	if isRGBImage {
 		return encodePPMforRGBImage(w, img1)
 	} else if isRGBA {
-		return encodePPMforRGBA(w, img2)
+		return p.encodePPMforRGBA(w, img2)
 	}
 	return encodePPMGeneric(w, img)
 }
@@ -90,9 +99,17 @@ func encodePPMforRGBImage(w io.Writer, img *vnc2video.RGBImage) error {
 		return err
 	}
 
-	if _, err := w.Write(img.Pix); err != nil {
+	rowLen := size.Dx() * 3
+	if img.Stride == rowLen {
+		_, err := w.Write(img.Pix[:size.Dy()*rowLen])
 		return err
 	}
+	// a cropped sub image, write only the visible part of each row
+	for y := 0; y < size.Dy(); y++ {
+		if _, err := w.Write(img.Pix[y*img.Stride : y*img.Stride+rowLen]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
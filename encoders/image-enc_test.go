@@ -0,0 +1,41 @@
+package encoders
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/amitbet/vnc2video"
+)
+
+func TestEncodePPMCropped(t *testing.T) {
+	rgb := vnc2video.NewRGBImage(image.Rect(0, 0, 8, 6))
+	rgba := image.NewRGBA(image.Rect(0, 0, 8, 6))
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 8; x++ {
+			c := color.RGBA{R: uint8(x), G: uint8(y), B: uint8(x * y), A: 0xff}
+			rgb.Set(x, y, c)
+			rgba.Set(x, y, c)
+		}
+	}
+	p := &ppmWriter{}
+	for _, r := range []image.Rectangle{
+		image.Rect(0, 0, 8, 6),
+		image.Rect(2, 1, 5, 4),
+		image.Rect(0, 2, 8, 4),
+	} {
+		for _, img := range []image.Image{rgb.SubImage(r), rgba.SubImage(r)} {
+			want, got := &bytes.Buffer{}, &bytes.Buffer{}
+			if err := encodePPMGeneric(want, img); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.encodePPM(got, img); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), want.Bytes()) {
+				t.Errorf("%T cropped to %v:\n%q\nwant\n%q", img, r, got.Bytes(), want.Bytes())
+			}
+		}
+	}
+}
@@ -15,6 +15,7 @@ type X264ImageEncoder struct {
 	FFMpegBinPath string
 	cmd           *exec.Cmd
 	input         io.WriteCloser
+	ppm           ppmWriter
 	closed        bool
 	Framerate     int
 }
@@ -107,7 +108,7 @@ func (enc *X264ImageEncoder) Encode(img image.Image) {
 		return
 	}
 
-	err := encodePPM(enc.input, img)
+	err := enc.ppm.encodePPM(enc.input, img)
 	if err != nil {
 		logger.Error("error while encoding image:", err)
 	}
@@ -115,5 +116,8 @@ func (enc *X264ImageEncoder) Encode(img image.Image) {
 
 func (enc *X264ImageEncoder) Close() {
 	enc.closed = true
-	//enc.cmd.Process.Kill()
+	// ffmpeg finishes the video at the end of its input
+	if enc.input != nil {
+		enc.input.Close()
+	}
 }
@@ -27,9 +27,10 @@ const (
 	EncUltra1                        EncodingType = 9
 	EncUltra2                        EncodingType = 10
 	EncJPEG                          EncodingType = 21
-	EncJRLE                          EncodingType = 22
+	EncJRLE                          EncodingType = 22 // not decoded, the format has no public specification
 	EncTRLE                          EncodingType = 15
 	EncZRLE                          EncodingType = 16
+	EncZYWRLE                        EncodingType = 17
 	EncAtenAST2100                   EncodingType = 0x57
 	EncAtenASTJPEG                   EncodingType = 0x58
 	EncAtenHermon                    EncodingType = 0x59
@@ -48,6 +49,7 @@ const (
 	EncPointerPosPseudo              EncodingType = -232
 	EncCursorPseudo                  EncodingType = -239
 	EncXCursorPseudo                 EncodingType = -240
+	EncCursorWithAlphaPseudo         EncodingType = -314
 	EncDesktopSizePseudo             EncodingType = -223
 	EncLastRectPseudo                EncodingType = -224
 	EncCompressionLevel10            EncodingType = -247
@@ -69,6 +71,14 @@ const (
 	EncClientRedirect                EncodingType = -311
 	EncFencePseudo                   EncodingType = -312
 	EncContinuousUpdatesPseudo       EncodingType = -313
+	EncFineQualityLevel0Pseudo       EncodingType = -512
+	EncFineQualityLevel100Pseudo     EncodingType = -412
+	EncSubsamp1XPseudo               EncodingType = -768
+	EncSubsamp4XPseudo               EncodingType = -767
+	EncSubsamp2XPseudo               EncodingType = -766
+	EncSubsampGrayPseudo             EncodingType = -765
+	EncSubsamp8XPseudo               EncodingType = -764
+	EncSubsamp16XPseudo              EncodingType = -763
 	EncExtendedClipboardPseudo       EncodingType = -1063131698 //C0A1E5CE
 )
 
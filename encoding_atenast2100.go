@@ -0,0 +1,589 @@
+package vnc2video
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image/color"
+	"image/draw"
+	"io"
+	"math"
+)
+
+// AST2100 block codes, with astSkip set the block position follows the
+// code instead of being the one after the previous block
+const (
+	astJPEG      = 0x0
+	astJPEGPass2 = 0x2
+	astLowJPEG   = 0x4
+	astVQ1Color  = 0x5
+	astVQ2Color  = 0x6
+	astVQ4Color  = 0x7
+	astSkip      = 0x8
+	astFrameEnd  = 0x9
+)
+
+// AST2100 chroma subsampling modes, as sent in the frame header
+const (
+	astMode444 = 444
+	astMode420 = 422
+)
+
+// astMaxFrame bounds the length of a frame, which is read whole before it
+// is decoded
+const astMaxFrame = 16 << 20
+
+// astVQColors are the VQ colors at the start of a frame, in YCbCr
+var astVQColors = [4]uint32{0x008080, 0xff8080, 0x808080, 0xc08080}
+
+// AtenAST2100 decodes the video of the ATEN iKVM BMCs built around the
+// ASPEED AST2100 and later chips. Every rect holds a whole frame of 8x8
+// (4:4:4) or 16x16 (4:2:0) blocks, coded as baseline JPEG with the
+// standard Huffman tables or as 1, 2 or 4 color vector quantization.
+type AtenAST2100 struct {
+	Image draw.Image
+
+	data   []byte
+	bits   astBits
+	quant  [2][64]int32
+	sel    [2]uint8
+	dc     [3]int32
+	vq     [4]uint32
+	mbSize int
+	cols   int
+	rows   int
+	// planes hold the Y, Cb and Cr samples at full resolution, pass 2
+	// blocks refine them
+	planes [3][]uint8
+}
+
+func (*AtenAST2100) Supported(Conn) bool {
+	return true
+}
+
+func (enc *AtenAST2100) SetTargetImage(img draw.Image) {
+	enc.Image = img
+}
+
+func (enc *AtenAST2100) Reset() error {
+	enc.planes = [3][]uint8{}
+	return nil
+}
+
+func (*AtenAST2100) Type() EncodingType { return EncAtenAST2100 }
+
+func (*AtenAST2100) Write(c Conn, rect *Rectangle) error {
+	return nil
+}
+
+func (enc *AtenAST2100) Read(c Conn, rect *Rectangle) error {
+	connLogger(c).Tracef("reading AtenAST2100:%v\n", rect)
+	var header struct {
+		_      [4]byte
+		Length uint32
+	}
+	if err := binary.Read(c, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	if header.Length > astMaxFrame {
+		return fmt.Errorf("AST2100 frame of %d bytes, more than %d", header.Length, astMaxFrame)
+	}
+	if cap(enc.data) < int(header.Length) {
+		enc.data = make([]byte, header.Length)
+	}
+	data := enc.data[:header.Length]
+	if _, err := io.ReadFull(c, data); err != nil {
+		return err
+	}
+	if atenScreenOff(rect) {
+		return nil
+	}
+	atenResize(c, rect)
+	return corrupt(enc.decode(data, rect))
+}
+
+// atenScreenOff reports whether rect is the marker ATEN servers send when
+// the host screen is off
+func atenScreenOff(rect *Rectangle) bool {
+	return rect.Width == 64896 && rect.Height == 65056
+}
+
+// atenResize follows the screen size of the ATEN video rects, which always
+// cover the whole screen
+func atenResize(c Conn, rect *Rectangle) {
+	atenSetSize(c, rect.Width, rect.Height)
+}
+
+// atenSetSize sets the screen size of c and resizes the canvas of client
+// connections
+func atenSetSize(c Conn, width, height uint16) {
+	if c.Width() == width && c.Height() == height {
+		return
+	}
+	c.SetWidth(width)
+	c.SetHeight(height)
+	if cc, ok := c.(*ClientConn); ok && cc.Canvas != nil {
+		cc.Canvas.Resize(int(width), int(height))
+	}
+}
+
+// decode draws a frame, its header holds the luma and chroma quantization
+// table selectors and the subsampling mode, the blocks follow as a bit
+// stream of little endian 32 bit words
+func (enc *AtenAST2100) decode(data []byte, rect *Rectangle) error {
+	if len(data) < 4 {
+		return fmt.Errorf("AST2100 frame of %d bytes", len(data))
+	}
+	mbSize := 0
+	switch mode := binary.BigEndian.Uint16(data[2:]); mode {
+	case astMode444:
+		mbSize = 8
+	case astMode420:
+		mbSize = 16
+	default:
+		return fmt.Errorf("unknown AST2100 subsampling mode %d", mode)
+	}
+	enc.setQuant(data[0], data[1])
+	enc.setSize(int(rect.Width), int(rect.Height), mbSize)
+	enc.dc = [3]int32{}
+	enc.vq = astVQColors
+	enc.bits = astBits{data: data[4:]}
+
+	x, y := 0, 0
+	for enc.bits.remaining() > 0 {
+		code := enc.bits.read(4)
+		if code == astFrameEnd {
+			break
+		}
+		if code&astSkip != 0 {
+			x, y = int(enc.bits.read(8)), int(enc.bits.read(8))
+			code &^= astSkip
+		}
+		if x >= enc.cols || y >= enc.rows {
+			return fmt.Errorf("AST2100 block %d,%d outside of the %dx%d screen", x, y, rect.Width, rect.Height)
+		}
+		var err error
+		switch code {
+		case astJPEG, astLowJPEG:
+			err = enc.decodeJPEG(x, y, false)
+		case astJPEGPass2:
+			err = enc.decodeJPEG(x, y, true)
+		case astVQ1Color, astVQ2Color, astVQ4Color:
+			enc.decodeVQ(x, y, uint(code-astVQ1Color))
+		default:
+			err = fmt.Errorf("unknown AST2100 block code %d", code)
+		}
+		if err != nil {
+			return err
+		}
+		if enc.bits.remaining() < 0 {
+			return fmt.Errorf("AST2100 frame truncated")
+		}
+		enc.render(x, y, rect)
+		if x++; x == enc.cols {
+			x = 0
+			y++
+		}
+	}
+	return nil
+}
+
+// setQuant loads the quantization tables of the luma and chroma table
+// selectors, from 0 for the lowest quality to 7 for the highest. Higher
+// selectors take the highest quality tables.
+func (enc *AtenAST2100) setQuant(luma, chroma uint8) {
+	if enc.sel == [2]uint8{luma, chroma} && enc.quant[0][0] != 0 {
+		return
+	}
+	enc.sel = [2]uint8{luma, chroma}
+	for i, sel := range enc.sel {
+		enc.quant[i] = astQuantTable(i, int(sel))
+	}
+}
+
+// astQuantScales scale the standard JPEG tables into the ASPEED tables of
+// each selector, named Tbl_000Y to Tbl_100Y in ATEN's JViewer. Selector 0
+// gives Tbl_000Y, the standard luma table times 1.25 rounded down, and
+// selector 7 gives Tbl_100Y, the standard table divided by 8 rounded down.
+// Those two are known, the scales in between are not: they are spaced
+// evenly on a log scale and the decoded detail may be a little off at
+// these selectors.
+var astQuantScales = [8]float64{1.25, 0.8996, 0.6474, 0.4659, 0.3353, 0.2413, 0.1737, 0.125}
+
+// astChromaScale is how much more the chroma tables are scaled than the
+// luma ones. It is an assumption, the ASPEED chroma tables could not be
+// checked.
+const astChromaScale = 1.5
+
+// astQuantTable returns the luma (table 0) or chroma (table 1)
+// quantization table of a selector, in zigzag order
+func astQuantTable(table, sel int) (q [64]int32) {
+	if sel >= len(astQuantScales) {
+		sel = len(astQuantScales) - 1
+	}
+	scale := astQuantScales[sel]
+	if table > 0 {
+		scale *= astChromaScale
+	}
+	for k, v := range astQuantTables[table] {
+		q[k] = int32(float64(v) * scale)
+		if q[k] < 1 {
+			q[k] = 1
+		} else if q[k] > 255 {
+			q[k] = 255
+		}
+	}
+	return q
+}
+
+// setSize allocates the planes for the screen size and subsampling mode
+func (enc *AtenAST2100) setSize(width, height, mbSize int) {
+	cols, rows := (width+mbSize-1)/mbSize, (height+mbSize-1)/mbSize
+	if enc.planes[0] != nil && enc.mbSize == mbSize && enc.cols == cols && enc.rows == rows {
+		return
+	}
+	enc.mbSize, enc.cols, enc.rows = mbSize, cols, rows
+	for i := range enc.planes {
+		enc.planes[i] = make([]uint8, cols*mbSize*rows*mbSize)
+	}
+}
+
+// decodeJPEG decodes the luma blocks of a macroblock followed by its Cb and
+// Cr blocks, pass 2 blocks are added to the samples already there
+func (enc *AtenAST2100) decodeJPEG(mx, my int, add bool) error {
+	var blk [64]int32
+	x0, y0 := mx*enc.mbSize, my*enc.mbSize
+	lumaBlocks := enc.mbSize / 8 * enc.mbSize / 8
+	for i := 0; i < lumaBlocks; i++ {
+		if err := enc.decodeBlock(&blk, 0); err != nil {
+			return err
+		}
+		enc.putBlock(0, x0+i%2*8, y0+i/2*8, 1, &blk, add)
+	}
+	for comp := 1; comp < 3; comp++ {
+		if err := enc.decodeBlock(&blk, comp); err != nil {
+			return err
+		}
+		enc.putBlock(comp, x0, y0, enc.mbSize/8, &blk, add)
+	}
+	return nil
+}
+
+// decodeBlock reads the Huffman coded coefficients of a block of comp and
+// returns its samples in blk, without the level shift
+func (enc *AtenAST2100) decodeBlock(blk *[64]int32, comp int) error {
+	table := 0
+	if comp > 0 {
+		table = 1
+	}
+	q := &enc.quant[table]
+	var coef [64]int32
+	s, err := enc.bits.decode(astHuffmanTables[2*table])
+	if err != nil {
+		return err
+	}
+	enc.dc[comp] += enc.bits.receiveExtend(uint(s))
+	coef[0] = enc.dc[comp] * q[0]
+	for k := 1; k < 64; k++ {
+		rs, err := enc.bits.decode(astHuffmanTables[2*table+1])
+		if err != nil {
+			return err
+		}
+		r, s := int(rs>>4), uint(rs&0x0f)
+		if s == 0 {
+			if r != 15 {
+				break
+			}
+			k += 15
+			continue
+		}
+		if k += r; k > 63 {
+			return fmt.Errorf("AST2100 coefficient run past the block end")
+		}
+		coef[astUnzig[k]] = enc.bits.receiveExtend(s) * q[k]
+	}
+	astIDCT(&coef, blk)
+	return nil
+}
+
+// putBlock stores blk in the plane of comp with its top left sample at
+// x0, y0, every sample covering scale x scale pixels
+func (enc *AtenAST2100) putBlock(comp, x0, y0, scale int, blk *[64]int32, add bool) {
+	plane, stride := enc.planes[comp], enc.cols*enc.mbSize
+	for i, v := range blk {
+		bx, by := x0+i%8*scale, y0+i/8*scale
+		for y := by; y < by+scale; y++ {
+			for x := bx; x < bx+scale; x++ {
+				base := int32(128)
+				if add {
+					base = int32(plane[y*stride+x])
+				}
+				plane[y*stride+x] = clampByte(int(base + v))
+			}
+		}
+	}
+}
+
+// decodeVQ decodes a block of 1 << bits colors, each color is an index in
+// the VQ colors optionally followed by a new value for it, then every pixel
+// picks one of the block colors
+func (enc *AtenAST2100) decodeVQ(mx, my int, bits uint) {
+	var colors [4]uint32
+	for i := 0; i < 1<<bits; i++ {
+		update := enc.bits.read(1)
+		index := enc.bits.read(2)
+		if update != 0 {
+			enc.vq[index] = enc.bits.read(24)
+		}
+		colors[i] = enc.vq[index]
+	}
+	var blk [3][64]int32
+	for i := 0; i < 64; i++ {
+		col := colors[0]
+		if bits > 0 {
+			col = colors[enc.bits.read(bits)]
+		}
+		blk[0][i] = int32(col>>16) - 128
+		blk[1][i] = int32(col>>8&0xff) - 128
+		blk[2][i] = int32(col&0xff) - 128
+	}
+	scale := enc.mbSize / 8
+	for comp := range blk {
+		enc.putBlock(comp, mx*enc.mbSize, my*enc.mbSize, scale, &blk[comp], false)
+	}
+}
+
+// render draws the macroblock at mx, my from the planes
+func (enc *AtenAST2100) render(mx, my int, rect *Rectangle) {
+	stride := enc.cols * enc.mbSize
+	x0, y0 := mx*enc.mbSize, my*enc.mbSize
+	for y := y0; y < y0+enc.mbSize && y < int(rect.Height); y++ {
+		for x := x0; x < x0+enc.mbSize && x < int(rect.Width); x++ {
+			i := y*stride + x
+			r, g, b := color.YCbCrToRGB(enc.planes[0][i], enc.planes[1][i], enc.planes[2][i])
+			enc.Image.Set(int(rect.X)+x, int(rect.Y)+y, color.RGBA{R: r, G: g, B: b, A: 1})
+		}
+	}
+}
+
+// astBits reads the AST2100 bit stream, which is a sequence of little
+// endian 32 bit words read from their most significant bit
+type astBits struct {
+	data []byte
+	// acc holds n bits aligned on its most significant bit, the last pad
+	// of them are past the end of data
+	acc uint64
+	n   int
+	pad int
+}
+
+func (b *astBits) fill() {
+	for b.n <= 32 {
+		var word [4]byte
+		l := copy(word[:], b.data)
+		b.data = b.data[l:]
+		b.pad += (4 - l) * 8
+		b.acc |= uint64(binary.LittleEndian.Uint32(word[:])) << uint(32-b.n)
+		b.n += 32
+	}
+}
+
+// remaining returns the number of bits left, it is negative once the
+// stream was read past its end
+func (b *astBits) remaining() int {
+	b.fill()
+	return b.n - b.pad
+}
+
+func (b *astBits) read(n uint) uint32 {
+	b.fill()
+	v := uint32(b.acc >> (64 - n))
+	b.acc <<= n
+	b.n -= int(n)
+	return v
+}
+
+// receiveExtend reads the n bits of a coefficient and extends their sign
+func (b *astBits) receiveExtend(n uint) int32 {
+	if n == 0 {
+		return 0
+	}
+	v := int32(b.read(n))
+	if v < 1<<(n-1) {
+		v += -1<<n + 1
+	}
+	return v
+}
+
+func (b *astBits) decode(h *astHuffman) (uint8, error) {
+	b.fill()
+	v := int32(b.acc >> 48)
+	for l := uint(1); l <= 16; l++ {
+		code := v >> (16 - l)
+		if code <= h.maxCode[l] {
+			b.read(l)
+			return h.vals[h.valPtr[l]+code], nil
+		}
+	}
+	return 0, fmt.Errorf("bad AST2100 Huffman code")
+}
+
+// astHuffman is a canonical Huffman table, the codes of length l run up to
+// maxCode[l] and their values start at vals[valPtr[l]+first code]
+type astHuffman struct {
+	maxCode [17]int32
+	valPtr  [17]int32
+	vals    []byte
+}
+
+func newASTHuffman(counts [16]byte, vals []byte) *astHuffman {
+	h := &astHuffman{vals: vals}
+	code, k := int32(0), int32(0)
+	for l := 1; l <= 16; l++ {
+		n := int32(counts[l-1])
+		h.valPtr[l] = k - code
+		code += n
+		k += n
+		h.maxCode[l] = code - 1
+		code <<= 1
+	}
+	return h
+}
+
+// astIDCT computes the inverse DCT of the coefficients in natural order
+func astIDCT(coef, out *[64]int32) {
+	var tmp [64]float64
+	for v := 0; v < 8; v++ {
+		for x := 0; x < 8; x++ {
+			var sum float64
+			for u := 0; u < 8; u++ {
+				sum += astCos[x][u] * float64(coef[v*8+u])
+			}
+			tmp[v*8+x] = sum
+		}
+	}
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			var sum float64
+			for v := 0; v < 8; v++ {
+				sum += astCos[y][v] * tmp[v*8+x]
+			}
+			out[y*8+x] = int32(math.Round(sum))
+		}
+	}
+}
+
+// astCos[x][u] is the IDCT basis C(u)/2*cos((2x+1)u*pi/16)
+var astCos = func() (t [8][8]float64) {
+	for x := 0; x < 8; x++ {
+		for u := 0; u < 8; u++ {
+			c := 0.5
+			if u == 0 {
+				c = 0.5 / math.Sqrt2
+			}
+			t[x][u] = c * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+	return t
+}()
+
+// astUnzig maps the zigzag order of the coefficients to the natural order
+var astUnzig = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// astQuantTables are the standard luma and chroma quantization tables, in
+// zigzag order
+var astQuantTables = [2][64]byte{
+	{
+		16, 11, 12, 14, 12, 10, 16, 14,
+		13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37,
+		29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68,
+		87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113,
+		121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	{
+		17, 18, 18, 24, 21, 24, 47, 26,
+		26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// astHuffmanTables are the standard luma DC, luma AC, chroma DC and chroma
+// AC Huffman tables
+var astHuffmanTables = [4]*astHuffman{
+	newASTHuffman(
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	),
+	newASTHuffman(
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	),
+	newASTHuffman(
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	),
+	newASTHuffman(
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	),
+}
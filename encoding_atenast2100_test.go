@@ -0,0 +1,285 @@
+package vnc2video
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+// astStream packs bits written as strings of 0 and 1 into the little endian
+// words of the AST2100 bit stream
+type astStream struct {
+	words []uint32
+	acc   uint32
+	n     uint
+}
+
+func (s *astStream) put(bits string) {
+	for _, b := range strings.Replace(bits, " ", "", -1) {
+		s.acc = s.acc<<1 | uint32(b-'0')
+		if s.n++; s.n == 32 {
+			s.words = append(s.words, s.acc)
+			s.acc, s.n = 0, 0
+		}
+	}
+}
+
+func (s *astStream) putN(v uint32, n int) {
+	s.put(fmt.Sprintf("%0*b", n, v))
+}
+
+func (s *astStream) bytes() []byte {
+	words := s.words
+	if s.n > 0 {
+		words = append(words, s.acc<<(32-s.n))
+	}
+	b := make([]byte, 4*len(words))
+	for i, w := range words {
+		binary.LittleEndian.PutUint32(b[4*i:], w)
+	}
+	return b
+}
+
+func TestAtenAST2100(t *testing.T) {
+	red := color.RGBA{R: 0xff}
+	y, cb, cr := color.RGBToYCbCr(red.R, red.G, red.B)
+
+	s := &astStream{}
+	// block 0,0: two colors, a new one in slot 1 and black from slot 0,
+	// the left half of the block takes the first one
+	s.put("0110")
+	s.put("1 01")
+	s.putN(uint32(y)<<16|uint32(cb)<<8|uint32(cr), 24)
+	s.put("0 00")
+	for i := 0; i < 64; i++ {
+		if i%8 < 4 {
+			s.put("0")
+		} else {
+			s.put("1")
+		}
+	}
+	// block 1,0 given by position: luma DC of 288 (category 9), quantized
+	// by 2, then EOB. The chroma blocks have a zero DC and EOB.
+	s.put("1000 00000001 00000000")
+	s.put("1111110 100100000 1010")
+	s.put("00 00 00 00")
+	// block 2,0: the DC prediction gives the same gray
+	s.put("0000")
+	s.put("00 1010 00 00 00 00")
+	s.put("1001")
+
+	data := append([]byte{11, 11, 0x01, 0xbc}, s.bytes()...)
+	conn := &bufConn{}
+	binary.Write(conn, binary.BigEndian, [4]byte{})
+	binary.Write(conn, binary.BigEndian, uint32(len(data)))
+	conn.Write(data)
+
+	img := NewRGBImage(image.Rect(0, 0, 24, 8))
+	enc := &AtenAST2100{Image: img}
+	if err := enc.Read(conn, &Rectangle{Width: 24, Height: 8, EncType: EncAtenAST2100}); err != nil {
+		t.Fatal(err)
+	}
+	gray := color.RGBA{R: 200, G: 200, B: 200}
+	for py := 0; py < 8; py++ {
+		for px := 0; px < 24; px++ {
+			want := gray
+			switch {
+			case px < 4:
+				want = red
+			case px < 8:
+				want = color.RGBA{}
+			}
+			got := rgbAt(img, px, py)
+			if !near(got.R, want.R, 2) || !near(got.G, want.G, 2) || !near(got.B, want.B, 2) {
+				t.Fatalf("pixel %d,%d is %v, want %v", px, py, got, want)
+			}
+		}
+	}
+
+	// a frame running out of bits is an error
+	conn.Reset()
+	binary.Write(conn, binary.BigEndian, [4]byte{})
+	binary.Write(conn, binary.BigEndian, uint32(8))
+	conn.Write([]byte{11, 11, 0x01, 0xbc, 0, 0, 0, 0})
+	if err := enc.Read(conn, &Rectangle{Width: 24, Height: 8, EncType: EncAtenAST2100}); err == nil {
+		t.Error("truncated frame decoded")
+	}
+}
+
+// astFrame returns the rect data of an AST2100 frame with the highest
+// quality tables
+func astFrame(mode uint16, s *astStream) *bufConn {
+	data := append([]byte{7, 7, byte(mode >> 8), byte(mode)}, s.bytes()...)
+	conn := &bufConn{}
+	binary.Write(conn, binary.BigEndian, [4]byte{})
+	binary.Write(conn, binary.BigEndian, uint32(len(data)))
+	conn.Write(data)
+	return conn
+}
+
+func TestAtenAST2100Quant(t *testing.T) {
+	natural := func(q [64]int32) (row []int32) {
+		var n [64]int32
+		for k, v := range q {
+			n[astUnzig[k]] = v
+		}
+		return n[:8]
+	}
+	// the first rows of JViewer's Tbl_000Y and Tbl_100Y
+	for sel, want := range map[int][]int32{
+		0:  {20, 13, 12, 20, 30, 50, 63, 76},
+		7:  {2, 1, 1, 2, 3, 5, 6, 7},
+		11: {2, 1, 1, 2, 3, 5, 6, 7},
+	} {
+		if got := natural(astQuantTable(0, sel)); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("luma table %d starts with %v, want %v", sel, got, want)
+		}
+	}
+}
+
+func TestAtenAST2100Subsampled(t *testing.T) {
+	s := &astStream{}
+	// a 4:2:0 macroblock: the four luma blocks go left to right then top
+	// to bottom, their DCs are 288, 0, 0 and 288. The Cb DC of 16 is
+	// quantized by 3 and covers the whole macroblock.
+	s.put("0000")
+	s.put("1111110 100100000 1010")
+	s.put("1111110 011011111 1010")
+	s.put("00 1010")
+	s.put("1111110 100100000 1010")
+	s.put("11110 10000 00")
+	s.put("00 00")
+	s.put("1001")
+
+	img := NewRGBImage(image.Rect(0, 0, 16, 16))
+	enc := &AtenAST2100{Image: img}
+	if err := enc.Read(astFrame(astMode420, s), &Rectangle{Width: 16, Height: 16, EncType: EncAtenAST2100}); err != nil {
+		t.Fatal(err)
+	}
+	for py := 0; py < 16; py++ {
+		for px := 0; px < 16; px++ {
+			y := uint8(128)
+			if (px < 8) == (py < 8) {
+				y = 200
+			}
+			r, g, b := color.YCbCrToRGB(y, 134, 128)
+			got := rgbAt(img, px, py)
+			if !near(got.R, r, 2) || !near(got.G, g, 2) || !near(got.B, b, 2) {
+				t.Fatalf("pixel %d,%d is %v, want %d,%d,%d", px, py, got, r, g, b)
+			}
+		}
+	}
+}
+
+func TestAtenAST2100Pass2(t *testing.T) {
+	s := &astStream{}
+	// a luma DC of 32 lifts the gray by 8, the pass 2 block at the same
+	// position adds the same DC again
+	s.put("0000")
+	s.put("1110 100000 1010")
+	s.put("00 00 00 00")
+	s.put("1010 00000000 00000000")
+	s.put("00 1010")
+	s.put("00 00 00 00")
+	s.put("1001")
+
+	img := NewRGBImage(image.Rect(0, 0, 8, 8))
+	enc := &AtenAST2100{Image: img}
+	if err := enc.Read(astFrame(astMode444, s), &Rectangle{Width: 8, Height: 8, EncType: EncAtenAST2100}); err != nil {
+		t.Fatal(err)
+	}
+	for py := 0; py < 8; py++ {
+		for px := 0; px < 8; px++ {
+			if got := rgbAt(img, px, py); !near(got.R, 144, 2) || !near(got.G, 144, 2) || !near(got.B, 144, 2) {
+				t.Fatalf("pixel %d,%d is %v, want the refined gray 144", px, py, got)
+			}
+		}
+	}
+}
+
+func TestAtenAST2100FrameLength(t *testing.T) {
+	conn := &bufConn{}
+	binary.Write(conn, binary.BigEndian, [4]byte{})
+	binary.Write(conn, binary.BigEndian, uint32(astMaxFrame+1))
+	enc := &AtenAST2100{Image: NewRGBImage(image.Rect(0, 0, 8, 8))}
+	if err := enc.Read(conn, &Rectangle{Width: 8, Height: 8, EncType: EncAtenAST2100}); err == nil {
+		t.Error("oversized frame accepted")
+	}
+}
+
+// atenClient returns a client connection speaking the aten1 protocol
+// which writes to out
+func atenClient(out *bytes.Buffer) *ClientConn {
+	return &ClientConn{
+		protocol: "aten1",
+		bw:       bufio.NewWriter(out),
+		Canvas:   NewVncCanvas(800, 600),
+		fbWidth:  800,
+		fbHeight: 600,
+	}
+}
+
+func TestAtenInput(t *testing.T) {
+	out := &bytes.Buffer{}
+	c := atenClient(out)
+	if err := c.SendMessage(&KeyEvent{Down: 1, Key: SmallA}); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{byte(AteniKVMKeyEventMsgType), 0, 1, 0, 0, 0, 0, 0, byte(SmallA)}
+	want = append(want, make([]byte, 9)...)
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("key event sent as % x, want % x", out.Bytes(), want)
+	}
+
+	out.Reset()
+	if err := c.SendMessage(&PointerEvent{Mask: 1, X: 0x102, Y: 0x304}); err != nil {
+		t.Fatal(err)
+	}
+	want = []byte{byte(AteniKVMPointerEventMsgType), 0, 1, 1, 2, 3, 4}
+	want = append(want, make([]byte, 11)...)
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("pointer event sent as % x, want % x", out.Bytes(), want)
+	}
+
+	// other messages are sent as they are
+	if _, ok := atenInput(&FramebufferUpdateRequest{}).(*FramebufferUpdateRequest); !ok {
+		t.Error("update request changed")
+	}
+}
+
+func TestAtenServerMessages(t *testing.T) {
+	out := &bytes.Buffer{}
+	c := atenClient(out)
+	if err := c.handleServerMessage(&AteniKVMKeepAliveEvent{}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{byte(AteniKVMKeepAliveReplyMsgType), 0}; !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("keep-alive answered with % x, want % x", out.Bytes(), want)
+	}
+
+	// the video info payload is skipped, the message following it is read
+	// in sync and the screen size is left alone
+	info := &bufConn{}
+	info.Write([]byte{4, 0, 3, 0})
+	info.Write(make([]byte, 36))
+	info.Write([]byte{byte(AteniKVMKeepAliveEventMsgType)})
+	msg, err := (&AteniKVMVideoGetInfo{}).Read(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Len() != 1 {
+		t.Errorf("%d bytes left after the video info, want 1", info.Len())
+	}
+	width, height := c.Width(), c.Height()
+	if err := c.handleServerMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	if c.Width() != width || c.Height() != height {
+		t.Errorf("screen set to %dx%d by the video info", c.Width(), c.Height())
+	}
+}
@@ -50,16 +50,13 @@ func (enc *AtenHermon) Read(c Conn, rect *Rectangle) error {
 	}
 	enc.AtenLength = aten_length
 
-	if rect.Width == 64896 && rect.Height == 65056 {
+	if atenScreenOff(rect) {
 		if aten_length != 10 && aten_length != 0 {
 			return fmt.Errorf("screen is off and length is invalid")
 		}
 		aten_length = 0
-	}
-
-	if c.Width() != rect.Width && c.Height() != rect.Height {
-		c.SetWidth(rect.Width)
-		c.SetHeight(rect.Height)
+	} else {
+		atenResize(c, rect)
 	}
 
 	var aten_type uint8
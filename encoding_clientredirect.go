@@ -0,0 +1,78 @@
+package vnc2video
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// clientRedirectMaxString is the longest host or X509 subject accepted
+const clientRedirectMaxString = 1 << 16
+
+// ClientRedirectPseudoEncoding asks the client to reconnect to another
+// server, ClientConn does so transparently when it is in its encodings.
+// The port is sent as the x position of the rectangle.
+type ClientRedirectPseudoEncoding struct {
+	Port        uint16
+	Host        []byte
+	X509Subject []byte
+}
+
+func (*ClientRedirectPseudoEncoding) Supported(Conn) bool {
+	return true
+}
+
+func (*ClientRedirectPseudoEncoding) Reset() error {
+	return nil
+}
+
+func (*ClientRedirectPseudoEncoding) Type() EncodingType { return EncClientRedirect }
+
+// Read implements the Encoding interface.
+func (enc *ClientRedirectPseudoEncoding) Read(c Conn, rect *Rectangle) error {
+	enc.Port = rect.X
+	var err error
+	if enc.Host, err = readClientRedirectString(c); err != nil {
+		return err
+	}
+	if enc.X509Subject, err = readClientRedirectString(c); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (enc *ClientRedirectPseudoEncoding) Write(c Conn, rect *Rectangle) error {
+	for _, s := range [][]byte{enc.Host, enc.X509Subject} {
+		if err := binary.Write(c, binary.BigEndian, uint32(len(s))); err != nil {
+			return err
+		}
+		if err := binary.Write(c, binary.BigEndian, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readClientRedirectString(c Conn) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(c, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length > clientRedirectMaxString {
+		return nil, fmt.Errorf("client redirect string too long: %d", length)
+	}
+	s := make([]byte, length)
+	if err := binary.Read(c, binary.BigEndian, &s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// clientRedirect returns the redirection of an update, nil if it has none
+func clientRedirect(msg *FramebufferUpdate) *ClientRedirectPseudoEncoding {
+	for _, rect := range msg.Rects {
+		if enc, ok := rect.Enc.(*ClientRedirectPseudoEncoding); ok && rect.EncType == EncClientRedirect {
+			return enc
+		}
+	}
+	return nil
+}
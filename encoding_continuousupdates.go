@@ -0,0 +1,24 @@
+package vnc2video
+
+// ContinuousUpdatesPseudoEncoding announces support for continuous updates.
+// The server never sends it as a rectangle, it replies with an
+// EndOfContinuousUpdates message instead.
+type ContinuousUpdatesPseudoEncoding struct{}
+
+func (*ContinuousUpdatesPseudoEncoding) Supported(Conn) bool {
+	return true
+}
+
+func (*ContinuousUpdatesPseudoEncoding) Reset() error {
+	return nil
+}
+
+func (*ContinuousUpdatesPseudoEncoding) Type() EncodingType { return EncContinuousUpdatesPseudo }
+
+func (*ContinuousUpdatesPseudoEncoding) Read(c Conn, rect *Rectangle) error {
+	return nil
+}
+
+func (*ContinuousUpdatesPseudoEncoding) Write(c Conn, rect *Rectangle) error {
+	return nil
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/binary"
 	"image"
 	"image/draw"
-	"github.com/amitbet/vnc2video/logger"
 )
 
 type CopyRectEncoding struct {
@@ -26,7 +25,7 @@ func (enc *CopyRectEncoding) SetTargetImage(img draw.Image) {
 }
 
 func (enc *CopyRectEncoding) Read(c Conn, rect *Rectangle) error {
-	logger.Tracef("Reading: CopyRect %v", rect)
+	connLogger(c).Tracef("Reading: CopyRect %v", rect)
 	if err := binary.Read(c, binary.BigEndian, &enc.SX); err != nil {
 		return err
 	}
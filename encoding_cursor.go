@@ -5,7 +5,6 @@ import (
 	"image"
 	"image/color"
 	"image/draw"
-	"github.com/amitbet/vnc2video/logger"
 )
 
 type CursorPseudoEncoding struct {
@@ -29,10 +28,10 @@ func (enc *CursorPseudoEncoding) Reset() error {
 func (*CursorPseudoEncoding) Type() EncodingType { return EncCursorPseudo }
 
 func (enc *CursorPseudoEncoding) Read(c Conn, rect *Rectangle) error {
-	logger.Tracef("CursorPseudoEncoding.Read: got rect: %v", rect)
+	connLogger(c).Tracef("CursorPseudoEncoding.Read: got rect: %v", rect)
 	//rgba := make([]byte, int(rect.Height)*int(rect.Width)*int(c.PixelFormat().BPP/8))
 	numColors := int(rect.Height) * int(rect.Width)
-	colors := make([]color.Color, numColors)
+	colors := make([]*color.RGBA, numColors)
 	var err error
 	pf := c.PixelFormat()
 	for i := 0; i < numColors; i++ {
@@ -50,31 +49,26 @@ func (enc *CursorPseudoEncoding) Read(c Conn, rect *Rectangle) error {
 		return err
 	}
 	scanLine := (rect.Width + 7) / 8
-	canvas := enc.Image.(*VncCanvas)
-	//canvas.Cursor =
-	cursorImg := image.NewRGBA(MakeRect(0, 0, int(rect.Width), int(rect.Height)))
-	//cursorMask := image.NewRGBA(cursorImg.Bounds())
-	cursorMask := [][]bool{}
-	for i := 0; i < int(rect.Width); i++ {
-		cursorMask = append(cursorMask, make([]bool, rect.Height))
+	canvas, ok := enc.Image.(*VncCanvas)
+	if !ok {
+		return nil
 	}
-
-	//int[] cursorPixels = new int[rect.width * rect.height];
+	if rect.Width == 0 || rect.Height == 0 {
+		canvas.SetCursor(nil)
+		return nil
+	}
+	// the rect position is the hotspot
+	cursor := NewCursor(int(rect.Width), int(rect.Height), image.Point{int(rect.X), int(rect.Y)})
 	for y := 0; y < int(rect.Height); y++ {
 		for x := 0; x < int(rect.Width); x++ {
 			offset := y*int(rect.Width) + x
 			if bitmask[y*int(scanLine)+x/8]&(1<<uint(7-x%8)) > 0 {
-				cursorImg.Set(x, y, colors[offset])
-				//cursorMask.Set(x, y, color.RGBA{1, 1, 1, 1})
-				cursorMask[x][y] = true
-				//logger.Tracef("CursorPseudoEncoding.Read: setting pixel: (%d,%d) %v", x+int(rect.X), y+int(rect.Y), colors[offset])
+				col := colors[offset]
+				cursor.Image.SetNRGBA(x, y, color.NRGBA{R: col.R, G: col.G, B: col.B, A: 0xff})
 			}
 		}
 	}
-	canvas.CursorOffset = &image.Point{int(rect.X), int(rect.Y)}
-	canvas.Cursor = cursorImg
-	canvas.CursorBackup = image.NewRGBA(cursorImg.Bounds())
-	canvas.CursorMask = cursorMask
+	canvas.SetCursor(cursor)
 	/*
 		rectStride := 4 * rect.Width
 		for i := uint16(0); i < rect.Height; i++ {
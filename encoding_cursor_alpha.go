@@ -0,0 +1,75 @@
+package vnc2video
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// CursorWithAlphaPseudoEncoding is a cursor shape with an alpha channel.
+// The pixels are sent with an encoding of their own, only raw is supported,
+// in a 32 bit RGBA format with premultiplied alpha.
+type CursorWithAlphaPseudoEncoding struct {
+	Image draw.Image
+}
+
+func (*CursorWithAlphaPseudoEncoding) Supported(Conn) bool {
+	return true
+}
+
+func (enc *CursorWithAlphaPseudoEncoding) SetTargetImage(img draw.Image) {
+	enc.Image = img
+}
+
+func (*CursorWithAlphaPseudoEncoding) Reset() error {
+	return nil
+}
+
+func (*CursorWithAlphaPseudoEncoding) Type() EncodingType { return EncCursorWithAlphaPseudo }
+
+func (enc *CursorWithAlphaPseudoEncoding) Read(c Conn, rect *Rectangle) error {
+	connLogger(c).Tracef("CursorWithAlphaPseudoEncoding.Read: got rect: %v", rect)
+	encType, err := ReadUint32(c)
+	if err != nil {
+		return err
+	}
+	if EncodingType(encType) != EncRaw {
+		return fmt.Errorf("cursor with alpha sent with unsupported encoding %s", EncodingType(encType))
+	}
+	// pixels are little endian with red at bit 16 and alpha at bit 24
+	data, err := ReadBytes(int(rect.Width)*int(rect.Height)*4, c)
+	if err != nil {
+		return err
+	}
+	canvas, ok := enc.Image.(*VncCanvas)
+	if !ok {
+		return nil
+	}
+	if rect.Width == 0 || rect.Height == 0 {
+		canvas.SetCursor(nil)
+		return nil
+	}
+	cursor := NewCursor(int(rect.Width), int(rect.Height), image.Point{int(rect.X), int(rect.Y)})
+	for i := 0; i < len(data); i += 4 {
+		b, g, r, a := data[i], data[i+1], data[i+2], data[i+3]
+		if a == 0 {
+			continue
+		}
+		x, y := (i/4)%int(rect.Width), (i/4)/int(rect.Width)
+		cursor.Image.SetNRGBA(x, y, color.NRGBA{R: unpremultiply(r, a), G: unpremultiply(g, a), B: unpremultiply(b, a), A: a})
+	}
+	canvas.SetCursor(cursor)
+	return nil
+}
+
+func (*CursorWithAlphaPseudoEncoding) Write(c Conn, rect *Rectangle) error {
+	return nil
+}
+
+func unpremultiply(v, a uint8) uint8 {
+	if v >= a {
+		return 0xff
+	}
+	return uint8(uint32(v) * 0xff / uint32(a))
+}
@@ -0,0 +1,26 @@
+package vnc2video
+
+// ExtendedClipboardPseudoEncoding announces support for the extended
+// clipboard protocol. The server never sends it as a rectangle, support is
+// signalled by an extended ServerCutText caps message instead.
+type ExtendedClipboardPseudoEncoding struct{}
+
+func (*ExtendedClipboardPseudoEncoding) Supported(Conn) bool {
+	return true
+}
+
+func (*ExtendedClipboardPseudoEncoding) Reset() error {
+	return nil
+}
+
+func (*ExtendedClipboardPseudoEncoding) Type() EncodingType {
+	return EncExtendedClipboardPseudo
+}
+
+func (*ExtendedClipboardPseudoEncoding) Read(c Conn, rect *Rectangle) error {
+	return nil
+}
+
+func (*ExtendedClipboardPseudoEncoding) Write(c Conn, rect *Rectangle) error {
+	return nil
+}
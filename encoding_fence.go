@@ -0,0 +1,23 @@
+package vnc2video
+
+// FencePseudoEncoding announces support for Fence messages. The server
+// never sends it as a rectangle, it replies with a Fence request instead.
+type FencePseudoEncoding struct{}
+
+func (*FencePseudoEncoding) Supported(Conn) bool {
+	return true
+}
+
+func (*FencePseudoEncoding) Reset() error {
+	return nil
+}
+
+func (*FencePseudoEncoding) Type() EncodingType { return EncFencePseudo }
+
+func (*FencePseudoEncoding) Read(c Conn, rect *Rectangle) error {
+	return nil
+}
+
+func (*FencePseudoEncoding) Write(c Conn, rect *Rectangle) error {
+	return nil
+}
@@ -1,11 +1,11 @@
 package vnc2video
 
 import (
+	"errors"
 	"image"
 	"image/color"
 	"image/draw"
 	"io"
-	"github.com/amitbet/vnc2video/logger"
 )
 
 const (
@@ -49,8 +49,15 @@ func (enc *HextileEncoding) Write(c Conn, rect *Rectangle) error {
 }
 
 func (z *HextileEncoding) Read(r Conn, rect *Rectangle) error {
+	return readHextile(r, rect, z.Image, nil)
+}
+
+// readHextile decodes a hextile rect into img, zs holds the zlib streams
+// of ZlibHex rects and is nil for plain hextile
+func readHextile(r Conn, rect *Rectangle, img draw.Image, zs *zlibHexStreams) error {
 	//func (z *HextileEncoding) Read(pixelFmt *PixelFormat, rect *Rectangle, r io.Reader) (Encoding, error) {
 	//bytesPerPixel := int(r.PixelFormat().BPP) / 8
+	log := connLogger(r)
 	pf := r.PixelFormat()
 	var bgCol *color.RGBA
 	var fgCol *color.RGBA
@@ -62,7 +69,7 @@ func (z *HextileEncoding) Read(r Conn, rect *Rectangle) error {
 	// defer func() {
 	// 	z.bytes = r.EndByteCollection()
 	// }()
-	logger.Tracef("HextileEncoding.Read: got hextile rect: %v", rect)
+	log.Tracef("HextileEncoding.Read: got hextile rect: %v", rect)
 	for ty := rect.Y; ty < rect.Y+rect.Height; ty += 16 {
 		th := 16
 		if rect.Y+rect.Height-ty < 16 {
@@ -79,35 +86,56 @@ func (z *HextileEncoding) Read(r Conn, rect *Rectangle) error {
 			subencoding, err = ReadUint8(r)
 
 			if err != nil {
-				logger.Errorf("HextileEncoding.Read: error in hextile reader: %v", err)
+				log.Errorf("HextileEncoding.Read: error in hextile reader: %v", err)
 				return err
 			}
 
+			if zs != nil && (subencoding&ZlibHexRaw) != 0 {
+				if err = zs.readRawTile(r, &pf, img, MakeRect(int(tx), int(ty), tw, th)); err != nil {
+					return err
+				}
+				continue
+			}
 			if (subencoding & HextileRaw) != 0 {
 				rawEnc := r.GetEncInstance(EncRaw)
-				rawEnc.Read(r, &Rectangle{X: uint16(tx), Y: uint16(ty), Width: uint16(tw), Height: uint16(th), EncType: EncRaw, Enc: rawEnc})
+				if rawEnc == nil {
+					return errors.New("hextile raw tile needs the raw encoding")
+				}
+				if err = rawEnc.Read(r, &Rectangle{X: uint16(tx), Y: uint16(ty), Width: uint16(tw), Height: uint16(th), EncType: EncRaw, Enc: rawEnc}); err != nil {
+					return err
+				}
 				//ReadBytes(tw*th*int(pf.BPP)/8, r)
 				continue
 			}
+			// ZlibHex compresses the rest of the tile
+			var tr io.Reader = r
+			if zs != nil && (subencoding&ZlibHexHex) != 0 {
+				if tr, err = zs.hex.read(r); err != nil {
+					return err
+				}
+			}
 			if (subencoding & HextileBackgroundSpecified) != 0 {
 				//ReadBytes(int(bytesPerPixel), r)
 
-				bgCol, err = ReadColor(r, &pf)
+				bgCol, err = ReadColor(tr, &pf)
 				if err != nil {
-					logger.Errorf("HextileEncoding.Read: error in hextile bg color reader: %v", err)
+					log.Errorf("HextileEncoding.Read: error in hextile bg color reader: %v", err)
 					return err
 				}
 
 				//logger.Tracef("%v %v", rBounds, bgCol)
 			}
+			if bgCol == nil {
+				return errors.New("hextile tile without background color")
+			}
 			rBounds := image.Rectangle{Min: image.Point{int(tx), int(ty)}, Max: image.Point{int(tx) + int(tw), int(ty) + int(th)}}
 			//logger.Tracef("filling background rect: %v, col: %v", rBounds, bgCol)
-			FillRect(z.Image, &rBounds, bgCol)
+			FillRect(img, &rBounds, bgCol)
 
 			if (subencoding & HextileForegroundSpecified) != 0 {
-				fgCol, err = ReadColor(r, &pf)
+				fgCol, err = ReadColor(tr, &pf)
 				if err != nil {
-					logger.Errorf("HextileEncoding.Read: error in hextile fg color reader: %v", err)
+					log.Errorf("HextileEncoding.Read: error in hextile fg color reader: %v", err)
 					return err
 				}
 			}
@@ -116,7 +144,7 @@ func (z *HextileEncoding) Read(r Conn, rect *Rectangle) error {
 				continue
 			}
 
-			nSubrects, err := ReadUint8(r)
+			nSubrects, err := ReadUint8(tr)
 			if err != nil {
 				return err
 			}
@@ -125,32 +153,35 @@ func (z *HextileEncoding) Read(r Conn, rect *Rectangle) error {
 			for i := 0; i < int(nSubrects); i++ {
 				var color *color.RGBA
 				if colorSpecified {
-					color, err = ReadColor(r, &pf)
+					color, err = ReadColor(tr, &pf)
 					if err != nil {
-						logger.Error("HextileEncoding.Read: problem reading color from connection: ", err)
+						log.Error("HextileEncoding.Read: problem reading color from connection: ", err)
 						return err
 					}
 				} else {
 					color = fgCol
 				}
+				if color == nil {
+					return errors.New("hextile subrect without foreground color")
+				}
 				//int color = colorSpecified ? renderer.readPixelColor(transport) : colors[FG_COLOR_INDEX];
 				fgCol = color
-				dimensions, err = ReadUint8(r) // bits 7-4 for x, bits 3-0 for y
+				dimensions, err = ReadUint8(tr) // bits 7-4 for x, bits 3-0 for y
 				if err != nil {
-					logger.Error("HextileEncoding.Read: problem reading dimensions from connection: ", err)
+					log.Error("HextileEncoding.Read: problem reading dimensions from connection: ", err)
 					return err
 				}
 				subtileX := dimensions >> 4 & 0x0f
 				subtileY := dimensions & 0x0f
-				dimensions, err = ReadUint8(r) // bits 7-4 for w, bits 3-0 for h
+				dimensions, err = ReadUint8(tr) // bits 7-4 for w, bits 3-0 for h
 				if err != nil {
-					logger.Error("HextileEncoding.Read: problem reading 2nd dimensions from connection: ", err)
+					log.Error("HextileEncoding.Read: problem reading 2nd dimensions from connection: ", err)
 					return err
 				}
 				subtileWidth := 1 + (dimensions >> 4 & 0x0f)
 				subtileHeight := 1 + (dimensions & 0x0f)
 				subrectBounds := image.Rectangle{Min: image.Point{int(tx) + int(subtileX), int(ty) + int(subtileY)}, Max: image.Point{int(tx) + int(subtileX) + int(subtileWidth), int(ty) + int(subtileY) + int(subtileHeight)}}
-				FillRect(z.Image, &subrectBounds, color)
+				FillRect(img, &subrectBounds, color)
 				//logger.Tracef("%v", subrectBounds)
 			}
 		}
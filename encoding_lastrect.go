@@ -0,0 +1,28 @@
+package vnc2video
+
+// LastRectPseudoEncoding marks the end of a FramebufferUpdate sent with an
+// unknown number of rectangles, it has no payload.
+type LastRectPseudoEncoding struct{}
+
+func (*LastRectPseudoEncoding) Supported(Conn) bool {
+	return true
+}
+
+func (*LastRectPseudoEncoding) Reset() error {
+	return nil
+}
+
+func (*LastRectPseudoEncoding) Type() EncodingType { return EncLastRectPseudo }
+
+func (*LastRectPseudoEncoding) Read(c Conn, rect *Rectangle) error {
+	return nil
+}
+
+func (*LastRectPseudoEncoding) Write(c Conn, rect *Rectangle) error {
+	return nil
+}
+
+// lastRect returns the rectangle ending an update of unknown length
+func lastRect() *Rectangle {
+	return &Rectangle{EncType: EncLastRectPseudo, Enc: &LastRectPseudoEncoding{}}
+}
@@ -0,0 +1,125 @@
+package vnc2video
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// failingEncoding fails to write its rects
+type failingEncoding struct{ RawEncoding }
+
+func (*failingEncoding) Write(Conn, *Rectangle) error { return errors.New("encoder failed") }
+
+// lastRectSession connects a client supporting LastRect and returns the
+// server side of the connection, once it got the client's encodings
+func lastRectSession(t *testing.T) (*ServerConn, *ClientConfig, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(connHandler, 1)
+	scfg := testServerConfig(16, conns)
+	scfg.Encodings = []Encoding{&RawEncoding{}, &LastRectPseudoEncoding{}}
+	go Serve(context.Background(), ln, scfg)
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ccfg := testClientConfig()
+	ccfg.Encodings = []Encoding{&RawEncoding{}, &LastRectPseudoEncoding{}}
+	cc, err := Connect(context.Background(), nc, ccfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := (<-conns).(*ServerConn)
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-scfg.ClientMessageCh:
+			if _, ok := msg.(*SetEncodings); ok {
+				return sc, ccfg, func() {
+					cc.Close()
+					ln.Close()
+				}
+			}
+		case <-timeout:
+			t.Fatal("no encodings received")
+		}
+	}
+}
+
+func TestUpdateWriter(t *testing.T) {
+	sc, ccfg, stop := lastRectSession(t)
+	defer stop()
+	raw := &encodedRect{EncRaw, []byte{1, 2, 3, 0}}
+	rect := func(x uint16) *Rectangle {
+		return &Rectangle{X: x, Width: 1, Height: 1, EncType: EncRaw, Enc: raw}
+	}
+
+	w, err := sc.BeginUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := uint16(0); x < 3; x++ {
+		if err := w.WriteRect(rect(x)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// other messages wait for the update to end
+	sent := make(chan error, 1)
+	go func() { sent <- sc.SendMessage(&Bell{}) }()
+	select {
+	case err := <-sent:
+		t.Fatalf("message sent within the update: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	next := func() ServerMessage {
+		select {
+		case msg := <-ccfg.ServerMessageCh:
+			return msg
+		case err := <-ccfg.ErrorCh:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message received")
+		}
+		return nil
+	}
+	if msg, ok := next().(*FramebufferUpdate); !ok || len(msg.Rects) != 4 || msg.Rects[3].EncType != EncLastRectPseudo {
+		t.Fatalf("update received as %v", msg)
+	}
+	if _, ok := next().(*Bell); !ok {
+		t.Fatal("bell not received after the update")
+	}
+	if err := w.WriteRect(rect(0)); err == nil {
+		t.Error("rect written to a closed update")
+	}
+
+	// a failed write ends the update, the connection can't be used any
+	// further but other senders are not blocked
+	w, err = sc.BeginUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteRect(&Rectangle{Width: 1, Height: 1, EncType: EncRaw, Enc: &failingEncoding{}}); err == nil {
+		t.Fatal("failed rect written")
+	}
+	go func() { sent <- sc.SendMessage(&Bell{}) }()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("send blocked after a failed update")
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("closing a failed update: %v", err)
+	}
+}
@@ -3,7 +3,6 @@ package vnc2video
 import (
 	"image"
 	"image/draw"
-	"github.com/amitbet/vnc2video/logger"
 )
 
 type CursorPosPseudoEncoding struct {
@@ -28,9 +27,10 @@ func (enc *CursorPosPseudoEncoding) Reset() error {
 func (*CursorPosPseudoEncoding) Type() EncodingType { return EncPointerPosPseudo }
 
 func (enc *CursorPosPseudoEncoding) Read(c Conn, rect *Rectangle) error {
-	logger.Tracef("CursorPosPseudoEncoding: got cursot pos update: %v", rect)
-	canvas := enc.Image.(*VncCanvas)
-	canvas.CursorLocation = &image.Point{X: int(rect.X), Y: int(rect.Y)}
+	connLogger(c).Tracef("CursorPosPseudoEncoding: got cursot pos update: %v", rect)
+	if canvas, ok := enc.Image.(*VncCanvas); ok {
+		canvas.SetCursorPos(image.Point{X: int(rect.X), Y: int(rect.Y)})
+	}
 	return nil
 }
 
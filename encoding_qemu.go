@@ -0,0 +1,66 @@
+package vnc2video
+
+// QEMUExtendedKeyEventPseudoEncoding is sent by QEMU servers to announce
+// that they accept the QEMU extended key event client message.
+type QEMUExtendedKeyEventPseudoEncoding struct{}
+
+func (*QEMUExtendedKeyEventPseudoEncoding) Supported(Conn) bool {
+	return true
+}
+
+func (*QEMUExtendedKeyEventPseudoEncoding) Reset() error {
+	return nil
+}
+
+func (*QEMUExtendedKeyEventPseudoEncoding) Type() EncodingType {
+	return EncQEMUExtendedKeyEventPseudo
+}
+
+// Read implements the Encoding interface, the rectangle carries no payload.
+func (enc *QEMUExtendedKeyEventPseudoEncoding) Read(c Conn, rect *Rectangle) error {
+	connLogger(c).Debug("QEMUExtendedKeyEventPseudoEncoding: server supports extended key events")
+	if cc, ok := c.(*ClientConn); ok {
+		cc.setServerSupports(EncQEMUExtendedKeyEventPseudo)
+	}
+	return nil
+}
+
+func (enc *QEMUExtendedKeyEventPseudoEncoding) Write(c Conn, rect *Rectangle) error {
+	return nil
+}
+
+// QEMUPointerMotionChangePseudoEncoding is sent by QEMU servers to switch the
+// client between absolute and relative pointer events. An x-position of 0
+// selects relative mode, 1 selects absolute mode.
+type QEMUPointerMotionChangePseudoEncoding struct {
+	Absolute bool
+}
+
+func (*QEMUPointerMotionChangePseudoEncoding) Supported(Conn) bool {
+	return true
+}
+
+func (*QEMUPointerMotionChangePseudoEncoding) Reset() error {
+	return nil
+}
+
+func (*QEMUPointerMotionChangePseudoEncoding) Type() EncodingType {
+	return EncQEMUPointerMotionChangePseudo
+}
+
+// Read implements the Encoding interface, the mode is carried in rect.X.
+func (enc *QEMUPointerMotionChangePseudoEncoding) Read(c Conn, rect *Rectangle) error {
+	enc.Absolute = rect.X != 0
+	connLogger(c).Debugf("QEMUPointerMotionChangePseudoEncoding: absolute pointer=%v", enc.Absolute)
+	if cc, ok := c.(*ClientConn); ok {
+		cc.setServerSupports(EncQEMUPointerMotionChangePseudo)
+		cc.setRelativePointer(!enc.Absolute)
+	}
+	return nil
+}
+
+// Write implements the Encoding interface, the caller is expected to set
+// rect.X to 1 for absolute mode or 0 for relative mode.
+func (enc *QEMUPointerMotionChangePseudoEncoding) Write(c Conn, rect *Rectangle) error {
+	return nil
+}
@@ -30,9 +30,7 @@ func (enc *RawEncoding) SetTargetImage(img draw.Image) {
 func (enc *RawEncoding) Read(c Conn, rect *Rectangle) error {
 	pf := c.PixelFormat()
 
-	DecodeRaw(c, &pf, rect, enc.Image)
-
-	return nil
+	return DecodeRaw(c, &pf, rect, enc.Image)
 }
 
 func (*RawEncoding) Type() EncodingType { return EncRaw }
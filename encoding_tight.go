@@ -37,12 +37,32 @@ const (
 
 type TightEncoding struct {
 	Image        draw.Image
+	Options      TightOptions
 	decoders     []io.Reader
 	decoderBuffs []*bytes.Buffer
+	// counter numbers the rects read, for tracing
+	counter int
+	// streams are the zlib streams of Write on connections not keeping
+	// their own, they belong to streamConn
+	streams    [4]*tightStream
+	streamConn Conn
+	// log is the logger of the connection read from
+	log logger.Logger
 }
 
-var instance *TightEncoding
-var TightMinToCompress int = 12
+// TightOptions holds the debugging switches of a TightEncoding, each one
+// skips drawing the rects of a sub-encoding
+type TightOptions struct {
+	DisablePalette  bool
+	DisableGradient bool
+	DisableCopy     bool
+	DisableJpeg     bool
+	DisableFill     bool
+}
+
+// TightMinToCompress is the data size below which tight data is sent
+// without zlib compression
+const TightMinToCompress = 12
 
 func (*TightEncoding) Supported(Conn) bool {
 	return true
@@ -50,15 +70,12 @@ func (*TightEncoding) Supported(Conn) bool {
 
 func (*TightEncoding) Type() EncodingType { return EncTight }
 
+// GetInstance returns a new TightEncoding.
+//
+// Deprecated: connections no longer share a TightEncoding, which mixed up
+// their zlib streams. Use &TightEncoding{}.
 func (*TightEncoding) GetInstance() *TightEncoding {
-	if instance == nil {
-		instance = &TightEncoding{}
-	}
-	return instance
-}
-
-func (enc *TightEncoding) Write(c Conn, rect *Rectangle) error {
-	return nil
+	return &TightEncoding{}
 }
 
 // Read unmarshal color from conn
@@ -116,6 +133,42 @@ func getTightColor(c io.Reader, pf *PixelFormat) (*color.RGBA, error) {
 	return &rgb, nil
 }
 
+// writeTightColor writes col as a tight pixel
+func writeTightColor(c io.Writer, pf *PixelFormat, col color.Color) error {
+	if pf.TrueColor == 0 {
+		return errors.New("support for non true color formats was not implemented")
+	}
+	r, g, b, _ := col.RGBA()
+	_, err := c.Write(appendTightPixel(nil, pf, uint8(r>>8), uint8(g>>8), uint8(b>>8)))
+	return err
+}
+
+// isTightPixelFormat reports whether pixels of pf are sent as 3 bytes RGB
+func isTightPixelFormat(pf *PixelFormat) bool {
+	return pf.TrueColor != 0 && pf.Depth == 24 && pf.BPP == 32 && pf.BlueMax <= 255 && pf.RedMax <= 255 && pf.GreenMax <= 255
+}
+
+// appendTightPixel appends a tight pixel to buf, which is 3 bytes RGB for
+// 24 bit depth true color formats and a regular pixel otherwise
+func appendTightPixel(buf []byte, pf *PixelFormat, r, g, b uint8) []byte {
+	if isTightPixelFormat(pf) {
+		return append(buf, r, g, b)
+	}
+	pixel := (uint32(r)*uint32(pf.RedMax)/255)<<pf.RedShift |
+		(uint32(g)*uint32(pf.GreenMax)/255)<<pf.GreenShift |
+		(uint32(b)*uint32(pf.BlueMax)/255)<<pf.BlueShift
+	var px [4]byte
+	switch pf.BPP {
+	case 8:
+		return append(buf, uint8(pixel))
+	case 16:
+		pf.order().PutUint16(px[:], uint16(pixel))
+		return append(buf, px[:2]...)
+	}
+	pf.order().PutUint32(px[:], pixel)
+	return append(buf, px[:]...)
+}
+
 func calcTightBytePerPixel(pf *PixelFormat) int {
 	bytesPerPixel := int(pf.BPP / 8)
 
@@ -128,17 +181,26 @@ func calcTightBytePerPixel(pf *PixelFormat) int {
 	return bytesPerPixelTight
 }
 
+// Reset keeps the zlib streams, the server resets them through the
+// compression control byte, not along with desktop size changes
 func (enc *TightEncoding) Reset() error {
-	//enc.decoders = make([]io.Reader, 4)
-	//enc.decoderBuffs = make([]*bytes.Buffer, 4)
 	return nil
 }
 
+// ensureDecoders makes room for the 4 zlib streams
+func (enc *TightEncoding) ensureDecoders() {
+	for len(enc.decoders) < 4 {
+		enc.decoders = append(enc.decoders, nil)
+		enc.decoderBuffs = append(enc.decoderBuffs, nil)
+	}
+}
+
 func (enc *TightEncoding) resetDecoders(compControl uint8) {
-	logger.Tracef("###resetDecoders compctl :%d", 0x0F&compControl)
+	enc.log.Tracef("###resetDecoders compctl :%d", 0x0F&compControl)
+	enc.ensureDecoders()
 	for i := 0; i < 4; i++ {
 		if (compControl&1) != 0 && enc.decoders[i] != nil {
-			logger.Tracef("###resetDecoders - resetting decoder #%d", i)
+			enc.log.Tracef("###resetDecoders - resetting decoder #%d", i)
 			enc.decoders[i] = nil //.(zlib.Resetter).Reset(nil,nil);
 		}
 		compControl >>= 1
@@ -149,13 +211,6 @@ func (enc *TightEncoding) SetTargetImage(img draw.Image) {
 	enc.Image = img
 }
 
-var counter int = 0
-var disablePalette bool = false
-var disableGradient bool = false
-var disableCopy bool = false
-var disableJpeg bool = false
-var disableFill bool = false
-
 func (enc *TightEncoding) Read(c Conn, rect *Rectangle) error {
 
 	var err error
@@ -164,6 +219,9 @@ func (enc *TightEncoding) Read(c Conn, rect *Rectangle) error {
 	// 	os.Exit(1)
 	// }
 	////////////
+	enc.log = connLogger(c)
+	enc.counter++
+	counter := enc.counter
 	pixelFmt := c.PixelFormat()
 	bytesPixel := calcTightBytePerPixel(&pixelFmt)
 	if enc.Image == nil {
@@ -184,10 +242,10 @@ func (enc *TightEncoding) Read(c Conn, rect *Rectangle) error {
 	// defer func() { counter++ }()
 	// defer jpeg.Encode(out, enc.Image, nil)
 	//////////////
-	logger.Tracef("-----------READ-Tight-encoding compctl=%d -------------", compctl)
+	enc.log.Tracef("-----------READ-Tight-encoding compctl=%d -------------", compctl)
 
 	if err != nil {
-		logger.Errorf("error in handling tight encoding: %v", err)
+		enc.log.Errorf("error in handling tight encoding: %v", err)
 		return err
 	}
 	//logger.Tracef("bytesPixel= %d, subencoding= %d", bytesPixel, compctl)
@@ -199,20 +257,20 @@ func (enc *TightEncoding) Read(c Conn, rect *Rectangle) error {
 	//logger.Tracef("afterSHL:%d", compType)
 	switch compType {
 	case TightCompressionFill:
-		logger.Tracef("--TIGHT_FILL: reading fill size=%d,counter=%d", bytesPixel, counter)
+		enc.log.Tracef("--TIGHT_FILL: reading fill size=%d,counter=%d", bytesPixel, counter)
 		//read color
 
 		rectColor, err := getTightColor(c, &pixelFmt)
 		if err != nil {
-			logger.Errorf("error in reading tight encoding: %v", err)
+			enc.log.Errorf("error in reading tight encoding: %v", err)
 			return err
 		}
 
 		//c1 := color.RGBAModel.Convert(rectColor).(color.RGBA)
 		dst := (enc.Image).(draw.Image) // enc.Image.(*image.RGBA)
 		myRect := MakeRectFromVncRect(rect)
-		logger.Tracef("--TIGHT_FILL: fill rect=%v,color=%v", myRect, rectColor)
-		if !disableFill {
+		enc.log.Tracef("--TIGHT_FILL: fill rect=%v,color=%v", myRect, rectColor)
+		if !enc.Options.DisableFill {
 			FillRect(dst, &myRect, rectColor)
 		}
 
@@ -221,7 +279,7 @@ func (enc *TightEncoding) Read(c Conn, rect *Rectangle) error {
 		}
 		return nil
 	case TightCompressionJPEG:
-		logger.Tracef("--TIGHT_JPEG,counter=%d", counter)
+		enc.log.Tracef("--TIGHT_JPEG,counter=%d", counter)
 		if pixelFmt.BPP == 8 {
 			return errors.New("Tight encoding: JPEG is not supported in 8 bpp mode")
 		}
@@ -240,10 +298,10 @@ func (enc *TightEncoding) Read(c Conn, rect *Rectangle) error {
 		buff := bytes.NewBuffer(jpegBytes)
 		img, err := jpeg.Decode(buff)
 		if err != nil {
-			logger.Error("problem while decoding jpeg:", err)
+			return corrupt(fmt.Errorf("decoding jpeg: %v", err))
 		}
 		//logger.Info("not drawing:", img)
-		if !disableJpeg {
+		if !enc.Options.DisableJpeg {
 			pos := image.Point{int(rect.X), int(rect.Y)}
 			DrawImage(enc.Image, img, pos)
 
@@ -254,16 +312,14 @@ func (enc *TightEncoding) Read(c Conn, rect *Rectangle) error {
 	default:
 
 		if compType > TightCompressionJPEG {
-			logger.Error("Compression control byte is incorrect!")
+			return fmt.Errorf("tight compression control byte is incorrect: %d", compctl)
 		}
 
-		enc.handleTightFilters(compctl, &pixelFmt, rect, c)
-
-		return nil
+		return enc.handleTightFilters(compctl, &pixelFmt, rect, c)
 	}
 }
 
-func (enc *TightEncoding) handleTightFilters(compCtl uint8, pixelFmt *PixelFormat, rect *Rectangle, r Conn) {
+func (enc *TightEncoding) handleTightFilters(compCtl uint8, pixelFmt *PixelFormat, rect *Rectangle, r Conn) error {
 
 	var STREAM_ID_MASK uint8 = 0x30
 	var FILTER_ID_MASK uint8 = 0x40
@@ -273,22 +329,20 @@ func (enc *TightEncoding) handleTightFilters(compCtl uint8, pixelFmt *PixelForma
 
 	decoderId := (compCtl & STREAM_ID_MASK) >> 4
 
-	for len(enc.decoders) < 4 {
-		enc.decoders = append(enc.decoders, nil)
-		enc.decoderBuffs = append(enc.decoderBuffs, nil)
-	}
+	enc.ensureDecoders()
 
 	if (compCtl & FILTER_ID_MASK) > 0 {
 		filterid, err = ReadUint8(r)
 
 		if err != nil {
-			logger.Errorf("error in handling tight encoding, reading filterid: %v", err)
-			return
+			enc.log.Errorf("error in handling tight encoding, reading filterid: %v", err)
+			return err
 		}
 		//logger.Tracef("handleTightFilters: read filter: %d", filterid)
 	}
 
 	bytesPixel := calcTightBytePerPixel(pixelFmt)
+	counter := enc.counter
 
 	//logger.Tracef("handleTightFilters: filter: %d", filterid)
 
@@ -299,10 +353,10 @@ func (enc *TightEncoding) handleTightFilters(compCtl uint8, pixelFmt *PixelForma
 
 		palette, err := enc.readTightPalette(r, bytesPixel)
 		if err != nil {
-			logger.Errorf("handleTightFilters: error in Reading Palette: %v", err)
-			return
+			enc.log.Errorf("handleTightFilters: error in Reading Palette: %v", err)
+			return err
 		}
-		logger.Debugf("----PALETTE_FILTER,palette len=%d counter=%d, rect= %v", len(palette), counter, rect)
+		enc.log.Debugf("----PALETTE_FILTER,palette len=%d counter=%d, rect= %v", len(palette), counter, rect)
 
 		//logger.Tracef("got palette: %v", palette)
 		var dataLength int
@@ -314,51 +368,50 @@ func (enc *TightEncoding) handleTightFilters(compCtl uint8, pixelFmt *PixelForma
 		tightBytes, err := enc.ReadTightData(dataLength, r, int(decoderId))
 		//logger.Tracef("got tightBytes: %v", tightBytes)
 		if err != nil {
-			logger.Errorf("handleTightFilters: error in handling tight encoding, reading palette filter data: %v", err)
-			return
+			enc.log.Errorf("handleTightFilters: error in handling tight encoding, reading palette filter data: %v", err)
+			return err
 		}
 		//logger.Errorf("handleTightFilters: got tight data: %v", tightBytes)
-		if !disablePalette {
-			enc.drawTightPalette(rect, palette, tightBytes)
+		if !enc.Options.DisablePalette {
+			return enc.drawTightPalette(rect, palette, tightBytes)
 		}
 		//enc.Image = myImg
 	case TightFilterGradient: //GRADIENT_FILTER
-		logger.Debugf("----GRADIENT_FILTER: bytesPixel=%d, counter=%d", bytesPixel, counter)
+		enc.log.Debugf("----GRADIENT_FILTER: bytesPixel=%d, counter=%d", bytesPixel, counter)
 		//logger.Tracef("usegrad: %d\n", filterid)
 		data, err := enc.ReadTightData(lengthCurrentbpp, r, int(decoderId))
 		if err != nil {
-			logger.Errorf("handleTightFilters: error in handling tight encoding, Reading GRADIENT_FILTER: %v", err)
-			return
+			enc.log.Errorf("handleTightFilters: error in handling tight encoding, Reading GRADIENT_FILTER: %v", err)
+			return err
 		}
 
 		enc.decodeGradData(rect, data)
 
 	case TightFilterCopy: //BASIC_FILTER
 		//lengthCurrentbpp1 := int(pixelFmt.BPP/8) * int(rect.Width) * int(rect.Height)
-		logger.Debugf("----BASIC_FILTER: bytesPixel=%d, counter=%d", bytesPixel, counter)
+		enc.log.Debugf("----BASIC_FILTER: bytesPixel=%d, counter=%d", bytesPixel, counter)
 
 		tightBytes, err := enc.ReadTightData(lengthCurrentbpp, r, int(decoderId))
 		if err != nil {
-			logger.Errorf("handleTightFilters: error in handling tight encoding, Reading BASIC_FILTER: %v", err)
-			return
+			enc.log.Errorf("handleTightFilters: error in handling tight encoding, Reading BASIC_FILTER: %v", err)
+			return err
 		}
-		logger.Tracef("tightBytes len= %d", len(tightBytes))
-		if !disableCopy {
+		enc.log.Tracef("tightBytes len= %d", len(tightBytes))
+		if !enc.Options.DisableCopy {
 			enc.drawTightBytes(tightBytes, rect)
 		}
 	default:
-		logger.Errorf("handleTightFilters: Bad tight filter id: %d", filterid)
-		return
+		return fmt.Errorf("bad tight filter id: %d", filterid)
 	}
 
-	return
+	return nil
 }
 
-func (enc *TightEncoding) drawTightPalette(rect *Rectangle, palette color.Palette, tightBytes []byte) {
+func (enc *TightEncoding) drawTightPalette(rect *Rectangle, palette color.Palette, tightBytes []byte) error {
 	bytePos := 0
 	bitPos := uint8(7)
 	var palettePos int
-	logger.Tracef("drawTightPalette numbytes=%d", len(tightBytes))
+	enc.log.Tracef("drawTightPalette numbytes=%d", len(tightBytes))
 
 	for y := 0; y < int(rect.Height); y++ {
 		for x := 0; x < int(rect.Width); x++ {
@@ -380,20 +433,27 @@ func (enc *TightEncoding) drawTightPalette(rect *Rectangle, palette color.Palett
 			} else {
 				palettePos = int(tightBytes[bytePos])
 				bytePos++
+				if palettePos >= len(palette) {
+					return corrupt(fmt.Errorf("tight palette index %d out of range %d", palettePos, len(palette)))
+				}
 			}
 			//palettePos = palettePos
 			enc.Image.Set(int(rect.X)+x, int(rect.Y)+y, palette[palettePos])
 			//logger.Tracef("(%d,%d): pos: %d col:%d", int(rect.X)+j, int(rect.Y)+i, palettePos, palette[palettePos])
 		}
 
-		// reset bit alignment to first bit in byte (msb)
+		// rows are padded to whole bytes, reset bit alignment to first bit in
+		// byte (msb)
+		if bitPos != 7 {
+			bytePos++
+		}
 		bitPos = 7
 	}
-
+	return nil
 }
 func (enc *TightEncoding) decodeGradData(rect *Rectangle, buffer []byte) {
 
-	logger.Tracef("putting gradient size: %v on image: %v", rect, enc.Image.Bounds())
+	enc.log.Tracef("putting gradient size: %v on image: %v", rect, enc.Image.Bounds())
 
 	prevRow := make([]byte, rect.Width*3+3) //new byte[w * 3];
 	thisRow := make([]byte, rect.Width*3+3) //new byte[w * 3];
@@ -441,9 +501,9 @@ func (enc *TightEncoding) decodeGradData(rect *Rectangle, buffer []byte) {
 			bIdx += 3
 		}
 
-		for idx := 3; idx < (len(thisRow) - 3); idx += 3 {
+		for idx := 3; idx < len(thisRow); idx += 3 {
 			myColor := color.RGBA{R: (thisRow[idx]), G: (thisRow[idx+1]), B: (thisRow[idx+2]), A: 1}
-			if !disableGradient {
+			if !enc.Options.DisableGradient {
 				enc.Image.Set(idx/3+int(rect.X)-1, int(rect.Y)+i, myColor)
 			}
 			//logger.Tracef("putting pixel: idx=%d, pos=(%d,%d), col=%v", idx, idx/3+int(rect.X), int(rect.Y)+i, myColor)
@@ -503,20 +563,24 @@ func (enc *TightEncoding) decodeGradData(rect *Rectangle, buffer []byte) {
 // }
 
 func ReadBytes(count int, r io.Reader) ([]byte, error) {
+	log := logger.Default()
+	if c, ok := r.(Conn); ok {
+		log = connLogger(c)
+	}
 	buff := make([]byte, count)
 
 	lengthRead, err := io.ReadFull(r, buff)
 
 	//lengthRead, err := r.Read(buff)
 	if lengthRead != count {
-		logger.Errorf("RfbReadHelper.ReadBytes unable to read bytes: lengthRead=%d, countExpected=%d", lengthRead, count)
+		log.Errorf("RfbReadHelper.ReadBytes unable to read bytes: lengthRead=%d, countExpected=%d", lengthRead, count)
 		return nil, errors.New("RfbReadHelper.ReadBytes unable to read bytes")
 	}
 
 	//err := binary.Read(r, binary.BigEndian, &buff)
 
 	if err != nil {
-		logger.Errorf("RfbReadHelper.ReadBytes error while reading bytes: ", err)
+		log.Errorf("RfbReadHelper.ReadBytes error while reading bytes: ", err)
 		//if err := binary.Read(d.conn, binary.BigEndian, &buff); err != nil {
 		return nil, err
 	}
@@ -528,7 +592,7 @@ func (enc *TightEncoding) readTightPalette(connReader Conn, bytesPixel int) (col
 
 	colorCount, err := ReadUint8(connReader)
 	if err != nil {
-		logger.Errorf("handleTightFilters: error in handling tight encoding, reading TightFilterPalette: %v", err)
+		enc.log.Errorf("handleTightFilters: error in handling tight encoding, reading TightFilterPalette: %v", err)
 		return nil, err
 	}
 
@@ -537,7 +601,7 @@ func (enc *TightEncoding) readTightPalette(connReader Conn, bytesPixel int) (col
 	//complete palette
 	paletteColorBytes, err := ReadBytes(int(paletteSize)*bytesPixel, connReader)
 	if err != nil {
-		logger.Errorf("handleTightFilters: error in handling tight encoding, reading TightFilterPalette.paletteSize: %v", err)
+		enc.log.Errorf("handleTightFilters: error in handling tight encoding, reading TightFilterPalette.paletteSize: %v", err)
 		return nil, err
 	}
 	var paletteColors color.Palette = make([]color.Color, 0)
@@ -550,7 +614,7 @@ func (enc *TightEncoding) readTightPalette(connReader Conn, bytesPixel int) (col
 
 func (enc *TightEncoding) ReadTightData(dataSize int, c Conn, decoderId int) ([]byte, error) {
 
-	logger.Tracef(">>> Reading zipped tight data from decoder Id: %d, openSize: %d", decoderId, dataSize)
+	connLogger(c).Tracef(">>> Reading zipped tight data from decoder Id: %d, openSize: %d", decoderId, dataSize)
 	if int(dataSize) < TightMinToCompress {
 		return ReadBytes(int(dataSize), c)
 	}
@@ -567,6 +631,9 @@ func (enc *TightEncoding) ReadTightData(dataSize int, c Conn, decoderId int) ([]
 	if enc.decoders[decoderId] == nil {
 		b := bytes.NewBuffer(zippedBytes)
 		r, err = zlib.NewReader(b)
+		if err != nil {
+			return nil, err
+		}
 		enc.decoders[decoderId] = r
 		enc.decoderBuffs[decoderId] = b
 	} else {
@@ -576,6 +643,8 @@ func (enc *TightEncoding) ReadTightData(dataSize int, c Conn, decoderId int) ([]
 		r = enc.decoders[decoderId]
 	}
 
+	// an inflate error leaves the stream out of sync with the server's,
+	// so it can't be recovered from
 	retBytes := make([]byte, dataSize)
 	count, err := io.ReadFull(r, retBytes)
 	if err != nil {
@@ -680,7 +749,7 @@ func readTightLength(c Conn) (int, error) {
  */
 func (enc *TightEncoding) drawTightBytes(bytes []byte, rect *Rectangle) {
 	bytesPos := 0
-	logger.Tracef("drawTightBytes: len(bytes)= %d, %v", len(bytes), rect)
+	enc.log.Tracef("drawTightBytes: len(bytes)= %d, %v", len(bytes), rect)
 
 	for ly := rect.Y; ly < rect.Y+rect.Height; ly++ {
 		for lx := rect.X; lx < rect.X+rect.Width; lx++ {
@@ -0,0 +1,437 @@
+package vnc2video
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"image"
+	"image/jpeg"
+)
+
+// TightDefaultCompressionLevel is the compression level used when the
+// client does not send a compression level pseudo-encoding
+const TightDefaultCompressionLevel = 6
+
+const (
+	// tightMinSplitRectSize is the area from which Rects looks for solid
+	// areas, tightMinSolidSubrectSize the area of a solid area to be sent
+	// as a rectangle of its own
+	tightMinSplitRectSize    = 4096
+	tightMinSolidSubrectSize = 2048
+	// tightSolidTile is the size of the tiles solid areas grow from
+	tightSolidTile = 16
+)
+
+// the zlib streams of the Tight encoder, one per kind of data
+const (
+	tightStreamRaw = iota
+	tightStreamMono
+	tightStreamIndexed
+	tightStreamGradient
+)
+
+// tightConf holds the encoder settings of a compression level, modelled on
+// the TightVNC server
+type tightConf struct {
+	maxRectSize         int
+	maxRectWidth        int
+	idxMaxColorsDivisor int
+	rawZlibLevel        int
+	monoZlibLevel       int
+	idxZlibLevel        int
+	gradientZlibLevel   int
+	// gradientThreshold is the mean prediction error per pixel below which
+	// an image is considered smooth, 0 disables the gradient filter
+	gradientThreshold int
+}
+
+var tightConfs = [10]tightConf{
+	{512, 32, 4, 0, 0, 0, 0, 0},
+	{2048, 128, 8, 1, 1, 1, 0, 0},
+	{6144, 256, 24, 2, 3, 3, 0, 0},
+	{10240, 1024, 32, 3, 5, 5, 0, 0},
+	{16384, 2048, 32, 4, 6, 6, 0, 0},
+	{32768, 2048, 32, 5, 7, 7, 4, 18},
+	{65536, 2048, 48, 6, 7, 7, 4, 21},
+	{65536, 2048, 64, 7, 8, 8, 5, 24},
+	{65536, 2048, 64, 8, 9, 9, 6, 27},
+	{65536, 2048, 96, 9, 9, 9, 6, 30},
+}
+
+// tightJPEGQuality maps JPEG quality levels to image/jpeg qualities
+var tightJPEGQuality = [10]int{15, 29, 41, 42, 62, 77, 79, 86, 92, 100}
+
+// encodingLevels is implemented by connections tracking the client's
+// quality and compression level pseudo-encodings
+type encodingLevels interface {
+	JPEGQualityLevel() int
+	CompressionLevel() int
+}
+
+// tightLevels returns the JPEG quality level of c, -1 if JPEG is off, and
+// its compression level
+func tightLevels(c Conn) (int, int) {
+	quality, compression := -1, TightDefaultCompressionLevel
+	if l, ok := c.(encodingLevels); ok {
+		quality = l.JPEGQualityLevel()
+		if cl := l.CompressionLevel(); cl >= 0 {
+			compression = cl
+		}
+	}
+	return quality, compression
+}
+
+// tightStream is a zlib stream of the Tight encoder, it is flushed after
+// every rectangle
+type tightStream struct {
+	level int
+	buf   bytes.Buffer
+	w     *zlib.Writer
+}
+
+// tightStreamer is implemented by connections keeping the zlib streams
+// of the Tight encoder, the streams match the client's inflaters and so
+// belong to the connection, not to the TightEncoding its server shares
+// between connections
+type tightStreamer interface {
+	tightStreams() *[4]*tightStream
+}
+
+// stream returns the zlib stream id of c at level and whether it is new,
+// in which case the client must reset its inflater
+func (enc *TightEncoding) stream(c Conn, id, level int) (*tightStream, bool) {
+	streams := &enc.streams
+	if ts, ok := c.(tightStreamer); ok {
+		streams = ts.tightStreams()
+	}
+	if s := streams[id]; s != nil && s.level == level {
+		return s, false
+	}
+	s := &tightStream{level: level}
+	s.w, _ = zlib.NewWriterLevel(&s.buf, level)
+	streams[id] = s
+	return s, true
+}
+
+// Write encodes the pixels of rect, Image is either the whole framebuffer
+// or holds only the rect's pixels. The sub-encoding is chosen per rect:
+// Fill for a single color, a palette for few colors, JPEG or the gradient
+// filter for photo-like content and zlib compressed pixels otherwise. On
+// server connections the JPEG quality and the compression level are the
+// ones the client asked for and the zlib streams are the connection's, so
+// servers can share a TightEncoding between connections. Rects wider than
+// 2048 pixels must be split with Rects first.
+func (enc *TightEncoding) Write(c Conn, rect *Rectangle) error {
+	pf := c.PixelFormat()
+	if pf.TrueColor == 0 {
+		return errors.New("tight encoding: color map pixel formats are not supported")
+	}
+	if _, ok := c.(tightStreamer); !ok && enc.streamConn != c {
+		// the client of a new connection starts with fresh inflaters
+		enc.streams = [4]*tightStream{}
+		enc.streamConn = c
+	}
+	quality, compression := tightLevels(c)
+	conf := &tightConfs[compression]
+	img := RectImage(enc.Image, rect)
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+
+	maxColors := w * h / conf.idxMaxColorsDivisor
+	if maxColors > 256 {
+		maxColors = 256
+	} else if maxColors < 2 {
+		maxColors = 2
+	}
+	palette, index := tightPalette(img, maxColors)
+	switch {
+	case len(palette) == 1:
+		return enc.writeFill(c, &pf, palette[0])
+	case len(palette) == 2:
+		data := make([]byte, 0, h*((w+7)/8))
+		for y := 0; y < h; y++ {
+			var b uint8
+			for x := 0; x < w; x++ {
+				b = b<<1 | index[y*w+x]
+				if x%8 == 7 {
+					data = append(data, b)
+					b = 0
+				}
+			}
+			if w%8 != 0 {
+				data = append(data, b<<uint(8-w%8))
+			}
+		}
+		return enc.writeBasic(c, tightStreamMono, conf.monoZlibLevel, tightPaletteFilter(&pf, palette), data)
+	case palette != nil:
+		return enc.writeBasic(c, tightStreamIndexed, conf.idxZlibLevel, tightPaletteFilter(&pf, palette), index)
+	case quality >= 0 && pf.BPP >= 16:
+		return enc.writeJPEG(c, img, tightJPEGQuality[quality])
+	case conf.gradientThreshold > 0 && isTightPixelFormat(&pf) && tightSmooth(img, conf.gradientThreshold):
+		return enc.writeBasic(c, tightStreamGradient, conf.gradientZlibLevel, []byte{TightFilterGradient}, tightGradientData(img))
+	}
+	data := make([]byte, 0, w*h*calcTightBytePerPixel(&pf))
+	for i := 0; i < len(img.Pix); i += 4 {
+		data = appendTightPixel(data, &pf, img.Pix[i], img.Pix[i+1], img.Pix[i+2])
+	}
+	return enc.writeBasic(c, tightStreamRaw, conf.rawZlibLevel, nil, data)
+}
+
+func (enc *TightEncoding) writeFill(c Conn, pf *PixelFormat, col [3]uint8) error {
+	_, err := c.Write(appendTightPixel([]byte{TightCompressionFill << 4}, pf, col[0], col[1], col[2]))
+	return err
+}
+
+func (enc *TightEncoding) writeJPEG(c Conn, img image.Image, quality int) error {
+	buf := bPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bPool.Put(buf)
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return err
+	}
+	if _, err := c.Write([]byte{TightCompressionJPEG << 4}); err != nil {
+		return err
+	}
+	if err := writeTightLength(c, buf.Len()); err != nil {
+		return err
+	}
+	_, err := c.Write(buf.Bytes())
+	return err
+}
+
+// writeBasic writes a Basic compression rect, filter holds the filter id
+// and its parameters and is empty for the copy filter. Data shorter than
+// TightMinToCompress is sent as is.
+func (enc *TightEncoding) writeBasic(c Conn, streamID, level int, filter, data []byte) error {
+	compctl := uint8(streamID) << 4
+	if len(filter) > 0 {
+		compctl |= 0x40
+	}
+	var s *tightStream
+	if len(data) >= TightMinToCompress {
+		var reset bool
+		if s, reset = enc.stream(c, streamID, level); reset {
+			compctl |= 1 << uint(streamID)
+		}
+	}
+	buf := append([]byte{compctl}, filter...)
+	if s == nil {
+		_, err := c.Write(append(buf, data...))
+		return err
+	}
+	s.buf.Reset()
+	if _, err := s.w.Write(data); err != nil {
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := c.Write(buf); err != nil {
+		return err
+	}
+	if err := writeTightLength(c, s.buf.Len()); err != nil {
+		return err
+	}
+	_, err := c.Write(s.buf.Bytes())
+	return err
+}
+
+// tightPalette returns the colors of img in order of appearance and the
+// palette index of every pixel, or nil if there are more than maxColors
+func tightPalette(img *image.RGBA, maxColors int) ([][3]uint8, []uint8) {
+	indexes := make(map[[3]uint8]uint8)
+	var palette [][3]uint8
+	index := make([]uint8, 0, len(img.Pix)/4)
+	for i := 0; i < len(img.Pix); i += 4 {
+		col := [3]uint8{img.Pix[i], img.Pix[i+1], img.Pix[i+2]}
+		n, ok := indexes[col]
+		if !ok {
+			if len(palette) == maxColors {
+				return nil, nil
+			}
+			n = uint8(len(palette))
+			indexes[col] = n
+			palette = append(palette, col)
+		}
+		index = append(index, n)
+	}
+	return palette, index
+}
+
+// tightPaletteFilter returns the palette filter id and parameters
+func tightPaletteFilter(pf *PixelFormat, palette [][3]uint8) []byte {
+	filter := []byte{TightFilterPalette, uint8(len(palette) - 1)}
+	for _, col := range palette {
+		filter = appendTightPixel(filter, pf, col[0], col[1], col[2])
+	}
+	return filter
+}
+
+// tightPredict returns the gradient filter prediction of the color
+// component at offset i of the pixel (x, y)
+func tightPredict(img *image.RGBA, x, y, i int) int {
+	var left, up, upLeft int
+	if x > 0 {
+		left = int(img.Pix[img.PixOffset(x-1, y)+i])
+	}
+	if y > 0 {
+		up = int(img.Pix[img.PixOffset(x, y-1)+i])
+		if x > 0 {
+			upLeft = int(img.Pix[img.PixOffset(x-1, y-1)+i])
+		}
+	}
+	p := left + up - upLeft
+	if p < 0 {
+		return 0
+	} else if p > 255 {
+		return 255
+	}
+	return p
+}
+
+// tightGradientData returns the gradient filtered 3 byte pixels of img
+func tightGradientData(img *image.RGBA) []byte {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	data := make([]byte, 0, w*h*3)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			off := img.PixOffset(x, y)
+			for i := 0; i < 3; i++ {
+				data = append(data, uint8(int(img.Pix[off+i])-tightPredict(img, x, y, i)))
+			}
+		}
+	}
+	return data
+}
+
+// tightSmooth reports whether img is photo-like, that is whether the mean
+// gradient prediction error of its pixels is below threshold
+func tightSmooth(img *image.RGBA, threshold int) bool {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	if w < 2 || h < 2 {
+		return false
+	}
+	sum := 0
+	for y := 1; y < h; y++ {
+		for x := 1; x < w; x++ {
+			off := img.PixOffset(x, y)
+			for i := 0; i < 3; i++ {
+				d := int(img.Pix[off+i]) - tightPredict(img, x, y, i)
+				if d < 0 {
+					d = -d
+				}
+				sum += d
+			}
+		}
+	}
+	return sum < threshold*(w-1)*(h-1)
+}
+
+// Rects splits r into the rectangles of a FramebufferUpdate for c. Large
+// solid areas become rectangles of their own and the rest is cut to the
+// size limits of the client's compression level. Image must hold the whole
+// framebuffer.
+func (enc *TightEncoding) Rects(c Conn, r image.Rectangle) []*Rectangle {
+	_, compression := tightLevels(c)
+	img := RectImage(enc.Image, &Rectangle{X: uint16(r.Min.X), Y: uint16(r.Min.Y), Width: uint16(r.Dx()), Height: uint16(r.Dy())})
+	var rects []*Rectangle
+	for _, sr := range tightSplit(img, img.Rect, &tightConfs[compression], nil) {
+		sr = sr.Add(r.Min)
+		rects = append(rects, &Rectangle{
+			X:       uint16(sr.Min.X),
+			Y:       uint16(sr.Min.Y),
+			Width:   uint16(sr.Dx()),
+			Height:  uint16(sr.Dy()),
+			EncType: EncTight,
+			Enc:     enc,
+		})
+	}
+	return rects
+}
+
+// tightSplit appends the rectangles r of img is split into to rects
+func tightSplit(img *image.RGBA, r image.Rectangle, conf *tightConf, rects []image.Rectangle) []image.Rectangle {
+	if r.Dx()*r.Dy() >= tightMinSplitRectSize {
+		if solid := tightFindSolid(img, r); solid.Dx()*solid.Dy() >= tightMinSolidSubrectSize {
+			rects = tightSplit(img, image.Rect(r.Min.X, r.Min.Y, r.Max.X, solid.Min.Y), conf, rects)
+			rects = tightSplit(img, image.Rect(r.Min.X, solid.Min.Y, solid.Min.X, solid.Max.Y), conf, rects)
+			rects = tightLimitSize(solid, conf, rects)
+			rects = tightSplit(img, image.Rect(solid.Max.X, solid.Min.Y, r.Max.X, solid.Max.Y), conf, rects)
+			return tightSplit(img, image.Rect(r.Min.X, solid.Max.Y, r.Max.X, r.Max.Y), conf, rects)
+		}
+	}
+	return tightLimitSize(r, conf, rects)
+}
+
+// tightLimitSize appends r cut to the size limits of conf to rects
+func tightLimitSize(r image.Rectangle, conf *tightConf, rects []image.Rectangle) []image.Rectangle {
+	if r.Empty() {
+		return rects
+	}
+	w := Min(r.Dx(), conf.maxRectWidth)
+	h := conf.maxRectSize / w
+	if h < 1 {
+		h = 1
+	}
+	for y := r.Min.Y; y < r.Max.Y; y += h {
+		for x := r.Min.X; x < r.Max.X; x += w {
+			rects = append(rects, image.Rect(x, y, x+w, y+h).Intersect(r))
+		}
+	}
+	return rects
+}
+
+// tightFindSolid returns the largest solid area of r, found by growing
+// solid tiles to the right and down and then to the area's exact edges
+func tightFindSolid(img *image.RGBA, r image.Rectangle) image.Rectangle {
+	const t = tightSolidTile
+	var best image.Rectangle
+	for y := r.Min.Y; y+t <= r.Max.Y; y += t {
+		for x := r.Min.X; x+t <= r.Max.X; x += t {
+			area := image.Rect(x, y, x+t, y+t)
+			if area.In(best) {
+				continue
+			}
+			off := img.PixOffset(x, y)
+			col := [3]uint8{img.Pix[off], img.Pix[off+1], img.Pix[off+2]}
+			if !tightSolid(img, area, col) {
+				continue
+			}
+			for area.Max.X+t <= r.Max.X && tightSolid(img, image.Rect(area.Max.X, y, area.Max.X+t, y+t), col) {
+				area.Max.X += t
+			}
+			for area.Max.Y+t <= r.Max.Y && tightSolid(img, image.Rect(x, area.Max.Y, area.Max.X, area.Max.Y+t), col) {
+				area.Max.Y += t
+			}
+			for area.Max.X < r.Max.X && tightSolid(img, image.Rect(area.Max.X, area.Min.Y, area.Max.X+1, area.Max.Y), col) {
+				area.Max.X++
+			}
+			for area.Max.Y < r.Max.Y && tightSolid(img, image.Rect(area.Min.X, area.Max.Y, area.Max.X, area.Max.Y+1), col) {
+				area.Max.Y++
+			}
+			for area.Min.X > r.Min.X && tightSolid(img, image.Rect(area.Min.X-1, area.Min.Y, area.Min.X, area.Max.Y), col) {
+				area.Min.X--
+			}
+			for area.Min.Y > r.Min.Y && tightSolid(img, image.Rect(area.Min.X, area.Min.Y-1, area.Max.X, area.Min.Y), col) {
+				area.Min.Y--
+			}
+			if area.Dx()*area.Dy() > best.Dx()*best.Dy() {
+				best = area
+			}
+		}
+	}
+	return best
+}
+
+// tightSolid reports whether all pixels of r have the color col
+func tightSolid(img *image.RGBA, r image.Rectangle, col [3]uint8) bool {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		off := img.PixOffset(r.Min.X, y)
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if img.Pix[off] != col[0] || img.Pix[off+1] != col[1] || img.Pix[off+2] != col[2] {
+				return false
+			}
+			off += 4
+		}
+	}
+	return true
+}
@@ -0,0 +1,157 @@
+package vnc2video
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tightTestImage is a gradient on the left and a checker board on the
+// right, so Write uses two of its zlib streams
+func tightTestImage(w, h int) *image.RGBA {
+	return patternImage(w, h, func(x, y int) color.RGBA {
+		if x < w/2 {
+			return gradient(x, y)
+		}
+		return checker(x, y)
+	})
+}
+
+// tightWriteSession serves updates encoded by the Tight encoding enc and
+// checks that the client decodes them back to enc.Image
+func tightWriteSession(enc *TightEncoding, updates int) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	bounds := enc.Image.Bounds()
+	scfg := &ServerConfig{
+		SecurityHandlers: []SecurityHandler{&ServerAuthNone{}},
+		Encodings:        []Encoding{&RawEncoding{}, enc},
+		PixelFormat:      PixelFormat32bit,
+		ClientMessageCh:  make(chan ClientMessage, 16),
+		ServerMessageCh:  make(chan ServerMessage, 16),
+		Messages:         DefaultClientMessages,
+		Width:            uint16(bounds.Dx()),
+		Height:           uint16(bounds.Dy()),
+		ErrorCh:          make(chan error, 4),
+	}
+	go Serve(context.Background(), ln, scfg)
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return err
+	}
+	ccfg := &ClientConfig{
+		SecurityHandlers: []SecurityHandler{&ClientAuthNone{}},
+		PixelFormat:      PixelFormat32bit,
+		ClientMessageCh:  make(chan ClientMessage, 16),
+		ServerMessageCh:  make(chan ServerMessage, 16),
+		Messages:         DefaultServerMessages,
+		Encodings:        []Encoding{&RawEncoding{}, &TightEncoding{}},
+		ErrorCh:          make(chan error, 4),
+	}
+	cc, err := Connect(context.Background(), nc, ccfg)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+
+	w, h := uint16(bounds.Dx()/2), uint16(bounds.Dy())
+	for i := 0; i < updates; i++ {
+		scfg.ServerMessageCh <- &FramebufferUpdate{
+			NumRect: 2,
+			Rects: []*Rectangle{
+				{Width: w, Height: h, EncType: EncTight, Enc: enc},
+				{X: w, Width: w, Height: h, EncType: EncTight, Enc: enc},
+			},
+		}
+		timeout := time.After(5 * time.Second)
+		for update := false; !update; {
+			select {
+			case msg := <-ccfg.ServerMessageCh:
+				_, update = msg.(*FramebufferUpdate)
+			case err := <-ccfg.ErrorCh:
+				return err
+			case err := <-scfg.ErrorCh:
+				return err
+			case <-timeout:
+				return fmt.Errorf("update %d not received", i)
+			}
+		}
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				r, g, b, _ := cc.Canvas.At(x, y).RGBA()
+				want := enc.Image.At(x, y).(color.RGBA)
+				if uint8(r>>8) != want.R || uint8(g>>8) != want.G || uint8(b>>8) != want.B {
+					return fmt.Errorf("update %d: pixel %d,%d is %d,%d,%d want %v", i, x, y, r>>8, g>>8, b>>8, want)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func TestTightWriteSharedEncoding(t *testing.T) {
+	// one encoding shared by the servers of concurrent connections, as
+	// with a ServerConfig serving several clients
+	enc := &TightEncoding{Image: tightTestImage(64, 32)}
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			if err := tightWriteSession(enc, 5); err != nil {
+				errs <- fmt.Errorf("session %d: %v", id, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestTightWriteStreams(t *testing.T) {
+	// connections without streams of their own use the encoding's, which
+	// start over for every new connection
+	enc := &TightEncoding{Image: tightTestImage(64, 32)}
+	rect := &Rectangle{Width: 32, Height: 32, EncType: EncTight, Enc: enc}
+	first := &bufConn{pf: PixelFormat32bit}
+	for i := 0; i < 2; i++ {
+		if err := enc.Write(first, rect); err != nil {
+			t.Fatal(err)
+		}
+		if reset := first.Bytes()[0] & 0x0F; (reset != 0) != (i == 0) {
+			t.Errorf("rect %d: compression control %#x", i, first.Bytes()[0])
+		}
+		first.Reset()
+	}
+	second := &bufConn{pf: PixelFormat32bit}
+	if err := enc.Write(second, rect); err != nil {
+		t.Fatal(err)
+	}
+	if second.Bytes()[0]&0x0F == 0 {
+		t.Error("streams of a new connection not reset")
+	}
+
+	// server connections keep their own
+	var sc ServerConn
+	if s, reset := enc.stream(&sc, tightStreamRaw, 6); !reset || s != sc.tightZlib[tightStreamRaw] {
+		t.Error("stream not kept by the server connection")
+	}
+	if _, reset := enc.stream(&sc, tightStreamRaw, 6); reset {
+		t.Error("stream of the server connection reset")
+	}
+	if _, reset := enc.stream(&sc, tightStreamRaw, 7); !reset {
+		t.Error("stream not reset on a new compression level")
+	}
+}
@@ -0,0 +1,47 @@
+package vnc2video
+
+import (
+	"bytes"
+	"compress/zlib"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestTightGradientRead(t *testing.T) {
+	want := [][]color.RGBA{
+		{{10, 20, 30, 255}, {40, 50, 60, 255}, {70, 80, 90, 255}},
+		{{20, 30, 40, 255}, {50, 60, 70, 255}, {100, 110, 120, 255}},
+	}
+	// the prediction errors of want, worked out by hand: the first row
+	// predicts from the left pixel, the second from left + up - up-left
+	data := []byte{
+		10, 20, 30, 30, 30, 30, 30, 30, 30,
+		10, 10, 10, 0, 0, 0, 20, 20, 20,
+	}
+	zbuf := &bytes.Buffer{}
+	zw := zlib.NewWriter(zbuf)
+	zw.Write(data)
+	zw.Flush()
+	c := &bufConn{pf: PixelFormat32bit}
+	c.Write([]byte{0x40, TightFilterGradient})
+	c.Write(tightCompactLength(zbuf.Len()))
+	c.Write(zbuf.Bytes())
+
+	// drawn at an offset into a larger canvas to check positioning
+	canvas := image.NewRGBA(image.Rect(0, 0, 6, 4))
+	enc := &TightEncoding{Image: canvas}
+	if err := enc.Read(c, &Rectangle{X: 2, Y: 1, Width: 3, Height: 2, EncType: EncTight, Enc: enc}); err != nil {
+		t.Fatal(err)
+	}
+	for y, row := range want {
+		for x, col := range row {
+			if got := canvas.RGBAAt(x+2, y+1); got.R != col.R || got.G != col.G || got.B != col.B {
+				t.Errorf("pixel %d,%d is %v, want %v", x, y, got, col)
+			}
+		}
+	}
+	if got := canvas.RGBAAt(5, 1); got != (color.RGBA{}) {
+		t.Errorf("pixel drawn right of the rect: %v", got)
+	}
+}
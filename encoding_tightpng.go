@@ -2,37 +2,60 @@ package vnc2video
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
 	"image"
-	"image/color"
 	"image/draw"
+	"image/jpeg"
 	"image/png"
-	"io"
-	"github.com/amitbet/vnc2video/logger"
 )
 
+// TightPngJPEGQuality is the JPEG quality used when TightCC forces JPEG
+// compression and JPEGQuality is not set
+const TightPngJPEGQuality = 75
+
+// tightPngMaxPNGColors is the number of colors above which a rectangle is
+// considered photo-like and sent as JPEG when JPEG is enabled
+const tightPngMaxPNGColors = 256
+
 func (*TightPngEncoding) Supported(Conn) bool {
 	return true
 }
-func (*TightPngEncoding) Reset() error {
-	return nil
+func (enc *TightPngEncoding) Reset() error {
+	return enc.tight.Reset()
 }
 
+// Write encodes the pixels of rect. TightCC forces the compression, by
+// default single color rects are sent as Fill, photo-like rects as JPEG if
+// JPEGQuality is set and all others as PNG.
 func (enc *TightPngEncoding) Write(c Conn, rect *Rectangle) error {
-	if err := writeTightCC(c, enc.TightCC); err != nil {
+	img := RectImage(enc.Image, rect)
+	pf := c.PixelFormat()
+	tcc := enc.TightCC
+	if tcc == nil {
+		tcc = &TightCC{Compression: enc.chooseCompression(img, &pf), Filter: TightFilterCopy}
+	}
+	if err := writeTightCC(c, tcc); err != nil {
 		return err
 	}
-	cmp := enc.TightCC.Compression
+	cmp := tcc.Compression
 	switch cmp {
-	case TightCompressionPNG:
+	case TightCompressionPNG, TightCompressionJPEG:
 		buf := bPool.Get().(*bytes.Buffer)
 		buf.Reset()
 		defer bPool.Put(buf)
-		pngEnc := &png.Encoder{CompressionLevel: png.BestSpeed}
-		//pngEnc := &png.Encoder{CompressionLevel: png.NoCompression}
-		if err := pngEnc.Encode(buf, enc.Image); err != nil {
-			return err
+		if cmp == TightCompressionPNG {
+			pngEnc := &png.Encoder{CompressionLevel: png.BestSpeed}
+			if err := pngEnc.Encode(buf, img); err != nil {
+				return err
+			}
+		} else {
+			quality := enc.JPEGQuality
+			if quality <= 0 {
+				quality = TightPngJPEGQuality
+			}
+			if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+				return err
+			}
 		}
 		if err := writeTightLength(c, buf.Len()); err != nil {
 			return err
@@ -42,12 +65,7 @@ func (enc *TightPngEncoding) Write(c Conn, rect *Rectangle) error {
 			return err
 		}
 	case TightCompressionFill:
-		var tpx TightPixel
-		r, g, b, _ := enc.Image.At(0, 0).RGBA()
-		tpx.R = uint8(r)
-		tpx.G = uint8(g)
-		tpx.B = uint8(b)
-		if err := binary.Write(c, binary.BigEndian, tpx); err != nil {
+		if err := writeTightColor(c, &pf, img.At(0, 0)); err != nil {
 			return err
 		}
 	default:
@@ -56,43 +74,78 @@ func (enc *TightPngEncoding) Write(c Conn, rect *Rectangle) error {
 	return nil
 }
 
+// chooseCompression picks the compression of a rect for Write
+func (enc *TightPngEncoding) chooseCompression(img *image.RGBA, pf *PixelFormat) TightCompression {
+	colors := make(map[[3]uint8]struct{})
+	for i := 0; i < len(img.Pix) && len(colors) <= tightPngMaxPNGColors; i += 4 {
+		colors[[3]uint8{img.Pix[i], img.Pix[i+1], img.Pix[i+2]}] = struct{}{}
+	}
+	switch {
+	case len(colors) <= 1:
+		return TightCompressionFill
+	case len(colors) > tightPngMaxPNGColors && enc.JPEGQuality > 0 && pf.BPP >= 16:
+		return TightCompressionJPEG
+	}
+	return TightCompressionPNG
+}
+
+// TightPngEncoding is the Tight encoding variant using PNG instead of zlib
+// compressed pixel data. Servers may also send Fill, JPEG and, though the
+// spec leaves it out, Basic compression rects, which are all decoded.
 type TightPngEncoding struct {
+	// TightCC forces the compression used by Write
 	TightCC *TightCC
 	Image   draw.Image
+	// JPEGQuality enables JPEG compression of photo-like rects in Write,
+	// 0 sends them losslessly as PNG
+	JPEGQuality int
+	// tight decodes Basic compression rects and owns their zlib streams
+	tight TightEncoding
 }
 
 func (*TightPngEncoding) Type() EncodingType { return EncTightPng }
 
 func (enc *TightPngEncoding) Read(c Conn, rect *Rectangle) error {
-	tcc, err := readTightCC(c)
-	logger.Trace("starting to read a tight rect: %v", rect)
+	compctl, err := ReadUint8(c)
 	if err != nil {
 		return err
 	}
-	enc.TightCC = tcc
-	cmp := enc.TightCC.Compression
-	switch cmp {
-	case TightCompressionPNG:
+	connLogger(c).Tracef("starting to read a tightPng rect: %v, compctl=%d", rect, compctl)
+	enc.tight.Image = enc.Image
+	enc.tight.log = connLogger(c)
+	enc.tight.resetDecoders(compctl)
+
+	pf := c.PixelFormat()
+	cmp := TightCompression(compctl >> 4)
+	switch {
+	case cmp == TightCompressionPNG, cmp == TightCompressionJPEG:
 		l, err := readTightLength(c)
 		if err != nil {
 			return err
 		}
-		img, err := png.Decode(io.LimitReader(c, int64(l)))
+		data, err := ReadBytes(l, c)
 		if err != nil {
 			return err
 		}
-		//draw.Draw(enc.Image, enc.Image.Bounds(), img, image.Point{X: int(rect.X), Y: int(rect.Y)}, draw.Src)
+		var img image.Image
+		if cmp == TightCompressionPNG {
+			img, err = png.Decode(bytes.NewReader(data))
+		} else {
+			img, err = jpeg.Decode(bytes.NewReader(data))
+		}
+		if err != nil {
+			return corrupt(fmt.Errorf("decoding %s: %v", cmp, err))
+		}
 		DrawImage(enc.Image, img, image.Point{X: int(rect.X), Y: int(rect.Y)})
-	case TightCompressionFill:
-		var tpx TightPixel
-		if err := binary.Read(c, binary.BigEndian, &tpx); err != nil {
+	case cmp == TightCompressionFill:
+		col, err := getTightColor(c, &pf)
+		if err != nil {
 			return err
 		}
-		//enc.Image = image.NewRGBA(image.Rect(0, 0, 1, 1))
-		col := color.RGBA{R: tpx.R, G: tpx.G, B: tpx.B, A: 1}
 		myRect := MakeRectFromVncRect(rect)
 		FillRect(enc.Image, &myRect, col)
-		//enc.Image.(draw.Image).Set(0, 0, color.RGBA{R: tpx.R, G: tpx.G, B: tpx.B, A: 1})
+	case cmp < TightCompressionFill:
+		return enc.tight.handleTightFilters(compctl, &pf, rect, c)
 	default:
 		return fmt.Errorf("unknown compression %d", cmp)
 	}
@@ -101,4 +154,5 @@ func (enc *TightPngEncoding) Read(c Conn, rect *Rectangle) error {
 
 func (enc *TightPngEncoding) SetTargetImage(img draw.Image) {
 	enc.Image = img
+	enc.tight.Image = img
 }
@@ -0,0 +1,161 @@
+package vnc2video
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden streams in testdata")
+
+// bufConn is a Conn reading and writing rectangle data from a buffer
+type bufConn struct {
+	bytes.Buffer
+	pf PixelFormat
+}
+
+func (c *bufConn) Close() error                             { return nil }
+func (c *bufConn) Conn() net.Conn                           { return nil }
+func (c *bufConn) Config() interface{}                      { return nil }
+func (c *bufConn) Protocol() string                         { return "RFB 003.008" }
+func (c *bufConn) PixelFormat() PixelFormat                 { return c.pf }
+func (c *bufConn) SetPixelFormat(pf PixelFormat) error      { c.pf = pf; return nil }
+func (c *bufConn) ColorMap() ColorMap                       { return ColorMap{} }
+func (c *bufConn) SetColorMap(ColorMap)                     {}
+func (c *bufConn) Encodings() []Encoding                    { return nil }
+func (c *bufConn) SetEncodings([]EncodingType) error        { return nil }
+func (c *bufConn) Width() uint16                            { return 0 }
+func (c *bufConn) Height() uint16                           { return 0 }
+func (c *bufConn) SetWidth(uint16)                          {}
+func (c *bufConn) SetHeight(uint16)                         {}
+func (c *bufConn) DesktopName() []byte                      { return nil }
+func (c *bufConn) SetDesktopName([]byte)                    {}
+func (c *bufConn) Flush() error                             { return nil }
+func (c *bufConn) Wait()                                    {}
+func (c *bufConn) SetProtoVersion(string)                   {}
+func (c *bufConn) SetSecurityHandler(SecurityHandler) error { return nil }
+func (c *bufConn) SecurityHandler() SecurityHandler         { return nil }
+func (c *bufConn) GetEncInstance(EncodingType) Encoding     { return nil }
+
+var (
+	checkerA = color.RGBA{R: 0x10, G: 0x80, B: 0xF0, A: 0xff}
+	checkerB = color.RGBA{R: 0xFF, G: 0xFF, B: 0x00, A: 0xff}
+)
+
+func solid(x, y int) color.RGBA { return color.RGBA{R: 0x11, G: 0x22, B: 0x33, A: 0xff} }
+
+func checker(x, y int) color.RGBA {
+	if (x+y)%2 == 1 {
+		return checkerB
+	}
+	return checkerA
+}
+
+func gradient(x, y int) color.RGBA {
+	return color.RGBA{R: uint8(x * 8), G: uint8(y * 8), B: uint8((x + y) * 4), A: 0xff}
+}
+
+func patternImage(w, h int, pattern func(x, y int) color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, pattern(x, y))
+		}
+	}
+	return img
+}
+
+// tightPngStreams are the golden streams, the ones without a writer were
+// produced by other encoders
+var tightPngStreams = []struct {
+	name      string
+	w, h      int
+	pattern   func(x, y int) color.RGBA
+	tolerance int
+	// jpegQuality configures the writer, -1 means there is none
+	jpegQuality int
+	compression TightCompression
+}{
+	{"fill", 4, 4, solid, 0, 0, TightCompressionFill},
+	{"png", 8, 8, checker, 0, 0, TightCompressionPNG},
+	{"jpeg", 32, 32, gradient, 12, 90, TightCompressionJPEG},
+	{"palette_png", 4, 4, checker, 0, -1, TightCompressionPNG},
+	{"basic_copy", 4, 4, gradient, 0, -1, TightCompressionBasic},
+	{"mono_palette", 4, 4, checker, 0, -1, TightCompressionBasic},
+}
+
+func goldenPath(name string) string {
+	return filepath.Join("testdata", "tightpng", name+".stream")
+}
+
+func TestTightPngWrite(t *testing.T) {
+	for _, tc := range tightPngStreams {
+		if tc.jpegQuality < 0 {
+			continue
+		}
+		enc := &TightPngEncoding{Image: patternImage(tc.w, tc.h, tc.pattern), JPEGQuality: tc.jpegQuality}
+		c := &bufConn{pf: PixelFormat32bit}
+		rect := &Rectangle{Width: uint16(tc.w), Height: uint16(tc.h), EncType: EncTightPng, Enc: enc}
+		if err := enc.Write(c, rect); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		got := c.Bytes()
+		if cmp := TightCompression(got[0] >> 4); cmp != tc.compression {
+			t.Errorf("%s: wrote compression %s, want %s", tc.name, cmp, tc.compression)
+		}
+		if *update {
+			if err := ioutil.WriteFile(goldenPath(tc.name), got, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(goldenPath(tc.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: stream differs from golden stream\n got %x\nwant %x", tc.name, got, want)
+		}
+	}
+}
+
+func TestTightPngRead(t *testing.T) {
+	for _, tc := range tightPngStreams {
+		data, err := ioutil.ReadFile(goldenPath(tc.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// draw at an offset into a larger canvas to check positioning
+		canvas := image.NewRGBA(image.Rect(0, 0, tc.w+4, tc.h+4))
+		enc := &TightPngEncoding{}
+		enc.SetTargetImage(canvas)
+		c := &bufConn{pf: PixelFormat32bit}
+		c.Write(data)
+		rect := &Rectangle{X: 2, Y: 2, Width: uint16(tc.w), Height: uint16(tc.h), EncType: EncTightPng, Enc: enc}
+		if err := enc.Read(c, rect); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if c.Len() != 0 {
+			t.Errorf("%s: %d bytes left unread", tc.name, c.Len())
+		}
+		for y := 0; y < tc.h; y++ {
+			for x := 0; x < tc.w; x++ {
+				r, g, b, _ := canvas.At(x+2, y+2).RGBA()
+				want := tc.pattern(x, y)
+				if !near(uint8(r>>8), want.R, tc.tolerance) || !near(uint8(g>>8), want.G, tc.tolerance) || !near(uint8(b>>8), want.B, tc.tolerance) {
+					t.Fatalf("%s: pixel (%d,%d) is %d,%d,%d want %v", tc.name, x, y, r>>8, g>>8, b>>8, want)
+				}
+			}
+		}
+	}
+}
+
+func near(a, b uint8, tolerance int) bool {
+	d := int(a) - int(b)
+	return d <= tolerance && d >= -tolerance
+}
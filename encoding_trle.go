@@ -0,0 +1,43 @@
+package vnc2video
+
+import (
+	"image/color"
+	"image/draw"
+)
+
+// TRLEEncoding is the tiled run-length encoding, it codes 16x16 tiles like
+// ZRLE does 64x64 tiles, without zlib compression
+type TRLEEncoding struct {
+	Image draw.Image
+	// palette is the palette of the last palette tile, which later tiles
+	// may reuse
+	palette []*color.RGBA
+}
+
+func (*TRLEEncoding) Supported(Conn) bool {
+	return true
+}
+
+func (enc *TRLEEncoding) SetTargetImage(img draw.Image) {
+	enc.Image = img
+}
+
+func (enc *TRLEEncoding) Reset() error {
+	enc.palette = nil
+	return nil
+}
+
+func (*TRLEEncoding) Type() EncodingType { return EncTRLE }
+
+func (enc *TRLEEncoding) Write(c Conn, rect *Rectangle) error {
+	return nil
+}
+
+func (enc *TRLEEncoding) Read(r Conn, rect *Rectangle) error {
+	connLogger(r).Tracef("reading TRLE:%v\n", rect)
+	pf := r.PixelFormat()
+	tiles := &rleTiles{r: r, log: connLogger(r), img: enc.Image, pf: &pf, tileSize: 16, trle: true, palette: enc.palette}
+	err := tiles.render(rect)
+	enc.palette = tiles.palette
+	return err
+}
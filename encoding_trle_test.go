@@ -0,0 +1,90 @@
+package vnc2video
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The TRLE, ZlibHex and ZYWRLE streams in testdata come with the pixels
+// they decode to. They are made by testdata/gen_rle_vectors.py, an encoder
+// written apart from the decoders and compressing with the C zlib library,
+// not captured from servers.
+
+// readReference returns the stream and the decoded pixels of a reference
+// vector in testdata
+func readReference(t *testing.T, enc, name string) (*bufConn, *image.RGBA) {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", enc, name+".stream"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filepath.Join("testdata", enc, name+".ppm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var w, h, max int
+	if _, err := fmt.Fscanf(r, "P6\n%d %d\n%d\n", &w, &h, &max); err != nil {
+		t.Fatalf("%s: %v", f.Name(), err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(img.Pix); i += 4 {
+		if _, err := r.Read(img.Pix[i : i+3]); err != nil {
+			t.Fatalf("%s: %v", f.Name(), err)
+		}
+		img.Pix[i+3] = 0xff
+	}
+	c := &bufConn{pf: PixelFormat32bit}
+	c.Write(data)
+	return c, img
+}
+
+// checkReference compares the pixels of img at x0, y0 with want
+func checkReference(t *testing.T, name string, img *image.RGBA, x0, y0 int, want *image.RGBA) {
+	t.Helper()
+	b := want.Bounds()
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			got, exp := img.RGBAAt(x0+x, y0+y), want.RGBAAt(x, y)
+			if got.R != exp.R || got.G != exp.G || got.B != exp.B {
+				t.Fatalf("%s: pixel (%d,%d) is %d,%d,%d want %d,%d,%d", name, x, y, got.R, got.G, got.B, exp.R, exp.G, exp.B)
+			}
+		}
+	}
+}
+
+func TestTRLERead(t *testing.T) {
+	// a 40x20 rect and a 40x16 rect below it, drawn at an offset. The
+	// tiles use every subencoding, the second rect reuses the palette of
+	// the first one's last palette tile.
+	c, want := readReference(t, "trle", "tiles")
+	canvas := image.NewRGBA(image.Rect(0, 0, 44, 40))
+	enc := &TRLEEncoding{}
+	enc.SetTargetImage(canvas)
+	for _, rect := range []*Rectangle{
+		{X: 2, Y: 1, Width: 40, Height: 20, EncType: EncTRLE, Enc: enc},
+		{X: 2, Y: 21, Width: 40, Height: 16, EncType: EncTRLE, Enc: enc},
+	} {
+		if err := enc.Read(c, rect); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkReference(t, "trle", canvas, 2, 1, want)
+	if c.Len() != 0 {
+		t.Errorf("%d bytes left unread", c.Len())
+	}
+
+	// Reset drops the palette
+	enc.Reset()
+	c.Write([]byte{127, 0})
+	rect := &Rectangle{Width: 4, Height: 1, EncType: EncTRLE, Enc: enc}
+	if err := enc.Read(c, rect); err == nil {
+		t.Error("tile reusing a palette after Reset decoded")
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"image/color"
 	"image/draw"
 	"io"
+	"sync"
+	"time"
 )
 
 const (
@@ -19,14 +21,50 @@ type VncCanvas struct {
 	draw.Image
 	//DisplayBuff draw.Image
 	//WriteBuff      draw.Image
-	imageBuffs     [2]draw.Image
-	Cursor         draw.Image
-	CursorMask     [][]bool
-	CursorBackup   draw.Image
-	CursorOffset   *image.Point
+	imageBuffs [2]draw.Image
+	DrawCursor bool
+	// FrameCursor draws the cursor only into the frames returned by Frame,
+	// the framebuffer keeps the pixels sent by the server
+	FrameCursor bool
+	Changed     map[string]bool
+
+	// Cursor is the cursor shape as an RGBA image.
+	//
+	// Deprecated: the cursor is drawn from CursorShape, which has an alpha
+	// channel. The fields below are set along with it for code reading
+	// them, changing them has no effect.
+	Cursor draw.Image
+	// CursorMask is indexed [x][y] and is true where the cursor is opaque.
+	//
+	// Deprecated: use the alpha of CursorShape.
+	CursorMask [][]bool
+	// CursorBackup is a cursor sized image.
+	//
+	// Deprecated: it no longer holds the pixels under the cursor.
+	CursorBackup draw.Image
+	// CursorOffset is the hotspot of the cursor.
+	//
+	// Deprecated: use the Hotspot of CursorShape.
+	CursorOffset *image.Point
+	// CursorLocation is the pointer position.
+	//
+	// Deprecated: use CursorPos.
 	CursorLocation *image.Point
-	DrawCursor     bool
-	Changed        map[string]bool
+
+	cropMu sync.Mutex
+	crop   image.Rectangle
+
+	cursorMu  sync.Mutex
+	cursor    *Cursor
+	cursorPos *image.Point
+	// cursorBackup holds the framebuffer pixels of cursorPainted, the part
+	// of the framebuffer the cursor was painted over
+	cursorBackup  *RGBImage
+	cursorPainted image.Rectangle
+	// frame is the copy of the framebuffer returned by Frame when the cursor
+	// or overlays are drawn into the frames only
+	frame    *RGBImage
+	overlays []FrameOverlay
 }
 
 func NewVncCanvas(width, height int) *VncCanvas {
@@ -57,79 +95,74 @@ func (c *VncCanvas) Reset(rect *Rectangle) {
 	c.Changed = nil
 }
 
-func (c *VncCanvas) RemoveCursor() image.Image {
-	if c.Cursor == nil || c.CursorLocation == nil {
-		return c.Image
-	}
-	if !c.DrawCursor {
-		return c.Image
-	}
-	rect := c.Cursor.Bounds()
-	loc := c.CursorLocation
-	img := c.Image
-	for y := rect.Min.Y; y < int(rect.Max.Y); y++ {
-		for x := rect.Min.X; x < int(rect.Max.X); x++ {
-			// offset := y*int(rect.Width) + x
-			// if bitmask[y*int(scanLine)+x/8]&(1<<uint(7-x%8)) > 0 {
-			col := c.CursorBackup.At(x, y)
-			//mask := c.CursorMask.At(x, y).(color.RGBA)
-			mask := c.CursorMask[x][y]
-			//logger.Info("Drawing Cursor: ", x, y, col, mask)
-			if mask {
-				//logger.Info("Drawing Cursor for real: ", x, y, col)
-				img.Set(x+loc.X-c.CursorOffset.X, y+loc.Y-c.CursorOffset.Y, col)
-			}
-			// 	//logger.Tracef("CursorPseudoEncoding.Read: setting pixel: (%d,%d) %v", x+int(rect.X), y+int(rect.Y), colors[offset])
-			// }
-		}
-	}
-	return img
+// Resize changes the size of the framebuffer, keeping the pixels of the
+// area the old and new sizes share
+func (c *VncCanvas) Resize(width, height int) {
+	img := NewRGBImage(image.Rect(0, 0, width, height))
+	copyPixels(img, c.Image, img.Rect.Intersect(c.Image.Bounds()))
+	c.Image = img
 }
 
-// func (c *VncCanvas) SwapBuffers() {
-// 	swapSpace := c.DisplayBuff
-// 	c.DisplayBuff = c.WriteBuff
-// 	c.WriteBuff = swapSpace
-// 	c.Image = c.WriteBuff
-// }
+// SetCrop limits the frames returned by Frame to r, an empty rectangle
+// exports the whole framebuffer
+func (c *VncCanvas) SetCrop(r image.Rectangle) {
+	c.cropMu.Lock()
+	defer c.cropMu.Unlock()
+	c.crop = r
+}
 
-func (c *VncCanvas) PaintCursor() image.Image {
-	if c.Cursor == nil || c.CursorLocation == nil {
-		return c.Image
+// Crop returns the region exported by Frame
+func (c *VncCanvas) Crop() image.Rectangle {
+	c.cropMu.Lock()
+	defer c.cropMu.Unlock()
+	return c.crop
+}
+
+// Frame returns the image to record, which is the crop region of the
+// canvas sharing its pixels, or the whole canvas if there is no crop. With
+// FrameCursor or overlays the frame is a copy holding them, it is reused by
+// the next call.
+func (c *VncCanvas) Frame() image.Image {
+	return c.FrameAt(time.Now())
+}
+
+// FrameAt returns the frame like Frame, with the overlays drawn as of now
+func (c *VncCanvas) FrameAt(now time.Time) image.Image {
+	crop := c.Crop()
+	bounds := c.Image.Bounds()
+	if !crop.Empty() {
+		bounds = crop.Intersect(bounds)
 	}
-	if !c.DrawCursor {
-		return c.Image
+	var cur *Cursor
+	var pos image.Point
+	if c.FrameCursor {
+		if cur, pos = c.visibleCursor(); cur != nil && !cur.bounds(pos).Overlaps(bounds) {
+			cur = nil
+		}
 	}
-	rect := c.Cursor.Bounds()
-	if c.CursorBackup == nil {
-		c.CursorBackup = image.NewRGBA(c.Cursor.Bounds())
-	}
-
-	loc := c.CursorLocation
-	img := c.Image
-	for y := rect.Min.Y; y < int(rect.Max.Y); y++ {
-		for x := rect.Min.X; x < int(rect.Max.X); x++ {
-			// offset := y*int(rect.Width) + x
-			// if bitmask[y*int(scanLine)+x/8]&(1<<uint(7-x%8)) > 0 {
-			col := c.Cursor.At(x, y)
-			//mask := c.CursorMask.At(x, y).(RGBColor)
-			mask := c.CursorMask[x][y]
-			backup := c.Image.At(x+loc.X-c.CursorOffset.X, y+loc.Y-c.CursorOffset.Y)
-			//c.CursorBackup.Set(x, y, backup)
-			//backup the previous data at this point
-
-			//logger.Info("Drawing Cursor: ", x, y, col, mask)
-			if mask {
-
-				c.CursorBackup.Set(x, y, backup)
-				//logger.Info("Drawing Cursor for real: ", x, y, col)
-				img.Set(x+loc.X-c.CursorOffset.X, y+loc.Y-c.CursorOffset.Y, col)
-			}
-			// 	//logger.Tracef("CursorPseudoEncoding.Read: setting pixel: (%d,%d) %v", x+int(rect.X), y+int(rect.Y), colors[offset])
-			// }
+	overlays := c.frameOverlays()
+	if cur != nil || len(overlays) > 0 {
+		if c.frame == nil || c.frame.Rect != bounds {
+			c.frame = NewRGBImage(bounds)
 		}
+		copyPixels(c.frame, c.Image, bounds)
+		if cur != nil {
+			cur.draw(c.frame, pos)
+		}
+		for _, o := range overlays {
+			o.DrawOverlay(c.frame, now)
+		}
+		return c.frame
+	}
+	if crop.Empty() {
+		return c.Image
+	}
+	if img, ok := c.Image.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return img.SubImage(crop)
 	}
-	return img
+	return c.Image
 }
 
 func Min(a, b int) int {
@@ -236,6 +269,28 @@ func ReadUint32(r io.Reader) (uint32, error) {
 	return myUint, nil
 }
 
+// RectImage returns the pixels of rect as an opaque image at the origin,
+// img is either the whole framebuffer or holds only the rect's pixels
+func RectImage(img image.Image, rect *Rectangle) *image.RGBA {
+	r := MakeRectFromVncRect(rect)
+	if !r.In(img.Bounds()) {
+		r = img.Bounds()
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	i := 0
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			cr, cg, cb, _ := img.At(x, y).RGBA()
+			dst.Pix[i] = uint8(cr >> 8)
+			dst.Pix[i+1] = uint8(cg >> 8)
+			dst.Pix[i+2] = uint8(cb >> 8)
+			dst.Pix[i+3] = 0xff
+			i += 4
+		}
+	}
+	return dst
+}
+
 func MakeRect(x, y, width, height int) image.Rectangle {
 	return image.Rectangle{Min: image.Point{X: x, Y: y}, Max: image.Point{X: x + width, Y: y + height}}
 }
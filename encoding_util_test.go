@@ -1,6 +1,9 @@
 package vnc2video
 
-import "testing"
+import (
+	"image"
+	"testing"
+)
 
 func TestSetChanged(t *testing.T) {
 	canvas := &VncCanvas{}
@@ -13,3 +16,31 @@ func TestSetChanged(t *testing.T) {
 	}
 
 }
+
+func TestFrameCrop(t *testing.T) {
+	canvas := NewVncCanvas(8, 8)
+	if frame := canvas.Frame(); frame != canvas.Image {
+		t.Error("uncropped frame is not the framebuffer")
+	}
+
+	canvas.SetCrop(image.Rect(2, 3, 6, 5))
+	frame := canvas.Frame()
+	if frame.Bounds() != image.Rect(2, 3, 6, 5) {
+		t.Fatalf("frame bounds are %v", frame.Bounds())
+	}
+	// the frame shares the pixels of the framebuffer
+	canvas.Image.(*RGBImage).Pix[(4*8+5)*3] = 0xff
+	if got := rgbAt(frame, 5, 4); got.R != 0xff {
+		t.Errorf("frame pixel is %v after drawing into the framebuffer", got)
+	}
+
+	// a crop sticking out of the framebuffer is clipped
+	canvas.SetCrop(image.Rect(6, 6, 12, 12))
+	if got := canvas.Frame().Bounds(); got != image.Rect(6, 6, 8, 8) {
+		t.Errorf("clipped frame bounds are %v", got)
+	}
+	canvas.SetCrop(image.Rectangle{})
+	if got := canvas.Frame().Bounds(); got != image.Rect(0, 0, 8, 8) {
+		t.Errorf("frame bounds are %v after removing the crop", got)
+	}
+}
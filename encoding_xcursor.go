@@ -2,10 +2,16 @@ package vnc2video
 
 import (
 	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
 	"math"
 )
 
+// XCursorPseudoEncoding is a two colors cursor shape, it is drawn on the
+// target canvas like the rich cursor
 type XCursorPseudoEncoding struct {
+	Image      draw.Image
 	PrimaryR   uint8
 	PrimaryG   uint8
 	PrimaryB   uint8
@@ -23,6 +29,10 @@ func (*XCursorPseudoEncoding) Reset() error {
 	return nil
 }
 
+func (enc *XCursorPseudoEncoding) SetTargetImage(img draw.Image) {
+	enc.Image = img
+}
+
 func (*XCursorPseudoEncoding) Type() EncodingType { return EncXCursorPseudo }
 
 // Read implements the Encoding interface.
@@ -58,9 +68,38 @@ func (enc *XCursorPseudoEncoding) Read(c Conn, rect *Rectangle) error {
 		return err
 	}
 
+	if canvas, ok := enc.Image.(*VncCanvas); ok {
+		canvas.SetCursor(enc.cursor(rect))
+	}
 	return nil
 }
 
+// cursor returns the cursor shape, nil for an empty one. Bitmap bits
+// select the primary color and mask bits the visible pixels.
+func (enc *XCursorPseudoEncoding) cursor(rect *Rectangle) *Cursor {
+	if rect.Width == 0 || rect.Height == 0 {
+		return nil
+	}
+	primary := color.NRGBA{R: enc.PrimaryR, G: enc.PrimaryG, B: enc.PrimaryB, A: 0xff}
+	secondary := color.NRGBA{R: enc.SecondaryR, G: enc.SecondaryG, B: enc.SecondaryB, A: 0xff}
+	scanLine := (int(rect.Width) + 7) / 8
+	cursor := NewCursor(int(rect.Width), int(rect.Height), image.Point{int(rect.X), int(rect.Y)})
+	for y := 0; y < int(rect.Height); y++ {
+		for x := 0; x < int(rect.Width); x++ {
+			bit := byte(1 << uint(7-x%8))
+			if enc.Bitmask[y*scanLine+x/8]&bit == 0 {
+				continue
+			}
+			if enc.Bitmap[y*scanLine+x/8]&bit != 0 {
+				cursor.Image.SetNRGBA(x, y, primary)
+			} else {
+				cursor.Image.SetNRGBA(x, y, secondary)
+			}
+		}
+	}
+	return cursor
+}
+
 func (enc *XCursorPseudoEncoding) Write(c Conn, rect *Rectangle) error {
 	if err := binary.Write(c, binary.BigEndian, enc.PrimaryR); err != nil {
 		return err
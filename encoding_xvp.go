@@ -0,0 +1,24 @@
+package vnc2video
+
+// XvpPseudoEncoding announces support for xvp power control. The server
+// never sends it as a rectangle, it replies with a xvp init message
+// instead, and only when ServerConfig.Xvp is set.
+type XvpPseudoEncoding struct{}
+
+func (*XvpPseudoEncoding) Supported(Conn) bool {
+	return true
+}
+
+func (*XvpPseudoEncoding) Reset() error {
+	return nil
+}
+
+func (*XvpPseudoEncoding) Type() EncodingType { return EncXvpPseudo }
+
+func (*XvpPseudoEncoding) Read(c Conn, rect *Rectangle) error {
+	return nil
+}
+
+func (*XvpPseudoEncoding) Write(c Conn, rect *Rectangle) error {
+	return nil
+}
@@ -59,12 +59,11 @@ func (enc *ZLibEncoding) Read(r Conn, rect *Rectangle) error {
 		enc.unzipper, err = zlib.NewReader(bytesBuff)
 		enc.zippedBuff = bytesBuff
 		if err != nil {
+			enc.unzipper = nil
 			return err
 		}
 	} else {
 		enc.zippedBuff.Write(b)
 	}
-	DecodeRaw(enc.unzipper, &pf, rect, enc.Image)
-
-	return nil
+	return DecodeRaw(enc.unzipper, &pf, rect, enc.Image)
 }
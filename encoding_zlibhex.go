@@ -0,0 +1,102 @@
+package vnc2video
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+)
+
+// ZlibHex tile subencoding flags, added to the hextile ones
+const (
+	ZlibHexRaw = 32
+	ZlibHexHex = 64
+)
+
+// zlibStream is a zlib stream spread over several chunks of compressed
+// data, each one prefixed by its 16 bit length
+type zlibStream struct {
+	unzipper   io.Reader
+	zippedBuff *bytes.Buffer
+}
+
+// read appends the next chunk of compressed data to the stream and
+// returns the reader of the inflated data
+func (z *zlibStream) read(r Conn) (io.Reader, error) {
+	l, err := ReadUint16(r)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ReadBytes(int(l), r)
+	if err != nil {
+		return nil, err
+	}
+	if z.unzipper == nil {
+		z.zippedBuff = bytes.NewBuffer(b)
+		if z.unzipper, err = zlib.NewReader(z.zippedBuff); err != nil {
+			z.unzipper = nil
+			return nil, err
+		}
+	} else {
+		z.zippedBuff.Write(b)
+	}
+	return z.unzipper, nil
+}
+
+func (z *zlibStream) reset() {
+	z.unzipper = nil
+	z.zippedBuff = nil
+}
+
+// zlibHexStreams are the zlib streams of ZlibHex, one for raw tiles and
+// one for hextile coded tiles
+type zlibHexStreams struct {
+	raw zlibStream
+	hex zlibStream
+}
+
+// readRawTile reads a zlib compressed raw tile
+func (zs *zlibHexStreams) readRawTile(r Conn, pf *PixelFormat, img draw.Image, tile image.Rectangle) error {
+	zr, err := zs.raw.read(r)
+	if err != nil {
+		return err
+	}
+	rect := &Rectangle{X: uint16(tile.Min.X), Y: uint16(tile.Min.Y), Width: uint16(tile.Dx()), Height: uint16(tile.Dy())}
+	if err := DecodeRaw(zr, pf, rect, img); err != nil {
+		return fmt.Errorf("ZlibHex raw tile: %v", err)
+	}
+	return nil
+}
+
+// ZlibHexEncoding is hextile with zlib compressed tiles
+type ZlibHexEncoding struct {
+	Image   draw.Image
+	streams zlibHexStreams
+}
+
+func (*ZlibHexEncoding) Supported(Conn) bool {
+	return true
+}
+
+func (enc *ZlibHexEncoding) SetTargetImage(img draw.Image) {
+	enc.Image = img
+}
+
+func (enc *ZlibHexEncoding) Reset() error {
+	enc.streams.raw.reset()
+	enc.streams.hex.reset()
+	return nil
+}
+
+func (*ZlibHexEncoding) Type() EncodingType { return EncZlibHex }
+
+func (enc *ZlibHexEncoding) Write(c Conn, rect *Rectangle) error {
+	return nil
+}
+
+func (enc *ZlibHexEncoding) Read(r Conn, rect *Rectangle) error {
+	connLogger(r).Tracef("reading ZlibHex:%v", rect)
+	return readHextile(r, rect, enc.Image, &enc.streams)
+}
@@ -0,0 +1,28 @@
+package vnc2video
+
+import (
+	"image"
+	"testing"
+)
+
+func TestZlibHexRead(t *testing.T) {
+	// a 40x20 rect and a 40x16 rect below it, the second continues the
+	// raw and hex zlib streams of the first. Small tiles are plain
+	// hextile, the others zlib compressed raw or hextile data.
+	c, want := readReference(t, "zlibhex", "tiles")
+	canvas := image.NewRGBA(image.Rect(0, 0, 44, 40))
+	enc := &ZlibHexEncoding{}
+	enc.SetTargetImage(canvas)
+	for _, rect := range []*Rectangle{
+		{X: 2, Y: 1, Width: 40, Height: 20, EncType: EncZlibHex, Enc: enc},
+		{X: 2, Y: 21, Width: 40, Height: 16, EncType: EncZlibHex, Enc: enc},
+	} {
+		if err := enc.Read(c, rect); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkReference(t, "zlibhex", canvas, 2, 1, want)
+	if c.Len() != 0 {
+		t.Errorf("%d bytes left unread", c.Len())
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"compress/zlib"
 	"errors"
+	"fmt"
+	"image"
 	"image/color"
 	"image/draw"
 	"io"
@@ -57,7 +59,18 @@ func CalcBytesPerCPixel(pf *PixelFormat) int {
 }
 
 func (enc *ZRLEEncoding) Read(r Conn, rect *Rectangle) error {
-	logger.Tracef("reading ZRLE:%v\n", rect)
+	connLogger(r).Tracef("reading ZRLE:%v\n", rect)
+	if err := enc.readZlibData(r); err != nil {
+		return err
+	}
+	pf := r.PixelFormat()
+	// an error leaves the inflated data of the rect partly read, out of
+	// sync with the server's zlib stream, so it can't be recovered from
+	return enc.renderZRLE(r, rect, &pf)
+}
+
+// readZlibData appends the zlib data of a rect to the zlib stream
+func (enc *ZRLEEncoding) readZlibData(r Conn) error {
 	len, err := ReadUint32(r)
 	if err != nil {
 		return err
@@ -74,46 +87,63 @@ func (enc *ZRLEEncoding) Read(r Conn, rect *Rectangle) error {
 		enc.unzipper, err = zlib.NewReader(bytesBuff)
 		enc.zippedBuff = bytesBuff
 		if err != nil {
+			enc.unzipper = nil
 			return err
 		}
 	} else {
 		enc.zippedBuff.Write(b)
 	}
-	pf := r.PixelFormat()
-	enc.renderZRLE(rect, &pf)
-
 	return nil
 }
 
-func (enc *ZRLEEncoding) readZRLERaw(reader io.Reader, pf *PixelFormat, tx, ty, tw, th int) error {
+func (enc *ZRLEEncoding) renderZRLE(c Conn, rect *Rectangle, pf *PixelFormat) error {
+	tiles := &rleTiles{r: enc.unzipper, log: connLogger(c), img: enc.Image, pf: pf, tileSize: 64}
+	return tiles.render(rect)
+}
+
+// rleTiles decodes the tiles of ZRLE, TRLE and ZYWRLE rects from r into
+// img. TRLE tiles may reuse the palette of the previous tile.
+type rleTiles struct {
+	r        io.Reader
+	log      logger.Logger
+	img      draw.Image
+	pf       *PixelFormat
+	tileSize int
+	trle     bool
+	palette  []*color.RGBA
+	// tileDone is called with the bounds of every tile decoded, if set
+	tileDone func(tile image.Rectangle)
+}
+
+func (t *rleTiles) readRaw(tx, ty, tw, th int) error {
 	for y := 0; y < int(th); y++ {
 		for x := 0; x < int(tw); x++ {
-			col, err := readCPixel(reader, pf)
+			col, err := readCPixel(t.r, t.pf)
 			if err != nil {
 				return err
 			}
 
-			enc.Image.Set(tx+x, ty+y, col)
+			t.img.Set(tx+x, ty+y, col)
 		}
 	}
 
 	return nil
 }
 
-func (enc *ZRLEEncoding) renderZRLE(rect *Rectangle, pf *PixelFormat) error {
-	logger.Trace("-----renderZRLE: rendering rect:", rect)
-	for tileOffsetY := 0; tileOffsetY < int(rect.Height); tileOffsetY += 64 {
+func (t *rleTiles) render(rect *Rectangle) error {
+	t.log.Trace("-----renderZRLE: rendering rect:", rect)
+	for tileOffsetY := 0; tileOffsetY < int(rect.Height); tileOffsetY += t.tileSize {
 
-		tileHeight := Min(64, int(rect.Height)-tileOffsetY)
+		tileHeight := Min(t.tileSize, int(rect.Height)-tileOffsetY)
 
-		for tileOffsetX := 0; tileOffsetX < int(rect.Width); tileOffsetX += 64 {
+		for tileOffsetX := 0; tileOffsetX < int(rect.Width); tileOffsetX += t.tileSize {
 
-			tileWidth := Min(64, int(rect.Width)-tileOffsetX)
+			tileWidth := Min(t.tileSize, int(rect.Width)-tileOffsetX)
 			// read subencoding
-			subEnc, err := ReadUint8(enc.unzipper)
-			logger.Tracef("-----renderZRLE: rendering got tile:(%d,%d) w:%d, h:%d subEnc:%d", tileOffsetX, tileOffsetY, tileWidth, tileHeight, subEnc)
+			subEnc, err := ReadUint8(t.r)
+			t.log.Tracef("-----renderZRLE: rendering got tile:(%d,%d) w:%d, h:%d subEnc:%d", tileOffsetX, tileOffsetY, tileWidth, tileHeight, subEnc)
 			if err != nil {
-				logger.Errorf("renderZRLE: error while reading subencoding: %v", err)
+				t.log.Errorf("renderZRLE: error while reading subencoding: %v", err)
 				return err
 			}
 
@@ -121,57 +151,83 @@ func (enc *ZRLEEncoding) renderZRLE(rect *Rectangle, pf *PixelFormat) error {
 
 			case subEnc == 0:
 				// Raw subencoding: read cpixels and paint
-				err = enc.readZRLERaw(enc.unzipper, pf, int(rect.X)+tileOffsetX, int(rect.Y)+tileOffsetY, tileWidth, tileHeight)
+				err = t.readRaw(int(rect.X)+tileOffsetX, int(rect.Y)+tileOffsetY, tileWidth, tileHeight)
 				if err != nil {
-					logger.Errorf("renderZRLE: error while reading Raw tile: %v", err)
+					t.log.Errorf("renderZRLE: error while reading Raw tile: %v", err)
 					return err
 				}
 			case subEnc == 1:
 				// background color tile - just fill
-				color, err := readCPixel(enc.unzipper, pf)
+				color, err := readCPixel(t.r, t.pf)
 				if err != nil {
-					logger.Errorf("renderZRLE: error while reading CPixel for bgColor tile: %v", err)
+					t.log.Errorf("renderZRLE: error while reading CPixel for bgColor tile: %v", err)
 					return err
 				}
 				myRect := MakeRect(int(rect.X)+tileOffsetX, int(rect.Y)+tileOffsetY, tileWidth, tileHeight)
-				FillRect(enc.Image, &myRect, color)
+				FillRect(t.img, &myRect, color)
 			case subEnc >= 2 && subEnc <= 16:
-				err = enc.handlePaletteTile(tileOffsetX, tileOffsetY, tileWidth, tileHeight, subEnc, pf, rect)
+				if err = t.readPalette(int(subEnc)); err != nil {
+					return err
+				}
+				err = t.handlePaletteTile(tileOffsetX, tileOffsetY, tileWidth, tileHeight, rect)
+				if err != nil {
+					return err
+				}
+			case subEnc == 127 && t.trle:
+				// packed palette tile reusing the previous palette
+				err = t.handlePaletteTile(tileOffsetX, tileOffsetY, tileWidth, tileHeight, rect)
 				if err != nil {
 					return err
 				}
 			case subEnc == 128:
-				err = enc.handlePlainRLETile(tileOffsetX, tileOffsetY, tileWidth, tileHeight, pf, rect)
+				err = t.handlePlainRLETile(tileOffsetX, tileOffsetY, tileWidth, tileHeight, rect)
+				if err != nil {
+					return err
+				}
+			case subEnc == 129 && t.trle:
+				// palette RLE tile reusing the previous palette
+				err = t.handlePaletteRLETile(tileOffsetX, tileOffsetY, tileWidth, tileHeight, rect)
 				if err != nil {
 					return err
 				}
 			case subEnc >= 130 && subEnc <= 255:
-				err = enc.handlePaletteRLETile(tileOffsetX, tileOffsetY, tileWidth, tileHeight, subEnc, pf, rect)
+				if err = t.readPalette(int(subEnc) - 128); err != nil {
+					return err
+				}
+				err = t.handlePaletteRLETile(tileOffsetX, tileOffsetY, tileWidth, tileHeight, rect)
 				if err != nil {
 					return err
 				}
 			default:
-				logger.Errorf("Unknown ZRLE subencoding: %v", subEnc)
+				return fmt.Errorf("unknown ZRLE subencoding: %v", subEnc)
+			}
+			if t.tileDone != nil {
+				t.tileDone(MakeRect(int(rect.X)+tileOffsetX, int(rect.Y)+tileOffsetY, tileWidth, tileHeight))
 			}
 		}
 	}
 	return nil
 }
 
-func (enc *ZRLEEncoding) handlePaletteRLETile(tileOffsetX, tileOffsetY, tileWidth, tileHeight int, subEnc uint8, pf *PixelFormat, rect *Rectangle) error {
-	// Palette RLE
-	paletteSize := subEnc - 128
+// readPalette reads the palette of a palette tile
+func (t *rleTiles) readPalette(paletteSize int) error {
 	palette := make([]*color.RGBA, paletteSize)
 	var err error
-
-	// Read RLE palette
-	for j := 0; j < int(paletteSize); j++ {
-		palette[j], err = readCPixel(enc.unzipper, pf)
+	for j := 0; j < paletteSize; j++ {
+		palette[j], err = readCPixel(t.r, t.pf)
 		if err != nil {
-			logger.Errorf("renderZRLE: error while reading color in palette RLE subencoding: %v", err)
+			t.log.Errorf("renderZRLE: error while reading color in palette subencoding: %v", err)
 			return err
 		}
 	}
+	t.palette = palette
+	return nil
+}
+
+func (t *rleTiles) handlePaletteRLETile(tileOffsetX, tileOffsetY, tileWidth, tileHeight int, rect *Rectangle) error {
+	// Palette RLE
+	palette := t.palette
+	var err error
 	var index uint8
 	runLen := 0
 	for y := 0; y < tileHeight; y++ {
@@ -180,10 +236,10 @@ func (enc *ZRLEEncoding) handlePaletteRLETile(tileOffsetX, tileOffsetY, tileWidt
 			if runLen == 0 {
 
 				// Read length and index
-				index, err = ReadUint8(enc.unzipper)
+				index, err = ReadUint8(t.r)
 				if err != nil {
-					logger.Errorf("renderZRLE: error while reading length and index in palette RLE subencoding: %v", err)
-					//return err
+					t.log.Errorf("renderZRLE: error while reading length and index in palette RLE subencoding: %v", err)
+					return err
 				}
 				runLen = 1
 
@@ -193,9 +249,9 @@ func (enc *ZRLEEncoding) handlePaletteRLETile(tileOffsetX, tileOffsetY, tileWidt
 
 					index -= 128
 
-					runLen, err = readRunLength(enc.unzipper)
+					runLen, err = readRunLength(t.r)
 					if err != nil {
-						logger.Errorf("handlePlainRLETile: error while reading runlength in plain RLE subencoding: %v", err)
+						t.log.Errorf("handlePlainRLETile: error while reading runlength in plain RLE subencoding: %v", err)
 						return err
 					}
 
@@ -203,27 +259,24 @@ func (enc *ZRLEEncoding) handlePaletteRLETile(tileOffsetX, tileOffsetY, tileWidt
 				//logger.Tracef("renderZRLE: writing pixel: col=%v times=%d", palette[index], runLen)
 			}
 
+			if int(index) >= len(palette) {
+				return fmt.Errorf("ZRLE palette index %d out of range %d", index, len(palette))
+			}
 			// Write pixel to image
-			enc.Image.Set(tileOffsetX+int(rect.X)+x, tileOffsetY+int(rect.Y)+y, palette[index])
+			t.img.Set(tileOffsetX+int(rect.X)+x, tileOffsetY+int(rect.Y)+y, palette[index])
 			runLen--
 		}
 	}
 	return nil
 }
 
-func (enc *ZRLEEncoding) handlePaletteTile(tileOffsetX, tileOffsetY, tileWidth, tileHeight int, subEnc uint8, pf *PixelFormat, rect *Rectangle) error {
-	//subenc here is also palette size
-	paletteSize := subEnc
-	palette := make([]*color.RGBA, paletteSize)
-	var err error
-	// Read palette
-	for j := 0; j < int(paletteSize); j++ {
-		palette[j], err = readCPixel(enc.unzipper, pf)
-		if err != nil {
-			logger.Errorf("renderZRLE: error while reading CPixel for palette tile: %v", err)
-			return err
-		}
+func (t *rleTiles) handlePaletteTile(tileOffsetX, tileOffsetY, tileWidth, tileHeight int, rect *Rectangle) error {
+	palette := t.palette
+	paletteSize := len(palette)
+	if paletteSize < 2 {
+		return fmt.Errorf("ZRLE packed palette of %d colors", paletteSize)
 	}
+	var err error
 	// Calculate index size
 	var indexBits, mask uint32
 	if paletteSize == 2 {
@@ -246,9 +299,9 @@ func (enc *ZRLEEncoding) handlePaletteTile(tileOffsetX, tileOffsetY, tileWidth,
 
 			// Buffer more bits if necessary
 			if bitsAvailable == 0 {
-				bits, err := ReadUint8(enc.unzipper)
+				bits, err := ReadUint8(t.r)
 				if err != nil {
-					logger.Errorf("renderZRLE: error while reading first uint8 into buffer: %v", err)
+					t.log.Errorf("renderZRLE: error while reading first uint8 into buffer: %v", err)
 					return err
 				}
 				buffer = uint32(bits)
@@ -259,15 +312,18 @@ func (enc *ZRLEEncoding) handlePaletteTile(tileOffsetX, tileOffsetY, tileWidth,
 			index := (buffer & mask) >> (8 - indexBits)
 			buffer <<= indexBits
 			bitsAvailable -= indexBits
+			if int(index) >= len(palette) {
+				return fmt.Errorf("ZRLE palette index %d out of range %d", index, len(palette))
+			}
 
 			// Write pixel to image
-			enc.Image.Set(tileOffsetX+int(rect.X)+x, tileOffsetY+int(rect.Y)+y, palette[index])
+			t.img.Set(tileOffsetX+int(rect.X)+x, tileOffsetY+int(rect.Y)+y, palette[index])
 		}
 	}
 	return err
 }
 
-func (enc *ZRLEEncoding) handlePlainRLETile(tileOffsetX int, tileOffsetY int, tileWidth int, tileHeight int, pf *PixelFormat, rect *Rectangle) error {
+func (t *rleTiles) handlePlainRLETile(tileOffsetX int, tileOffsetY int, tileWidth int, tileHeight int, rect *Rectangle) error {
 	var col *color.RGBA
 	var err error
 	runLen := 0
@@ -277,21 +333,21 @@ func (enc *ZRLEEncoding) handlePlainRLETile(tileOffsetX int, tileOffsetY int, ti
 			if runLen == 0 {
 
 				// Read length and color
-				col, err = readCPixel(enc.unzipper, pf)
+				col, err = readCPixel(t.r, t.pf)
 				if err != nil {
-					logger.Errorf("handlePlainRLETile: error while reading CPixel in plain RLE subencoding: %v", err)
+					t.log.Errorf("handlePlainRLETile: error while reading CPixel in plain RLE subencoding: %v", err)
 					return err
 				}
-				runLen, err = readRunLength(enc.unzipper)
+				runLen, err = readRunLength(t.r)
 				if err != nil {
-					logger.Errorf("handlePlainRLETile: error while reading runlength in plain RLE subencoding: %v", err)
+					t.log.Errorf("handlePlainRLETile: error while reading runlength in plain RLE subencoding: %v", err)
 					return err
 				}
 
 			}
 
 			// Write pixel to image
-			enc.Image.Set(tileOffsetX+int(rect.X)+x, tileOffsetY+int(rect.Y)+y, col)
+			t.img.Set(tileOffsetX+int(rect.X)+x, tileOffsetY+int(rect.Y)+y, col)
 			runLen--
 		}
 	}
@@ -303,7 +359,6 @@ func readRunLength(r io.Reader) (int, error) {
 
 	addition, err := ReadUint8(r)
 	if err != nil {
-		logger.Errorf("renderZRLE: error while reading addition to runLen in plain RLE subencoding: %v", err)
 		return 0, err
 	}
 	runLen += int(addition)
@@ -311,7 +366,6 @@ func readRunLength(r io.Reader) (int, error) {
 	for addition == 255 {
 		addition, err = ReadUint8(r)
 		if err != nil {
-			logger.Errorf("renderZRLE: error while reading addition to runLen in-loop plain RLE subencoding: %v", err)
 			return 0, err
 		}
 		runLen += int(addition)
@@ -353,7 +407,7 @@ func readCPixel(c io.Reader, pf *PixelFormat) (*color.RGBA, error) {
 
 	col, err := ReadColor(c, pf)
 	if err != nil {
-		logger.Errorf("readCPixel: Error while reading zrle: %v", err)
+		return nil, err
 	}
 
 	return col, nil
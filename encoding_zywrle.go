@@ -0,0 +1,179 @@
+package vnc2video
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math/bits"
+)
+
+// ZYWRLEEncoding is ZRLE with tiles carrying the coefficients of a lossy
+// wavelet transform of the pixels in the YUV color space
+type ZYWRLEEncoding struct {
+	ZRLEEncoding
+	// Level is the number of wavelet levels, between 1 and 3. When not set it
+	// follows the JPEG quality asked from the server, as the server does.
+	Level int
+}
+
+func (*ZYWRLEEncoding) Type() EncodingType { return EncZYWRLE }
+
+func (enc *ZYWRLEEncoding) Read(r Conn, rect *Rectangle) error {
+	connLogger(r).Tracef("reading ZYWRLE:%v\n", rect)
+	if err := enc.readZlibData(r); err != nil {
+		return err
+	}
+	pf := r.PixelFormat()
+	level := enc.level(r)
+	tiles := &rleTiles{r: enc.unzipper, log: connLogger(r), img: enc.Image, pf: &pf, tileSize: 64}
+	tiles.tileDone = func(tile image.Rectangle) {
+		zywrleSynthesize(enc.Image, tile, level, &pf)
+	}
+	return tiles.render(rect)
+}
+
+// level returns the wavelet level, the server picks it from the JPEG
+// quality level it was sent
+func (enc *ZYWRLEEncoding) level(r Conn) int {
+	if enc.Level > 0 {
+		return enc.Level
+	}
+	cc, ok := r.(*ClientConn)
+	if !ok {
+		return 1
+	}
+	q := int(cc.Quality().JPEGQuality) - 1
+	switch {
+	case q < 0:
+		return 1
+	case q < 3:
+		return 3
+	case q < 6:
+		return 2
+	}
+	return 1
+}
+
+// zywrleShift returns the shift scaling a color component of pf to 8 bits
+func zywrleShift(max uint16) uint {
+	n := bits.Len16(max)
+	if n >= 8 {
+		return 0
+	}
+	return uint(8 - n)
+}
+
+// zywrleHarr is the Harr wavelet step on a pair of signed coefficients, it
+// is its own inverse
+func zywrleHarr(x0, x1 *int8) {
+	X0, X1 := int(*x0), int(*x1)
+	orgX0, orgX1 := X0, X1
+	if (X0^X1)&0x80 != 0 {
+		X1 += X0
+		if (X1^orgX1)&0x80 == 0 {
+			X0 -= X1
+		}
+	} else {
+		X0 -= X1
+		if (X0^orgX0)&0x80 == 0 {
+			X1 += X0
+		}
+	}
+	*x0 = int8(X1)
+	*x1 = int8(X0)
+}
+
+// zywrleWaveletLevel runs the level l Harr steps on the size coefficients
+// starting at pos, skip coefficients apart
+func zywrleWaveletLevel(buf [][3]int8, pos, size, l, skip int) {
+	step := (2 << uint(l)) * skip
+	ofs := (1 << uint(l)) * skip
+	for n := 0; n < size>>uint(l+1); n++ {
+		p := pos + n*step
+		for ch := 0; ch < 3; ch++ {
+			zywrleHarr(&buf[p][ch], &buf[p+ofs][ch])
+		}
+	}
+}
+
+// zywrleInvWavelet reverts the wavelet transform of a w x h buffer
+func zywrleInvWavelet(buf [][3]int8, w, h, level int) {
+	for l := level - 1; l >= 0; l-- {
+		s := 1 << uint(l)
+		for x := 0; x < w; x += s {
+			zywrleWaveletLevel(buf, x, h, l, w)
+		}
+		for y := 0; y < h; y += s {
+			zywrleWaveletLevel(buf, y*w, w, l, 1)
+		}
+	}
+}
+
+// zywrleCoeffOrder returns the buffer positions of the coefficients of a
+// w x h buffer in the order they are sent, subband by subband
+func zywrleCoeffOrder(w, h, level int) []int {
+	order := make([]int, 0, w*h)
+	for l := 0; l < level; l++ {
+		s := 2 << uint(l)
+		for t := 3; t >= 0; t-- {
+			if t == 0 && l != level-1 {
+				continue
+			}
+			start := 0
+			if t&1 != 0 {
+				start += s >> 1
+			}
+			if t&2 != 0 {
+				start += (s >> 1) * w
+			}
+			for y := 0; start+y*w < w*h; y += s {
+				for x := 0; x < w-start%w; x += s {
+					order = append(order, start+y*w+x)
+				}
+			}
+		}
+	}
+	return order
+}
+
+// zywrleSynthesize turns the coefficients decoded into a tile of img back
+// into pixels. Only the part of the tile aligned to the wavelet size is
+// transformed, the rest holds plain pixels.
+func zywrleSynthesize(img draw.Image, tile image.Rectangle, level int, pf *PixelFormat) {
+	mask := (1 << uint(level)) - 1
+	w, h := tile.Dx()&^mask, tile.Dy()&^mask
+	if w == 0 || h == 0 {
+		return
+	}
+	rs, gs, bs := zywrleShift(pf.RedMax), zywrleShift(pf.GreenMax), zywrleShift(pf.BlueMax)
+
+	buf := make([][3]int8, w*h)
+	for k, pos := range zywrleCoeffOrder(w, h, level) {
+		c := color.RGBAModel.Convert(img.At(tile.Min.X+k%w, tile.Min.Y+k/w)).(color.RGBA)
+		// the red, green and blue bytes carry V, Y and U
+		buf[pos] = [3]int8{int8(c.R << rs), int8(c.G << gs), int8(c.B << bs)}
+	}
+	zywrleInvWavelet(buf, w, h, level)
+
+	for k, px := range buf {
+		x, y := tile.Min.X+k%w, tile.Min.Y+k/w
+		a := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA).A
+		Y := int(px[1]) + 128
+		U := int(px[2]) << 1
+		V := int(px[0]) << 1
+		G := Y - ((U + V) >> 2)
+		B := U + G
+		R := V + G
+		img.Set(x, y, color.RGBA{R: clampByte(R) >> rs, G: clampByte(G) >> gs, B: clampByte(B) >> bs, A: a})
+	}
+}
+
+func clampByte(v int) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
@@ -0,0 +1,25 @@
+package vnc2video
+
+import (
+	"fmt"
+	"image"
+	"testing"
+)
+
+func TestZYWRLERead(t *testing.T) {
+	for level := 1; level <= 3; level++ {
+		// a 70x37 rect of a 64x37 tile and a 6x37 one, the parts of the
+		// tiles not aligned to the wavelet size hold plain pixels. The
+		// expected pixels are the ones libvncclient's synthesis gives.
+		name := fmt.Sprintf("level%d", level)
+		c, want := readReference(t, "zywrle", name)
+		canvas := image.NewRGBA(image.Rect(0, 0, 74, 41))
+		enc := &ZYWRLEEncoding{Level: level}
+		enc.SetTargetImage(canvas)
+		rect := &Rectangle{X: 2, Y: 3, Width: 70, Height: 37, EncType: EncZYWRLE, Enc: enc}
+		if err := enc.Read(c, rect); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		checkReference(t, "zywrle "+name, canvas, 2, 3, want)
+	}
+}
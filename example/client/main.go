@@ -38,21 +38,29 @@ func main() {
 			&vnc.ClientAuthVNC{Password: []byte("12345")},
 			&vnc.ClientAuthNone{},
 		},
-		DrawCursor:      true,
-		PixelFormat:     vnc.PixelFormat32bit,
-		ClientMessageCh: cchClient,
-		ServerMessageCh: cchServer,
-		Messages:        vnc.DefaultServerMessages,
+		DrawCursor:        true,
+		ContinuousUpdates: true,
+		AutoUpdates:       true,
+		UpdateFPS:         framerate,
+		Quality:           vnc.QualityOptions{JPEGQuality: 9, Compression: 7},
+		PixelFormat:       vnc.PixelFormat32bit,
+		ClientMessageCh:   cchClient,
+		ServerMessageCh:   cchServer,
+		Messages:          vnc.DefaultServerMessages,
 		Encodings: []vnc.Encoding{
 			&vnc.RawEncoding{},
 			&vnc.TightEncoding{},
 			&vnc.HextileEncoding{},
 			&vnc.ZRLEEncoding{},
 			&vnc.CopyRectEncoding{},
+			&vnc.CursorWithAlphaPseudoEncoding{},
 			&vnc.CursorPseudoEncoding{},
 			&vnc.CursorPosPseudoEncoding{},
 			&vnc.ZLibEncoding{},
 			&vnc.RREEncoding{},
+			&vnc.ContinuousUpdatesPseudoEncoding{},
+			&vnc.FencePseudoEncoding{},
+			&vnc.LastRectPseudoEncoding{},
 		},
 		ErrorCh: errorCh,
 	}
@@ -85,6 +93,7 @@ func main() {
 	//vcodec.Run("./output")
 
 	//screenImage := vnc.NewVncCanvas(int(cc.Width()), int(cc.Height()))
+	screenImage.AddOverlay(vnc.NewStampOverlay(cc, os.Getenv("USER")))
 
 	for _, enc := range ccfg.Encodings {
 		myRenderer, ok := enc.(vnc.Renderer)
@@ -99,11 +108,15 @@ func main() {
 	defer cc.Close()
 
 	cc.SetEncodings([]vnc.EncodingType{
+		vnc.EncCursorWithAlphaPseudo,
 		vnc.EncCursorPseudo,
 		vnc.EncPointerPosPseudo,
 		vnc.EncCopyRect,
 		vnc.EncTight,
 		vnc.EncZRLE,
+		vnc.EncContinuousUpdatesPseudo,
+		vnc.EncFencePseudo,
+		vnc.EncLastRectPseudo,
 		//vnc.EncHextile,
 		//vnc.EncZlib,
 		//vnc.EncRRE,
@@ -116,7 +129,7 @@ func main() {
 		for {
 			timeStart := time.Now()
 
-			vcodec.Encode(screenImage.Image)
+			vcodec.Encode(screenImage.Frame())
 
 			timeTarget := timeStart.Add((1000 / time.Duration(framerate)) * time.Millisecond)
 			timeLeft := timeTarget.Sub(time.Now())
@@ -168,10 +181,6 @@ func main() {
 				//jpeg.Encode(out, screenImage, nil)
 				///vcodec.Encode(screenImage)
 				logger.Infof("reqs=%d, seconds=%f, Req Per second= %f", frameBufferReq, secsPassed, reqPerSec)
-
-				reqMsg := vnc.FramebufferUpdateRequest{Inc: 1, X: 0, Y: 0, Width: cc.Width(), Height: cc.Height()}
-				//cc.ResetAllEncodings()
-				reqMsg.Write(cc)
 			}
 		case signal := <-sigc:
 			if signal != nil {
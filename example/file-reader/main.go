@@ -18,10 +18,26 @@ func main() {
 		logger.Errorf("please provide a fbs file name")
 		return
 	}
-	if _, err := os.Stat(os.Args[1]); os.IsNotExist(err) {
+	info, err := os.Stat(os.Args[1])
+	if os.IsNotExist(err) {
 		logger.Errorf("File doesn't exist", err)
 		return
 	}
+	// the recording start time stamped on the frames, unless given in RFC
+	// 3339 format it is the file modification time, when the recording
+	// ended, less the length of the recording
+	duration, err := vnc.FbsDuration(os.Args[1])
+	if err != nil {
+		logger.Errorf("failed to read the fbs file: %v", err)
+		return
+	}
+	recordingStart := info.ModTime().Add(-duration)
+	if len(os.Args) > 2 {
+		if recordingStart, err = time.Parse(time.RFC3339, os.Args[2]); err != nil {
+			logger.Errorf("bad recording start time: %v", err)
+			return
+		}
+	}
 	encs := []vnc.Encoding{
 		&vnc.RawEncoding{},
 		&vnc.TightEncoding{},
@@ -49,6 +65,7 @@ func main() {
 	//screenImage := image.NewRGBA(image.Rect(0, 0, int(fbs.Width()), int(fbs.Height())))
 	screenImage := vnc.NewVncCanvas(int(fbs.Width()), int(fbs.Height()))
 	screenImage.DrawCursor = false
+	screenImage.AddOverlay(vnc.NewStampOverlay(fbs, os.Getenv("USER")))
 
 	for _, enc := range encs {
 		myRenderer, ok := enc.(vnc.Renderer)
@@ -66,7 +83,7 @@ func main() {
 		for {
 			timeStart := time.Now()
 
-			vcodec.Encode(screenImage.Image)
+			vcodec.Encode(screenImage.FrameAt(fbs.FrameTime(recordingStart)))
 			timeTarget := timeStart.Add(frameDuration)
 			timeLeft := timeTarget.Sub(time.Now())
 			//.Add(1 * time.Millisecond)
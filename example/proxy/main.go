@@ -170,10 +170,42 @@ func (auth *AuthVNCHTTP) Auth(c vnc.Conn) error {
 
 	v := url.Values{}
 	v.Set("hash", buf.String())
-	buf.Reset()
+	return directoryAuth(auth.c, c, v)
+}
+
+func (*AuthVNCHTTP) Type() vnc.SecurityType {
+	return vnc.SecTypeVNC
+}
+
+func (*AuthVNCHTTP) SubType() vnc.SecuritySubType {
+	return vnc.SecSubTypeUnknown
+}
+
+// AuthMSLogonHTTP accepts UltraVNC MS-Logon II clients, their credentials
+// are checked by the same directory as the AuthVNCHTTP hashes
+type AuthMSLogonHTTP struct {
+	c *http.Client
+	vnc.ServerAuthMSLogonII
+}
+
+func (auth *AuthMSLogonHTTP) Auth(c vnc.Conn) error {
+	username, password, err := auth.ServerAuthMSLogonII.ReadCredentials(c)
+	if err != nil {
+		return err
+	}
+	v := url.Values{}
+	v.Set("username", string(username))
+	v.Set("password", string(password))
+	return directoryAuth(auth.c, c, v)
+}
+
+// directoryAuth posts the client credentials in v to the directory, which
+// answers with the host to proxy to and its password
+func directoryAuth(client *http.Client, c vnc.Conn, v url.Values) error {
+	buf := new(bytes.Buffer)
 	src, _, _ := net.SplitHostPort(c.Conn().RemoteAddr().String())
 	v.Set("ip", src)
-	res, err := auth.c.PostForm("https://api.ix.clodo.ru/system/vnc", v)
+	res, err := client.PostForm("https://api.ix.clodo.ru/system/vnc", v)
 	if err != nil {
 		return err
 	}
@@ -213,14 +245,6 @@ func (auth *AuthVNCHTTP) Auth(c vnc.Conn) error {
 	return nil
 }
 
-func (*AuthVNCHTTP) Type() vnc.SecurityType {
-	return vnc.SecTypeVNC
-}
-
-func (*AuthVNCHTTP) SubType() vnc.SecuritySubType {
-	return vnc.SecSubTypeUnknown
-}
-
 func main() {
 	go func() {
 		logger.Info(http.ListenAndServe(":6060", nil))
@@ -237,6 +261,7 @@ func main() {
 	scfg := &vnc.ServerConfig{
 		SecurityHandlers: []vnc.SecurityHandler{
 			&AuthVNCHTTP{c: &http.Client{}},
+			&AuthMSLogonHTTP{c: &http.Client{}},
 		},
 		Encodings: []vnc.Encoding{
 			//		&vnc.TightPngEncoding{},
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"github.com/amitbet/vnc2video/recorder"
+	"github.com/amitbet/vnc2video/logger"
+)
+
+// a recording service, e.g.:
+//
+//	export RECORDER_TOKEN=<token>
+//	curl -H "Authorization: Bearer $RECORDER_TOKEN" -d '{"host": "10.0.0.5:5900", "password": "12345", "format": "x264"}' localhost:8080/sessions
+//	curl -H "Authorization: Bearer $RECORDER_TOKEN" localhost:8080/sessions?state=recording
+//	curl -H "Authorization: Bearer $RECORDER_TOKEN" -X POST localhost:8080/sessions/<id>/stop
+//	curl -H "Authorization: Bearer $RECORDER_TOKEN" -O -J localhost:8080/sessions/<id>/file
+//
+// The API takes the token of RECORDER_TOKEN, a random one is logged at
+// start when it is not set. It listens on localhost unless -listen says
+// otherwise: serve it over TLS, e.g. behind a reverse proxy, when it is
+// reached from other hosts.
+//
+// -rules names a JSON file of recording rules and retention, e.g.:
+//
+//	{
+//		"rules": [{"name": "office", "session": {"host": "10.0.0.5:5900", "password": "12345", "idle_seconds": 60},
+//			"windows": [{"from": "09:00", "to": "17:00", "days": ["mon", "tue", "wed", "thu", "fri"]}]}],
+//		"retention": {"max_age_days": 30, "max_bytes_per_host": 10000000000, "compact_after_days": 7}
+//	}
+func main() {
+	listen := flag.String("listen", "localhost:8080", "address of the HTTP API")
+	dir := flag.String("dir", "./recordings", "directory of the recordings")
+	ffmpeg := flag.String("ffmpeg", "", "ffmpeg binary, looked up in PATH by default")
+	rules := flag.String("rules", "", "JSON file of recording rules and retention")
+	sshKeys := flag.String("ssh-keys", "", "comma separated private key files of the SSH tunnels")
+	knownHosts := flag.String("known-hosts", "", "comma separated known_hosts files of the SSH tunnels, ~/.ssh/known_hosts by default")
+	flag.Parse()
+
+	token := os.Getenv("RECORDER_TOKEN")
+	if token == "" {
+		random := make([]byte, 16)
+		if _, err := rand.Read(random); err != nil {
+			logger.Fatalf("can't make a token: %v", err)
+		}
+		token = hex.EncodeToString(random)
+		logger.Infof("API token: %s", token)
+	}
+	m, err := recorder.NewManager(recorder.Config{
+		Dir:                *dir,
+		FFMpegBinPath:      *ffmpeg,
+		SSHKeyFiles:        fileList(*sshKeys),
+		SSHKnownHostsFiles: fileList(*knownHosts),
+	})
+	if err != nil {
+		logger.Fatalf("can't start the recorder: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	schedulerDone := make(chan struct{})
+	close(schedulerDone)
+	if *rules != "" {
+		data, err := ioutil.ReadFile(*rules)
+		if err != nil {
+			logger.Fatalf("can't read the rules: %v", err)
+		}
+		var cfg recorder.SchedulerConfig
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			logger.Fatalf("can't read the rules: %v", err)
+		}
+		scheduler, err := recorder.NewScheduler(m, cfg)
+		if err != nil {
+			logger.Fatalf("bad rules: %v", err)
+		}
+		schedulerDone = make(chan struct{})
+		go func() {
+			scheduler.Run(ctx)
+			close(schedulerDone)
+		}()
+	}
+
+	// the recordings are completed before exiting
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		cancel()
+		<-schedulerDone
+		m.Close()
+		os.Exit(0)
+	}()
+
+	logger.Infof("recorder listening on %s, storing to %s", *listen, *dir)
+	logger.Fatal(http.ListenAndServe(*listen, recorder.NewHandler(m, recorder.BearerToken(token))))
+}
+
+// fileList splits a comma separated list of files
+func fileList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
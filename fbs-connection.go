@@ -92,6 +92,12 @@ func (c *FbsConn) GetEncInstance(typ EncodingType) Encoding {
 	return nil
 }
 
+// FrameTime returns the time the current message was recorded at, for a
+// recording started at start
+func (c *FbsConn) FrameTime(start time.Time) time.Time {
+	return start.Add(time.Duration(c.CurrentTimestamp()) * time.Millisecond)
+}
+
 type VncStreamFileReader interface {
 	io.Reader
 	CurrentTimestamp() int
@@ -3,8 +3,10 @@ package vnc2video
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 	"os"
+	"time"
 	//"vncproxy/common"
 	//"vncproxy/encodings"
 	"github.com/amitbet/vnc2video/logger"
@@ -16,6 +18,7 @@ type FbsReader struct {
 	reader           io.ReadCloser
 	buffer           bytes.Buffer
 	currentTimestamp int
+	readCount        int64
 	//pixelFormat      *PixelFormat
 	//encodings        []IEncoding
 }
@@ -39,7 +42,13 @@ func (fbs *FbsReader) Read(p []byte) (n int, err error) {
 		fbs.buffer.Write(seg.bytes)
 		fbs.currentTimestamp = int(seg.timestamp)
 	}
-	return fbs.buffer.Read(p)
+	n, err = fbs.buffer.Read(p)
+	fbs.readCount += int64(n)
+	return n, err
+}
+
+func (fbs *FbsReader) bytesRead() int64 {
+	return fbs.readCount
 }
 
 //func (fbs *FbsReader) CurrentPixelFormat() *PixelFormat { return fbs.pixelFormat }
@@ -184,6 +193,39 @@ func (fbs *FbsReader) ReadSegment() (*FbsSegment, error) {
 	return seg, nil
 }
 
+// FbsDuration returns the timestamp of the last segment of an fbs file, the
+// time from the start to the end of the recording. A segment cut short at
+// the end of the file is ignored.
+func FbsDuration(fbsFile string) (time.Duration, error) {
+	f, err := os.Open(fbsFile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, err
+	}
+	if string(header[:4]) != "FBS " {
+		return 0, errors.New("not an fbs file")
+	}
+	var last uint32
+	for {
+		var length, stamp uint32
+		if err := binary.Read(f, binary.BigEndian, &length); err != nil {
+			break
+		}
+		if _, err := f.Seek(int64((length+3)&0x7FFFFFFC), io.SeekCurrent); err != nil {
+			return 0, err
+		}
+		if err := binary.Read(f, binary.BigEndian, &stamp); err != nil {
+			break
+		}
+		last = stamp
+	}
+	return time.Duration(last) * time.Millisecond, nil
+}
+
 type FbsSegment struct {
 	bytes     []byte
 	timestamp uint32
@@ -0,0 +1,52 @@
+package vnc2video
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFbsDuration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fbs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("FBS 001.000\n")
+	for _, seg := range []struct {
+		data  string
+		stamp uint32
+	}{{"RFB 003.008\n", 0}, {"abcde", 1500}, {"fghijklm", 2750}} {
+		binary.Write(buf, binary.BigEndian, uint32(len(seg.data)))
+		buf.WriteString(seg.data)
+		buf.Write(make([]byte, (4-len(seg.data)%4)%4))
+		binary.Write(buf, binary.BigEndian, seg.stamp)
+	}
+	// a segment cut short by the end of the recording
+	binary.Write(buf, binary.BigEndian, uint32(100))
+	buf.WriteString("no")
+	name := filepath.Join(dir, "test.fbs")
+	if err := ioutil.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := FbsDuration(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != 2750*time.Millisecond {
+		t.Errorf("duration is %v, want 2.75s", d)
+	}
+
+	if err := ioutil.WriteFile(name, []byte("RFB 003.008\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FbsDuration(name); err == nil {
+		t.Error("duration of a file which isn't fbs")
+	}
+}
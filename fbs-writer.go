@@ -0,0 +1,108 @@
+package vnc2video
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// fbsMaxSegment bounds the data held back to share a segment
+const fbsMaxSegment = 64 * 1024
+
+// FbsWriter records the server messages of a client connection in the FBS
+// format read by FbsReader: the "FBS 001.000\n" header, then segments of
+// data stamped with the milliseconds since the recording started. The
+// data read within the same millisecond shares a segment. Set it as
+// ClientConfig.FbsRecorder to record a session.
+type FbsWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	start   time.Time
+	pending []byte
+	stamp   uint32
+	err     error
+}
+
+// NewFbsWriter returns an FbsWriter writing to w
+func NewFbsWriter(w io.Writer) *FbsWriter {
+	return &FbsWriter{w: w, start: time.Now()}
+}
+
+// WriteStartSession writes the header and the server init of c, the
+// segments that follow are timed from now on
+func (f *FbsWriter) WriteStartSession(c Conn) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := io.WriteString(f.w, "FBS 001.000\n"); err != nil {
+		f.err = err
+		return err
+	}
+
+	// the security type is written the way protocol 3.3 does
+	name := c.DesktopName()
+	buf := &bytes.Buffer{}
+	buf.WriteString(ProtoVersion38)
+	binary.Write(buf, binary.BigEndian, uint32(SecTypeNone))
+	binary.Write(buf, binary.BigEndian, []uint16{c.Width(), c.Height()})
+	binary.Write(buf, binary.BigEndian, c.PixelFormat())
+	binary.Write(buf, binary.BigEndian, uint32(len(name)))
+	buf.Write(name)
+	f.start = time.Now()
+	f.pending, f.stamp = buf.Bytes(), 0
+	return f.flush()
+}
+
+// Write records p, it is held back until data read in a later
+// millisecond or Flush ends its segment
+func (f *FbsWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return 0, f.err
+	}
+	stamp := uint32(time.Since(f.start) / time.Millisecond)
+	if len(f.pending) > 0 && (stamp != f.stamp || len(f.pending)+len(p) > fbsMaxSegment) {
+		if err := f.flush(); err != nil {
+			return 0, err
+		}
+	}
+	if len(f.pending) == 0 {
+		f.stamp = stamp
+	}
+	f.pending = append(f.pending, p...)
+	return len(p), nil
+}
+
+// Flush writes the data held back
+func (f *FbsWriter) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	return f.flush()
+}
+
+// flush writes the pending data as a segment: its length, the data padded
+// to 4 bytes and its timestamp
+func (f *FbsWriter) flush() error {
+	if len(f.pending) == 0 {
+		return nil
+	}
+	seg := make([]byte, 4, 8+len(f.pending)+3)
+	binary.BigEndian.PutUint32(seg, uint32(len(f.pending)))
+	seg = append(seg, f.pending...)
+	for len(seg)%4 != 0 {
+		seg = append(seg, 0)
+	}
+	seg = append(seg, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(seg[len(seg)-4:], f.stamp)
+	f.pending = f.pending[:0]
+	if _, err := f.w.Write(seg); err != nil {
+		f.err = err
+		return err
+	}
+	return nil
+}
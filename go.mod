@@ -2,4 +2,7 @@ module github.com/amitbet/vnc2video
 
 go 1.12
 
-require github.com/icza/mjpeg v0.0.0-20170217094447-85dfbe473743
+require (
+	github.com/icza/mjpeg v0.0.0-20170217094447-85dfbe473743
+	golang.org/x/crypto v0.33.0
+)
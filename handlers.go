@@ -3,7 +3,6 @@ package vnc2video
 import (
 	"encoding/binary"
 	"fmt"
-	"github.com/amitbet/vnc2video/logger"
 )
 
 // Handler represents handler of handshake
@@ -44,11 +43,48 @@ func ParseProtoVersion(pv []byte) (uint, uint, error) {
 	return major, minor, nil
 }
 
+// negotiateProtoVersion returns the version to speak with a peer announcing
+// major.minor: the highest of 3.3, 3.7 and 3.8 it supports, at most max.
+// Vendor versions such as 3.889 (Apple) and 4.x (RealVNC) speak 3.8, the
+// unofficial 3.4 to 3.6 speak 3.3. An empty min or max means 3.3 or 3.8.
+func negotiateProtoVersion(major, minor uint, min, max string) (string, error) {
+	if min == ProtoVersionUnknown {
+		min = ProtoVersion33
+	}
+	if max == ProtoVersionUnknown {
+		max = ProtoVersion38
+	}
+	for _, v := range []string{min, max} {
+		if v != ProtoVersion33 && v != ProtoVersion37 && v != ProtoVersion38 {
+			return ProtoVersionUnknown, fmt.Errorf("unsupported configured version '%v'", v)
+		}
+	}
+
+	pv := ProtoVersionUnknown
+	switch {
+	case major > 3 || major == 3 && minor >= 8:
+		pv = ProtoVersion38
+	case major == 3 && minor == 7:
+		pv = ProtoVersion37
+	case major == 3 && minor >= 3:
+		pv = ProtoVersion33
+	}
+	// the versions all have the same length, they compare as strings
+	if pv > max {
+		pv = max
+	}
+	if pv == ProtoVersionUnknown || pv < min {
+		return ProtoVersionUnknown, fmt.Errorf("ProtocolVersion handshake failed; unsupported version %d.%d", major, minor)
+	}
+	return pv, nil
+}
+
 // DefaultClientVersionHandler represents default handler
 type DefaultClientVersionHandler struct{}
 
 // Handle provide version handler for client side
 func (*DefaultClientVersionHandler) Handle(c Conn) error {
+	cfg := c.Config().(*ClientConfig)
 	var version [ProtoVersionLength]byte
 
 	if err := binary.Read(c, binary.BigEndian, &version); err != nil {
@@ -60,18 +96,15 @@ func (*DefaultClientVersionHandler) Handle(c Conn) error {
 		return err
 	}
 
-	pv := ProtoVersionUnknown
-	if major == 3 {
-		if minor >= 8 {
-			pv = ProtoVersion38
-		} else if minor >= 3 {
-			pv = ProtoVersion38
-		}
+	pv, err := negotiateProtoVersion(major, minor, cfg.MinVersion, cfg.MaxVersion)
+	if err != nil {
+		return err
 	}
-	if pv == ProtoVersionUnknown {
-		return fmt.Errorf("ProtocolVersion handshake failed; unsupported version '%v'", string(version[:]))
+	connLogger(c).Tracef("server version %q, speaking %q", version[:], pv)
+	if cc, ok := c.(*ClientConn); ok {
+		cc.serverVersion = string(version[:])
 	}
-	c.SetProtoVersion(string(version[:]))
+	c.SetProtoVersion(pv)
 
 	if err := binary.Write(c, binary.BigEndian, []byte(pv)); err != nil {
 		return err
@@ -84,8 +117,13 @@ type DefaultServerVersionHandler struct{}
 
 // Handle provide server version handler
 func (*DefaultServerVersionHandler) Handle(c Conn) error {
+	cfg := c.Config().(*ServerConfig)
+	max := cfg.MaxVersion
+	if max == ProtoVersionUnknown {
+		max = ProtoVersion38
+	}
 	var version [ProtoVersionLength]byte
-	if err := binary.Write(c, binary.BigEndian, []byte(ProtoVersion38)); err != nil {
+	if err := binary.Write(c, binary.BigEndian, []byte(max)); err != nil {
 		return err
 	}
 	if err := c.Flush(); err != nil {
@@ -99,16 +137,9 @@ func (*DefaultServerVersionHandler) Handle(c Conn) error {
 		return err
 	}
 
-	pv := ProtoVersionUnknown
-	if major == 3 {
-		if minor >= 8 {
-			pv = ProtoVersion38
-		} else if minor >= 3 {
-			pv = ProtoVersion33
-		}
-	}
-	if pv == ProtoVersionUnknown {
-		return fmt.Errorf("ProtocolVersion handshake failed; unsupported version '%v'", string(version[:]))
+	pv, err := negotiateProtoVersion(major, minor, cfg.MinVersion, max)
+	if err != nil {
+		return err
 	}
 
 	c.SetProtoVersion(pv)
@@ -121,59 +152,107 @@ type DefaultClientSecurityHandler struct{}
 // Handle provide client side security handler
 func (*DefaultClientSecurityHandler) Handle(c Conn) error {
 	cfg := c.Config().(*ClientConfig)
-	var numSecurityTypes uint8
-	if err := binary.Read(c, binary.BigEndian, &numSecurityTypes); err != nil {
-		return err
-	}
-	secTypes := make([]SecurityType, numSecurityTypes)
-	if err := binary.Read(c, binary.BigEndian, &secTypes); err != nil {
-		return err
+	// the security handler may change the protocol, as ATEN does
+	protocol := c.Protocol()
+	var secTypes []SecurityType
+	if protocol == ProtoVersion33 {
+		// the server picks the type, 0 is followed by the failure reason
+		var st uint32
+		if err := binary.Read(c, binary.BigEndian, &st); err != nil {
+			return err
+		}
+		if st == 0 {
+			return readFailureReason(c)
+		}
+		if st > 255 {
+			return fmt.Errorf("unsupported security type %d", st)
+		}
+		secTypes = []SecurityType{SecurityType(st)}
+	} else {
+		var numSecurityTypes uint8
+		if err := binary.Read(c, binary.BigEndian, &numSecurityTypes); err != nil {
+			return err
+		}
+		if numSecurityTypes == 0 {
+			return readFailureReason(c)
+		}
+		secTypes = make([]SecurityType, numSecurityTypes)
+		if err := binary.Read(c, binary.BigEndian, &secTypes); err != nil {
+			return err
+		}
 	}
 
+	// the first configured handler the server offers wins, ClientAuthTight
+	// and ClientAuthATEN share their type and the former hands ATEN servers
+	// to the latter
 	var secType SecurityHandler
 	for _, st := range cfg.SecurityHandlers {
 		for _, sc := range secTypes {
-			if st.Type() == sc {
+			if st.Type() == sc && secType == nil {
 				secType = st
 			}
 		}
 	}
-
-	if err := binary.Write(c, binary.BigEndian, cfg.SecurityHandlers[0].Type()); err != nil {
-		return err
+	if secType == nil {
+		return fmt.Errorf("no security handler for the server security types %v", secTypes)
 	}
 
-	if err := c.Flush(); err != nil {
-		return err
+	if protocol != ProtoVersion33 {
+		if err := binary.Write(c, binary.BigEndian, secType.Type()); err != nil {
+			return err
+		}
+
+		if err := c.Flush(); err != nil {
+			return err
+		}
 	}
 
 	err := secType.Auth(c)
 	if err != nil {
-		logger.Error("Authentication error: ", err)
+		connLogger(c).Error("Authentication error: ", err)
 		return err
 	}
 
+	// before 3.8 there is no security result for the None type
+	if secType.Type() == SecTypeNone && protocol != ProtoVersion38 {
+		c.SetSecurityHandler(secType)
+		return nil
+	}
+
 	var authCode uint32
 	if err := binary.Read(c, binary.BigEndian, &authCode); err != nil {
 		return err
 	}
 
-	logger.Tracef("authenticating, secType: %d, auth code(0=success): %d", secType.Type(), authCode)
-	if authCode == 1 {
-		var reasonLength uint32
-		if err := binary.Read(c, binary.BigEndian, &reasonLength); err != nil {
-			return err
+	connLogger(c).Tracef("authenticating, secType: %d, auth code(0=success): %d", secType.Type(), authCode)
+	if authCode != 0 {
+		// before 3.8 the failure has no reason
+		if protocol == ProtoVersion33 || protocol == ProtoVersion37 {
+			return fmt.Errorf("authentication failed")
 		}
-		reasonText := make([]byte, reasonLength)
-		if err := binary.Read(c, binary.BigEndian, &reasonText); err != nil {
-			return err
-		}
-		return fmt.Errorf("%s", reasonText)
+		return readFailureReason(c)
 	}
 	c.SetSecurityHandler(secType)
 	return nil
 }
 
+// readFailureReason reads the reason string of a failed handshake and
+// returns it as an error
+func readFailureReason(c Conn) error {
+	var reasonLength uint32
+	if err := binary.Read(c, binary.BigEndian, &reasonLength); err != nil {
+		return err
+	}
+	if reasonLength > 1<<16 {
+		return fmt.Errorf("handshake failed, reason of %d bytes", reasonLength)
+	}
+	reasonText := make([]byte, reasonLength)
+	if err := binary.Read(c, binary.BigEndian, &reasonText); err != nil {
+		return err
+	}
+	return fmt.Errorf("%s", reasonText)
+}
+
 // DefaultServerSecurityHandler used for server security handler
 type DefaultServerSecurityHandler struct{}
 
@@ -192,22 +271,35 @@ func (*DefaultServerSecurityHandler) Handle(c Conn) error {
 			}
 		}
 	} else {
-		st := uint32(0)
+		// 3.3 only knows None and VNC, the server picks the first one
+		// configured
 		for _, sectype := range cfg.SecurityHandlers {
-			if uint32(sectype.Type()) > st {
-				st = uint32(sectype.Type())
-				secType = sectype.Type()
+			if t := sectype.Type(); secType == SecTypeUnknown && (t == SecTypeNone || t == SecTypeVNC) {
+				secType = t
 			}
 		}
-		if err := binary.Write(c, binary.BigEndian, st); err != nil {
+		if err := binary.Write(c, binary.BigEndian, uint32(secType)); err != nil {
 			return err
 		}
+		if secType == SecTypeUnknown {
+			reason := "no security type supported by RFB 3.3"
+			if err := binary.Write(c, binary.BigEndian, uint32(len(reason))); err != nil {
+				return err
+			}
+			if err := binary.Write(c, binary.BigEndian, []byte(reason)); err != nil {
+				return err
+			}
+			if err := c.Flush(); err != nil {
+				return err
+			}
+			return fmt.Errorf("%s", reason)
+		}
 	}
 	if err := c.Flush(); err != nil {
 		return err
 	}
 
-	if c.Protocol() == ProtoVersion38 {
+	if c.Protocol() == ProtoVersion37 || c.Protocol() == ProtoVersion38 {
 		if err := binary.Read(c, binary.BigEndian, &secType); err != nil {
 			return err
 		}
@@ -228,6 +320,14 @@ func (*DefaultServerSecurityHandler) Handle(c Conn) error {
 		authCode = uint32(1)
 	}
 
+	// before 3.8 there is no security result for the None type
+	if secType == SecTypeNone && c.Protocol() != ProtoVersion38 {
+		if authErr == nil {
+			c.SetSecurityHandler(sType)
+		}
+		return authErr
+	}
+
 	if err := binary.Write(c, binary.BigEndian, authCode); err != nil {
 		return err
 	}
@@ -247,9 +347,9 @@ func (*DefaultServerSecurityHandler) Handle(c Conn) error {
 		if err := binary.Write(c, binary.BigEndian, []byte(authErr.Error())); err != nil {
 			return err
 		}
-		if err := c.Flush(); err != nil {
-			return err
-		}
+	}
+	if err := c.Flush(); err != nil {
+		return err
 	}
 	return authErr
 }
@@ -259,7 +359,7 @@ type DefaultClientServerInitHandler struct{}
 
 // Handle provide default server init handler
 func (*DefaultClientServerInitHandler) Handle(c Conn) error {
-	logger.Trace("starting DefaultClientServerInitHandler")
+	connLogger(c).Trace("starting DefaultClientServerInitHandler")
 	var err error
 	srvInit := ServerInit{}
 
@@ -280,11 +380,27 @@ func (*DefaultClientServerInitHandler) Handle(c Conn) error {
 	if err = binary.Read(c, binary.BigEndian, &srvInit.NameText); err != nil {
 		return err
 	}
-	logger.Tracef("DefaultClientServerInitHandler got serverInit: %v", srvInit)
+	connLogger(c).Tracef("DefaultClientServerInitHandler got serverInit: %v", srvInit)
 	c.SetDesktopName(srvInit.NameText)
+	if _, ok := c.SecurityHandler().(*ClientAuthTight); ok && c.Protocol() != "aten1" {
+		caps, err := readTightCapabilities(c)
+		if err != nil {
+			return err
+		}
+		connLogger(c).Tracef("DefaultClientServerInitHandler got tight capabilities: %v", caps)
+		if cc, ok := c.(*ClientConn); ok {
+			cc.tightCaps = caps
+		}
+	}
 	if c.Protocol() == "aten1" {
+		// the video rects carry the screen size and resize the canvas, until
+		// the first one arrives the size sent here is only a guess
 		c.SetWidth(800)
 		c.SetHeight(600)
+		if srvInit.FBWidth != 0 && srvInit.FBHeight != 0 && !atenScreenOff(&Rectangle{Width: srvInit.FBWidth, Height: srvInit.FBHeight}) {
+			c.SetWidth(srvInit.FBWidth)
+			c.SetHeight(srvInit.FBHeight)
+		}
 		c.SetPixelFormat(NewPixelFormatAten())
 	} else {
 		c.SetWidth(srvInit.FBWidth)
@@ -308,43 +424,6 @@ func (*DefaultClientServerInitHandler) Handle(c Conn) error {
 			return err
 		}
 	}
-	/*
-		caps := struct {
-			ServerMessagesNum uint16
-			ClientMessagesNum uint16
-			EncodingsNum      uint16
-			_                 [2]byte
-		}{}
-		if err := binary.Read(c, binary.BigEndian, &caps); err != nil {
-			return err
-		}
-
-		caps.ServerMessagesNum = uint16(1)
-		var item [16]byte
-		for i := uint16(0); i < caps.ServerMessagesNum; i++ {
-			if err := binary.Read(c, binary.BigEndian, &item); err != nil {
-				return err
-			}
-			fmt.Printf("server message cap %s\n", item)
-		}
-
-			for i := uint16(0); i < caps.ClientMessagesNum; i++ {
-				if err := binary.Read(c, binary.BigEndian, &item); err != nil {
-					return err
-				}
-				fmt.Printf("client message cap %s\n", item)
-			}
-			for i := uint16(0); i < caps.EncodingsNum; i++ {
-				if err := binary.Read(c, binary.BigEndian, &item); err != nil {
-					return err
-				}
-				fmt.Printf("encoding cap %s\n", item)
-			}
-		//	var pad [1]byte
-		//	if err := binary.Read(c, binary.BigEndian, &pad); err != nil {
-		//		return err
-		//	}
-	}*/
 	return nil
 }
 
@@ -376,7 +455,7 @@ type DefaultClientClientInitHandler struct{}
 
 // Handle provide default client client init handler
 func (*DefaultClientClientInitHandler) Handle(c Conn) error {
-	logger.Trace("starting DefaultClientClientInitHandler")
+	connLogger(c).Trace("starting DefaultClientClientInitHandler")
 	cfg := c.Config().(*ClientConfig)
 	var shared uint8
 	if cfg.Exclusive {
@@ -387,7 +466,7 @@ func (*DefaultClientClientInitHandler) Handle(c Conn) error {
 	if err := binary.Write(c, binary.BigEndian, shared); err != nil {
 		return err
 	}
-	logger.Tracef("DefaultClientClientInitHandler sending: shared=%d", shared)
+	connLogger(c).Tracef("DefaultClientClientInitHandler sending: shared=%d", shared)
 	return c.Flush()
 }
 
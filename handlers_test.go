@@ -0,0 +1,99 @@
+package vnc2video
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestNegotiateProtoVersion(t *testing.T) {
+	for _, v := range []struct {
+		major, minor uint
+		min, max     string
+		want         string
+	}{
+		{3, 3, "", "", ProtoVersion33},
+		{3, 5, "", "", ProtoVersion33},
+		{3, 7, "", "", ProtoVersion37},
+		{3, 8, "", "", ProtoVersion38},
+		{3, 889, "", "", ProtoVersion38},
+		{4, 1, "", "", ProtoVersion38},
+		{3, 8, "", ProtoVersion37, ProtoVersion37},
+		{3, 8, "", ProtoVersion33, ProtoVersion33},
+		{3, 3, ProtoVersion37, "", ""},
+		{3, 2, "", "", ""},
+		{2, 9, "", "", ""},
+		{3, 8, "RFB 003.005\n", "", ""},
+	} {
+		got, err := negotiateProtoVersion(v.major, v.minor, v.min, v.max)
+		if got != v.want || (err == nil) != (v.want != "") {
+			t.Errorf("%d.%d between %q and %q is %q, %v, want %q", v.major, v.minor, v.min, v.max, got, err, v.want)
+		}
+	}
+}
+
+// TestVersionSessions connects clients and servers downgraded to each
+// version with and without a password
+func TestVersionSessions(t *testing.T) {
+	for _, v := range [][2]string{
+		{ProtoVersion33, ""}, {ProtoVersion37, ""}, {"", ProtoVersion33}, {"", ProtoVersion37}, {"", ""},
+	} {
+		sv, cv := v[0], v[1]
+		if err := versionSession(t, &ServerAuthNone{}, &ClientAuthNone{}, sv, cv); err != nil {
+			t.Errorf("none, server %q client %q: %v", sv, cv, err)
+		}
+		if err := versionSession(t, &ServerAuthVNC{Challenge: make([]byte, 16), Password: []byte("secret")},
+			&ClientAuthVNC{Password: []byte("secret")}, sv, cv); err != nil {
+			t.Errorf("vnc, server %q client %q: %v", sv, cv, err)
+		}
+		if err := versionSession(t, &ServerAuthVNC{Challenge: make([]byte, 16), Password: []byte("secret")},
+			&ClientAuthVNC{Password: []byte("wrong")}, sv, cv); err == nil {
+			t.Errorf("vnc, server %q client %q: wrong password accepted", sv, cv)
+		}
+	}
+}
+
+// TestVendorVersion connects to a scripted Apple server announcing 3.889
+func TestVendorVersion(t *testing.T) {
+	sc, cc := net.Pipe()
+	defer sc.Close()
+	got := make(chan []byte, 1)
+	go func() {
+		sc.Write([]byte("RFB 003.889\n"))
+		version := make([]byte, ProtoVersionLength)
+		io.ReadFull(sc, version)
+		sc.Write([]byte{1, byte(SecTypeNone)})
+		io.ReadFull(sc, make([]byte, 1))
+		sc.Write([]byte{0, 0, 0, 0})
+		io.ReadFull(sc, make([]byte, 1))
+		sc.Write([]byte{0, 16, 0, 16})
+		sc.Write(make([]byte, 16))
+		sc.Write([]byte{0, 0, 0, 0})
+		got <- version
+		io.Copy(ioutil.Discard, sc)
+	}()
+
+	cfg := &ClientConfig{
+		SecurityHandlers: []SecurityHandler{&ClientAuthNone{}},
+		PixelFormat:      PixelFormat32bit,
+		ClientMessageCh:  make(chan ClientMessage, 16),
+		ServerMessageCh:  make(chan ServerMessage, 16),
+		Messages:         DefaultServerMessages,
+		Encodings:        []Encoding{&RawEncoding{}},
+		ErrorCh:          make(chan error, 4),
+	}
+	conn, err := Connect(context.Background(), cc, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if version := <-got; !bytes.Equal(version, []byte(ProtoVersion38)) {
+		t.Errorf("client answered %q", version)
+	}
+	if conn.ServerVersion() != "RFB 003.889\n" || conn.Protocol() != ProtoVersion38 {
+		t.Errorf("server version %q, protocol %q", conn.ServerVersion(), conn.Protocol())
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	"image"
-	"github.com/amitbet/vnc2video/logger"
 )
 
 //var _ draw.Drawer = (*ServerConn)(nil)
@@ -167,7 +166,8 @@ func (rect *Rectangle) Read(c Conn) error {
 	if err = binary.Read(c, binary.BigEndian, &rect.EncType); err != nil {
 		return err
 	}
-	logger.Debug(rect)
+	connLogger(c).Debug(rect)
+	start := bytesRead(c)
 	switch rect.EncType {
 	// case EncCopyRect:
 	// 	rect.Enc = &CopyRectEncoding{}
@@ -185,6 +185,10 @@ func (rect *Rectangle) Read(c Conn) error {
 		rect.Enc = &DesktopSizePseudoEncoding{}
 	case EncDesktopNamePseudo:
 		rect.Enc = &DesktopNamePseudoEncoding{}
+	case EncLastRectPseudo:
+		rect.Enc = &LastRectPseudoEncoding{}
+	case EncClientRedirect:
+		rect.Enc = &ClientRedirectPseudoEncoding{}
 	// case EncXCursorPseudo:
 	// 	rect.Enc = &XCursorPseudoEncoding{}
 	// case EncAtenHermon:
@@ -192,11 +196,14 @@ func (rect *Rectangle) Read(c Conn) error {
 	default:
 		rect.Enc = c.GetEncInstance(rect.EncType)
 		if rect.Enc == nil {
-			return fmt.Errorf("unsupported encoding %s", rect.EncType)
+			return newDecodeError(c, rect, start, fmt.Errorf("unsupported encoding %s", rect.EncType))
 		}
 	}
 
-	return rect.Enc.Read(c, rect)
+	if err = rect.Enc.Read(c, rect); err != nil {
+		return newDecodeError(c, rect, start, err)
+	}
+	return nil
 }
 
 // Area returns the total area in pixels of the Rectangle
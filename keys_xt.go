@@ -0,0 +1,176 @@
+package vnc2video
+
+// xtKeycodes maps keysyms to XT scancodes of a US PC keyboard. Two byte
+// scancodes prefixed with 0xe0 are encoded with the high bit of the low
+// byte set, as expected by the QEMU extended key event message.
+var xtKeycodes = map[Key]uint32{
+	Escape:         0x01,
+	Digit1:         0x02,
+	Exclaim:        0x02,
+	Digit2:         0x03,
+	At:             0x03,
+	Digit3:         0x04,
+	NumberSign:     0x04,
+	Digit4:         0x05,
+	Dollar:         0x05,
+	Digit5:         0x06,
+	Percent:        0x06,
+	Digit6:         0x07,
+	AsciiCircum:    0x07,
+	Digit7:         0x08,
+	Ampersand:      0x08,
+	Digit8:         0x09,
+	Asterisk:       0x09,
+	Digit9:         0x0a,
+	ParenLeft:      0x0a,
+	Digit0:         0x0b,
+	ParenRight:     0x0b,
+	Minus:          0x0c,
+	Underscore:     0x0c,
+	Equal:          0x0d,
+	Plus:           0x0d,
+	BackSpace:      0x0e,
+	Tab:            0x0f,
+	Q:              0x10,
+	SmallQ:         0x10,
+	W:              0x11,
+	SmallW:         0x11,
+	E:              0x12,
+	SmallE:         0x12,
+	R:              0x13,
+	SmallR:         0x13,
+	T:              0x14,
+	SmallT:         0x14,
+	Y:              0x15,
+	SmallY:         0x15,
+	U:              0x16,
+	SmallU:         0x16,
+	I:              0x17,
+	SmallI:         0x17,
+	O:              0x18,
+	SmallO:         0x18,
+	P:              0x19,
+	SmallP:         0x19,
+	BracketLeft:    0x1a,
+	BraceLeft:      0x1a,
+	BracketRight:   0x1b,
+	BraceRight:     0x1b,
+	Return:         0x1c,
+	ControlLeft:    0x1d,
+	A:              0x1e,
+	SmallA:         0x1e,
+	S:              0x1f,
+	SmallS:         0x1f,
+	D:              0x20,
+	SmallD:         0x20,
+	F:              0x21,
+	SmallF:         0x21,
+	G:              0x22,
+	SmallG:         0x22,
+	H:              0x23,
+	SmallH:         0x23,
+	J:              0x24,
+	SmallJ:         0x24,
+	K:              0x25,
+	SmallK:         0x25,
+	L:              0x26,
+	SmallL:         0x26,
+	Semicolon:      0x27,
+	Colon:          0x27,
+	Apostrophe:     0x28,
+	QuoteDbl:       0x28,
+	Grave:          0x29,
+	AsciiTilde:     0x29,
+	ShiftLeft:      0x2a,
+	Backslash:      0x2b,
+	Bar:            0x2b,
+	Z:              0x2c,
+	SmallZ:         0x2c,
+	X:              0x2d,
+	SmallX:         0x2d,
+	C:              0x2e,
+	SmallC:         0x2e,
+	V:              0x2f,
+	SmallV:         0x2f,
+	B:              0x30,
+	SmallB:         0x30,
+	N:              0x31,
+	SmallN:         0x31,
+	M:              0x32,
+	SmallM:         0x32,
+	Comma:          0x33,
+	Less:           0x33,
+	Period:         0x34,
+	Greater:        0x34,
+	Slash:          0x35,
+	Question:       0x35,
+	ShiftRight:     0x36,
+	KeypadMultiply: 0x37,
+	AltLeft:        0x38,
+	Space:          0x39,
+	CapsLock:       0x3a,
+	F1:             0x3b,
+	F2:             0x3c,
+	F3:             0x3d,
+	F4:             0x3e,
+	F5:             0x3f,
+	F6:             0x40,
+	F7:             0x41,
+	F8:             0x42,
+	F9:             0x43,
+	F10:            0x44,
+	NumLock:        0x45,
+	ScrollLock:     0x46,
+	Keypad7:        0x47,
+	KeypadHome:     0x47,
+	Keypad8:        0x48,
+	KeypadUp:       0x48,
+	Keypad9:        0x49,
+	KeypadPageUp:   0x49,
+	KeypadSubtract: 0x4a,
+	Keypad4:        0x4b,
+	KeypadLeft:     0x4b,
+	Keypad5:        0x4c,
+	KeypadBegin:    0x4c,
+	Keypad6:        0x4d,
+	KeypadRight:    0x4d,
+	KeypadAdd:      0x4e,
+	Keypad1:        0x4f,
+	KeypadEnd:      0x4f,
+	Keypad2:        0x50,
+	KeypadDown:     0x50,
+	Keypad3:        0x51,
+	KeypadPageDown: 0x51,
+	Keypad0:        0x52,
+	KeypadInsert:   0x52,
+	KeypadDecimal:  0x53,
+	KeypadDelete:   0x53,
+	F11:            0x57,
+	F12:            0x58,
+	KeypadEnter:    0x9c,
+	ControlRight:   0x9d,
+	KeypadDivide:   0xb5,
+	AltRight:       0xb8,
+	Home:           0xc7,
+	Up:             0xc8,
+	PageUp:         0xc9,
+	Left:           0xcb,
+	Right:          0xcd,
+	End:            0xcf,
+	Down:           0xd0,
+	PageDown:       0xd1,
+	Delete:         0xd3,
+	SuperLeft:      0xdb,
+	SuperRight:     0xdc,
+
+	// the misc function keysyms in keys.go all share the value of Select
+	Key(0xff61): 0xb7, // Print
+	Key(0xff63): 0xd2, // Insert
+	Key(0xff67): 0xdd, // Menu
+}
+
+// QEMUKeycode returns the XT scancode for key on a US PC keyboard, or 0
+// when the key has no known scancode.
+func QEMUKeycode(key Key) uint32 {
+	return xtKeycodes[key]
+}
@@ -1,8 +1,32 @@
 package logger
 
-import "fmt"
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// defaultLogger holds the Logger used by the package level functions
+var defaultLogger atomic.Value
+
+func init() {
+	defaultLogger.Store(loggerHolder{&SimpleLogger{level: LogLevelWarn}})
+}
 
-var simpleLogger = SimpleLogger{LogLevelWarn}
+// loggerHolder keeps the concrete type stored in defaultLogger constant
+type loggerHolder struct {
+	Logger
+}
+
+// SetDefault replaces the logger used by the package level functions, it
+// is safe to call while other goroutines are logging
+func SetDefault(l Logger) {
+	defaultLogger.Store(loggerHolder{l})
+}
+
+// Default returns the logger used by the package level functions
+func Default() Logger {
+	return defaultLogger.Load().(loggerHolder).Logger
+}
 
 type Logger interface {
 	Trace(v ...interface{})
@@ -31,12 +55,30 @@ const (
 )
 
 type SimpleLogger struct {
-	level LogLevel
+	level  LogLevel
+	prefix string
+}
+
+// NewSimpleLogger returns a logger printing messages of level and above to
+// stdout, each message starts with prefix unless it is empty (e.g. a
+// session name)
+func NewSimpleLogger(level LogLevel, prefix string) *SimpleLogger {
+	if prefix != "" {
+		prefix += ": "
+	}
+	return &SimpleLogger{level: level, prefix: prefix}
+}
+
+func (sl *SimpleLogger) start(tag string) []interface{} {
+	if sl.prefix == "" {
+		return []interface{}{tag}
+	}
+	return []interface{}{tag, sl.prefix[:len(sl.prefix)-1]}
 }
 
 func (sl *SimpleLogger) Trace(v ...interface{}) {
 	if sl.level <= LogLevelTrace {
-		arr := []interface{}{"[Trace]"}
+		arr := sl.start("[Trace]")
 		for _, item := range v {
 			arr = append(arr, item)
 		}
@@ -46,13 +88,13 @@ func (sl *SimpleLogger) Trace(v ...interface{}) {
 }
 func (sl *SimpleLogger) Tracef(format string, v ...interface{}) {
 	if sl.level <= LogLevelTrace {
-		fmt.Printf("[Trace] "+format+"\n", v...)
+		fmt.Printf("[Trace] "+sl.prefix+format+"\n", v...)
 	}
 }
 
 func (sl *SimpleLogger) Debug(v ...interface{}) {
 	if sl.level <= LogLevelDebug {
-		arr := []interface{}{"[Debug]"}
+		arr := sl.start("[Debug]")
 		for _, item := range v {
 			arr = append(arr, item)
 		}
@@ -62,12 +104,12 @@ func (sl *SimpleLogger) Debug(v ...interface{}) {
 }
 func (sl *SimpleLogger) Debugf(format string, v ...interface{}) {
 	if sl.level <= LogLevelDebug {
-		fmt.Printf("[Debug] "+format+"\n", v...)
+		fmt.Printf("[Debug] "+sl.prefix+format+"\n", v...)
 	}
 }
 func (sl *SimpleLogger) Info(v ...interface{}) {
 	if sl.level <= LogLevelInfo {
-		arr := []interface{}{"[Info ]"}
+		arr := sl.start("[Info ]")
 		for _, item := range v {
 			arr = append(arr, item)
 		}
@@ -76,18 +118,18 @@ func (sl *SimpleLogger) Info(v ...interface{}) {
 }
 func (sl *SimpleLogger) DebugfNoCR(format string, v ...interface{}) {
 	if sl.level <= LogLevelDebug {
-		fmt.Printf("[Info ] "+format, v...)
+		fmt.Printf("[Info ] "+sl.prefix+format, v...)
 	}
 }
 
 func (sl *SimpleLogger) Infof(format string, v ...interface{}) {
 	if sl.level <= LogLevelInfo {
-		fmt.Printf("[Info ] "+format+"\n", v...)
+		fmt.Printf("[Info ] "+sl.prefix+format+"\n", v...)
 	}
 }
 func (sl *SimpleLogger) Warn(v ...interface{}) {
 	if sl.level <= LogLevelWarn {
-		arr := []interface{}{"[Warn ]"}
+		arr := sl.start("[Warn ]")
 		for _, item := range v {
 			arr = append(arr, item)
 		}
@@ -96,12 +138,12 @@ func (sl *SimpleLogger) Warn(v ...interface{}) {
 }
 func (sl *SimpleLogger) Warnf(format string, v ...interface{}) {
 	if sl.level <= LogLevelWarn {
-		fmt.Printf("[Warn ] "+format+"\n", v...)
+		fmt.Printf("[Warn ] "+sl.prefix+format+"\n", v...)
 	}
 }
 func (sl *SimpleLogger) Error(v ...interface{}) {
 	if sl.level <= LogLevelError {
-		arr := []interface{}{"[Error]"}
+		arr := sl.start("[Error]")
 		for _, item := range v {
 			arr = append(arr, item)
 		}
@@ -110,12 +152,12 @@ func (sl *SimpleLogger) Error(v ...interface{}) {
 }
 func (sl *SimpleLogger) Errorf(format string, v ...interface{}) {
 	if sl.level <= LogLevelError {
-		fmt.Printf("[Error] "+format+"\n", v...)
+		fmt.Printf("[Error] "+sl.prefix+format+"\n", v...)
 	}
 }
 func (sl *SimpleLogger) Fatal(v ...interface{}) {
 	if sl.level <= LogLevelFatal {
-		arr := []interface{}{"[Fatal]"}
+		arr := sl.start("[Fatal]")
 		for _, item := range v {
 			arr = append(arr, item)
 		}
@@ -125,49 +167,49 @@ func (sl *SimpleLogger) Fatal(v ...interface{}) {
 }
 func (sl *SimpleLogger) Fatalf(format string, v ...interface{}) {
 	if sl.level <= LogLevelFatal {
-		fmt.Printf("[Fatal] "+format+"\n", v)
+		fmt.Printf("[Fatal] "+sl.prefix+format+"\n", v)
 	}
 }
 func Trace(v ...interface{}) {
-	simpleLogger.Trace(v...)
+	Default().Trace(v...)
 }
 func Tracef(format string, v ...interface{}) {
-	simpleLogger.Tracef(format, v...)
+	Default().Tracef(format, v...)
 }
 
 func Debug(v ...interface{}) {
-	simpleLogger.Debug(v...)
+	Default().Debug(v...)
 }
 func Debugf(format string, v ...interface{}) {
-	simpleLogger.Tracef(format, v...)
+	Default().Tracef(format, v...)
 }
 
 func Info(v ...interface{}) {
-	simpleLogger.Info(v...)
+	Default().Info(v...)
 }
 func Infof(format string, v ...interface{}) {
-	simpleLogger.Infof(format, v...)
+	Default().Infof(format, v...)
 }
 func DebugfNoCR(format string, v ...interface{}) {
-	simpleLogger.DebugfNoCR(format, v...)
+	Default().DebugfNoCR(format, v...)
 }
 func Warn(v ...interface{}) {
-	simpleLogger.Warn(v...)
+	Default().Warn(v...)
 }
 func Warnf(format string, v ...interface{}) {
-	simpleLogger.Warnf(format, v...)
+	Default().Warnf(format, v...)
 }
 
 func Error(v ...interface{}) {
-	simpleLogger.Error(v...)
+	Default().Error(v...)
 }
 func Errorf(format string, v ...interface{}) {
-	simpleLogger.Errorf(format, v...)
+	Default().Errorf(format, v...)
 }
 
 func Fatal(v ...interface{}) {
-	simpleLogger.Fatal(v...)
+	Default().Fatal(v...)
 }
 func Fatalf(format string, v ...interface{}) {
-	simpleLogger.Fatalf(format, v...)
+	Default().Fatalf(format, v...)
 }
@@ -4,7 +4,6 @@ import (
 	"encoding/binary"
 	"fmt"
 
-	"github.com/amitbet/vnc2video/logger"
 )
 
 var (
@@ -16,6 +15,10 @@ var (
 		&KeyEvent{},
 		&PointerEvent{},
 		&ClientCutText{},
+		&QEMUExtendedKeyEvent{},
+		&EnableContinuousUpdates{},
+		&ClientFence{},
+		&ClientXvp{},
 	}
 
 	// DefaultServerMessages slice of default server messages sent to client
@@ -24,6 +27,9 @@ var (
 		&SetColorMapEntries{},
 		&Bell{},
 		&ServerCutText{},
+		&EndOfContinuousUpdates{},
+		&ServerFence{},
+		&ServerXvp{},
 	}
 )
 
@@ -83,11 +89,15 @@ type ServerMessage interface {
 	Supported(Conn) bool
 }
 
+// NumRectUnknown is the number of rectangles of a FramebufferUpdate whose
+// length is not known in advance, a LastRect pseudo-rectangle ends it.
+const NumRectUnknown uint16 = 0xFFFF
+
 // FramebufferUpdate holds a FramebufferUpdate wire format message.
 type FramebufferUpdate struct {
 	_       [1]byte      // pad
 	NumRect uint16       // number-of-rectangles
-	Rects   []*Rectangle // rectangles
+	Rects   []*Rectangle // rectangles, ending with the LastRect one if any
 }
 
 // String provide stringer
@@ -115,20 +125,26 @@ func (*FramebufferUpdate) Read(c Conn) (ServerMessage, error) {
 	if err := binary.Read(c, binary.BigEndian, &msg.NumRect); err != nil {
 		return nil, err
 	}
-	logger.Debugf("-------Reading FrameBuffer update with %d rects-------", msg.NumRect)
+	connLogger(c).Debugf("-------Reading FrameBuffer update with %d rects-------", msg.NumRect)
 
-	for i := uint16(0); i < msg.NumRect; i++ {
+	for i := 0; msg.NumRect == NumRectUnknown || i < int(msg.NumRect); i++ {
 		rect := NewRectangle()
-		logger.DebugfNoCR("----------RECT %d----------", i)
+		connLogger(c).DebugfNoCR("----------RECT %d----------", i)
 
 		if err := rect.Read(c); err != nil {
+			if recoverDecodeError(c, err) {
+				continue
+			}
 			return nil, err
 		}
 		if rect.EncType == EncDesktopSizePseudo {
 			c.(*ClientConn).ResetAllEncodings()
 		}
-		logger.Tracef("----End RECT #%d Info (%dx%d) encType:%s", i, rect.Width, rect.Height, rect.EncType)
+		connLogger(c).Tracef("----End RECT #%d Info (%dx%d) encType:%s", i, rect.Width, rect.Height, rect.EncType)
 		msg.Rects = append(msg.Rects, rect)
+		if rect.EncType == EncLastRectPseudo {
+			break
+		}
 	}
 	return &msg, nil
 }
@@ -142,10 +158,23 @@ func (msg *FramebufferUpdate) Write(c Conn) error {
 	if err := binary.Write(c, binary.BigEndian, pad); err != nil {
 		return err
 	}
-	if err := binary.Write(c, binary.BigEndian, msg.NumRect); err != nil {
+	numRect, rects := msg.NumRect, msg.Rects
+	ended := len(rects) > 0 && rects[len(rects)-1].EncType == EncLastRectPseudo
+	if numRect == NumRectUnknown {
+		if c.GetEncInstance(EncLastRectPseudo) == nil {
+			// the client can't parse it, send the actual count
+			if ended {
+				rects = rects[:len(rects)-1]
+			}
+			numRect = uint16(len(rects))
+		} else if !ended {
+			rects = append(rects[:len(rects):len(rects)], lastRect())
+		}
+	}
+	if err := binary.Write(c, binary.BigEndian, numRect); err != nil {
 		return err
 	}
-	for _, rect := range msg.Rects {
+	for _, rect := range rects {
 		if err := rect.Write(c); err != nil {
 			return err
 		}
@@ -158,6 +187,9 @@ type ServerCutText struct {
 	_      [1]byte
 	Length uint32
 	Text   []byte
+	// Extended holds the payload of extended clipboard messages, in which
+	// case Text is unused
+	Extended *ExtendedClipboard
 }
 
 func (msg *ServerCutText) Supported(c Conn) bool {
@@ -166,6 +198,9 @@ func (msg *ServerCutText) Supported(c Conn) bool {
 
 // String returns string
 func (msg *ServerCutText) String() string {
+	if msg.Extended != nil {
+		return fmt.Sprintf("extended: { %v }", msg.Extended)
+	}
 	return fmt.Sprintf("lenght: %d text: %s", msg.Length, msg.Text)
 }
 
@@ -187,6 +222,16 @@ func (*ServerCutText) Read(c Conn) (ServerMessage, error) {
 		return nil, err
 	}
 
+	// a negative length marks an extended clipboard message
+	if int32(msg.Length) < 0 {
+		ec, err := readExtendedClipboard(c, uint32(-int32(msg.Length)))
+		if err != nil {
+			return nil, err
+		}
+		msg.Extended = ec
+		return &msg, nil
+	}
+
 	msg.Text = make([]byte, msg.Length)
 	if err := binary.Read(c, binary.BigEndian, &msg.Text); err != nil {
 		return nil, err
@@ -204,6 +249,10 @@ func (msg *ServerCutText) Write(c Conn) error {
 		return err
 	}
 
+	if msg.Extended != nil {
+		return writeExtendedClipboard(c, msg.Extended)
+	}
+
 	if msg.Length < uint32(len(msg.Text)) {
 		msg.Length = uint32(len(msg.Text))
 	}
@@ -271,7 +320,7 @@ func (*SetColorMapEntries) Type() ServerMessageType {
 
 // Read unmrashal message from conn
 func (*SetColorMapEntries) Read(c Conn) (ServerMessage, error) {
-	logger.Info("Reading SetColorMapEntries message")
+	connLogger(c).Info("Reading SetColorMapEntries message")
 	msg := SetColorMapEntries{}
 	var pad [1]byte
 	if err := binary.Read(c, binary.BigEndian, &pad); err != nil {
@@ -576,6 +625,9 @@ type ClientCutText struct {
 	_      [3]byte // padding
 	Length uint32  // length
 	Text   []byte
+	// Extended holds the payload of extended clipboard messages, in which
+	// case Text is unused
+	Extended *ExtendedClipboard
 }
 
 func (msg *ClientCutText) Supported(c Conn) bool {
@@ -584,6 +636,9 @@ func (msg *ClientCutText) Supported(c Conn) bool {
 
 // String returns string
 func (msg *ClientCutText) String() string {
+	if msg.Extended != nil {
+		return fmt.Sprintf("extended: { %v }", msg.Extended)
+	}
 	return fmt.Sprintf("length: %d, text: %s", msg.Length, msg.Text)
 }
 
@@ -604,6 +659,16 @@ func (*ClientCutText) Read(c Conn) (ClientMessage, error) {
 		return nil, err
 	}
 
+	// a negative length marks an extended clipboard message
+	if int32(msg.Length) < 0 {
+		ec, err := readExtendedClipboard(c, uint32(-int32(msg.Length)))
+		if err != nil {
+			return nil, err
+		}
+		msg.Extended = ec
+		return &msg, nil
+	}
+
 	msg.Text = make([]byte, msg.Length)
 	if err := binary.Read(c, binary.BigEndian, &msg.Text); err != nil {
 		return nil, err
@@ -622,6 +687,10 @@ func (msg *ClientCutText) Write(c Conn) error {
 		return err
 	}
 
+	if msg.Extended != nil {
+		return writeExtendedClipboard(c, msg.Extended)
+	}
+
 	if uint32(len(msg.Text)) > msg.Length {
 		msg.Length = uint32(len(msg.Text))
 	}
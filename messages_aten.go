@@ -17,10 +17,22 @@ const (
 
 // Aten IKVM client message types
 const (
-	AteniKVMKeyEventMsgType     ClientMessageType = 4
-	AteniKVMPointerEventMsgType ClientMessageType = 5
+	AteniKVMKeyEventMsgType       ClientMessageType = 4
+	AteniKVMPointerEventMsgType   ClientMessageType = 5
+	AteniKVMKeepAliveReplyMsgType ClientMessageType = 22
 )
 
+// AtenServerMessages are the Aten IKVM server messages, the client reads
+// them on aten connections even when they are not in ClientConfig.Messages
+var AtenServerMessages = []ServerMessage{
+	&AteniKVMFrontGroundEvent{},
+	&AteniKVMKeepAliveEvent{},
+	&AteniKVMVideoGetInfo{},
+	&AteniKVMMouseGetInfo{},
+	&AteniKVMSessionMessage{},
+	&AteniKVMGetViewerLang{},
+}
+
 // AteniKVMKeyEvent holds the wire format message
 type AteniKVMKeyEvent struct {
 	_    [1]byte // padding
@@ -40,7 +52,7 @@ type AteniKVMPointerEvent struct {
 }
 
 func (msg *AteniKVMPointerEvent) Supported(c Conn) bool {
-	return false
+	return c.Protocol() == "aten1"
 }
 
 func (msg *AteniKVMPointerEvent) String() string {
@@ -73,7 +85,7 @@ func (msg *AteniKVMPointerEvent) Write(c Conn) error {
 }
 
 func (msg *AteniKVMKeyEvent) Supported(c Conn) bool {
-	return false
+	return c.Protocol() == "aten1"
 }
 
 func (msg *AteniKVMKeyEvent) String() string {
@@ -105,6 +117,18 @@ func (msg *AteniKVMKeyEvent) Write(c Conn) error {
 	return c.Flush()
 }
 
+// atenInput returns the aten counterpart of the standard key and pointer
+// events, which aten servers ignore
+func atenInput(msg ClientMessage) ClientMessage {
+	switch msg := msg.(type) {
+	case *KeyEvent:
+		return &AteniKVMKeyEvent{Down: msg.Down, Key: msg.Key}
+	case *PointerEvent:
+		return &AteniKVMPointerEvent{Mask: msg.Mask, X: msg.X, Y: msg.Y}
+	}
+	return msg
+}
+
 // AteniKVMFrontGroundEvent unknown aten ikvm message
 type AteniKVMFrontGroundEvent struct {
 	_ [20]byte
@@ -193,7 +217,54 @@ func (msg *AteniKVMKeepAliveEvent) Write(c Conn) error {
 	return c.Flush()
 }
 
-// AteniKVMVideoGetInfo unknown aten ikvm message
+// AteniKVMKeepAliveReply answers AteniKVMKeepAliveEvent, the server drops
+// the session when it is not answered
+type AteniKVMKeepAliveReply struct {
+	_ [1]byte
+}
+
+func (msg *AteniKVMKeepAliveReply) Supported(c Conn) bool {
+	return c.Protocol() == "aten1"
+}
+
+// String return string representation
+func (msg *AteniKVMKeepAliveReply) String() string {
+	return fmt.Sprintf("%v", msg.Type())
+}
+
+// Type return ClientMessageType
+func (*AteniKVMKeepAliveReply) Type() ClientMessageType {
+	return AteniKVMKeepAliveReplyMsgType
+}
+
+// Read unmarshal message from conn
+func (*AteniKVMKeepAliveReply) Read(c Conn) (ClientMessage, error) {
+	msg := &AteniKVMKeepAliveReply{}
+	var pad [1]byte
+	if err := binary.Read(c, binary.BigEndian, &pad); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Write marshal message to conn
+func (msg *AteniKVMKeepAliveReply) Write(c Conn) error {
+	if !msg.Supported(c) {
+		return nil
+	}
+	var pad [1]byte
+	if err := binary.Write(c, binary.BigEndian, msg.Type()); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, pad); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// AteniKVMVideoGetInfo unknown aten ikvm message. Its 40 bytes are
+// skipped, the layout is not known and the screen size only comes from
+// the AST2100 video.
 type AteniKVMVideoGetInfo struct {
 	_ [20]byte
 }
@@ -258,7 +329,7 @@ func (*AteniKVMMouseGetInfo) Type() ServerMessageType {
 
 // Read unmarshal message from conn
 func (*AteniKVMMouseGetInfo) Read(c Conn) (ServerMessage, error) {
-	msg := &AteniKVMFrontGroundEvent{}
+	msg := &AteniKVMMouseGetInfo{}
 	var pad [2]byte
 	if err := binary.Read(c, binary.BigEndian, &pad); err != nil {
 		return nil, err
@@ -0,0 +1,88 @@
+package vnc2video
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Continuous updates message types
+const (
+	EndOfContinuousUpdatesMsgType  ServerMessageType = 150
+	EnableContinuousUpdatesMsgType ClientMessageType = 150
+)
+
+// EndOfContinuousUpdates server message, it is sent once to announce
+// support for continuous updates and whenever they are disabled
+type EndOfContinuousUpdates struct{}
+
+func (*EndOfContinuousUpdates) Supported(c Conn) bool {
+	return true
+}
+
+// String returns string
+func (*EndOfContinuousUpdates) String() string {
+	return "end of continuous updates"
+}
+
+// Type returns MessageType
+func (*EndOfContinuousUpdates) Type() ServerMessageType {
+	return EndOfContinuousUpdatesMsgType
+}
+
+// Read unmarshal message from conn
+func (*EndOfContinuousUpdates) Read(c Conn) (ServerMessage, error) {
+	return &EndOfContinuousUpdates{}, nil
+}
+
+// Write marshal message to conn
+func (msg *EndOfContinuousUpdates) Write(c Conn) error {
+	if err := binary.Write(c, binary.BigEndian, msg.Type()); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// EnableContinuousUpdates holds the wire format message
+type EnableContinuousUpdates struct {
+	Enable        uint8  // enable-flag
+	X, Y          uint16 // x-, y-position
+	Width, Height uint16 // width, height
+}
+
+// Supported reports whether the server announced continuous updates
+func (*EnableContinuousUpdates) Supported(c Conn) bool {
+	if cc, ok := c.(*ClientConn); ok {
+		return cc.ServerSupports(EncContinuousUpdatesPseudo)
+	}
+	return true
+}
+
+// String returns string
+func (msg *EnableContinuousUpdates) String() string {
+	return fmt.Sprintf("enable: %d, x: %d, y: %d, width: %d, height: %d", msg.Enable, msg.X, msg.Y, msg.Width, msg.Height)
+}
+
+// Type returns MessageType
+func (*EnableContinuousUpdates) Type() ClientMessageType {
+	return EnableContinuousUpdatesMsgType
+}
+
+// Read unmarshal message from conn
+func (*EnableContinuousUpdates) Read(c Conn) (ClientMessage, error) {
+	msg := EnableContinuousUpdates{}
+	if err := binary.Read(c, binary.BigEndian, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Write marshal message to conn
+func (msg *EnableContinuousUpdates) Write(c Conn) error {
+	if err := binary.Write(c, binary.BigEndian, msg.Type()); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, msg); err != nil {
+		return err
+	}
+	return c.Flush()
+}
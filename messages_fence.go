@@ -0,0 +1,155 @@
+package vnc2video
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Fence message types
+const (
+	ServerFenceMsgType ServerMessageType = 248
+	ClientFenceMsgType ClientMessageType = 248
+)
+
+// Fence flags
+const (
+	FenceFlagBlockBefore uint32 = 1 << 0
+	FenceFlagBlockAfter  uint32 = 1 << 1
+	FenceFlagSyncNext    uint32 = 1 << 2
+	FenceFlagRequest     uint32 = 1 << 31
+
+	// fenceFlagsSupported are the flags honoured when answering a fence,
+	// messages are processed in order so both block modes are trivially met
+	fenceFlagsSupported = FenceFlagBlockBefore | FenceFlagBlockAfter
+)
+
+// fenceMaxPayload is the maximal payload length allowed by the protocol
+const fenceMaxPayload = 64
+
+// ServerFence holds the wire format message
+type ServerFence struct {
+	_       [3]byte // padding
+	Flags   uint32  // flags
+	Payload []byte  // payload, echoed back in the reply
+}
+
+func (*ServerFence) Supported(c Conn) bool {
+	return true
+}
+
+// String returns string
+func (msg *ServerFence) String() string {
+	return fmt.Sprintf("flags: 0x%x, payload: %v", msg.Flags, msg.Payload)
+}
+
+// Type returns MessageType
+func (*ServerFence) Type() ServerMessageType {
+	return ServerFenceMsgType
+}
+
+// Read unmarshal message from conn
+func (*ServerFence) Read(c Conn) (ServerMessage, error) {
+	flags, payload, err := readFence(c)
+	if err != nil {
+		return nil, err
+	}
+	return &ServerFence{Flags: flags, Payload: payload}, nil
+}
+
+// Write marshal message to conn
+func (msg *ServerFence) Write(c Conn) error {
+	if err := binary.Write(c, binary.BigEndian, msg.Type()); err != nil {
+		return err
+	}
+	return writeFence(c, msg.Flags, msg.Payload)
+}
+
+// ClientFence holds the wire format message
+type ClientFence struct {
+	_       [3]byte // padding
+	Flags   uint32  // flags
+	Payload []byte  // payload, echoed back in the reply
+}
+
+// Supported reports whether the server announced fence support
+func (*ClientFence) Supported(c Conn) bool {
+	if cc, ok := c.(*ClientConn); ok {
+		return cc.ServerSupports(EncFencePseudo)
+	}
+	return true
+}
+
+// String returns string
+func (msg *ClientFence) String() string {
+	return fmt.Sprintf("flags: 0x%x, payload: %v", msg.Flags, msg.Payload)
+}
+
+// Type returns MessageType
+func (*ClientFence) Type() ClientMessageType {
+	return ClientFenceMsgType
+}
+
+// Read unmarshal message from conn
+func (*ClientFence) Read(c Conn) (ClientMessage, error) {
+	flags, payload, err := readFence(c)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientFence{Flags: flags, Payload: payload}, nil
+}
+
+// Write marshal message to conn
+func (msg *ClientFence) Write(c Conn) error {
+	if err := binary.Write(c, binary.BigEndian, msg.Type()); err != nil {
+		return err
+	}
+	return writeFence(c, msg.Flags, msg.Payload)
+}
+
+// fenceReplyFlags returns the flags of the answer to a fence request
+func fenceReplyFlags(flags uint32) uint32 {
+	return flags & fenceFlagsSupported
+}
+
+func readFence(c Conn) (uint32, []byte, error) {
+	var pad [3]byte
+	if err := binary.Read(c, binary.BigEndian, &pad); err != nil {
+		return 0, nil, err
+	}
+	var flags uint32
+	if err := binary.Read(c, binary.BigEndian, &flags); err != nil {
+		return 0, nil, err
+	}
+	var length uint8
+	if err := binary.Read(c, binary.BigEndian, &length); err != nil {
+		return 0, nil, err
+	}
+	if length > fenceMaxPayload {
+		return 0, nil, fmt.Errorf("fence payload too long: %d", length)
+	}
+	payload := make([]byte, length)
+	if err := binary.Read(c, binary.BigEndian, &payload); err != nil {
+		return 0, nil, err
+	}
+	return flags, payload, nil
+}
+
+func writeFence(c Conn, flags uint32, payload []byte) error {
+	if len(payload) > fenceMaxPayload {
+		return fmt.Errorf("fence payload too long: %d", len(payload))
+	}
+	var pad [3]byte
+	if err := binary.Write(c, binary.BigEndian, pad); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, flags); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, uint8(len(payload))); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, payload); err != nil {
+		return err
+	}
+	return c.Flush()
+}
@@ -0,0 +1,119 @@
+package vnc2video
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// QEMUClientMessageMsgType is the client message type shared by all QEMU
+// extension messages, the actual message is selected by a sub-type byte.
+const QEMUClientMessageMsgType ClientMessageType = 255
+
+// QEMU client message sub-types
+const (
+	QEMUExtendedKeyEventSubType uint8 = 0
+)
+
+// relativePointerOrigin is the x/y value that represents no movement when
+// the server has requested relative pointer events.
+const relativePointerOrigin = 0x7FFF
+
+// QEMUExtendedKeyEvent holds the wire format message, it carries both the
+// keysym and the XT scancode of the pressed key, so that the server does
+// not need to guess the physical key from the keysym.
+type QEMUExtendedKeyEvent struct {
+	SubType uint8  // sub-type, always QEMUExtendedKeyEventSubType
+	Down    uint16 // down-flag
+	Key     Key    // keysym
+	Keycode uint32 // XT scancode
+}
+
+// Supported reports whether the server has announced extended key events
+func (msg *QEMUExtendedKeyEvent) Supported(c Conn) bool {
+	if cc, ok := c.(*ClientConn); ok {
+		return cc.ServerSupports(EncQEMUExtendedKeyEventPseudo)
+	}
+	return true
+}
+
+// String returns string
+func (msg *QEMUExtendedKeyEvent) String() string {
+	return fmt.Sprintf("down: %d, key: %v, keycode: 0x%x", msg.Down, msg.Key, msg.Keycode)
+}
+
+// Type returns MessageType
+func (*QEMUExtendedKeyEvent) Type() ClientMessageType {
+	return QEMUClientMessageMsgType
+}
+
+// Read unmarshal message from conn
+func (*QEMUExtendedKeyEvent) Read(c Conn) (ClientMessage, error) {
+	msg := QEMUExtendedKeyEvent{}
+	if err := binary.Read(c, binary.BigEndian, &msg.SubType); err != nil {
+		return nil, err
+	}
+	if msg.SubType != QEMUExtendedKeyEventSubType {
+		return nil, fmt.Errorf("unsupported qemu client message sub-type: %d", msg.SubType)
+	}
+	if err := binary.Read(c, binary.BigEndian, &msg.Down); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(c, binary.BigEndian, &msg.Key); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(c, binary.BigEndian, &msg.Keycode); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Write marshal message to conn, falls back to a plain KeyEvent when the
+// server did not announce support for extended key events
+func (msg *QEMUExtendedKeyEvent) Write(c Conn) error {
+	if !msg.Supported(c) {
+		keyMsg := &KeyEvent{Key: msg.Key}
+		if msg.Down != 0 {
+			keyMsg.Down = 1
+		}
+		return keyMsg.Write(c)
+	}
+	if err := binary.Write(c, binary.BigEndian, msg.Type()); err != nil {
+		return err
+	}
+	msg.SubType = QEMUExtendedKeyEventSubType
+	if err := binary.Write(c, binary.BigEndian, msg); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// NewQEMUExtendedKeyEvent returns an extended key event for key, the XT
+// scancode is looked up with QEMUKeycode
+func NewQEMUExtendedKeyEvent(key Key, down bool) *QEMUExtendedKeyEvent {
+	msg := &QEMUExtendedKeyEvent{Key: key, Keycode: QEMUKeycode(key)}
+	if down {
+		msg.Down = 1
+	}
+	return msg
+}
+
+// NewRelativePointerEvent returns a PointerEvent describing a movement of
+// dx, dy pixels, as expected by servers in relative pointer mode.
+func NewRelativePointerEvent(mask uint8, dx, dy int) *PointerEvent {
+	return &PointerEvent{
+		Mask: mask,
+		X:    relativePointerValue(dx),
+		Y:    relativePointerValue(dy),
+	}
+}
+
+func relativePointerValue(d int) uint16 {
+	v := relativePointerOrigin + d
+	if v < 0 {
+		v = 0
+	}
+	if v > 0xFFFF {
+		v = 0xFFFF
+	}
+	return uint16(v)
+}
@@ -0,0 +1,139 @@
+package vnc2video
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRelativePointerEvent(t *testing.T) {
+	for _, test := range []struct {
+		dx, dy int
+		x, y   uint16
+	}{
+		{0, 0, 0x7FFF, 0x7FFF},
+		{5, -3, 0x8004, 0x7FFC},
+		{-0x10000, 0x10000, 0, 0xFFFF},
+	} {
+		msg := NewRelativePointerEvent(1, test.dx, test.dy)
+		if msg.Mask != 1 || msg.X != test.x || msg.Y != test.y {
+			t.Errorf("move %d,%d: got %+v, want %d,%d", test.dx, test.dy, msg, test.x, test.y)
+		}
+	}
+}
+
+func TestQEMUExtensions(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	scfg := &ServerConfig{
+		SecurityHandlers: []SecurityHandler{&ServerAuthNone{}},
+		Encodings:        []Encoding{&RawEncoding{}},
+		PixelFormat:      PixelFormat32bit,
+		ClientMessageCh:  make(chan ClientMessage, 16),
+		ServerMessageCh:  make(chan ServerMessage, 16),
+		Messages:         DefaultClientMessages,
+		Width:            16,
+		Height:           16,
+		ErrorCh:          make(chan error, 4),
+	}
+	go Serve(context.Background(), ln, scfg)
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ccfg := &ClientConfig{
+		SecurityHandlers: []SecurityHandler{&ClientAuthNone{}},
+		PixelFormat:      PixelFormat32bit,
+		ClientMessageCh:  make(chan ClientMessage, 16),
+		ServerMessageCh:  make(chan ServerMessage, 16),
+		Messages:         DefaultServerMessages,
+		Encodings: []Encoding{
+			&RawEncoding{},
+			&QEMUExtendedKeyEventPseudoEncoding{},
+			&QEMUPointerMotionChangePseudoEncoding{},
+		},
+		ErrorCh: make(chan error, 4),
+	}
+	cc, err := Connect(context.Background(), nc, ccfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	// next returns the next input event of the client
+	next := func() ClientMessage {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case msg := <-scfg.ClientMessageCh:
+				switch msg.(type) {
+				case *KeyEvent, *QEMUExtendedKeyEvent, *PointerEvent:
+					return msg
+				}
+			case err := <-scfg.ErrorCh:
+				t.Fatal(err)
+			case <-timeout:
+				t.Fatal("no client message received")
+			}
+		}
+	}
+
+	// without the server announcing it, the key goes as a plain key event
+	ccfg.ClientMessageCh <- NewQEMUExtendedKeyEvent(Escape, true)
+	if msg, ok := next().(*KeyEvent); !ok || msg.Key != Escape || msg.Down != 1 {
+		t.Fatalf("unannounced extended key sent as %v", msg)
+	}
+
+	scfg.ServerMessageCh <- &FramebufferUpdate{
+		NumRect: 2,
+		Rects: []*Rectangle{
+			{EncType: EncQEMUExtendedKeyEventPseudo, Enc: &QEMUExtendedKeyEventPseudoEncoding{}},
+			{X: 0, EncType: EncQEMUPointerMotionChangePseudo, Enc: &QEMUPointerMotionChangePseudoEncoding{}},
+		},
+	}
+	timeout := time.After(5 * time.Second)
+	for update := false; !update; {
+		select {
+		case msg := <-ccfg.ServerMessageCh:
+			_, update = msg.(*FramebufferUpdate)
+		case err := <-ccfg.ErrorCh:
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatal("no update received")
+		}
+	}
+	if !cc.ServerSupports(EncQEMUExtendedKeyEventPseudo) || !cc.ServerSupports(EncQEMUPointerMotionChangePseudo) {
+		t.Fatal("announcements not recorded")
+	}
+	if !cc.RelativePointer() {
+		t.Error("pointer not switched to relative mode")
+	}
+
+	ccfg.ClientMessageCh <- NewQEMUExtendedKeyEvent(Left, false)
+	msg, ok := next().(*QEMUExtendedKeyEvent)
+	if !ok || msg.Key != Left || msg.Down != 0 || msg.Keycode != 0xcb {
+		t.Fatalf("extended key sent as %v", msg)
+	}
+	ccfg.ClientMessageCh <- NewRelativePointerEvent(0, 2, -2)
+	if msg, ok := next().(*PointerEvent); !ok || msg.X != 0x8001 || msg.Y != 0x7FFD {
+		t.Fatalf("relative pointer sent as %v", msg)
+	}
+
+	// back to absolute mode
+	scfg.ServerMessageCh <- &FramebufferUpdate{
+		NumRect: 1,
+		Rects:   []*Rectangle{{X: 1, EncType: EncQEMUPointerMotionChangePseudo, Enc: &QEMUPointerMotionChangePseudoEncoding{}}},
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for cc.RelativePointer() {
+		if time.Now().After(deadline) {
+			t.Fatal("pointer not switched back to absolute mode")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,133 @@
+package vnc2video
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Xvp message types
+const (
+	ServerXvpMsgType ServerMessageType = 250
+	ClientXvpMsgType ClientMessageType = 250
+)
+
+// XvpCode is the code of a xvp message
+type XvpCode uint8
+
+// Xvp codes, the server sends XvpFail and XvpInit, the client the power
+// operations
+const (
+	XvpFail     XvpCode = 0
+	XvpInit     XvpCode = 1
+	XvpShutdown XvpCode = 2
+	XvpReboot   XvpCode = 3
+	XvpReset    XvpCode = 4
+)
+
+// xvpVersion is the xvp extension version spoken
+const xvpVersion = 1
+
+// String returns string
+func (code XvpCode) String() string {
+	switch code {
+	case XvpFail:
+		return "fail"
+	case XvpInit:
+		return "init"
+	case XvpShutdown:
+		return "shutdown"
+	case XvpReboot:
+		return "reboot"
+	case XvpReset:
+		return "reset"
+	}
+	return fmt.Sprintf("XvpCode(%d)", uint8(code))
+}
+
+// ServerXvp holds the wire format message, XvpInit announces support and
+// XvpFail reports a failed operation
+type ServerXvp struct {
+	_       [1]byte // padding
+	Version uint8   // xvp extension version
+	Code    XvpCode // message code
+}
+
+func (*ServerXvp) Supported(c Conn) bool {
+	return true
+}
+
+// String returns string
+func (msg *ServerXvp) String() string {
+	return fmt.Sprintf("version: %d, code: %s", msg.Version, msg.Code)
+}
+
+// Type returns MessageType
+func (*ServerXvp) Type() ServerMessageType {
+	return ServerXvpMsgType
+}
+
+// Read unmarshal message from conn
+func (*ServerXvp) Read(c Conn) (ServerMessage, error) {
+	msg := ServerXvp{}
+	if err := binary.Read(c, binary.BigEndian, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Write marshal message to conn
+func (msg *ServerXvp) Write(c Conn) error {
+	if err := binary.Write(c, binary.BigEndian, msg.Type()); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, msg); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// ClientXvp holds the wire format message, asking the server for a power
+// operation
+type ClientXvp struct {
+	_       [1]byte // padding
+	Version uint8   // xvp extension version
+	Code    XvpCode // message code
+}
+
+// Supported reports whether the server announced xvp support
+func (*ClientXvp) Supported(c Conn) bool {
+	if cc, ok := c.(*ClientConn); ok {
+		return cc.ServerSupports(EncXvpPseudo)
+	}
+	return true
+}
+
+// String returns string
+func (msg *ClientXvp) String() string {
+	return fmt.Sprintf("version: %d, code: %s", msg.Version, msg.Code)
+}
+
+// Type returns MessageType
+func (*ClientXvp) Type() ClientMessageType {
+	return ClientXvpMsgType
+}
+
+// Read unmarshal message from conn
+func (*ClientXvp) Read(c Conn) (ClientMessage, error) {
+	msg := ClientXvp{}
+	if err := binary.Read(c, binary.BigEndian, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Write marshal message to conn
+func (msg *ClientXvp) Write(c Conn) error {
+	if err := binary.Write(c, binary.BigEndian, msg.Type()); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, msg); err != nil {
+		return err
+	}
+	return c.Flush()
+}
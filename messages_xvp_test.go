@@ -0,0 +1,93 @@
+package vnc2video
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestXvp(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	codes := make(chan XvpCode, 4)
+	scfg := &ServerConfig{
+		SecurityHandlers: []SecurityHandler{&ServerAuthNone{}},
+		Encodings:        []Encoding{&RawEncoding{}, &XvpPseudoEncoding{}},
+		PixelFormat:      PixelFormat32bit,
+		ClientMessageCh:  make(chan ClientMessage, 16),
+		ServerMessageCh:  make(chan ServerMessage, 16),
+		Messages:         DefaultClientMessages,
+		Width:            16,
+		Height:           16,
+		ErrorCh:          make(chan error, 4),
+		Xvp: func(c Conn, code XvpCode) error {
+			codes <- code
+			if code == XvpReset {
+				return fmt.Errorf("no reset")
+			}
+			return nil
+		},
+	}
+	go Serve(context.Background(), ln, scfg)
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ccfg := &ClientConfig{
+		SecurityHandlers: []SecurityHandler{&ClientAuthNone{}},
+		PixelFormat:      PixelFormat32bit,
+		ClientMessageCh:  make(chan ClientMessage, 16),
+		ServerMessageCh:  make(chan ServerMessage, 16),
+		Messages:         DefaultServerMessages,
+		Encodings:        []Encoding{&RawEncoding{}, &XvpPseudoEncoding{}},
+		ErrorCh:          make(chan error, 4),
+	}
+	cc, err := Connect(context.Background(), nc, ccfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	// wait for the init message announcing xvp
+	next := func() *ServerXvp {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case msg := <-ccfg.ServerMessageCh:
+				if msg, ok := msg.(*ServerXvp); ok {
+					return msg
+				}
+			case <-timeout:
+				t.Fatal("no xvp message received")
+			}
+		}
+	}
+	if msg := next(); msg.Code != XvpInit || !cc.ServerSupports(EncXvpPseudo) {
+		t.Fatalf("got %v, server supports xvp: %v", msg, cc.ServerSupports(EncXvpPseudo))
+	}
+	if err := cc.SendXvp(XvpInit); err == nil {
+		t.Error("init sent as an operation")
+	}
+
+	if err := cc.SendXvp(XvpReboot); err != nil {
+		t.Fatal(err)
+	}
+	if code := <-codes; code != XvpReboot {
+		t.Errorf("server got %s, want reboot", code)
+	}
+	if err := cc.SendXvp(XvpReset); err != nil {
+		t.Fatal(err)
+	}
+	if code := <-codes; code != XvpReset {
+		t.Errorf("server got %s, want reset", code)
+	}
+	if msg := next(); msg.Code != XvpFail {
+		t.Errorf("failed reset answered with %v", msg)
+	}
+}
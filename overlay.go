@@ -0,0 +1,75 @@
+package vnc2video
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"time"
+)
+
+// FrameOverlay draws annotations over the frames returned by
+// VncCanvas.Frame, in framebuffer coordinates. The framebuffer itself is
+// never drawn into.
+type FrameOverlay interface {
+	DrawOverlay(dst draw.Image, now time.Time)
+}
+
+// AddOverlay adds an overlay drawn over the exported frames, overlays are
+// drawn in the order they were added
+func (c *VncCanvas) AddOverlay(o FrameOverlay) {
+	c.cropMu.Lock()
+	defer c.cropMu.Unlock()
+	c.overlays = append(c.overlays, o)
+}
+
+func (c *VncCanvas) frameOverlays() []FrameOverlay {
+	c.cropMu.Lock()
+	defer c.cropMu.Unlock()
+	return c.overlays
+}
+
+// blendPixel blends col over the pixel of dst at x, y
+func blendPixel(dst draw.Image, x, y int, col color.NRGBA) {
+	switch col.A {
+	case 0:
+		return
+	case 0xff:
+		dst.Set(x, y, color.RGBA{R: col.R, G: col.G, B: col.B, A: 1})
+		return
+	}
+	d := color.RGBAModel.Convert(dst.At(x, y)).(color.RGBA)
+	a, na := uint32(col.A), 0xff-uint32(col.A)
+	dst.Set(x, y, color.RGBA{
+		R: uint8((uint32(col.R)*a + uint32(d.R)*na) / 0xff),
+		G: uint8((uint32(col.G)*a + uint32(d.G)*na) / 0xff),
+		B: uint8((uint32(col.B)*a + uint32(d.B)*na) / 0xff),
+		A: 1,
+	})
+}
+
+// fillRectAlpha blends col over the r part of dst
+func fillRectAlpha(dst draw.Image, r image.Rectangle, col color.NRGBA) {
+	r = r.Intersect(dst.Bounds())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			blendPixel(dst, x, y, col)
+		}
+	}
+}
+
+// drawRing blends a ring of the given radius and width centered on p
+func drawRing(dst draw.Image, p image.Point, radius, width int, col color.NRGBA) {
+	outer, inner := radius*radius, (radius-width)*(radius-width)
+	if radius < width {
+		inner = 0
+	}
+	r := image.Rect(p.X-radius, p.Y-radius, p.X+radius+1, p.Y+radius+1).Intersect(dst.Bounds())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			d := (x-p.X)*(x-p.X) + (y-p.Y)*(y-p.Y)
+			if d <= outer && d >= inner {
+				blendPixel(dst, x, y, col)
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package vnc2video
+
+import "fmt"
+
+// QualityLevel is a JPEG quality level from 1 (lowest) to 10, it is sent
+// as the EncJPEGQualityLevelPseudo encoding of the same number. The zero
+// value leaves the choice to the server.
+type QualityLevel int
+
+// CompressionLevel is a compression level from 1 (fastest) to 10, it is
+// sent as the EncCompressionLevel encoding of the same number. The zero
+// value leaves the choice to the server.
+type CompressionLevel int
+
+// Subsampling is the chroma subsampling of JPEG compressed rectangles, it
+// is sent as an EncSubsamp pseudo-encoding. The zero value leaves the
+// choice to the server.
+type Subsampling int
+
+const (
+	SubsamplingDefault Subsampling = iota
+	Subsampling1X                  // 4:4:4, no subsampling
+	Subsampling4X                  // 4:2:0
+	Subsampling2X                  // 4:2:2
+	SubsamplingGray                // luminance only
+	Subsampling8X
+	Subsampling16X
+)
+
+// QualityOptions are the image quality settings a client asks the server
+// for, they are sent as pseudo-encodings along with the encodings
+type QualityOptions struct {
+	JPEGQuality QualityLevel
+	Compression CompressionLevel
+	// FineQuality is a JPEG quality from 1 to 100 for servers supporting the
+	// fine-grained quality pseudo-encodings, which use it over JPEGQuality
+	FineQuality int
+	Subsampling Subsampling
+}
+
+func (o QualityOptions) validate() error {
+	switch {
+	case o.JPEGQuality < 0 || o.JPEGQuality > 10:
+		return fmt.Errorf("invalid JPEG quality level %d", o.JPEGQuality)
+	case o.Compression < 0 || o.Compression > 10:
+		return fmt.Errorf("invalid compression level %d", o.Compression)
+	case o.FineQuality < 0 || o.FineQuality > 100:
+		return fmt.Errorf("invalid fine JPEG quality %d", o.FineQuality)
+	case o.Subsampling < SubsamplingDefault || o.Subsampling > Subsampling16X:
+		return fmt.Errorf("invalid subsampling %d", o.Subsampling)
+	}
+	return nil
+}
+
+// kinds of quality pseudo-encodings, a set option replaces the
+// pseudo-encodings of its kind in the encodings list
+const (
+	qualityKindNone = iota
+	qualityKindJPEG
+	qualityKindCompression
+	qualityKindFine
+	qualityKindSubsampling
+)
+
+func qualityKind(enc EncodingType) int {
+	switch {
+	case enc >= EncJPEGQualityLevelPseudo1 && enc <= EncJPEGQualityLevelPseudo10:
+		return qualityKindJPEG
+	case enc >= EncCompressionLevel1 && enc <= EncCompressionLevel10:
+		return qualityKindCompression
+	case enc >= EncFineQualityLevel0Pseudo && enc <= EncFineQualityLevel100Pseudo:
+		return qualityKindFine
+	case enc >= EncSubsamp1XPseudo && enc <= EncSubsamp16XPseudo:
+		return qualityKindSubsampling
+	}
+	return qualityKindNone
+}
+
+// pseudoEncodings returns the pseudo-encodings of the options that are set
+func (o QualityOptions) pseudoEncodings() map[int]EncodingType {
+	encs := make(map[int]EncodingType)
+	if o.JPEGQuality > 0 {
+		encs[qualityKindJPEG] = EncJPEGQualityLevelPseudo1 + EncodingType(o.JPEGQuality-1)
+	}
+	if o.Compression > 0 {
+		encs[qualityKindCompression] = EncCompressionLevel1 + EncodingType(o.Compression-1)
+	}
+	if o.FineQuality > 0 {
+		encs[qualityKindFine] = EncFineQualityLevel0Pseudo + EncodingType(o.FineQuality)
+	}
+	if o.Subsampling > SubsamplingDefault {
+		encs[qualityKindSubsampling] = EncSubsamp1XPseudo + EncodingType(o.Subsampling-1)
+	}
+	return encs
+}
+
+// withQuality returns encs with the pseudo-encodings of o appended, they
+// replace the ones of the same kind in encs
+func withQuality(encs []EncodingType, o QualityOptions) []EncodingType {
+	pseudo := o.pseudoEncodings()
+	res := make([]EncodingType, 0, len(encs)+len(pseudo))
+	for _, enc := range encs {
+		if _, ok := pseudo[qualityKind(enc)]; !ok {
+			res = append(res, enc)
+		}
+	}
+	for kind := qualityKindJPEG; kind <= qualityKindSubsampling; kind++ {
+		if enc, ok := pseudo[kind]; ok {
+			res = append(res, enc)
+		}
+	}
+	return res
+}
+
+// Quality returns the image quality settings asked from the server
+func (c *ClientConn) Quality() QualityOptions {
+	c.encMu.Lock()
+	defer c.encMu.Unlock()
+	return c.quality
+}
+
+// SetQuality changes the image quality settings, mid-session the encodings
+// are sent again with the new pseudo-encodings
+func (c *ClientConn) SetQuality(o QualityOptions) error {
+	if err := o.validate(); err != nil {
+		return err
+	}
+	c.encMu.Lock()
+	c.quality = o
+	encs := c.encTypes
+	c.encMu.Unlock()
+	if encs == nil {
+		return nil
+	}
+	return c.SetEncodings(encs)
+}
@@ -0,0 +1,77 @@
+package vnc2video
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQualityPseudoEncodings(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts QualityOptions
+		encs []EncodingType
+		want []EncodingType
+	}{
+		{"none", QualityOptions{}, []EncodingType{EncTight, EncJPEGQualityLevelPseudo5}, []EncodingType{EncTight, EncJPEGQualityLevelPseudo5}},
+		{"lowest", QualityOptions{JPEGQuality: 1, Compression: 1}, []EncodingType{EncTight}, []EncodingType{EncTight, -32, -256}},
+		{"highest", QualityOptions{JPEGQuality: 10, Compression: 10}, []EncodingType{EncTight}, []EncodingType{EncTight, -23, -247}},
+		{"fine", QualityOptions{FineQuality: 100}, nil, []EncodingType{-412}},
+		{"subsampling 1x", QualityOptions{Subsampling: Subsampling1X}, nil, []EncodingType{-768}},
+		{"subsampling 4x", QualityOptions{Subsampling: Subsampling4X}, nil, []EncodingType{-767}},
+		{"subsampling 2x", QualityOptions{Subsampling: Subsampling2X}, nil, []EncodingType{-766}},
+		{"subsampling gray", QualityOptions{Subsampling: SubsamplingGray}, nil, []EncodingType{-765}},
+		{"subsampling 16x", QualityOptions{Subsampling: Subsampling16X}, nil, []EncodingType{-763}},
+		{
+			"replaced",
+			QualityOptions{JPEGQuality: 3, FineQuality: 1},
+			[]EncodingType{EncJPEGQualityLevelPseudo8, EncTight, EncFineQualityLevel0Pseudo, EncCompressionLevel2},
+			[]EncodingType{EncTight, EncCompressionLevel2, -30, -511},
+		},
+	} {
+		if got := withQuality(test.encs, test.opts); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	for _, opts := range []QualityOptions{
+		{JPEGQuality: 11},
+		{JPEGQuality: -1},
+		{Compression: 11},
+		{FineQuality: 101},
+		{Subsampling: Subsampling16X + 1},
+	} {
+		if opts.validate() == nil {
+			t.Errorf("%+v accepted", opts)
+		}
+	}
+}
+
+func TestServerQualityLevels(t *testing.T) {
+	for _, test := range []struct {
+		opts                 QualityOptions
+		quality, compression int
+	}{
+		{QualityOptions{}, -1, -1},
+		{QualityOptions{JPEGQuality: 1, Compression: 1}, 0, 0},
+		{QualityOptions{JPEGQuality: 10, Compression: 10}, 9, 9},
+		{QualityOptions{JPEGQuality: 6}, 5, -1},
+		// the fine quality and subsampling levels are not mapped
+		{QualityOptions{FineQuality: 80, Subsampling: Subsampling2X}, -1, -1},
+	} {
+		c := &ServerConn{cfg: &ServerConfig{Encodings: []Encoding{&TightEncoding{}}}}
+		c.SetEncodings(withQuality([]EncodingType{EncTight}, test.opts))
+		if c.JPEGQualityLevel() != test.quality || c.CompressionLevel() != test.compression {
+			t.Errorf("%+v: levels %d,%d want %d,%d", test.opts, c.JPEGQualityLevel(), c.CompressionLevel(), test.quality, test.compression)
+		}
+		// the levels the Tight encoder uses, the compression level
+		// defaults to TightDefaultCompressionLevel
+		quality, compression := tightLevels(c)
+		wantCompression := test.compression
+		if wantCompression < 0 {
+			wantCompression = TightDefaultCompressionLevel
+		}
+		if quality != test.quality || compression != wantCompression {
+			t.Errorf("%+v: Tight levels %d,%d want %d,%d", test.opts, quality, compression, test.quality, wantCompression)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package recorder
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// NewHandler returns the HTTP API of m:
+//
+//	POST   /sessions            starts a recording, the body is a SessionConfig
+//	GET    /sessions            lists the sessions, ?state=recording the active ones
+//	GET    /sessions/{id}       returns a session
+//	POST   /sessions/{id}/stop  stops a recording
+//	GET    /sessions/{id}/file  downloads the recording of a finished session
+//	DELETE /sessions/{id}       removes a finished session and its recording
+//
+// Sessions are sent as JSON, errors as {"error": "..."}.
+//
+// authorize checks every request, the refused ones get a 401 response.
+// Whoever gets through records any host the manager reaches with the
+// credentials they choose and downloads every recording: only leave it
+// nil when the handler is behind another authentication.
+func NewHandler(m *Manager, authorize func(*http.Request) error) http.Handler {
+	return &handler{m: m, authorize: authorize}
+}
+
+// BearerToken returns a NewHandler authorization accepting the requests
+// with an "Authorization: Bearer <token>" header. An empty token refuses
+// every request.
+func BearerToken(token string) func(*http.Request) error {
+	return func(r *http.Request) error {
+		got := r.Header.Get("Authorization")
+		if token == "" || !strings.HasPrefix(got, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(got[len("Bearer "):]), []byte(token)) != 1 {
+			return errors.New("bad or missing token")
+		}
+		return nil
+	}
+}
+
+type handler struct {
+	m         *Manager
+	authorize func(*http.Request) error
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.authorize != nil {
+		if err := h.authorize(r); err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	if parts[0] != "sessions" || len(parts) > 3 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		h.list(w, r)
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		h.start(w, r)
+	case len(parts) == 1:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		s, err := h.m.Session(parts[1])
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		switch err := h.m.Remove(parts[1]); err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case ErrNotFound:
+			writeError(w, http.StatusNotFound, err.Error())
+		case ErrRecording:
+			writeError(w, http.StatusConflict, err.Error())
+		default:
+			writeError(w, http.StatusInternalServerError, err.Error())
+		}
+	case len(parts) == 2:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+
+	case parts[2] == "stop" && r.Method == http.MethodPost:
+		s, err := h.m.Stop(parts[1])
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	case parts[2] == "file" && r.Method == http.MethodGet:
+		h.download(w, r, parts[1])
+	case parts[2] == "stop" || parts[2] == "file":
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (h *handler) list(w http.ResponseWriter, r *http.Request) {
+	state := State(r.URL.Query().Get("state"))
+	list := []*Session{}
+	for _, s := range h.m.Sessions() {
+		if state == "" || s.State == state {
+			list = append(list, s)
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (h *handler) start(w http.ResponseWriter, r *http.Request) {
+	var cfg SessionConfig
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		writeError(w, http.StatusBadRequest, "bad session config: "+err.Error())
+		return
+	}
+	s, err := h.m.Start(cfg)
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusCreated, s)
+	case s == nil:
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		// the host could not be recorded, the failed session is kept
+		writeError(w, http.StatusBadGateway, err.Error())
+	}
+}
+
+func (h *handler) download(w http.ResponseWriter, r *http.Request, id string) {
+	s, err := h.m.Session(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if s.State == StateRecording {
+		writeError(w, http.StatusConflict, ErrRecording.Error())
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="`+s.File+`"`)
+	http.ServeFile(w, r, h.m.Path(s))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
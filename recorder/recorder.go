@@ -0,0 +1,475 @@
+// Package recorder is a service recording many VNC sessions at once, to
+// videos or FBS files, with an HTTP API to start and stop recordings,
+// follow them and download what they recorded. The metadata of every
+// session is kept as JSON next to its recording, so the sessions outlive
+// the process.
+package recorder
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amitbet/vnc2video/logger"
+)
+
+// Format is the output of a recording
+type Format string
+
+const (
+	// FormatFBS records the server messages, vnc2video.FbsConn plays them
+	// back and turns them into any video later
+	FormatFBS     Format = "fbs"
+	FormatMJPEG   Format = "mjpeg"
+	FormatX264    Format = "x264"
+	FormatVP8     Format = "vp8"
+	FormatHuffYUV Format = "huffyuv"
+	FormatQTRLE   Format = "qtrle"
+)
+
+// formatExt is the file extension of every format, the one the encoders
+// give their videos
+var formatExt = map[Format]string{
+	FormatFBS:     ".fbs",
+	FormatMJPEG:   ".avi",
+	FormatX264:    ".mp4",
+	FormatVP8:     ".webm",
+	FormatHuffYUV: ".avi",
+	FormatQTRLE:   ".mov",
+}
+
+// State is the state of a session
+type State string
+
+const (
+	StateRecording State = "recording"
+	// StateStopped is a recording stopped by Stop or its time limit
+	StateStopped State = "stopped"
+	// StateFailed is a session that could not connect or lost its
+	// connection, Session.Error tells why
+	StateFailed State = "failed"
+	// StateInterrupted is a session found recording when the manager
+	// started, the process ended without finishing it
+	StateInterrupted State = "interrupted"
+)
+
+var (
+	ErrNotFound  = errors.New("recorder: no such session")
+	ErrRecording = errors.New("recorder: the session is recording")
+)
+
+// SSHConfig reaches the host through SSH, see sshtunnel.Config. The key
+// and known_hosts files are the ones of the manager Config, sessions
+// don't name files.
+type SSHConfig struct {
+	Hops       []string `json:"hops"`
+	User       string   `json:"user,omitempty"`
+	Passphrase string   `json:"passphrase,omitempty"`
+	Agent      bool     `json:"agent,omitempty"`
+}
+
+// SessionConfig is the configuration of a recording
+type SessionConfig struct {
+	// Host is the VNC server as host:port
+	Host string `json:"host"`
+	// Username and Password are the credentials, the security types
+	// taking a username are offered when it is set. The password is left
+	// out of the session metadata.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// ServerKeyFingerprint is the vnc2video.RSAKeyFingerprint of the
+	// server key, the RSA-AES security types are offered first when it is
+	// set
+	ServerKeyFingerprint string `json:"server_key_fingerprint,omitempty"`
+	// AllowPlain offers VeNCrypt Plain, which sends the username and the
+	// password unencrypted, after the other security types
+	AllowPlain bool `json:"allow_plain,omitempty"`
+	// Format is the output, FormatFBS when empty
+	Format Format `json:"format,omitempty"`
+	// Framerate is the frames per second of the videos and the rate of
+	// update requests, 12 when not set
+	Framerate int `json:"framerate,omitempty"`
+	// MaxSeconds stops the recording after that long, when set
+	MaxSeconds int `json:"max_seconds,omitempty"`
+	// IdleSeconds pauses the videos once the screen did not change for
+	// that long, until it changes again. FBS recordings hold the changes
+	// only anyway.
+	IdleSeconds int `json:"idle_seconds,omitempty"`
+	// SSH tunnels the connection to Host, when set
+	SSH *SSHConfig `json:"ssh,omitempty"`
+	// Rule is the name of the Scheduler rule starting the session
+	Rule string `json:"rule,omitempty"`
+}
+
+// withoutSecrets returns cfg without its password and passphrase
+func (cfg SessionConfig) withoutSecrets() SessionConfig {
+	cfg.Password = ""
+	if cfg.SSH != nil {
+		ssh := *cfg.SSH
+		ssh.Passphrase = ""
+		cfg.SSH = &ssh
+	}
+	return cfg
+}
+
+// Stats are the counters of a session
+type Stats struct {
+	// Updates is the number of framebuffer updates received
+	Updates int64 `json:"updates"`
+	// Frames is the number of video frames encoded
+	Frames    int64 `json:"frames"`
+	BytesRead int64 `json:"bytes_read"`
+	FileSize  int64 `json:"file_size"`
+}
+
+// Session is the metadata of a recording
+type Session struct {
+	ID     string        `json:"id"`
+	Config SessionConfig `json:"config"`
+	State  State         `json:"state"`
+	Error  string        `json:"error,omitempty"`
+	// File is the name of the recording in the manager directory
+	File    string     `json:"file"`
+	Started time.Time  `json:"started"`
+	Stopped *time.Time `json:"stopped,omitempty"`
+	Stats   Stats      `json:"stats"`
+}
+
+// Config configures a Manager
+type Config struct {
+	// Dir holds the recordings and their metadata, it is created when
+	// missing
+	Dir string
+	// FFMpegBinPath is the ffmpeg binary the video formats but mjpeg run,
+	// it is looked up in PATH when empty
+	FFMpegBinPath string
+	// ConnectTimeout limits connecting to a host, 10 seconds when not set
+	ConnectTimeout time.Duration
+	// SSHKeyFiles are the private keys the SSH tunnels of the sessions
+	// authenticate with, SSHKnownHostsFiles verify their host keys,
+	// ~/.ssh/known_hosts when empty
+	SSHKeyFiles        []string
+	SSHKnownHostsFiles []string
+	// Clock dates the sessions and tells when they are idle, the system
+	// clock when nil
+	Clock Clock
+	// Logger is the logger of the manager and its sessions, by default
+	// the logger package's default logger is used
+	Logger logger.Logger
+}
+
+// Manager runs recording sessions
+type Manager struct {
+	cfg   Config
+	log   logger.Logger
+	clock Clock
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// session is a Session and the state of its recording
+type session struct {
+	// the counters, updated by the recording goroutine
+	updates   int64
+	frames    int64
+	bytesRead int64
+
+	mu   sync.Mutex
+	info Session
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewManager returns a manager storing to cfg.Dir, with the sessions
+// found there
+func NewManager(cfg Config) (*Manager, error) {
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("recorder: no directory")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("recorder: %v", err)
+	}
+	if cfg.FFMpegBinPath == "" {
+		// the formats needing ffmpeg fail to start without it
+		cfg.FFMpegBinPath, _ = exec.LookPath("ffmpeg")
+	}
+	if cfg.ConnectTimeout == 0 {
+		cfg.ConnectTimeout = 10 * time.Second
+	}
+	m := &Manager{cfg: cfg, log: cfg.Logger, clock: cfg.Clock, sessions: make(map[string]*session)}
+	if m.log == nil {
+		m.log = logger.Default()
+	}
+	if m.clock == nil {
+		m.clock = realClock{}
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Start connects to cfg.Host and starts recording. A session is returned
+// along with the error when the connection failed.
+func (m *Manager) Start(cfg SessionConfig) (*Session, error) {
+	if cfg.Host == "" {
+		return nil, fmt.Errorf("recorder: no host")
+	}
+	if cfg.Format == "" {
+		cfg.Format = FormatFBS
+	}
+	ext, ok := formatExt[cfg.Format]
+	if !ok {
+		return nil, fmt.Errorf("recorder: unknown format %q", cfg.Format)
+	}
+	if cfg.Format != FormatFBS && cfg.Format != FormatMJPEG && m.cfg.FFMpegBinPath == "" {
+		return nil, fmt.Errorf("recorder: the %s format needs ffmpeg", cfg.Format)
+	}
+	if cfg.Framerate <= 0 {
+		cfg.Framerate = 12
+	}
+	if cfg.SSH != nil && len(cfg.SSH.Hops) == 0 {
+		return nil, fmt.Errorf("recorder: no SSH host")
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session{
+		info: Session{
+			ID:      id,
+			Config:  cfg.withoutSecrets(),
+			State:   StateRecording,
+			File:    id + ext,
+			Started: m.clock.Now(),
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	r, err := m.record(s, &cfg)
+	m.mu.Lock()
+	m.sessions[id] = s
+	m.mu.Unlock()
+	if err != nil {
+		m.log.Errorf("recording %s of %s failed: %v", id, cfg.Host, err)
+		os.Remove(m.path(s.info.File))
+		m.finish(s, err)
+		return m.snapshot(s), err
+	}
+	m.log.Infof("recording %s of %s started", id, cfg.Host)
+	m.save(s)
+	go r.run()
+	return m.snapshot(s), nil
+}
+
+// Stop stops a recording and waits for its file to be complete, stopping a
+// finished session does nothing
+func (m *Manager) Stop(id string) (*Session, error) {
+	s := m.session(id)
+	if s == nil {
+		return nil, ErrNotFound
+	}
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.done
+	return m.snapshot(s), nil
+}
+
+// Session returns the session id, with its stats so far
+func (m *Manager) Session(id string) (*Session, error) {
+	s := m.session(id)
+	if s == nil {
+		return nil, ErrNotFound
+	}
+	return m.snapshot(s), nil
+}
+
+// Sessions returns the sessions, the oldest first
+func (m *Manager) Sessions() []*Session {
+	m.mu.Lock()
+	all := make([]*session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		all = append(all, s)
+	}
+	m.mu.Unlock()
+	list := make([]*Session, len(all))
+	for i, s := range all {
+		list[i] = m.snapshot(s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Started.Equal(list[j].Started) {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].Started.Before(list[j].Started)
+	})
+	return list
+}
+
+// Path returns the path of the recording of a session
+func (m *Manager) Path(s *Session) string {
+	return m.path(s.File)
+}
+
+// Remove deletes a finished session, its recording and its metadata
+func (m *Manager) Remove(id string) error {
+	m.mu.Lock()
+	s := m.sessions[id]
+	if s == nil {
+		m.mu.Unlock()
+		return ErrNotFound
+	}
+	select {
+	case <-s.done:
+	default:
+		m.mu.Unlock()
+		return ErrRecording
+	}
+	delete(m.sessions, id)
+	m.mu.Unlock()
+	s.mu.Lock()
+	file := s.info.File
+	s.mu.Unlock()
+	if err := os.Remove(m.path(file)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("recorder: %v", err)
+	}
+	if err := os.Remove(m.path(id + ".json")); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("recorder: %v", err)
+	}
+	return nil
+}
+
+// Close stops the recordings
+func (m *Manager) Close() error {
+	var wg sync.WaitGroup
+	for _, s := range m.Sessions() {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			m.Stop(id)
+		}(s.ID)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (m *Manager) session(id string) *session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sessions[id]
+}
+
+func (m *Manager) path(name string) string {
+	return filepath.Join(m.cfg.Dir, name)
+}
+
+// snapshot returns a copy of the session, the stats of a recording are
+// the current ones
+func (m *Manager) snapshot(s *session) *Session {
+	s.mu.Lock()
+	info := s.info
+	s.mu.Unlock()
+	if info.State == StateRecording {
+		info.Stats = s.stats()
+		if fi, err := os.Stat(m.path(info.File)); err == nil {
+			info.Stats.FileSize = fi.Size()
+		}
+	}
+	return &info
+}
+
+func (s *session) stats() Stats {
+	return Stats{
+		Updates:   atomic.LoadInt64(&s.updates),
+		Frames:    atomic.LoadInt64(&s.frames),
+		BytesRead: atomic.LoadInt64(&s.bytesRead),
+	}
+}
+
+// finish records the end of a session, err is the reason it failed
+func (m *Manager) finish(s *session, err error) {
+	stats := s.stats()
+	if fi, e := os.Stat(m.path(s.info.File)); e == nil {
+		stats.FileSize = fi.Size()
+	}
+	now := m.clock.Now()
+	s.mu.Lock()
+	s.info.State, s.info.Stopped, s.info.Stats = StateStopped, &now, stats
+	if err != nil {
+		s.info.State, s.info.Error = StateFailed, err.Error()
+	}
+	s.mu.Unlock()
+	m.save(s)
+	close(s.done)
+}
+
+// save writes the metadata of a session to <id>.json, through a temporary
+// file so that it is never found half written
+func (m *Manager) save(s *session) {
+	info := m.snapshot(s)
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		m.log.Errorf("saving session %s: %v", info.ID, err)
+		return
+	}
+	name := m.path(info.ID + ".json")
+	if err := ioutil.WriteFile(name+".tmp", data, 0644); err != nil {
+		m.log.Errorf("saving session %s: %v", info.ID, err)
+		return
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		m.log.Errorf("saving session %s: %v", info.ID, err)
+	}
+}
+
+// load reads the sessions saved in the directory, the ones still
+// recording were interrupted
+func (m *Manager) load() error {
+	files, err := filepath.Glob(m.path("*.json"))
+	if err != nil {
+		return fmt.Errorf("recorder: %v", err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("recorder: %v", err)
+		}
+		s := &session{stop: make(chan struct{}), done: make(chan struct{})}
+		if err := json.Unmarshal(data, &s.info); err != nil || s.info.ID == "" {
+			m.log.Warnf("skipping session file %s: %v", file, err)
+			continue
+		}
+		close(s.stop)
+		close(s.done)
+		m.sessions[s.info.ID] = s
+		if s.info.State == StateRecording {
+			s.info.State = StateInterrupted
+			if fi, err := os.Stat(m.path(s.info.File)); err == nil {
+				mod := fi.ModTime()
+				s.info.Stopped, s.info.Stats.FileSize = &mod, fi.Size()
+			}
+			m.save(s)
+		}
+	}
+	return nil
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("recorder: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,326 @@
+package recorder
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	vnc "github.com/amitbet/vnc2video"
+	"github.com/amitbet/vnc2video/logger"
+)
+
+// fillRect writes raw pixels of a single gray, standing in for a server
+// side encoder
+type fillRect byte
+
+func (fillRect) Type() vnc.EncodingType              { return vnc.EncRaw }
+func (fillRect) Supported(vnc.Conn) bool             { return true }
+func (fillRect) Reset() error                        { return nil }
+func (fillRect) Read(vnc.Conn, *vnc.Rectangle) error { return nil }
+func (f fillRect) Write(c vnc.Conn, rect *vnc.Rectangle) error {
+	_, err := c.Write(bytes.Repeat([]byte{byte(f), byte(f), byte(f), 0}, int(rect.Width)*int(rect.Height)))
+	return err
+}
+
+// update returns a framebuffer update filling the 32x16 desktop
+func update(gray int) *vnc.FramebufferUpdate {
+	return &vnc.FramebufferUpdate{
+		NumRect: 1,
+		Rects: []*vnc.Rectangle{
+			{Width: 32, Height: 16, EncType: vnc.EncRaw, Enc: fillRect(gray)},
+		},
+	}
+}
+
+// vncServer serves a 32x16 desktop, with auto set it sends an update every
+// 10ms until the test ends, otherwise the test sends them on the returned
+// config
+func vncServer(t *testing.T, auto bool) (string, *vnc.ServerConfig, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &vnc.ServerConfig{
+		SecurityHandlers: []vnc.SecurityHandler{&vnc.ServerAuthVNC{Challenge: make([]byte, 16), Password: []byte("secret")}},
+		Encodings:        []vnc.Encoding{&vnc.RawEncoding{}},
+		PixelFormat:      vnc.PixelFormat32bit,
+		ClientMessageCh:  make(chan vnc.ClientMessage, 16),
+		ServerMessageCh:  make(chan vnc.ServerMessage),
+		Messages:         vnc.DefaultClientMessages,
+		Width:            32,
+		Height:           16,
+		ErrorCh:          make(chan error, 16),
+		Logger:           logger.NewSimpleLogger(logger.LogLevelError, "server"),
+	}
+	go vnc.Serve(context.Background(), ln, cfg)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; auto; i++ {
+			select {
+			case cfg.ServerMessageCh <- update(i):
+			case <-done:
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	return ln.Addr().String(), cfg, func() {
+		close(done)
+		ln.Close()
+	}
+}
+
+// newManager returns a manager of dir, clock is nil for the system clock
+func newManager(t *testing.T, dir string, clock Clock) *Manager {
+	m, err := NewManager(Config{Dir: dir, Clock: clock, Logger: logger.NewSimpleLogger(logger.LogLevelError, "recorder")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// waitUpdates waits for a session to receive n updates
+func waitUpdates(t *testing.T, m *Manager, id string, n int64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s, err := m.Session(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Stats.Updates >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d updates received, waited for %d", s.Stats.Updates, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRecordFBS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, _, stop := vncServer(t, true)
+	defer stop()
+	m := newManager(t, dir, nil)
+
+	if _, err := m.Start(SessionConfig{Host: addr, Password: "wrong"}); err == nil {
+		t.Fatal("recording started with a wrong password")
+	}
+	s, err := m.Start(SessionConfig{Host: addr, Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitUpdates(t, m, s.ID, 3)
+	if s, err = m.Stop(s.ID); err != nil {
+		t.Fatal(err)
+	}
+	if s.State != StateStopped || s.Stats.FileSize == 0 || s.Stats.BytesRead == 0 || s.Config.Password != "" {
+		t.Errorf("stopped session %+v", s)
+	}
+
+	// the recording plays back
+	fbs, err := vnc.NewFbsConn(m.Path(s), []vnc.Encoding{&vnc.RawEncoding{Image: vnc.NewVncCanvas(32, 16)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fbs.Close()
+	if fbs.Width() != 32 || fbs.Height() != 16 {
+		t.Errorf("recorded desktop is %dx%d", fbs.Width(), fbs.Height())
+	}
+	msg, err := vnc.NewFBSPlayHelper(fbs).ReadFbsMessage(false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type() != vnc.FramebufferUpdateMsgType {
+		t.Errorf("first recorded message is %v", msg.Type())
+	}
+
+	// the sessions are found again, a session left recording was
+	// interrupted
+	var left Session
+	left.ID, left.State, left.File = "left", StateRecording, "left.fbs"
+	data, _ := json.Marshal(&left)
+	if err := ioutil.WriteFile(filepath.Join(dir, "left.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m = newManager(t, dir, nil)
+	list := m.Sessions()
+	if len(list) != 3 {
+		t.Fatalf("%d sessions loaded", len(list))
+	}
+	states := map[State]int{}
+	for _, s := range list {
+		states[s.State]++
+	}
+	if states[StateFailed] != 1 || states[StateStopped] != 1 || states[StateInterrupted] != 1 {
+		t.Errorf("loaded session states %v", states)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, _, stop := vncServer(t, true)
+	defer stop()
+	m := newManager(t, dir, nil)
+	defer m.Close()
+	srv := httptest.NewServer(NewHandler(m, BearerToken("letmein")))
+	defer srv.Close()
+
+	token := "letmein"
+	do := func(method, path, body string, status int, v interface{}) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != status {
+			t.Fatalf("%s %s: %d %s, expected %d", method, path, resp.StatusCode, data, status)
+		}
+		if v != nil {
+			if p, ok := v.(*[]byte); ok {
+				*p = data
+			} else if err := json.Unmarshal(data, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, token = range []string{"", "other"} {
+		do("GET", "/sessions", "", http.StatusUnauthorized, nil)
+		do("POST", "/sessions", `{"host": "`+addr+`", "password": "secret"}`, http.StatusUnauthorized, nil)
+	}
+	if len(m.Sessions()) != 0 {
+		t.Fatal("session started without the token")
+	}
+	token = "letmein"
+
+	do("POST", "/sessions", `{"host": "`+addr+`", "format": "gif"}`, http.StatusBadRequest, nil)
+	var s Session
+	do("POST", "/sessions", `{"host": "`+addr+`", "password": "secret", "format": "mjpeg", "framerate": 50}`, http.StatusCreated, &s)
+	waitUpdates(t, m, s.ID, 3)
+
+	var list []Session
+	do("GET", "/sessions?state=recording", "", http.StatusOK, &list)
+	if len(list) != 1 || list[0].ID != s.ID || list[0].Stats.Updates < 3 {
+		t.Errorf("active sessions %+v", list)
+	}
+	do("GET", "/sessions/"+s.ID+"/file", "", http.StatusConflict, nil)
+	do("DELETE", "/sessions/"+s.ID, "", http.StatusConflict, nil)
+	do("POST", "/sessions/"+s.ID+"/stop", "", http.StatusOK, &s)
+	if s.State != StateStopped || s.Stats.Frames == 0 {
+		t.Errorf("stopped session %+v", s)
+	}
+	do("GET", "/sessions?state=recording", "", http.StatusOK, &list)
+	if len(list) != 0 {
+		t.Errorf("active sessions %+v", list)
+	}
+
+	var video []byte
+	do("GET", "/sessions/"+s.ID+"/file", "", http.StatusOK, &video)
+	if !bytes.HasPrefix(video, []byte("RIFF")) {
+		t.Errorf("downloaded %d bytes, not an AVI file", len(video))
+	}
+	do("DELETE", "/sessions/"+s.ID, "", http.StatusNoContent, nil)
+	do("GET", "/sessions/"+s.ID, "", http.StatusNotFound, nil)
+	if _, err := os.Stat(filepath.Join(dir, s.File)); !os.IsNotExist(err) {
+		t.Errorf("recording left after removal: %v", err)
+	}
+}
+
+func TestSecurityHandlers(t *testing.T) {
+	types := func(cfg SessionConfig) []vnc.SecurityType {
+		var list []vnc.SecurityType
+		for _, h := range cfg.securityHandlers() {
+			list = append(list, h.Type())
+		}
+		return list
+	}
+	for _, test := range []struct {
+		cfg  SessionConfig
+		want []vnc.SecurityType
+	}{
+		{SessionConfig{}, []vnc.SecurityType{vnc.SecTypeNone}},
+		{SessionConfig{Password: "p"}, []vnc.SecurityType{vnc.SecTypeVNC, vnc.SecTypeNone}},
+		{SessionConfig{Username: "u", Password: "p"}, []vnc.SecurityType{vnc.SecTypeARD, vnc.SecTypeMSLogonII, vnc.SecTypeVNC, vnc.SecTypeNone}},
+		{SessionConfig{Username: "u", Password: "p", AllowPlain: true}, []vnc.SecurityType{vnc.SecTypeARD, vnc.SecTypeMSLogonII, vnc.SecTypeVNC, vnc.SecTypeVeNCrypt, vnc.SecTypeNone}},
+		{SessionConfig{Username: "u", Password: "p", ServerKeyFingerprint: "ab"}, []vnc.SecurityType{vnc.SecTypeRA256, vnc.SecTypeRA2, vnc.SecTypeARD, vnc.SecTypeMSLogonII, vnc.SecTypeVNC, vnc.SecTypeNone}},
+	} {
+		if got := types(test.cfg); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%+v offers %v, want %v", test.cfg, got, test.want)
+		}
+	}
+}
+
+func TestRecordRSAAES(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go vnc.Serve(context.Background(), ln, &vnc.ServerConfig{
+		SecurityHandlers: []vnc.SecurityHandler{&vnc.ServerAuthRA2{Key: key, Authenticate: func(username, password []byte) error {
+			if string(password) != "secret" {
+				return errors.New("wrong password")
+			}
+			return nil
+		}}},
+		Encodings:       []vnc.Encoding{&vnc.RawEncoding{}},
+		PixelFormat:     vnc.PixelFormat32bit,
+		ClientMessageCh: make(chan vnc.ClientMessage, 16),
+		ServerMessageCh: make(chan vnc.ServerMessage),
+		Messages:        vnc.DefaultClientMessages,
+		Width:           32,
+		Height:          16,
+		ErrorCh:         make(chan error, 16),
+		Logger:          logger.NewSimpleLogger(logger.LogLevelError, "server"),
+	})
+	m := newManager(t, dir, nil)
+	defer m.Close()
+
+	cfg := SessionConfig{Host: ln.Addr().String(), Username: "u", Password: "secret"}
+	if _, err := m.Start(cfg); err == nil {
+		t.Error("recording started without the server key fingerprint")
+	}
+	cfg.ServerKeyFingerprint = vnc.RSAKeyFingerprint(&key.PublicKey)
+	s, err := m.Start(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err = m.Stop(s.ID); err != nil || s.State != StateStopped {
+		t.Errorf("stopped session %+v: %v", s, err)
+	}
+}
@@ -0,0 +1,388 @@
+package recorder
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clock is the time source of a Manager and its Scheduler, tests replace
+// it with a fake one
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Window is a daily time window, such as 09:00 to 17:00 on weekdays. A
+// window ending before it starts goes on past midnight.
+type Window struct {
+	// From and To are hh:mm in the time zone of the clock
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Days are the days the window starts on, as "mon" to "sun", every
+	// day when empty
+	Days []string `json:"days,omitempty"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseClock returns the minutes since midnight of hh:mm
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("recorder: bad time of day %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w *Window) validate() error {
+	if _, err := parseClock(w.From); err != nil {
+		return err
+	}
+	if _, err := parseClock(w.To); err != nil {
+		return err
+	}
+	for _, d := range w.Days {
+		if _, ok := weekdays[strings.ToLower(d)]; !ok {
+			return fmt.Errorf("recorder: bad day %q", d)
+		}
+	}
+	return nil
+}
+
+// contains tells whether t is within the window
+func (w *Window) contains(t time.Time) bool {
+	from, _ := parseClock(w.From)
+	to, _ := parseClock(w.To)
+	now := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	switch {
+	case from < to:
+		if now < from || now >= to {
+			return false
+		}
+	case now >= from:
+	case now < to:
+		// the window started the day before
+		day = (day + 6) % 7
+	default:
+		return false
+	}
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Rule records a host during time windows. A recording reaching its
+// MaxSeconds or losing its connection within a window is started again,
+// so MaxSeconds cuts long recordings into parts.
+type Rule struct {
+	// Name identifies the rule, it is set as the Rule of its sessions
+	Name    string        `json:"name"`
+	Session SessionConfig `json:"session"`
+	// Windows are the times to record, always when empty
+	Windows []Window `json:"windows,omitempty"`
+}
+
+// active tells whether the rule records at t
+func (r *Rule) active(t time.Time) bool {
+	if len(r.Windows) == 0 {
+		return true
+	}
+	for i := range r.Windows {
+		if r.Windows[i].contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Retention limits the recordings kept for every host, the oldest go
+// first and recordings in progress are never removed
+type Retention struct {
+	// MaxAgeDays removes the recordings started that many days ago
+	MaxAgeDays int `json:"max_age_days,omitempty"`
+	// MaxBytesPerHost removes the oldest recordings of a host once its
+	// recordings take more
+	MaxBytesPerHost int64 `json:"max_bytes_per_host,omitempty"`
+	// CompactAfterDays gzips the FBS recordings started that many days
+	// ago, they are gunzipped before playing them back
+	CompactAfterDays int `json:"compact_after_days,omitempty"`
+}
+
+// SchedulerConfig configures a Scheduler
+type SchedulerConfig struct {
+	Rules     []Rule    `json:"rules"`
+	Retention Retention `json:"retention"`
+	// IntervalSeconds is the time between two checks of the rules and the
+	// retention, 30 seconds when not set
+	IntervalSeconds int `json:"interval_seconds,omitempty"`
+}
+
+// Scheduler starts and stops the recordings of a Manager following rules,
+// and applies the retention to its directory
+type Scheduler struct {
+	m        *Manager
+	cfg      SchedulerConfig
+	interval time.Duration
+
+	mu sync.Mutex
+	// running is the recording session of every rule, failed its last
+	// session that could not start, only the last one is kept
+	running map[string]string
+	failed  map[string]string
+	// busy are the rules a Tick is starting or stopping the recording of,
+	// other Ticks leave them alone
+	busy map[string]bool
+	// done is set once Run stopped the recordings, none starts afterwards
+	done bool
+}
+
+// NewScheduler returns a scheduler of m, the rules are checked by Run or
+// Tick
+func NewScheduler(m *Manager, cfg SchedulerConfig) (*Scheduler, error) {
+	names := make(map[string]bool)
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		if r.Name == "" || names[r.Name] {
+			return nil, fmt.Errorf("recorder: rules need distinct names, got %q", r.Name)
+		}
+		names[r.Name] = true
+		if r.Session.Host == "" {
+			return nil, fmt.Errorf("recorder: rule %s has no host", r.Name)
+		}
+		for j := range r.Windows {
+			if err := r.Windows[j].validate(); err != nil {
+				return nil, fmt.Errorf("rule %s: %v", r.Name, err)
+			}
+		}
+		r.Session.Rule = r.Name
+	}
+	interval := time.Duration(cfg.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	return &Scheduler{
+		m:        m,
+		cfg:      cfg,
+		interval: interval,
+		running:  make(map[string]string),
+		failed:   make(map[string]string),
+		busy:     make(map[string]bool),
+	}, nil
+}
+
+// Run checks the rules and the retention until ctx is done, then stops
+// the recordings of the rules. The scheduler starts no recording after
+// Run returned.
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		s.Tick()
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.done = true
+			running := s.running
+			s.running = make(map[string]string)
+			s.mu.Unlock()
+			for _, id := range running {
+				s.m.Stop(id)
+			}
+			return
+		case <-s.m.clock.After(s.interval):
+		}
+	}
+}
+
+// Tick starts the recordings of the rules entering a window, stops the
+// ones leaving it and applies the retention
+func (s *Scheduler) Tick() {
+	now := s.m.clock.Now()
+	for i := range s.cfg.Rules {
+		s.tickRule(&s.cfg.Rules[i], now)
+	}
+	s.applyRetention(now)
+}
+
+// tickRule starts or stops the recording of r. The rule is marked busy
+// meanwhile instead of holding s.mu, as starting connects to the host and
+// stopping waits for the video to be finished.
+func (s *Scheduler) tickRule(r *Rule, now time.Time) {
+	s.mu.Lock()
+	if s.busy[r.Name] {
+		s.mu.Unlock()
+		return
+	}
+	id, ok := s.running[r.Name]
+	failed, hasFailed := s.failed[r.Name]
+	done := s.done
+	s.busy[r.Name] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.busy, r.Name)
+		s.mu.Unlock()
+	}()
+
+	if ok {
+		if sess, err := s.m.Session(id); err != nil || sess.State != StateRecording {
+			// stopped by its time limit or failed, it starts again while
+			// the rule is active
+			s.forget(r.Name)
+			ok = false
+		}
+	}
+	switch active := r.active(now); {
+	case active && !ok && !done:
+		sess, err := s.m.Start(r.Session)
+		if hasFailed {
+			s.m.Remove(failed)
+		}
+		s.mu.Lock()
+		delete(s.failed, r.Name)
+		if err != nil {
+			if sess != nil {
+				s.failed[r.Name] = sess.ID
+			}
+			s.mu.Unlock()
+			s.m.log.Errorf("rule %s: %v", r.Name, err)
+			return
+		}
+		// Run may have stopped the recordings meanwhile
+		done = s.done
+		if !done {
+			s.running[r.Name] = sess.ID
+		}
+		s.mu.Unlock()
+		if done {
+			s.m.Stop(sess.ID)
+		}
+	case !active && ok:
+		s.m.Stop(id)
+		s.forget(r.Name)
+	}
+}
+
+// forget drops the recording of a rule
+func (s *Scheduler) forget(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, name)
+}
+
+// applyRetention removes and compacts the finished recordings of every
+// host as the retention says
+func (s *Scheduler) applyRetention(now time.Time) {
+	ret := s.cfg.Retention
+	hosts := make(map[string][]*Session)
+	for _, sess := range s.m.Sessions() {
+		hosts[sess.Config.Host] = append(hosts[sess.Config.Host], sess)
+	}
+	for _, list := range hosts {
+		// the newest first, they are kept over the older ones
+		sort.Slice(list, func(i, j int) bool { return list[i].Started.After(list[j].Started) })
+		var total int64
+		for _, sess := range list {
+			if fi, err := os.Stat(s.m.Path(sess)); err == nil {
+				total += fi.Size()
+			}
+			if sess.State == StateRecording {
+				continue
+			}
+			age := now.Sub(sess.Started)
+			switch {
+			case ret.MaxAgeDays > 0 && age >= days(ret.MaxAgeDays),
+				ret.MaxBytesPerHost > 0 && total > ret.MaxBytesPerHost:
+				if err := s.m.Remove(sess.ID); err != nil {
+					s.m.log.Errorf("removing session %s: %v", sess.ID, err)
+				} else {
+					s.m.log.Infof("removed session %s of %s, started %v", sess.ID, sess.Config.Host, sess.Started)
+				}
+			case ret.CompactAfterDays > 0 && age >= days(ret.CompactAfterDays) && sess.Config.Format == FormatFBS && !strings.HasSuffix(sess.File, ".gz"):
+				if err := s.m.compact(sess.ID); err != nil {
+					s.m.log.Errorf("compacting session %s: %v", sess.ID, err)
+				}
+			}
+		}
+	}
+}
+
+func days(n int) time.Duration {
+	return time.Duration(n) * 24 * time.Hour
+}
+
+// compact gzips the recording of a finished session
+func (m *Manager) compact(id string) error {
+	s := m.session(id)
+	if s == nil {
+		return ErrNotFound
+	}
+	select {
+	case <-s.done:
+	default:
+		return ErrRecording
+	}
+	s.mu.Lock()
+	name := s.info.File
+	s.mu.Unlock()
+	if err := gzipFile(m.path(name), m.path(name+".gz")); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.info.File = name + ".gz"
+	if fi, err := os.Stat(m.path(s.info.File)); err == nil {
+		s.info.Stats.FileSize = fi.Size()
+	}
+	s.mu.Unlock()
+	m.save(s)
+	return os.Remove(m.path(name))
+}
+
+// gzipFile writes the gzipped src to dst
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
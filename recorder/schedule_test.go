@@ -0,0 +1,342 @@
+package recorder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amitbet/vnc2video/logger"
+)
+
+// fakeClock only moves forward when advanced
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeTimer{c.now.Add(d), ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+		} else {
+			w.ch <- c.now
+		}
+	}
+	c.waiters = waiters
+}
+
+func TestWindow(t *testing.T) {
+	monday := time.Date(2026, 10, 19, 0, 0, 0, 0, time.Local)
+	for _, test := range []struct {
+		w      Window
+		at     time.Duration
+		active bool
+	}{
+		{Window{From: "09:00", To: "17:00"}, 9 * time.Hour, true},
+		{Window{From: "09:00", To: "17:00"}, 17 * time.Hour, false},
+		{Window{From: "09:00", To: "17:00"}, 8*time.Hour + 59*time.Minute, false},
+		{Window{From: "09:00", To: "17:00", Days: []string{"sat", "sun"}}, 10 * time.Hour, false},
+		{Window{From: "09:00", To: "17:00", Days: []string{"sat", "sun"}}, 6*24*time.Hour + 10*time.Hour, true},
+		// past midnight, the day is the one the window started on
+		{Window{From: "22:00", To: "06:00", Days: []string{"sun"}}, 5 * time.Hour, true},
+		{Window{From: "22:00", To: "06:00", Days: []string{"sun"}}, 23 * time.Hour, false},
+		{Window{From: "22:00", To: "06:00", Days: []string{"Mon"}}, 23 * time.Hour, true},
+		{Window{From: "22:00", To: "06:00"}, 12 * time.Hour, false},
+	} {
+		if err := test.w.validate(); err != nil {
+			t.Fatal(err)
+		}
+		at := monday.Add(test.at)
+		if active := test.w.contains(at); active != test.active {
+			t.Errorf("%+v at %v: active %v", test.w, at, active)
+		}
+	}
+	if err := (&Window{From: "9h", To: "17:00"}).validate(); err == nil {
+		t.Error("bad time of day accepted")
+	}
+}
+
+// recordingSessions returns the sessions recording
+func recordingSessions(m *Manager) []*Session {
+	var list []*Session
+	for _, s := range m.Sessions() {
+		if s.State == StateRecording {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+func TestSchedulerWindows(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, _, stop := vncServer(t, true)
+	defer stop()
+	clock := &fakeClock{now: time.Date(2026, 10, 19, 8, 0, 0, 0, time.Local)}
+	m := newManager(t, dir, clock)
+	defer m.Close()
+	s, err := NewScheduler(m, SchedulerConfig{Rules: []Rule{{
+		Name:    "office",
+		Session: SessionConfig{Host: addr, Password: "secret"},
+		Windows: []Window{{From: "09:00", To: "17:00", Days: []string{"mon", "tue", "wed", "thu", "fri"}}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Tick()
+	if len(m.Sessions()) != 0 {
+		t.Fatal("recording before the window")
+	}
+	clock.Advance(time.Hour)
+	s.Tick()
+	active := recordingSessions(m)
+	if len(active) != 1 || active[0].Config.Rule != "office" {
+		t.Fatalf("recording in the window: %+v", active)
+	}
+	first := active[0].ID
+	waitUpdates(t, m, first, 3)
+	clock.Advance(time.Hour)
+	s.Tick()
+	if active = recordingSessions(m); len(active) != 1 || active[0].ID != first {
+		t.Fatalf("recording later in the window: %+v", active)
+	}
+
+	// a recording lost within the window starts again
+	m.Stop(first)
+	s.Tick()
+	if active = recordingSessions(m); len(active) != 1 || active[0].ID == first {
+		t.Fatalf("recording after a stop in the window: %+v", active)
+	}
+	clock.Advance(7 * time.Hour)
+	s.Tick()
+	if active = recordingSessions(m); len(active) != 0 {
+		t.Fatalf("recording after the window: %+v", active)
+	}
+	if len(m.Sessions()) != 2 {
+		t.Errorf("%d sessions recorded", len(m.Sessions()))
+	}
+	// no window on saturdays
+	clock.Advance(4*24*time.Hour + 17*time.Hour)
+	s.Tick()
+	if active = recordingSessions(m); len(active) != 0 {
+		t.Fatalf("recording on saturday: %+v", active)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.Local)
+	data := bytes.Repeat([]byte("FBS data "), 20)[:100]
+	for _, s := range []struct {
+		id, host string
+		format   Format
+		age      time.Duration
+		size     int
+	}{
+		{"a1", "a:5900", FormatFBS, 40 * 24 * time.Hour, 10},
+		{"a2", "a:5900", FormatFBS, 3 * 24 * time.Hour, 100},
+		{"a3", "a:5900", FormatFBS, 24 * time.Hour, 100},
+		{"b1", "b:5900", FormatFBS, 5 * 24 * time.Hour, 40},
+		{"b2", "b:5900", FormatMJPEG, 24 * time.Hour, 100},
+	} {
+		sess := Session{
+			ID:      s.id,
+			Config:  SessionConfig{Host: s.host, Format: s.format},
+			State:   StateStopped,
+			File:    s.id + formatExt[s.format],
+			Started: now.Add(-s.age),
+		}
+		meta, _ := json.Marshal(&sess)
+		if err := ioutil.WriteFile(filepath.Join(dir, s.id+".json"), meta, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, sess.File), data[:s.size], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := newManager(t, dir, &fakeClock{now: now})
+	s, err := NewScheduler(m, SchedulerConfig{Retention: Retention{MaxAgeDays: 30, MaxBytesPerHost: 150, CompactAfterDays: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Tick()
+	kept := make(map[string]string)
+	for _, sess := range m.Sessions() {
+		kept[sess.ID] = sess.File
+	}
+	if len(kept) != 3 || kept["a3"] != "a3.fbs" || kept["b1"] != "b1.fbs.gz" || kept["b2"] != "b2.avi" {
+		t.Fatalf("kept %v", kept)
+	}
+	for _, gone := range []string{"a1.fbs", "a1.json", "a2.fbs", "a2.json", "b1.fbs"} {
+		if _, err := os.Stat(filepath.Join(dir, gone)); !os.IsNotExist(err) {
+			t.Errorf("%s left: %v", gone, err)
+		}
+	}
+
+	// the compacted recording holds the same data, and is found again
+	f, err := os.Open(filepath.Join(dir, "b1.fbs.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(zr); err != nil || !bytes.Equal(got, data[:40]) {
+		t.Errorf("compacted recording is %q, %v", got, err)
+	}
+	if sess, err := newManager(t, dir, nil).Session("b1"); err != nil || sess.File != "b1.fbs.gz" {
+		t.Errorf("reloaded compacted session %+v, %v", sess, err)
+	}
+}
+
+func TestIdle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, scfg, stop := vncServer(t, false)
+	defer stop()
+	clock := &fakeClock{now: time.Date(2026, 10, 19, 12, 0, 0, 0, time.Local)}
+	m := newManager(t, dir, clock)
+	defer m.Close()
+
+	s, err := m.Start(SessionConfig{Host: addr, Password: "secret", Format: FormatMJPEG, Framerate: 50, IdleSeconds: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := func() int64 {
+		sess, err := m.Session(s.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sess.Stats.Frames
+	}
+	// waitFrames waits for frames to be encoded after n, or for them to
+	// stop being encoded
+	waitFrames := func(n int64, paused bool) int64 {
+		deadline := time.Now().Add(5 * time.Second)
+		for last := frames(); time.Now().Before(deadline); {
+			time.Sleep(100 * time.Millisecond)
+			f := frames()
+			if paused && f == last || !paused && f > n {
+				return f
+			}
+			last = f
+		}
+		t.Fatalf("frames at %d, paused %v", frames(), paused)
+		return 0
+	}
+
+	scfg.ServerMessageCh <- update(1)
+	waitFrames(0, false)
+	clock.Advance(2 * time.Minute)
+	paused := waitFrames(0, true)
+	time.Sleep(100 * time.Millisecond)
+	if f := frames(); f != paused {
+		t.Fatalf("frames encoded while idle: %d, paused at %d", f, paused)
+	}
+	scfg.ServerMessageCh <- update(2)
+	waitFrames(paused, false)
+}
+
+func TestTickStartsOutsideLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// a host accepting connections but never answering, starting its
+	// recording lasts until the connect timeout
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+	m, err := NewManager(Config{Dir: dir, ConnectTimeout: time.Second, Logger: logger.NewSimpleLogger(logger.LogLevelError, "recorder")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	s, err := NewScheduler(m, SchedulerConfig{Rules: []Rule{{Name: "slow", Session: SessionConfig{Host: ln.Addr().String()}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ticked := make(chan struct{})
+	go func() {
+		s.Tick()
+		close(ticked)
+	}()
+	select {
+	case c := <-accepted:
+		defer c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection to the host")
+	}
+	// other ticks skip the rule being started instead of waiting for it
+	second := make(chan struct{})
+	go func() {
+		s.Tick()
+		close(second)
+	}()
+	select {
+	case <-second:
+	case <-ticked:
+		t.Fatal("second tick waited for the first one")
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("second tick blocked while a recording starts")
+	}
+	<-ticked
+	if len(m.Sessions()) != 1 || len(s.failed) != 1 {
+		t.Errorf("%d sessions, %d failed rules after the ticks", len(m.Sessions()), len(s.failed))
+	}
+}
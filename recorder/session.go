@@ -0,0 +1,326 @@
+package recorder
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	vnc "github.com/amitbet/vnc2video"
+	"github.com/amitbet/vnc2video/encoders"
+	"github.com/amitbet/vnc2video/sshtunnel"
+)
+
+// videoCloseTimeout bounds the wait for ffmpeg to finish a video
+const videoCloseTimeout = 30 * time.Second
+
+// videoEncoder is what the recordings need of the encoders
+type videoEncoder interface {
+	Encode(image.Image)
+	Close()
+}
+
+// recording is a running session
+type recording struct {
+	m      *Manager
+	s      *session
+	cfg    *vnc.ClientConfig
+	cc     *vnc.ClientConn
+	dialer *sshtunnel.Dialer
+
+	// file and fbs are set for FormatFBS, video and videoDone for the
+	// video formats
+	file      *os.File
+	fbs       *vnc.FbsWriter
+	video     videoEncoder
+	videoDone chan struct{}
+
+	framerate int
+	limit     time.Duration
+	idle      time.Duration
+}
+
+// countingConn counts the bytes read from the server
+type countingConn struct {
+	net.Conn
+	n *int64
+}
+
+func (c *countingConn) Read(buf []byte) (int, error) {
+	n, err := c.Conn.Read(buf)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// securityHandlers returns the client security types cfg has credentials
+// for, the ones encrypting the credentials first. RSA-AES, which encrypts
+// the session too, needs the server key fingerprint, VeNCrypt Plain sends
+// the password in clear and is only offered when allowed.
+func (cfg *SessionConfig) securityHandlers() []vnc.SecurityHandler {
+	var handlers []vnc.SecurityHandler
+	user, pass := []byte(cfg.Username), []byte(cfg.Password)
+	if cfg.ServerKeyFingerprint != "" && cfg.Password != "" {
+		verify := vnc.VerifyRSAFingerprint(cfg.ServerKeyFingerprint)
+		handlers = append(handlers,
+			&vnc.ClientAuthRA2{SecType: vnc.SecTypeRA256, Username: user, Password: pass, VerifyServer: verify},
+			&vnc.ClientAuthRA2{SecType: vnc.SecTypeRA2, Username: user, Password: pass, VerifyServer: verify},
+		)
+	}
+	if cfg.Username != "" {
+		handlers = append(handlers,
+			&vnc.ClientAuthARD{Username: user, Password: pass},
+			&vnc.ClientAuthMSLogonII{Username: user, Password: pass},
+		)
+	}
+	if cfg.Password != "" {
+		handlers = append(handlers, &vnc.ClientAuthVNC{Password: pass})
+	}
+	if cfg.Username != "" && cfg.AllowPlain {
+		handlers = append(handlers, &vnc.ClientAuthVeNCrypt02Plain{Username: user, Password: pass})
+	}
+	return append(handlers, &vnc.ClientAuthNone{})
+}
+
+// dialer returns the function connecting to the hosts of cfg, and the SSH
+// dialer to close along with the session
+func (m *Manager) dialer(cfg *SessionConfig) (func(network, address string) (net.Conn, error), *sshtunnel.Dialer, error) {
+	if cfg.SSH == nil {
+		return func(network, address string) (net.Conn, error) {
+			return net.DialTimeout(network, address, m.cfg.ConnectTimeout)
+		}, nil, nil
+	}
+	d, err := sshtunnel.NewDialer(&sshtunnel.Config{
+		Hops:            cfg.SSH.Hops,
+		User:            cfg.SSH.User,
+		KeyFiles:        m.cfg.SSHKeyFiles,
+		Passphrase:      []byte(cfg.SSH.Passphrase),
+		Agent:           cfg.SSH.Agent,
+		KnownHostsFiles: m.cfg.SSHKnownHostsFiles,
+		Timeout:         m.cfg.ConnectTimeout,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return d.Dial, d, nil
+}
+
+// record connects to the host of s and sets up its output
+func (m *Manager) record(s *session, cfg *SessionConfig) (*recording, error) {
+	dial, dialer, err := m.dialer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	nc, err := dial("tcp", cfg.Host)
+	if err != nil {
+		if dialer != nil {
+			dialer.Close()
+		}
+		return nil, err
+	}
+	r := &recording{
+		m:      m,
+		s:      s,
+		dialer: dialer,
+		cfg: &vnc.ClientConfig{
+			SecurityHandlers:  cfg.securityHandlers(),
+			DrawCursor:        true,
+			ContinuousUpdates: true,
+			AutoUpdates:       true,
+			UpdateFPS:         cfg.Framerate,
+			PixelFormat:       vnc.PixelFormat32bit,
+			ClientMessageCh:   make(chan vnc.ClientMessage, 16),
+			ServerMessageCh:   make(chan vnc.ServerMessage, 16),
+			Messages:          vnc.DefaultServerMessages,
+			Encodings: []vnc.Encoding{
+				&vnc.TightEncoding{},
+				&vnc.ZRLEEncoding{},
+				&vnc.HextileEncoding{},
+				&vnc.ZLibEncoding{},
+				&vnc.RREEncoding{},
+				&vnc.CopyRectEncoding{},
+				&vnc.RawEncoding{},
+				&vnc.CursorWithAlphaPseudoEncoding{},
+				&vnc.CursorPseudoEncoding{},
+				&vnc.CursorPosPseudoEncoding{},
+				&vnc.ContinuousUpdatesPseudoEncoding{},
+				&vnc.FencePseudoEncoding{},
+				&vnc.LastRectPseudoEncoding{},
+				&vnc.DesktopSizePseudoEncoding{},
+			},
+			ErrorCh: make(chan error, 4),
+			Dial:    dial,
+			Logger:  m.log,
+		},
+		framerate: cfg.Framerate,
+		limit:     time.Duration(cfg.MaxSeconds) * time.Second,
+		idle:      time.Duration(cfg.IdleSeconds) * time.Second,
+	}
+	path := m.path(s.info.File)
+	if cfg.Format == FormatFBS {
+		if r.file, err = os.Create(path); err != nil {
+			nc.Close()
+			r.closeDialer()
+			return nil, fmt.Errorf("recorder: %v", err)
+		}
+		r.fbs = vnc.NewFbsWriter(r.file)
+		r.cfg.FbsRecorder = r.fbs
+	} else {
+		// the video goes on over a new connection when a decode error
+		// leaves the stream out of sync, an FBS recording can't
+		r.cfg.Redial = func() (net.Conn, error) {
+			nc, err := dial("tcp", cfg.Host)
+			if err != nil {
+				return nil, err
+			}
+			return &countingConn{Conn: nc, n: &s.bytesRead}, nil
+		}
+	}
+
+	nc.SetDeadline(time.Now().Add(m.cfg.ConnectTimeout))
+	r.cc, err = vnc.Connect(context.Background(), &countingConn{Conn: nc, n: &s.bytesRead}, r.cfg)
+	if err != nil {
+		if r.file != nil {
+			r.file.Close()
+		}
+		r.closeDialer()
+		return nil, err
+	}
+	nc.SetDeadline(time.Time{})
+	if cfg.Format != FormatFBS {
+		r.startVideo(cfg.Format, path)
+	}
+	return r, nil
+}
+
+// startVideo starts the encoder of format, the ffmpeg ones run until
+// closed
+func (r *recording) startVideo(format Format, path string) {
+	ffmpeg := r.m.cfg.FFMpegBinPath
+	r.videoDone = make(chan struct{})
+	switch format {
+	case FormatMJPEG:
+		enc := &encoders.MJPegImageEncoder{Quality: 80, Framerate: int32(r.framerate)}
+		enc.Init(path)
+		r.video = enc
+		close(r.videoDone)
+		return
+	case FormatX264:
+		enc := &encoders.X264ImageEncoder{FFMpegBinPath: ffmpeg, Framerate: r.framerate}
+		r.video = enc
+		go func() {
+			enc.Run(path)
+			close(r.videoDone)
+		}()
+	case FormatVP8:
+		enc := &encoders.VP8ImageEncoder{FFMpegBinPath: ffmpeg, Framerate: r.framerate}
+		r.video = enc
+		go func() {
+			enc.Run(path)
+			close(r.videoDone)
+		}()
+	case FormatHuffYUV:
+		enc := &encoders.HuffYuvImageEncoder{FFMpegBinPath: ffmpeg, Framerate: r.framerate}
+		r.video = enc
+		go func() {
+			enc.Run(path)
+			close(r.videoDone)
+		}()
+	case FormatQTRLE:
+		enc := &encoders.QTRLEImageEncoder{FFMpegBinPath: ffmpeg, Framerate: r.framerate}
+		r.video = enc
+		go func() {
+			enc.Run(path)
+			close(r.videoDone)
+		}()
+	}
+}
+
+// run records until the session is stopped, reaches its time limit or
+// loses its connection
+func (r *recording) run() {
+	var limit <-chan time.Time
+	if r.limit > 0 {
+		timer := time.NewTimer(r.limit)
+		defer timer.Stop()
+		limit = timer.C
+	}
+	var frames <-chan time.Time
+	if r.video != nil {
+		ticker := time.NewTicker(time.Second / time.Duration(r.framerate))
+		defer ticker.Stop()
+		frames = ticker.C
+	}
+
+	// the screen changed when an update held rectangles
+	changed := r.m.clock.Now()
+	var err error
+loop:
+	for {
+		select {
+		case <-r.s.stop:
+			break loop
+		case <-limit:
+			break loop
+		case err = <-r.cfg.ErrorCh:
+			break loop
+		case msg := <-r.cfg.ServerMessageCh:
+			if update, ok := msg.(*vnc.FramebufferUpdate); ok {
+				atomic.AddInt64(&r.s.updates, 1)
+				if len(update.Rects) > 0 {
+					changed = r.m.clock.Now()
+				}
+			}
+		case <-frames:
+			if r.idle > 0 && r.m.clock.Now().Sub(changed) >= r.idle {
+				// paused until the screen changes
+				break
+			}
+			r.video.Encode(r.cc.Canvas.Frame())
+			atomic.AddInt64(&r.s.frames, 1)
+		}
+	}
+	r.close()
+	if err != nil {
+		r.m.log.Errorf("recording %s failed: %v", r.s.info.ID, err)
+	} else {
+		r.m.log.Infof("recording %s stopped", r.s.info.ID)
+	}
+	r.m.finish(r.s, err)
+}
+
+// close ends the connection and completes the output
+func (r *recording) close() {
+	r.cc.Close()
+	// the message handler may be blocked delivering a message
+	go func() {
+		for {
+			select {
+			case <-r.cfg.ServerMessageCh:
+			case <-time.After(time.Second):
+				return
+			}
+		}
+	}()
+	r.closeDialer()
+	if r.fbs != nil {
+		r.fbs.Flush()
+		r.file.Close()
+	}
+	if r.video != nil {
+		r.video.Close()
+		select {
+		case <-r.videoDone:
+		case <-time.After(videoCloseTimeout):
+			r.m.log.Warnf("recording %s: the encoder did not finish", r.s.info.ID)
+		}
+	}
+}
+
+func (r *recording) closeDialer() {
+	if r.dialer != nil {
+		r.dialer.Close()
+	}
+}
@@ -0,0 +1,88 @@
+package vnc2video
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// AcceptServer waits for a server to dial in, as servers behind NAT do
+// with listening viewers, then runs the client handshake on the connection
+// like Connect. Call it in a loop to serve several servers, each with its
+// own config.
+func AcceptServer(ctx context.Context, ln net.Listener, cfg *ClientConfig) (*ClientConn, error) {
+	type accepted struct {
+		c   net.Conn
+		err error
+	}
+	ch := make(chan accepted, 1)
+	go func() {
+		c, err := ln.Accept()
+		ch <- accepted{c, err}
+	}()
+	select {
+	case a := <-ch:
+		if a.err != nil {
+			return nil, a.err
+		}
+		return Connect(ctx, a.c, cfg)
+	case <-ctx.Done():
+		drop := func() {
+			if a := <-ch; a.c != nil {
+				a.c.Close()
+			}
+		}
+		// stop accepting so that no connection is taken from the next
+		// call, with listeners without deadlines the next one is dropped
+		if d, ok := ln.(interface{ SetDeadline(time.Time) error }); ok {
+			d.SetDeadline(time.Now())
+			drop()
+			d.SetDeadline(time.Time{})
+		} else {
+			go drop()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// repeaterIDLength is the length of the id message sent to a repeater
+const repeaterIDLength = 250
+
+// ClientRepeaterHandler reaches the server through an UltraVNC repeater, it
+// goes before the handlers of ClientConfig.Handlers, e.g.
+//
+//	Handlers: append([]Handler{&ClientRepeaterHandler{ID: "1234"}}, DefaultClientHandlers...)
+type ClientRepeaterHandler struct {
+	// ID is the id the server registered at the repeater with (mode II),
+	// without the "ID:" prefix
+	ID string
+	// Host is the host:port of the server the repeater connects to (mode
+	// I), it is used when ID is not set
+	Host string
+}
+
+// Handle reads the repeater version and sends it the server to connect to
+func (h *ClientRepeaterHandler) Handle(c Conn) error {
+	var version [ProtoVersionLength]byte
+	if err := binary.Read(c, binary.BigEndian, &version); err != nil {
+		return err
+	}
+	if major, minor, err := ParseProtoVersion(version[:]); err != nil || major != 0 || minor != 0 {
+		return fmt.Errorf("not a repeater, version '%v'", string(version[:]))
+	}
+	dest := h.Host
+	if h.ID != "" {
+		dest = "ID:" + h.ID
+	}
+	if dest == "" || len(dest) >= repeaterIDLength {
+		return fmt.Errorf("bad repeater destination %q", dest)
+	}
+	msg := make([]byte, repeaterIDLength)
+	copy(msg, dest)
+	if err := binary.Write(c, binary.BigEndian, msg); err != nil {
+		return err
+	}
+	return c.Flush()
+}
@@ -0,0 +1,308 @@
+package vnc2video
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connHandler hands the connection over, it goes before the message
+// handler of a server
+type connHandler chan Conn
+
+func (h connHandler) Handle(c Conn) error {
+	h <- c
+	return nil
+}
+
+func testServerConfig(width uint16, conns connHandler) *ServerConfig {
+	return &ServerConfig{
+		Handlers: []Handler{
+			&DefaultServerVersionHandler{},
+			&DefaultServerSecurityHandler{},
+			&DefaultServerClientInitHandler{},
+			&DefaultServerServerInitHandler{},
+			conns,
+			&DefaultServerMessageHandler{},
+		},
+		SecurityHandlers: []SecurityHandler{&ServerAuthNone{}},
+		Encodings:        []Encoding{&RawEncoding{}, &ClientRedirectPseudoEncoding{}},
+		PixelFormat:      PixelFormat32bit,
+		ClientMessageCh:  make(chan ClientMessage, 16),
+		ServerMessageCh:  make(chan ServerMessage, 16),
+		Messages:         DefaultClientMessages,
+		Width:            width,
+		Height:           16,
+		ErrorCh:          make(chan error, 4),
+	}
+}
+
+func testClientConfig() *ClientConfig {
+	return &ClientConfig{
+		SecurityHandlers: []SecurityHandler{&ClientAuthNone{}},
+		PixelFormat:      PixelFormat32bit,
+		ClientMessageCh:  make(chan ClientMessage, 16),
+		ServerMessageCh:  make(chan ServerMessage, 16),
+		Messages:         DefaultServerMessages,
+		Encodings:        []Encoding{&RawEncoding{}, &ClientRedirectPseudoEncoding{}},
+		ErrorCh:          make(chan error, 4),
+	}
+}
+
+// dialIn runs the server side of a connection the server opened itself
+func dialIn(t *testing.T, addr string, cfg *ServerConfig) {
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	conn, err := NewServerConn(nc, cfg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, h := range cfg.Handlers {
+		if err := h.Handle(conn); err != nil {
+			conn.Close()
+			return
+		}
+	}
+}
+
+func TestAcceptServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := AcceptServer(ctx, ln, testClientConfig()); err != context.DeadlineExceeded {
+		t.Errorf("no server dialed in, got %v", err)
+	}
+
+	scfg := testServerConfig(16, make(connHandler, 1))
+	go dialIn(t, ln.Addr().String(), scfg)
+	cc, err := AcceptServer(context.Background(), ln, testClientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	if cc.Width() != 16 || cc.Height() != 16 {
+		t.Errorf("server init is %dx%d", cc.Width(), cc.Height())
+	}
+}
+
+func TestClientRepeaterHandler(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	id := make(chan []byte, 1)
+	go func() {
+		nc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		// the repeater announces itself, then relays to the server
+		nc.Write([]byte("RFB 000.000\n"))
+		buf := make([]byte, repeaterIDLength)
+		io.ReadFull(nc, buf)
+		id <- buf
+		conn, _ := NewServerConn(nc, testServerConfig(16, make(connHandler, 1)))
+		for _, h := range conn.cfg.Handlers {
+			if err := h.Handle(conn); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ccfg := testClientConfig()
+	ccfg.Handlers = append([]Handler{&ClientRepeaterHandler{ID: "1234"}}, DefaultClientHandlers...)
+	cc, err := Connect(context.Background(), nc, ccfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	want := make([]byte, repeaterIDLength)
+	copy(want, "ID:1234")
+	if got := <-id; !bytes.Equal(got, want) {
+		t.Errorf("repeater got %q", bytes.TrimRight(got, "\x00"))
+	}
+}
+
+func TestClientRedirect(t *testing.T) {
+	var lns [2]net.Listener
+	var conns [2]connHandler
+	var scfgs [2]*ServerConfig
+	for i := range lns {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		lns[i], conns[i] = ln, make(connHandler, 1)
+		scfgs[i] = testServerConfig(uint16(16+8*i), conns[i])
+		go Serve(context.Background(), ln, scfgs[i])
+	}
+
+	nc, err := net.Dial("tcp", lns[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ccfg := testClientConfig()
+	cc, err := Connect(context.Background(), nc, ccfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	// redirect once the client asked for updates, its encodings are known
+	// by then
+	timeout := time.After(5 * time.Second)
+	waitRequest := func(i int) {
+		for {
+			select {
+			case msg := <-scfgs[i].ClientMessageCh:
+				if _, ok := msg.(*FramebufferUpdateRequest); ok {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("no update request on server %d", i)
+			}
+		}
+	}
+	waitRequest(0)
+	host, port, _ := net.SplitHostPort(lns[1].Addr().String())
+	var p int
+	for _, d := range port {
+		p = 10*p + int(d-'0')
+	}
+	if err := (<-conns[0]).(*ServerConn).Redirect(host, uint16(p)); err != nil {
+		t.Fatal(err)
+	}
+
+	<-conns[1]
+	waitRequest(1)
+	if cc.Width() != 24 || cc.Canvas.Bounds().Dx() != 24 {
+		t.Errorf("redirected session is %d wide, canvas %d", cc.Width(), cc.Canvas.Bounds().Dx())
+	}
+	scfgs[1].ServerMessageCh <- &Bell{}
+	for {
+		select {
+		case msg := <-ccfg.ServerMessageCh:
+			if _, ok := msg.(*Bell); ok {
+				return
+			}
+		case err := <-ccfg.ErrorCh:
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatal("no bell from the redirected server")
+		}
+	}
+}
+
+// redirectSession connects a client with ccfg and returns the server side
+// of its connection, once the client asked for updates
+func redirectSession(t *testing.T, ccfg *ClientConfig) (*ClientConn, *ServerConn, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(connHandler, 1)
+	scfg := testServerConfig(16, conns)
+	go Serve(context.Background(), ln, scfg)
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := Connect(context.Background(), nc, ccfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := (<-conns).(*ServerConn)
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-scfg.ClientMessageCh:
+			if _, ok := msg.(*FramebufferUpdateRequest); ok {
+				return cc, sc, func() {
+					cc.Close()
+					ln.Close()
+				}
+			}
+		case <-timeout:
+			t.Fatal("no update request")
+		}
+	}
+}
+
+func TestClientCheckRedirect(t *testing.T) {
+	ccfg := testClientConfig()
+	var checked string
+	ccfg.CheckRedirect = func(host string, port uint16) error {
+		checked = net.JoinHostPort(host, fmt.Sprint(port))
+		return errors.New("not allowed")
+	}
+	ccfg.Dial = func(network, address string) (net.Conn, error) {
+		t.Errorf("dialed %s", address)
+		return nil, errors.New("no dial")
+	}
+	_, sc, stop := redirectSession(t, ccfg)
+	defer stop()
+	if err := sc.Redirect("10.0.0.1", 5900); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-ccfg.ErrorCh:
+		if !strings.Contains(err.Error(), "refused") {
+			t.Errorf("session ended with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("refused redirection did not end the session")
+	}
+	if checked != "10.0.0.1:5900" {
+		t.Errorf("checked %q", checked)
+	}
+}
+
+func TestClientCloseDuringRedirect(t *testing.T) {
+	ccfg := testClientConfig()
+	dialing, release := make(chan struct{}), make(chan struct{})
+	peer := make(chan net.Conn, 1)
+	ccfg.Dial = func(network, address string) (net.Conn, error) {
+		close(dialing)
+		<-release
+		a, b := net.Pipe()
+		peer <- b
+		return a, nil
+	}
+	cc, sc, stop := redirectSession(t, ccfg)
+	defer stop()
+	if err := sc.Redirect("127.0.0.1", 1); err != nil {
+		t.Fatal(err)
+	}
+	<-dialing
+	cc.Close()
+	close(release)
+
+	// the connection opened for the redirection is closed, not used
+	p := <-peer
+	p.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := p.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("redirected connection left open: %v", err)
+	}
+}
@@ -5,12 +5,18 @@ type SecurityType uint8
 //go:generate stringer -type=SecurityType
 
 const (
-	SecTypeUnknown  SecurityType = SecurityType(0)
-	SecTypeNone     SecurityType = SecurityType(1)
-	SecTypeVNC      SecurityType = SecurityType(2)
-	SecTypeTight    SecurityType = SecurityType(16)
-	SecTypeATEN     SecurityType = SecurityType(16)
-	SecTypeVeNCrypt SecurityType = SecurityType(19)
+	SecTypeUnknown   SecurityType = SecurityType(0)
+	SecTypeNone      SecurityType = SecurityType(1)
+	SecTypeVNC       SecurityType = SecurityType(2)
+	SecTypeRA2       SecurityType = SecurityType(5)
+	SecTypeRA2ne     SecurityType = SecurityType(6)
+	SecTypeTight     SecurityType = SecurityType(16)
+	SecTypeATEN      SecurityType = SecurityType(16)
+	SecTypeVeNCrypt  SecurityType = SecurityType(19)
+	SecTypeARD       SecurityType = SecurityType(30)
+	SecTypeMSLogonII SecurityType = SecurityType(113)
+	SecTypeRA256     SecurityType = SecurityType(129)
+	SecTypeRAne256   SecurityType = SecurityType(130)
 )
 
 type SecuritySubType uint32
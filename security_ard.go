@@ -0,0 +1,186 @@
+package vnc2video
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// ardCredentialsSize is the size of the encrypted credentials, the username
+// and the password each take half of it with their terminating zero
+const ardCredentialsSize = 128
+
+// ardPrime is the 1024 bit MODP group of RFC 2409, which macOS uses
+var ardPrime, _ = new(big.Int).SetString(
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+		"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+		"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+		"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381"+
+		"FFFFFFFFFFFFFFFF", 16)
+
+// ClientAuthARD is the Apple Remote Desktop security type of macOS Screen
+// Sharing: Diffie-Hellman key agreement, then the username and password
+// encrypted with AES-128 keyed by the MD5 of the shared secret
+type ClientAuthARD struct {
+	Username []byte
+	Password []byte
+}
+
+func (*ClientAuthARD) Type() SecurityType {
+	return SecTypeARD
+}
+
+func (*ClientAuthARD) SubType() SecuritySubType {
+	return SecSubTypeUnknown
+}
+
+func (auth *ClientAuthARD) Auth(c Conn) error {
+	if len(auth.Username) >= ardCredentialsSize/2 || len(auth.Password) >= ardCredentialsSize/2 {
+		return fmt.Errorf("username/password is too long, allowed 0-63")
+	}
+	var params struct {
+		Generator uint16
+		KeyLength uint16
+	}
+	if err := binary.Read(c, binary.BigEndian, &params); err != nil {
+		return err
+	}
+	if params.KeyLength == 0 || params.KeyLength > 1024 {
+		return fmt.Errorf("ARD key of %d bytes", params.KeyLength)
+	}
+	keys := make([]byte, 2*int(params.KeyLength))
+	if _, err := io.ReadFull(c, keys); err != nil {
+		return err
+	}
+	prime := new(big.Int).SetBytes(keys[:params.KeyLength])
+	serverPub := new(big.Int).SetBytes(keys[params.KeyLength:])
+
+	priv, pub, err := ardKeyPair(big.NewInt(int64(params.Generator)), prime)
+	if err != nil {
+		return err
+	}
+	creds := make([]byte, ardCredentialsSize)
+	if _, err := io.ReadFull(rand.Reader, creds); err != nil {
+		return err
+	}
+	creds[copy(creds, auth.Username)] = 0
+	creds[ardCredentialsSize/2+copy(creds[ardCredentialsSize/2:], auth.Password)] = 0
+	if err := ardCrypt(creds, serverPub, priv, prime, int(params.KeyLength), true); err != nil {
+		return err
+	}
+	if _, err := c.Write(creds); err != nil {
+		return err
+	}
+	if _, err := c.Write(bigBytes(pub, int(params.KeyLength))); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// ServerAuthARD is the server side of ClientAuthARD, Authenticate checks
+// the credentials sent by the client
+type ServerAuthARD struct {
+	// Generator and Prime are the Diffie-Hellman group, 2 and the 1024 bit
+	// MODP group of RFC 2409 when not set
+	Generator    uint16
+	Prime        *big.Int
+	Authenticate func(username, password []byte) error
+}
+
+func (*ServerAuthARD) Type() SecurityType {
+	return SecTypeARD
+}
+
+func (*ServerAuthARD) SubType() SecuritySubType {
+	return SecSubTypeUnknown
+}
+
+func (auth *ServerAuthARD) Auth(c Conn) error {
+	if auth.Authenticate == nil {
+		return fmt.Errorf("ARD server needs an Authenticate function")
+	}
+	generator, prime := auth.Generator, auth.Prime
+	if generator == 0 {
+		generator = 2
+	}
+	if prime == nil {
+		prime = ardPrime
+	}
+	keyLength := (prime.BitLen() + 7) / 8
+	priv, pub, err := ardKeyPair(big.NewInt(int64(generator)), prime)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, []uint16{generator, uint16(keyLength)}); err != nil {
+		return err
+	}
+	if _, err := c.Write(bigBytes(prime, keyLength)); err != nil {
+		return err
+	}
+	if _, err := c.Write(bigBytes(pub, keyLength)); err != nil {
+		return err
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+
+	msg := make([]byte, ardCredentialsSize+keyLength)
+	if _, err := io.ReadFull(c, msg); err != nil {
+		return err
+	}
+	creds := msg[:ardCredentialsSize]
+	clientPub := new(big.Int).SetBytes(msg[ardCredentialsSize:])
+	if err := ardCrypt(creds, clientPub, priv, prime, keyLength, false); err != nil {
+		return err
+	}
+	return auth.Authenticate(cString(creds[:ardCredentialsSize/2]), cString(creds[ardCredentialsSize/2:]))
+}
+
+// cString returns b up to its first zero
+func cString(b []byte) []byte {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return b[:i]
+	}
+	return b
+}
+
+// ardKeyPair returns a Diffie-Hellman private key and its public key
+func ardKeyPair(generator, prime *big.Int) (*big.Int, *big.Int, error) {
+	if prime.Cmp(big.NewInt(5)) < 0 {
+		return nil, nil, fmt.Errorf("ARD prime too small")
+	}
+	priv, err := rand.Int(rand.Reader, new(big.Int).Sub(prime, big.NewInt(3)))
+	if err != nil {
+		return nil, nil, err
+	}
+	priv.Add(priv, big.NewInt(2))
+	return priv, new(big.Int).Exp(generator, priv, prime), nil
+}
+
+// ardCrypt encrypts or decrypts the credentials in place with AES-128 in
+// ECB mode, keyed by the MD5 of the secret shared with the peer key
+func ardCrypt(creds []byte, peerPub, priv, prime *big.Int, keyLength int, encrypt bool) error {
+	if peerPub.Cmp(big.NewInt(1)) <= 0 || peerPub.Cmp(new(big.Int).Sub(prime, big.NewInt(1))) >= 0 {
+		return fmt.Errorf("bad ARD public key")
+	}
+	shared := new(big.Int).Exp(peerPub, priv, prime)
+	key := md5.Sum(bigBytes(shared, keyLength))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(creds); i += block.BlockSize() {
+		if encrypt {
+			block.Encrypt(creds[i:], creds[i:])
+		} else {
+			block.Decrypt(creds[i:], creds[i:])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package vnc2video
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestARD(t *testing.T) {
+	server := &ServerAuthARD{Authenticate: func(username, password []byte) error {
+		if string(username) != "user" || string(password) != "secret" {
+			return fmt.Errorf("got %q %q", username, password)
+		}
+		return nil
+	}}
+	if err := authSession(t, server, &ClientAuthARD{Username: []byte("user"), Password: []byte("secret")}); err != nil {
+		t.Error(err)
+	}
+	if err := authSession(t, server, &ClientAuthARD{Username: []byte("user"), Password: []byte("wrong")}); err == nil {
+		t.Error("wrong password accepted")
+	}
+}
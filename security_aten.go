@@ -29,27 +29,22 @@ func charCodeAt(s string, n int) rune {
 }
 
 func (auth *ClientAuthATEN) Auth(c Conn) error {
+	nt, err := readTightTunnels(c)
+	if err != nil {
+		return err
+	}
+	return auth.authTunnels(c, nt)
+}
+
+// authTunnels finishes the authentication once the tunnel count nt was read
+func (auth *ClientAuthATEN) authTunnels(c Conn, nt uint32) error {
 	var definedAuthLen = 24
 
 	if len(auth.Username) > definedAuthLen || len(auth.Password) > definedAuthLen {
 		return fmt.Errorf("username/password is too long, allowed 0-23")
 	}
 
-	nt, err := readTightTunnels(c)
-	if err != nil {
-		return err
-	}
-	/*
-		fmt.Printf("tunnels %d\n", nt)
-		for i := uint32(0); i < nt; i++ {
-			code, vendor, signature, err := readTightCaps(c)
-			if err != nil {
-				return err
-			}
-			fmt.Printf("code %d vendor %s signature %s\n", code, vendor, signature)
-		}
-	*/
-	if ((nt&0xffff0ff0)>>0 == 0xaff90fb0) || (nt <= 0 || nt > 0x1000000) {
+	if atenTunnels(nt) || nt == 0 {
 		c.SetProtoVersion("aten1")
 		var skip [20]byte
 		binary.Read(c, binary.BigEndian, &skip)
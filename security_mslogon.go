@@ -0,0 +1,189 @@
+package vnc2video
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+const (
+	// msLogonUsernameSize and msLogonPasswordSize are the sizes of the
+	// encrypted credentials, each holds its terminating zero
+	msLogonUsernameSize = 256
+	msLogonPasswordSize = 64
+)
+
+// ClientAuthMSLogonII is the UltraVNC MS-Logon II security type: a 64 bit
+// Diffie-Hellman key agreement, then the Windows username and password
+// encrypted with DES in CBC mode keyed by the shared secret
+type ClientAuthMSLogonII struct {
+	Username []byte
+	Password []byte
+}
+
+func (*ClientAuthMSLogonII) Type() SecurityType {
+	return SecTypeMSLogonII
+}
+
+func (*ClientAuthMSLogonII) SubType() SecuritySubType {
+	return SecSubTypeUnknown
+}
+
+func (auth *ClientAuthMSLogonII) Auth(c Conn) error {
+	if len(auth.Username) >= msLogonUsernameSize || len(auth.Password) >= msLogonPasswordSize {
+		return fmt.Errorf("username/password is too long, allowed 0-255/0-63")
+	}
+	var params struct {
+		Generator uint64
+		Modulus   uint64
+		ServerPub uint64
+	}
+	if err := binary.Read(c, binary.BigEndian, &params); err != nil {
+		return err
+	}
+	priv, pub, err := msLogonKeyPair(params.Generator, params.Modulus)
+	if err != nil {
+		return err
+	}
+	key, err := msLogonSharedKey(params.ServerPub, priv, params.Modulus)
+	if err != nil {
+		return err
+	}
+
+	creds := make([]byte, msLogonUsernameSize+msLogonPasswordSize)
+	if _, err := io.ReadFull(rand.Reader, creds); err != nil {
+		return err
+	}
+	creds[copy(creds, auth.Username)] = 0
+	creds[msLogonUsernameSize+copy(creds[msLogonUsernameSize:], auth.Password)] = 0
+	if err := msLogonCrypt(creds[:msLogonUsernameSize], key, true); err != nil {
+		return err
+	}
+	if err := msLogonCrypt(creds[msLogonUsernameSize:], key, true); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, pub); err != nil {
+		return err
+	}
+	if _, err := c.Write(creds); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// ServerAuthMSLogonII is the server side of ClientAuthMSLogonII.
+// Authenticate checks the credentials sent by the client, types embedding
+// ServerAuthMSLogonII can call ReadCredentials and check them on their own
+// instead.
+type ServerAuthMSLogonII struct {
+	// Generator and Modulus are the Diffie-Hellman group, a random one is
+	// picked for every connection when Modulus is not set
+	Generator    uint64
+	Modulus      uint64
+	Authenticate func(username, password []byte) error
+}
+
+func (*ServerAuthMSLogonII) Type() SecurityType {
+	return SecTypeMSLogonII
+}
+
+func (*ServerAuthMSLogonII) SubType() SecuritySubType {
+	return SecSubTypeUnknown
+}
+
+// ReadCredentials runs the key agreement and returns the credentials sent
+// by the client
+func (auth *ServerAuthMSLogonII) ReadCredentials(c Conn) ([]byte, []byte, error) {
+	generator, modulus := auth.Generator, auth.Modulus
+	if modulus == 0 {
+		p, err := rand.Prime(rand.Reader, 63)
+		if err != nil {
+			return nil, nil, err
+		}
+		generator, modulus = 5, p.Uint64()
+	}
+	priv, pub, err := msLogonKeyPair(generator, modulus)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := binary.Write(c, binary.BigEndian, []uint64{generator, modulus, pub}); err != nil {
+		return nil, nil, err
+	}
+	if err := c.Flush(); err != nil {
+		return nil, nil, err
+	}
+
+	var clientPub uint64
+	if err := binary.Read(c, binary.BigEndian, &clientPub); err != nil {
+		return nil, nil, err
+	}
+	creds := make([]byte, msLogonUsernameSize+msLogonPasswordSize)
+	if _, err := io.ReadFull(c, creds); err != nil {
+		return nil, nil, err
+	}
+	key, err := msLogonSharedKey(clientPub, priv, modulus)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := msLogonCrypt(creds[:msLogonUsernameSize], key, false); err != nil {
+		return nil, nil, err
+	}
+	if err := msLogonCrypt(creds[msLogonUsernameSize:], key, false); err != nil {
+		return nil, nil, err
+	}
+	return cString(creds[:msLogonUsernameSize]), cString(creds[msLogonUsernameSize:]), nil
+}
+
+func (auth *ServerAuthMSLogonII) Auth(c Conn) error {
+	if auth.Authenticate == nil {
+		return fmt.Errorf("MS-Logon server needs an Authenticate function")
+	}
+	username, password, err := auth.ReadCredentials(c)
+	if err != nil {
+		return err
+	}
+	return auth.Authenticate(username, password)
+}
+
+// msLogonKeyPair returns a Diffie-Hellman private key and its public key
+func msLogonKeyPair(generator, modulus uint64) (*big.Int, uint64, error) {
+	if modulus < 5 || generator < 2 {
+		return nil, 0, fmt.Errorf("bad MS-Logon group %d, %d", generator, modulus)
+	}
+	mod := new(big.Int).SetUint64(modulus)
+	priv, err := rand.Int(rand.Reader, new(big.Int).Sub(mod, big.NewInt(3)))
+	if err != nil {
+		return nil, 0, err
+	}
+	priv.Add(priv, big.NewInt(2))
+	return priv, new(big.Int).Exp(new(big.Int).SetUint64(generator), priv, mod).Uint64(), nil
+}
+
+// msLogonSharedKey returns the secret shared with the peer key, big endian
+func msLogonSharedKey(peerPub uint64, priv *big.Int, modulus uint64) ([]byte, error) {
+	if peerPub <= 1 || peerPub >= modulus-1 {
+		return nil, fmt.Errorf("bad MS-Logon public key")
+	}
+	shared := new(big.Int).Exp(new(big.Int).SetUint64(peerPub), priv, new(big.Int).SetUint64(modulus))
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, shared.Uint64())
+	return key, nil
+}
+
+// msLogonCrypt encrypts or decrypts data in place with VNC keyed DES in
+// CBC mode, the key being the IV as well
+func msLogonCrypt(data, key []byte, encrypt bool) error {
+	block, err := vncDESCipher(key)
+	if err != nil {
+		return err
+	}
+	if encrypt {
+		cipher.NewCBCEncrypter(block, key).CryptBlocks(data, data)
+	} else {
+		cipher.NewCBCDecrypter(block, key).CryptBlocks(data, data)
+	}
+	return nil
+}
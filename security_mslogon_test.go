@@ -0,0 +1,26 @@
+package vnc2video
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMSLogonII(t *testing.T) {
+	authenticate := func(username, password []byte) error {
+		if string(username) != `DOMAIN\user` || string(password) != "secret" {
+			return fmt.Errorf("got %q %q", username, password)
+		}
+		return nil
+	}
+	for _, server := range []*ServerAuthMSLogonII{
+		{Authenticate: authenticate},
+		{Generator: 3, Modulus: 0xffffffff00000001, Authenticate: authenticate},
+	} {
+		if err := authSession(t, server, &ClientAuthMSLogonII{Username: []byte(`DOMAIN\user`), Password: []byte("secret")}); err != nil {
+			t.Error(err)
+		}
+		if err := authSession(t, server, &ClientAuthMSLogonII{Username: []byte(`DOMAIN\user`), Password: []byte("wrong")}); err == nil {
+			t.Error("wrong password accepted")
+		}
+	}
+}
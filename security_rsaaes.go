@@ -0,0 +1,588 @@
+package vnc2video
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"strings"
+)
+
+// RSA-AES subtypes, the credentials the server asks for
+const (
+	rsaAESUserPass uint8 = 1
+	rsaAESPass     uint8 = 2
+)
+
+// RSA key sizes accepted from the peer, in bits
+const (
+	rsaAESMinKeyBits = 1024
+	rsaAESMaxKeyBits = 8192
+)
+
+// rsaAESParams describes a RSA-AES security type: the size of the randoms
+// and AES keys, the hash deriving the keys and checking the public keys,
+// and whether the session stays encrypted after the authentication
+type rsaAESParams struct {
+	size    int
+	newHash func() hash.Hash
+	all     bool
+}
+
+func rsaAESParamsFor(t SecurityType) (rsaAESParams, error) {
+	switch t {
+	case SecTypeRA2:
+		return rsaAESParams{16, sha1.New, true}, nil
+	case SecTypeRA2ne:
+		return rsaAESParams{16, sha1.New, false}, nil
+	case SecTypeRA256:
+		return rsaAESParams{32, sha256.New, true}, nil
+	case SecTypeRAne256:
+		return rsaAESParams{32, sha256.New, false}, nil
+	}
+	return rsaAESParams{}, fmt.Errorf("security type %d is not a RSA-AES type", t)
+}
+
+// ClientAuthRA2 is the RSA-AES security type of TigerVNC and libvncserver:
+// RSA key exchange, then username and password sent over AES-EAX. SecType
+// picks the variant, SecTypeRA2 (the default) and SecTypeRA256 keep the
+// session encrypted, SecTypeRA2ne and SecTypeRAne256 only the
+// authentication.
+type ClientAuthRA2 struct {
+	SecType  SecurityType
+	Username []byte
+	Password []byte
+	// Key is the client RSA key, a 2048 bit key is generated when nil
+	Key *rsa.PrivateKey
+	// VerifyServer decides whether to trust the server key, see
+	// VerifyRSAFingerprint. It is required unless InsecureSkipVerify is set.
+	VerifyServer func(*rsa.PublicKey) error
+	// InsecureSkipVerify trusts any server key when VerifyServer is nil.
+	// The credentials and the session are then encrypted for whoever sits
+	// between the client and the server: anyone able to intercept the
+	// connection reads the password. Only use it for testing.
+	InsecureSkipVerify bool
+}
+
+// RSAKeyFingerprint returns the hex encoded SHA-256 hash of the wire
+// format of a RSA-AES public key, as accepted by VerifyRSAFingerprint
+func RSAKeyFingerprint(pub *rsa.PublicKey) string {
+	sum := sha256.Sum256(marshalRSAKey(pub))
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyRSAFingerprint returns a ClientAuthRA2.VerifyServer trusting the
+// server keys with one of the fingerprints given by RSAKeyFingerprint
+func VerifyRSAFingerprint(fingerprints ...string) func(*rsa.PublicKey) error {
+	return func(pub *rsa.PublicKey) error {
+		got := RSAKeyFingerprint(pub)
+		for _, fp := range fingerprints {
+			if subtle.ConstantTimeCompare([]byte(got), []byte(strings.ToLower(fp))) == 1 {
+				return nil
+			}
+		}
+		return fmt.Errorf("untrusted server key %s", got)
+	}
+}
+
+func (auth *ClientAuthRA2) Type() SecurityType {
+	if auth.SecType == SecTypeUnknown {
+		return SecTypeRA2
+	}
+	return auth.SecType
+}
+
+func (*ClientAuthRA2) SubType() SecuritySubType {
+	return SecSubTypeUnknown
+}
+
+func (auth *ClientAuthRA2) Auth(c Conn) error {
+	params, err := rsaAESParamsFor(auth.Type())
+	if err != nil {
+		return err
+	}
+	if auth.VerifyServer == nil && !auth.InsecureSkipVerify {
+		return errors.New("RSA-AES server key not verified, set VerifyServer or InsecureSkipVerify")
+	}
+	serverKey, serverKeyBytes, err := readRSAKey(c)
+	if err != nil {
+		return err
+	}
+	if auth.VerifyServer != nil {
+		if err := auth.VerifyServer(serverKey); err != nil {
+			return err
+		}
+	}
+	key := auth.Key
+	if key == nil {
+		if key, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			return err
+		}
+	}
+	clientKeyBytes := marshalRSAKey(&key.PublicKey)
+	if _, err := c.Write(clientKeyBytes); err != nil {
+		return err
+	}
+	clientRandom := make([]byte, params.size)
+	if _, err := io.ReadFull(rand.Reader, clientRandom); err != nil {
+		return err
+	}
+	if err := writeRSARandom(c, serverKey, clientRandom); err != nil {
+		return err
+	}
+	serverRandom, err := readRSARandom(c, key, params.size)
+	if err != nil {
+		return err
+	}
+
+	ch, err := newRSAAESChannel(c, params, clientRandom, serverRandom)
+	if err != nil {
+		return err
+	}
+	if err := ch.exchangeHashes(params, clientKeyBytes, serverKeyBytes); err != nil {
+		return err
+	}
+	var subtype uint8
+	if err := binary.Read(ch, binary.BigEndian, &subtype); err != nil {
+		return err
+	}
+	username := auth.Username
+	switch subtype {
+	case rsaAESUserPass:
+	case rsaAESPass:
+		username = nil
+	default:
+		return fmt.Errorf("unknown RSA-AES subtype %d", subtype)
+	}
+	if len(username) > 255 || len(auth.Password) > 255 {
+		return fmt.Errorf("username/password is too long, allowed 0-255")
+	}
+	creds := append([]byte{uint8(len(username))}, username...)
+	creds = append(creds, uint8(len(auth.Password)))
+	creds = append(creds, auth.Password...)
+	if _, err := ch.Write(creds); err != nil {
+		return err
+	}
+	if params.all {
+		return secureConnection(c, ch)
+	}
+	return nil
+}
+
+// ServerAuthRA2 is the server side of ClientAuthRA2, Authenticate checks
+// the credentials sent by the client
+type ServerAuthRA2 struct {
+	SecType SecurityType
+	// Key is the server RSA key, it is required
+	Key *rsa.PrivateKey
+	// PasswordOnly asks the client for a password without a username
+	PasswordOnly bool
+	Authenticate func(username, password []byte) error
+}
+
+func (auth *ServerAuthRA2) Type() SecurityType {
+	if auth.SecType == SecTypeUnknown {
+		return SecTypeRA2
+	}
+	return auth.SecType
+}
+
+func (*ServerAuthRA2) SubType() SecuritySubType {
+	return SecSubTypeUnknown
+}
+
+func (auth *ServerAuthRA2) Auth(c Conn) error {
+	params, err := rsaAESParamsFor(auth.Type())
+	if err != nil {
+		return err
+	}
+	if auth.Key == nil || auth.Authenticate == nil {
+		return fmt.Errorf("RSA-AES server needs a key and an Authenticate function")
+	}
+	serverKeyBytes := marshalRSAKey(&auth.Key.PublicKey)
+	if _, err := c.Write(serverKeyBytes); err != nil {
+		return err
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	clientKey, clientKeyBytes, err := readRSAKey(c)
+	if err != nil {
+		return err
+	}
+	serverRandom := make([]byte, params.size)
+	if _, err := io.ReadFull(rand.Reader, serverRandom); err != nil {
+		return err
+	}
+	if err := writeRSARandom(c, clientKey, serverRandom); err != nil {
+		return err
+	}
+	clientRandom, err := readRSARandom(c, auth.Key, params.size)
+	if err != nil {
+		return err
+	}
+
+	ch, err := newRSAAESChannel(c, params, serverRandom, clientRandom)
+	if err != nil {
+		return err
+	}
+	if err := ch.exchangeHashes(params, serverKeyBytes, clientKeyBytes); err != nil {
+		return err
+	}
+	subtype := rsaAESUserPass
+	if auth.PasswordOnly {
+		subtype = rsaAESPass
+	}
+	if _, err := ch.Write([]byte{subtype}); err != nil {
+		return err
+	}
+	username, err := readRSAAESString(ch)
+	if err != nil {
+		return err
+	}
+	password, err := readRSAAESString(ch)
+	if err != nil {
+		return err
+	}
+	// the security result is sent encrypted, whatever it is
+	if params.all {
+		if err := secureConnection(c, ch); err != nil {
+			return err
+		}
+	}
+	return auth.Authenticate(username, password)
+}
+
+func readRSAAESString(r io.Reader) ([]byte, error) {
+	var l uint8
+	if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+		return nil, err
+	}
+	s := make([]byte, l)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// secureConnection routes the traffic of c through ch from now on
+func secureConnection(c Conn, ch *eaxChannel) error {
+	sc, ok := c.(secureConn)
+	if !ok {
+		return fmt.Errorf("connection can't be encrypted")
+	}
+	sc.secure(func(r io.Reader, w io.Writer) io.ReadWriter {
+		ch.r, ch.w = r, w
+		return ch
+	})
+	return nil
+}
+
+// marshalRSAKey returns the wire format of a public key: its size in bits,
+// then the modulus and the exponent, both as long as the key
+func marshalRSAKey(pub *rsa.PublicKey) []byte {
+	size := (pub.N.BitLen() + 7) / 8
+	b := make([]byte, 4, 4+2*size)
+	binary.BigEndian.PutUint32(b, uint32(pub.N.BitLen()))
+	b = append(b, bigBytes(pub.N, size)...)
+	return append(b, bigBytes(big.NewInt(int64(pub.E)), size)...)
+}
+
+// readRSAKey reads a public key, it returns its wire format as well
+func readRSAKey(c Conn) (*rsa.PublicKey, []byte, error) {
+	var bits uint32
+	if err := binary.Read(c, binary.BigEndian, &bits); err != nil {
+		return nil, nil, err
+	}
+	if bits < rsaAESMinKeyBits || bits > rsaAESMaxKeyBits {
+		return nil, nil, fmt.Errorf("RSA key of %d bits", bits)
+	}
+	size := int(bits+7) / 8
+	b := make([]byte, 4+2*size)
+	binary.BigEndian.PutUint32(b, bits)
+	if _, err := io.ReadFull(c, b[4:]); err != nil {
+		return nil, nil, err
+	}
+	e := new(big.Int).SetBytes(b[4+size:])
+	if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+		return nil, nil, fmt.Errorf("bad RSA public exponent")
+	}
+	pub := &rsa.PublicKey{N: new(big.Int).SetBytes(b[4 : 4+size]), E: int(e.Int64())}
+	return pub, b, nil
+}
+
+func writeRSARandom(c Conn, pub *rsa.PublicKey, random []byte) error {
+	encrypted, err := rsa.EncryptPKCS1v15(rand.Reader, pub, random)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, uint16(len(encrypted))); err != nil {
+		return err
+	}
+	if _, err := c.Write(encrypted); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+func readRSARandom(c Conn, key *rsa.PrivateKey, size int) ([]byte, error) {
+	var l uint16
+	if err := binary.Read(c, binary.BigEndian, &l); err != nil {
+		return nil, err
+	}
+	if int(l) != key.Size() {
+		return nil, fmt.Errorf("RSA encrypted random of %d bytes for a %d byte key", l, key.Size())
+	}
+	encrypted := make([]byte, l)
+	if _, err := io.ReadFull(c, encrypted); err != nil {
+		return nil, err
+	}
+	random, err := rsa.DecryptPKCS1v15(nil, key, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if len(random) != size {
+		return nil, fmt.Errorf("RSA-AES random of %d bytes, want %d", len(random), size)
+	}
+	return random, nil
+}
+
+// bigBytes returns n as a big endian number of size bytes
+func bigBytes(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) >= size {
+		return b[len(b)-size:]
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
+
+// eaxMaxMessage is the largest plaintext of a RSA-AES message
+const eaxMaxMessage = 8192
+
+// eaxChannel is the encrypted channel of the RSA-AES security types. Every
+// message is the big endian length of its plaintext, which is authenticated
+// too, the ciphertext and the tag. The nonces are little endian counters.
+type eaxChannel struct {
+	r io.Reader
+	w io.Writer
+
+	in, out           cipher.AEAD
+	inNonce, outNonce [16]byte
+	// buf holds the plaintext of the last message not read yet
+	buf []byte
+}
+
+// newRSAAESChannel returns the channel of a side, the key of each direction
+// is hashed from the randoms, the sender's one last
+func newRSAAESChannel(c Conn, params rsaAESParams, localRandom, remoteRandom []byte) (*eaxChannel, error) {
+	key := func(first, second []byte) (cipher.AEAD, error) {
+		h := params.newHash()
+		h.Write(first)
+		h.Write(second)
+		block, err := aes.NewCipher(h.Sum(nil)[:params.size])
+		if err != nil {
+			return nil, err
+		}
+		return newEAX(block), nil
+	}
+	in, err := key(localRandom, remoteRandom)
+	if err != nil {
+		return nil, err
+	}
+	out, err := key(remoteRandom, localRandom)
+	if err != nil {
+		return nil, err
+	}
+	return &eaxChannel{r: c, w: c, in: in, out: out}, nil
+}
+
+// exchangeHashes sends the hash of both public keys, the local one first,
+// and checks the one of the peer
+func (ch *eaxChannel) exchangeHashes(params rsaAESParams, localKey, remoteKey []byte) error {
+	h := params.newHash()
+	h.Write(localKey)
+	h.Write(remoteKey)
+	if _, err := ch.Write(h.Sum(nil)); err != nil {
+		return err
+	}
+	h.Reset()
+	h.Write(remoteKey)
+	h.Write(localKey)
+	want := h.Sum(nil)
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(ch, got); err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return fmt.Errorf("RSA-AES public key hash mismatch")
+	}
+	return nil
+}
+
+func (ch *eaxChannel) Read(p []byte) (int, error) {
+	for len(ch.buf) == 0 {
+		var header [2]byte
+		if _, err := io.ReadFull(ch.r, header[:]); err != nil {
+			return 0, err
+		}
+		msg := make([]byte, int(binary.BigEndian.Uint16(header[:]))+ch.in.Overhead())
+		if _, err := io.ReadFull(ch.r, msg); err != nil {
+			return 0, err
+		}
+		plain, err := ch.in.Open(msg[:0], ch.inNonce[:], msg, header[:])
+		if err != nil {
+			return 0, err
+		}
+		incNonce(&ch.inNonce)
+		ch.buf = plain
+	}
+	n := copy(p, ch.buf)
+	ch.buf = ch.buf[n:]
+	return n, nil
+}
+
+// Write sends p as one message, or several when it is larger than
+// eaxMaxMessage, and flushes the underlying writer
+func (ch *eaxChannel) Write(p []byte) (int, error) {
+	for written := 0; written < len(p); {
+		chunk := p[written:]
+		if len(chunk) > eaxMaxMessage {
+			chunk = chunk[:eaxMaxMessage]
+		}
+		header := make([]byte, 2, 2+len(chunk)+ch.out.Overhead())
+		binary.BigEndian.PutUint16(header, uint16(len(chunk)))
+		msg := ch.out.Seal(header, ch.outNonce[:], chunk, header[:2])
+		incNonce(&ch.outNonce)
+		if _, err := ch.w.Write(msg); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	if f, ok := ch.w.(interface{ Flush() error }); ok {
+		return len(p), f.Flush()
+	}
+	return len(p), nil
+}
+
+func incNonce(nonce *[16]byte) {
+	for i := range nonce {
+		if nonce[i]++; nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// eaxAEAD is the EAX mode of a 128 bit block cipher
+type eaxAEAD struct {
+	block  cipher.Block
+	k1, k2 [16]byte
+}
+
+func newEAX(block cipher.Block) cipher.AEAD {
+	e := &eaxAEAD{block: block}
+	var l [16]byte
+	block.Encrypt(l[:], l[:])
+	e.k1 = cmacDouble(l)
+	e.k2 = cmacDouble(e.k1)
+	return e
+}
+
+// cmacDouble multiplies b by x in GF(2^128)
+func cmacDouble(b [16]byte) [16]byte {
+	var d [16]byte
+	for i := 0; i < 15; i++ {
+		d[i] = b[i]<<1 | b[i+1]>>7
+	}
+	d[15] = b[15] << 1
+	if b[0]&0x80 != 0 {
+		d[15] ^= 0x87
+	}
+	return d
+}
+
+// omac is the CMAC of data prefixed by the block holding t
+func (e *eaxAEAD) omac(t byte, data []byte) []byte {
+	msg := make([]byte, 16, 16+len(data))
+	msg[15] = t
+	msg = append(msg, data...)
+	x := make([]byte, 16)
+	last := (len(msg) - 1) / 16 * 16
+	for i := 0; i < last; i += 16 {
+		xorBytes(x, msg[i:i+16])
+		e.block.Encrypt(x, x)
+	}
+	pad := make([]byte, 16)
+	k := e.k1
+	if n := copy(pad, msg[last:]); n < 16 {
+		pad[n] = 0x80
+		k = e.k2
+	}
+	xorBytes(x, pad)
+	xorBytes(x, k[:])
+	e.block.Encrypt(x, x)
+	return x
+}
+
+func xorBytes(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+func (*eaxAEAD) NonceSize() int { return 16 }
+func (*eaxAEAD) Overhead() int  { return 16 }
+
+func (e *eaxAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	n := e.omac(0, nonce)
+	h := e.omac(1, additionalData)
+	ret, out := sliceForAppend(dst, len(plaintext)+16)
+	ct := out[:len(plaintext)]
+	cipher.NewCTR(e.block, n).XORKeyStream(ct, plaintext)
+	tag := e.omac(2, ct)
+	for i := range tag {
+		out[len(plaintext)+i] = tag[i] ^ n[i] ^ h[i]
+	}
+	return ret
+}
+
+func (e *eaxAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < 16 {
+		return nil, errors.New("EAX message too short")
+	}
+	ct, tag := ciphertext[:len(ciphertext)-16], ciphertext[len(ciphertext)-16:]
+	n := e.omac(0, nonce)
+	h := e.omac(1, additionalData)
+	want := e.omac(2, ct)
+	for i := range want {
+		want[i] ^= n[i] ^ h[i]
+	}
+	if subtle.ConstantTimeCompare(want, tag) != 1 {
+		return nil, errors.New("EAX message authentication failed")
+	}
+	ret, out := sliceForAppend(dst, len(ct))
+	cipher.NewCTR(e.block, n).XORKeyStream(out, ct)
+	return ret, nil
+}
+
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
@@ -0,0 +1,104 @@
+package vnc2video
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestEAX(t *testing.T) {
+	for _, v := range []struct{ key, nonce, header, msg, sealed string }{
+		{"233952DEE4D5ED5F9B9C6D6FF80FF478", "62EC67F9C3A4A407FCB2A8C49031A8B3", "6BFB914FD07EAE6B", "", "E037830E8389F27B025A2D6527E79D01"},
+		{"91945D3F4DCBEE0BF45EF52255F095A4", "BECAF043B0A23D843194BA972C66DEBD", "FA3BFD4806EB53FA", "F7FB", "19DD5C4C9331049D0BDAB0277408F67967E5"},
+	} {
+		b := func(s string) []byte {
+			d, _ := hex.DecodeString(s)
+			return d
+		}
+		block, err := aes.NewCipher(b(v.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		eax := newEAX(block)
+		sealed := eax.Seal(nil, b(v.nonce), b(v.msg), b(v.header))
+		if !bytes.Equal(sealed, b(v.sealed)) {
+			t.Errorf("sealed %X, want %s", sealed, v.sealed)
+		}
+		if msg, err := eax.Open(nil, b(v.nonce), sealed, b(v.header)); err != nil || !bytes.Equal(msg, b(v.msg)) {
+			t.Errorf("opened %X, %v, want %s", msg, err, v.msg)
+		}
+		sealed[0] ^= 1
+		if _, err := eax.Open(nil, b(v.nonce), sealed, b(v.header)); err == nil {
+			t.Error("tampered message opened")
+		}
+	}
+}
+
+func TestRSAAES(t *testing.T) {
+	serverKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := VerifyRSAFingerprint(RSAKeyFingerprint(&serverKey.PublicKey))
+	for _, typ := range []SecurityType{SecTypeRA2, SecTypeRA2ne, SecTypeRA256, SecTypeRAne256} {
+		var gotUser, gotPass []byte
+		server := &ServerAuthRA2{SecType: typ, Key: serverKey, Authenticate: func(username, password []byte) error {
+			gotUser, gotPass = username, password
+			if string(password) != "secret" {
+				return fmt.Errorf("wrong password")
+			}
+			return nil
+		}}
+		client := &ClientAuthRA2{SecType: typ, Username: []byte("user"), Password: []byte("secret"), Key: clientKey, VerifyServer: trusted}
+		if err := authSession(t, server, client); err != nil {
+			t.Errorf("%v: %v", typ, err)
+			continue
+		}
+		if string(gotUser) != "user" || string(gotPass) != "secret" {
+			t.Errorf("%v: server got %q %q", typ, gotUser, gotPass)
+		}
+	}
+
+	server := &ServerAuthRA2{Key: serverKey, Authenticate: func(username, password []byte) error {
+		return fmt.Errorf("wrong password")
+	}}
+	if err := authSession(t, server, &ClientAuthRA2{Password: []byte("bad"), Key: clientKey, InsecureSkipVerify: true}); err == nil {
+		t.Error("rejected client connected")
+	}
+}
+
+func TestRSAAESVerifyServer(t *testing.T) {
+	serverKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &ServerAuthRA2{Key: serverKey, Authenticate: func(username, password []byte) error { return nil }}
+	for _, test := range []struct {
+		name   string
+		client *ClientAuthRA2
+		ok     bool
+	}{
+		{"no verifier", &ClientAuthRA2{}, false},
+		{"other key", &ClientAuthRA2{VerifyServer: VerifyRSAFingerprint(RSAKeyFingerprint(&otherKey.PublicKey))}, false},
+		{"trusted key", &ClientAuthRA2{VerifyServer: VerifyRSAFingerprint(strings.ToUpper(RSAKeyFingerprint(&serverKey.PublicKey)))}, true},
+		{"insecure", &ClientAuthRA2{InsecureSkipVerify: true}, true},
+	} {
+		test.client.Key = otherKey
+		if err := authSession(t, server, test.client); (err == nil) != test.ok {
+			t.Errorf("%s: connect error %v", test.name, err)
+		}
+	}
+}
@@ -1,6 +1,43 @@
 package vnc2video
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// TightCapability describes a tunnel, auth type, message or encoding in the
+// capability lists of the TightVNC protocol extensions
+type TightCapability struct {
+	Code      int32
+	Vendor    [4]byte
+	Signature [8]byte
+}
+
+func (c TightCapability) String() string {
+	return fmt.Sprintf("%d %s%s", c.Code, c.Vendor[:], c.Signature[:])
+}
+
+// TightCapabilities holds the capability lists a TightVNC server sends
+// after ServerInit
+type TightCapabilities struct {
+	ServerMessages []TightCapability
+	ClientMessages []TightCapability
+	Encodings      []TightCapability
+}
+
+// Tight tunnel and auth capability codes
+const (
+	TightNoTunnel int32 = 0
+	TightNoAuth   int32 = 1
+	TightVNCAuth  int32 = 2
+)
+
+// tightAuthTypes maps the Tight auth codes to the security types of the
+// inner handlers
+var tightAuthTypes = map[int32]SecurityType{
+	TightNoAuth:  SecTypeNone,
+	TightVNCAuth: SecTypeVNC,
+}
 
 func readTightTunnels(c Conn) (uint32, error) {
 	var n uint32
@@ -10,18 +47,161 @@ func readTightTunnels(c Conn) (uint32, error) {
 	return n, nil
 }
 
-func readTightCaps(c Conn) (int32, []byte, []byte, error) {
-	var code int32
-	var vendor [4]byte
-	var signature [8]byte
-	if err := binary.Read(c, binary.BigEndian, &code); err != nil {
-		return 0, nil, nil, err
+// maxTightCaps bounds the capability lists, real servers send a handful
+const maxTightCaps = 1024
+
+func readTightCaps(c Conn, n int) ([]TightCapability, error) {
+	if n > maxTightCaps {
+		return nil, fmt.Errorf("too many tight capabilities: %d", n)
+	}
+	caps := make([]TightCapability, n)
+	if err := binary.Read(c, binary.BigEndian, caps); err != nil {
+		return nil, err
+	}
+	return caps, nil
+}
+
+// atenTunnels reports whether the tunnel count sent after choosing security
+// type 16 is the signature of an ATEN iKVM server rather than a real count
+func atenTunnels(nt uint32) bool {
+	return nt&0xffff0ff0 == 0xaff90fb0 || nt > 0x1000000
+}
+
+// atenBlock reports whether the data following a zero tunnel count is the
+// 20 byte block of an ATEN iKVM server rather than a TightVNC auth list: a
+// small count and capabilities of vendors named in capital letters. The
+// data is peeked at, a block starting with a zero word reads as an empty
+// auth list.
+func atenBlock(c Conn) bool {
+	cc, ok := c.(*ClientConn)
+	if !ok {
+		return false
+	}
+	b, err := cc.br.Peek(4)
+	if err != nil {
+		return false
+	}
+	na := binary.BigEndian.Uint32(b)
+	if na == 0 {
+		return false
+	}
+	if na > maxTightCaps {
+		return true
+	}
+	// both the block and a list of at least one capability are 20 bytes
+	if b, err = cc.br.Peek(20); err != nil {
+		return false
+	}
+	for _, v := range b[8:12] {
+		if v < 'A' || v > 'Z' {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientAuthTight is the TightVNC security type. It negotiates the tunnel
+// and auth capabilities and runs the chosen auth with the ClientAuthNone or
+// ClientAuthVNC handler of the client config.
+//
+// ATEN iKVM servers use the same security type, when one is detected the
+// authentication goes to the ClientAuthATEN handler of the config, so one
+// config can handle both as long as ClientAuthTight comes first. ATEN
+// servers sending no tunnels are told apart by the data that follows, one
+// whose block starts with a zero word is taken for a TightVNC server and
+// needs a config with ClientAuthATEN alone.
+type ClientAuthTight struct{}
+
+func (*ClientAuthTight) Type() SecurityType {
+	return SecTypeTight
+}
+
+func (*ClientAuthTight) SubType() SecuritySubType {
+	return SecSubTypeUnknown
+}
+
+func (auth *ClientAuthTight) Auth(c Conn) error {
+	cfg := c.Config().(*ClientConfig)
+	nt, err := readTightTunnels(c)
+	if err != nil {
+		return err
+	}
+	if atenTunnels(nt) || nt == 0 && atenBlock(c) {
+		for _, h := range cfg.SecurityHandlers {
+			if aten, ok := h.(*ClientAuthATEN); ok {
+				return aten.authTunnels(c, nt)
+			}
+		}
+		return fmt.Errorf("ATEN iKVM server, no ClientAuthATEN handler configured")
+	}
+
+	if nt > 0 {
+		tunnels, err := readTightCaps(c, int(nt))
+		if err != nil {
+			return err
+		}
+		connLogger(c).Tracef("tight tunnels: %v", tunnels)
+		// tunnelling is only ever offered alongside plain connections
+		if err := binary.Write(c, binary.BigEndian, TightNoTunnel); err != nil {
+			return err
+		}
+		if err := c.Flush(); err != nil {
+			return err
+		}
+	}
+
+	var na uint32
+	if err := binary.Read(c, binary.BigEndian, &na); err != nil {
+		return err
+	}
+	// no auth types means no authentication
+	if na == 0 {
+		return nil
+	}
+	auths, err := readTightCaps(c, int(na))
+	if err != nil {
+		return err
+	}
+	connLogger(c).Tracef("tight auth types: %v", auths)
+
+	for _, h := range cfg.SecurityHandlers {
+		for _, a := range auths {
+			if st, ok := tightAuthTypes[a.Code]; !ok || st != h.Type() {
+				continue
+			}
+			if err := binary.Write(c, binary.BigEndian, a.Code); err != nil {
+				return err
+			}
+			if err := c.Flush(); err != nil {
+				return err
+			}
+			return h.Auth(c)
+		}
+	}
+	return fmt.Errorf("no handler for the tight auth types %v", auths)
+}
+
+// readTightCapabilities reads the capability lists following ServerInit
+func readTightCapabilities(c Conn) (*TightCapabilities, error) {
+	var counts struct {
+		ServerMessages uint16
+		ClientMessages uint16
+		Encodings      uint16
+		_              [2]byte
+	}
+	if err := binary.Read(c, binary.BigEndian, &counts); err != nil {
+		return nil, err
+	}
+	var caps TightCapabilities
+	var err error
+	if caps.ServerMessages, err = readTightCaps(c, int(counts.ServerMessages)); err != nil {
+		return nil, err
 	}
-	if err := binary.Read(c, binary.BigEndian, &vendor); err != nil {
-		return 0, nil, nil, err
+	if caps.ClientMessages, err = readTightCaps(c, int(counts.ClientMessages)); err != nil {
+		return nil, err
 	}
-	if err := binary.Read(c, binary.BigEndian, &signature); err != nil {
-		return 0, nil, nil, err
+	if caps.Encodings, err = readTightCaps(c, int(counts.Encodings)); err != nil {
+		return nil, err
 	}
-	return code, vendor[:], signature[:], nil
+	return &caps, nil
 }
@@ -0,0 +1,133 @@
+package vnc2video
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func tightCap(code int32, vendor, signature string) TightCapability {
+	c := TightCapability{Code: code}
+	copy(c.Vendor[:], vendor)
+	copy(c.Signature[:], signature)
+	return c
+}
+
+// TestClientAuthTight connects to a scripted TightVNC server offering a
+// tunnel and both None and VNC auth
+func TestClientAuthTight(t *testing.T) {
+	sc, cc := net.Pipe()
+	defer sc.Close()
+	encCaps := []TightCapability{tightCap(int32(EncTight), "TGHT", "TIGHT___"), tightCap(int32(EncZRLE), "TRDV", "ZRLE____")}
+	got := make(chan []byte, 1)
+	go func() {
+		var out bytes.Buffer
+		w := func(data ...interface{}) {
+			for _, d := range data {
+				binary.Write(&out, binary.BigEndian, d)
+			}
+			sc.Write(out.Bytes())
+			out.Reset()
+		}
+		read := func(n int) []byte {
+			buf := make([]byte, n)
+			io.ReadFull(sc, buf)
+			return buf
+		}
+		var replies []byte
+		w([]byte("RFB 003.008\n"))
+		read(12)
+		w(uint8(2), SecTypeVNC, SecTypeTight)
+		replies = append(replies, read(1)...)
+		w(uint32(1), tightCap(TightNoTunnel, "TGHT", "NOTUNNEL"))
+		replies = append(replies, read(4)...)
+		w(uint32(2), tightCap(TightNoAuth, "STDV", "NOAUTH__"), tightCap(TightVNCAuth, "STDV", "VNCAUTH_"))
+		replies = append(replies, read(4)...)
+		w(uint32(0))
+		read(1)
+		w(uint16(16), uint16(8), PixelFormat32bit, uint32(4), []byte("test"),
+			uint16(0), uint16(0), uint16(len(encCaps)), uint16(0), encCaps)
+		got <- replies
+		io.Copy(ioutil.Discard, sc)
+	}()
+
+	cfg := &ClientConfig{
+		SecurityHandlers: []SecurityHandler{&ClientAuthTight{}, &ClientAuthATEN{}, &ClientAuthNone{}},
+		PixelFormat:      PixelFormat32bit,
+		ClientMessageCh:  make(chan ClientMessage, 16),
+		ServerMessageCh:  make(chan ServerMessage, 16),
+		Messages:         DefaultServerMessages,
+		Encodings:        []Encoding{&RawEncoding{}},
+		ErrorCh:          make(chan error, 4),
+	}
+	conn, err := Connect(context.Background(), cc, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// security type 16, no tunnel, no auth
+	if want := []byte{16, 0, 0, 0, 0, 0, 0, 0, 1}; !bytes.Equal(<-got, want) {
+		t.Errorf("client replies are not %v", want)
+	}
+	caps := conn.TightCapabilities()
+	if caps == nil || len(caps.Encodings) != 2 || caps.Encodings[1] != encCaps[1] {
+		t.Errorf("tight capabilities are %v, want encodings %v", caps, encCaps)
+	}
+	if conn.Width() != 16 || string(conn.DesktopName()) != "test" {
+		t.Errorf("server init is %dx%d %q", conn.Width(), conn.Height(), conn.DesktopName())
+	}
+}
+
+// TestClientAuthTightNoTunnels tells ATEN iKVM servers sending no tunnels
+// from TightVNC servers by the data following the count
+func TestClientAuthTightNoTunnels(t *testing.T) {
+	block := []byte{0x8a, 0x3c, 0, 1, 0xde, 0xad, 0xbe, 0xef, 0x10, 0x20, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	for _, test := range []struct {
+		name     string
+		send     []interface{}
+		replyLen int
+		reply    []byte
+		protocol string
+	}{
+		{"aten", []interface{}{uint32(0), block}, 48, []byte("admin\x00"), "aten1"},
+		{"tight", []interface{}{uint32(0), uint32(1), tightCap(TightNoAuth, "STDV", "NOAUTH__")}, 4, []byte{0, 0, 0, 1}, ""},
+		{"tight no auth", []interface{}{uint32(0), uint32(0)}, 0, nil, ""},
+	} {
+		sc, cc := net.Pipe()
+		got := make(chan []byte, 1)
+		go func() {
+			var out bytes.Buffer
+			for _, d := range test.send {
+				binary.Write(&out, binary.BigEndian, d)
+			}
+			sc.Write(out.Bytes())
+			reply := make([]byte, test.replyLen)
+			io.ReadFull(sc, reply)
+			got <- reply
+		}()
+		cfg := &ClientConfig{
+			SecurityHandlers: []SecurityHandler{&ClientAuthTight{}, &ClientAuthATEN{Username: []byte("admin")}, &ClientAuthNone{}},
+			Encodings:        []Encoding{&RawEncoding{}},
+		}
+		conn, err := NewClientConn(cc, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := (&ClientAuthTight{}).Auth(conn); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		reply := <-got
+		if conn.Protocol() != test.protocol {
+			t.Errorf("%s: protocol is %q", test.name, conn.Protocol())
+		}
+		if !bytes.HasPrefix(reply, test.reply) {
+			t.Errorf("%s: sent %v, want %v", test.name, reply, test.reply)
+		}
+		sc.Close()
+	}
+}
@@ -2,6 +2,7 @@ package vnc2video
 
 import (
 	"bytes"
+	"crypto/cipher"
 	"crypto/des"
 	"encoding/binary"
 	"fmt"
@@ -95,6 +96,21 @@ func AuthVNCEncode(password []byte, challenge []byte) ([]byte, error) {
 	if len(challenge) != 16 {
 		return nil, fmt.Errorf("challenge size not 16 byte long")
 	}
+	// Encrypt challenge with key.
+	cipher, err := vncDESCipher(password)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(challenge); i += cipher.BlockSize() {
+		cipher.Encrypt(challenge[i:i+cipher.BlockSize()], challenge[i:i+cipher.BlockSize()])
+	}
+
+	return challenge, nil
+}
+
+// vncDESCipher returns the DES cipher keyed the VNC way by the first 8
+// bytes of password
+func vncDESCipher(password []byte) (cipher.Block, error) {
 	// Copy password string to 8 byte 0-padded slice
 	key := make([]byte, 8)
 	copy(key, password)
@@ -106,15 +122,5 @@ func AuthVNCEncode(password []byte, challenge []byte) ([]byte, error) {
 		key[i] = (key[i]&0x33)<<2 | (key[i]&0xCC)>>2 // Swap adjacent pairs
 		key[i] = (key[i]&0x0F)<<4 | (key[i]&0xF0)>>4 // Swap the 2 halves
 	}
-
-	// Encrypt challenge with key.
-	cipher, err := des.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-	for i := 0; i < len(challenge); i += cipher.BlockSize() {
-		cipher.Encrypt(challenge[i:i+cipher.BlockSize()], challenge[i:i+cipher.BlockSize()])
-	}
-
-	return challenge, nil
+	return des.NewCipher(key)
 }
@@ -5,8 +5,11 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
+	"image"
+	"io"
 	"net"
 	"sync"
+	"github.com/amitbet/vnc2video/logger"
 )
 
 var _ Conn = (*ServerConn)(nil)
@@ -40,14 +43,45 @@ func (c *ServerConn) SetEncodings(encs []EncodingType) error {
 	for _, enc := range c.cfg.Encodings {
 		encodings[enc.Type()] = enc
 	}
+	quality, compression := -1, -1
 	for _, encType := range encs {
 		if enc, ok := encodings[encType]; ok {
 			c.encodings = append(c.encodings, enc)
 		}
+		switch {
+		case encType >= EncJPEGQualityLevelPseudo1 && encType <= EncJPEGQualityLevelPseudo10:
+			quality = int(encType - EncJPEGQualityLevelPseudo1)
+		case encType >= EncCompressionLevel1 && encType <= EncCompressionLevel10:
+			compression = int(encType - EncCompressionLevel1)
+		}
 	}
+	c.stateMu.Lock()
+	c.qualityLevel, c.compressionLevel = quality, compression
+	c.stateMu.Unlock()
 	return nil
 }
 
+// JPEGQualityLevel returns the JPEG quality level 0-9 requested by the
+// client, or -1 if it did not ask for JPEG compression
+func (c *ServerConn) JPEGQualityLevel() int {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.qualityLevel
+}
+
+// CompressionLevel returns the compression level 0-9 requested by the
+// client, or -1 if it left it to the server
+func (c *ServerConn) CompressionLevel() int {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.compressionLevel
+}
+
+// tightStreams implements tightStreamer
+func (c *ServerConn) tightStreams() *[4]*tightStream {
+	return &c.tightZlib
+}
+
 // SetProtoVersion ??? sets proto version
 func (c *ServerConn) SetProtoVersion(pv string) {
 	c.protocol = pv
@@ -72,6 +106,12 @@ func (c *ServerConn) Read(buf []byte) (int, error) {
 	return c.br.Read(buf)
 }
 
+func (c *ServerConn) secure(wrap func(r io.Reader, w io.Writer) io.ReadWriter) {
+	ch := wrap(c.br, c.bw)
+	c.br = bufio.NewReader(ch)
+	c.bw = bufio.NewWriter(ch)
+}
+
 // Write writes data to net.Conn, must be Flashed
 func (c *ServerConn) Write(buf []byte) (int, error) {
 	return c.bw.Write(buf)
@@ -185,6 +225,229 @@ type ServerConn struct {
 	pixelFormat PixelFormat
 
 	quit chan struct{}
+
+	// sendMu serializes messages written with SendMessage
+	sendMu    sync.Mutex
+	clipboard clipboardState
+
+	// announced holds the pseudo-encodings whose support has already been
+	// announced to the client, it is only used by the message handler
+	announced map[EncodingType]bool
+
+	stateMu           sync.Mutex
+	continuousUpdates bool
+	updateArea        image.Rectangle
+	// qualityLevel and compressionLevel are the levels of the client's
+	// quality and compression pseudo-encodings, -1 if it sent none
+	qualityLevel     int
+	compressionLevel int
+
+	// tightZlib holds the zlib streams of the Tight encoder, it is only
+	// used by the goroutine writing the updates
+	tightZlib [4]*tightStream
+}
+
+// ContinuousUpdates reports whether the client enabled continuous updates
+// and the area it wants to receive updates for
+func (c *ServerConn) ContinuousUpdates() (bool, image.Rectangle) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.continuousUpdates, c.updateArea
+}
+
+// announce sends the message announcing support for enc, once per conn
+func (c *ServerConn) announce(enc EncodingType, msg ServerMessage) error {
+	if c.announced[enc] || c.GetEncInstance(enc) == nil {
+		return nil
+	}
+	if c.announced == nil {
+		c.announced = make(map[EncodingType]bool)
+	}
+	c.announced[enc] = true
+	return c.SendMessage(msg)
+}
+
+// SendMessage writes msg to the client, it is safe to call concurrently
+// with other SendMessage calls and with the message handler
+func (c *ServerConn) SendMessage(msg ServerMessage) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return msg.Write(c)
+}
+
+// UpdateWriter streams a FramebufferUpdate whose number of rectangles is not
+// known in advance, messages sent meanwhile wait until Close ends it. A
+// failed write leaves the update half sent, which the client can't parse
+// past, so it ends the update and closes the connection.
+type UpdateWriter struct {
+	c      *ServerConn
+	closed bool
+}
+
+// BeginUpdate starts a FramebufferUpdate of unknown length, it needs the
+// client to support the LastRect pseudo-encoding. No other message is sent
+// until the update ends, so Close must be called, best deferred.
+func (c *ServerConn) BeginUpdate() (*UpdateWriter, error) {
+	if c.GetEncInstance(EncLastRectPseudo) == nil {
+		return nil, fmt.Errorf("client does not support %s", EncLastRectPseudo)
+	}
+	c.sendMu.Lock()
+	w := &UpdateWriter{c: c}
+	for _, v := range []interface{}{FramebufferUpdateMsgType, [1]byte{}, NumRectUnknown} {
+		if err := binary.Write(c, binary.BigEndian, v); err != nil {
+			w.abort()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// WriteRect sends the next rectangle of the update
+func (w *UpdateWriter) WriteRect(rect *Rectangle) error {
+	if w.closed {
+		return fmt.Errorf("write to a closed update")
+	}
+	err := rect.Write(w.c)
+	if err == nil {
+		err = w.c.Flush()
+	}
+	if err != nil {
+		w.abort()
+	}
+	return err
+}
+
+// Close ends the update with a LastRect rectangle
+func (w *UpdateWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	err := lastRect().Write(w.c)
+	if err == nil {
+		err = w.c.Flush()
+	}
+	if err != nil {
+		w.abort()
+		return err
+	}
+	w.closed = true
+	w.c.sendMu.Unlock()
+	return nil
+}
+
+// abort ends an update that failed to be written
+func (w *UpdateWriter) abort() {
+	w.closed = true
+	w.c.sendMu.Unlock()
+	w.c.Close()
+}
+
+// ExtendedClipboard reports whether the client supports the extended
+// clipboard protocol
+func (c *ServerConn) ExtendedClipboard() bool {
+	return c.clipboard.Extended()
+}
+
+// SetClipboard sets the client clipboard, using the extended clipboard
+// protocol when available and Latin-1 cut text otherwise
+func (c *ServerConn) SetClipboard(data *ClipboardData) error {
+	if ec := c.clipboard.set(data); ec != nil {
+		return c.SendMessage(&ServerCutText{Extended: ec})
+	}
+	return c.SendMessage(&ServerCutText{Text: clipboardDataToLatin1(data)})
+}
+
+// Redirect asks the client to reconnect to the server at host:port, it
+// fails unless both the client and ServerConfig.Encodings have
+// ClientRedirectPseudoEncoding
+func (c *ServerConn) Redirect(host string, port uint16) error {
+	if c.GetEncInstance(EncClientRedirect) == nil {
+		return fmt.Errorf("client does not support redirects")
+	}
+	return c.SendMessage(&FramebufferUpdate{
+		NumRect: 1,
+		Rects: []*Rectangle{{
+			X:       port,
+			EncType: EncClientRedirect,
+			Enc:     &ClientRedirectPseudoEncoding{Port: port, Host: []byte(host)},
+		}},
+	})
+}
+
+// RequestClipboard asks the client for its clipboard contents, which are
+// delivered on ServerConfig.ClipboardCh
+func (c *ServerConn) RequestClipboard() error {
+	if ec := c.clipboard.request(); ec != nil {
+		return c.SendMessage(&ServerCutText{Extended: ec})
+	}
+	return nil
+}
+
+// handleClientMessage performs the protocol bookkeeping for messages
+// received from the client
+func (c *ServerConn) handleClientMessage(msg ClientMessage) error {
+	switch msg := msg.(type) {
+	case *SetEncodings:
+		for _, enc := range msg.Encodings {
+			var err error
+			switch enc {
+			case EncExtendedClipboardPseudo:
+				err = c.announce(enc, &ServerCutText{Extended: c.clipboard.caps()})
+			case EncContinuousUpdatesPseudo:
+				err = c.announce(enc, &EndOfContinuousUpdates{})
+			case EncFencePseudo:
+				err = c.announce(enc, &ServerFence{Flags: FenceFlagRequest})
+			case EncXvpPseudo:
+				if c.cfg.Xvp != nil {
+					err = c.announce(enc, &ServerXvp{Version: xvpVersion, Code: XvpInit})
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case *EnableContinuousUpdates:
+		c.stateMu.Lock()
+		c.continuousUpdates = msg.Enable != 0
+		c.updateArea = MakeRect(int(msg.X), int(msg.Y), int(msg.Width), int(msg.Height))
+		c.stateMu.Unlock()
+		if msg.Enable == 0 {
+			return c.SendMessage(&EndOfContinuousUpdates{})
+		}
+	case *ClientFence:
+		if msg.Flags&FenceFlagRequest != 0 {
+			return c.SendMessage(&ServerFence{Flags: fenceReplyFlags(msg.Flags), Payload: msg.Payload})
+		}
+	case *ClientXvp:
+		if c.cfg.Xvp == nil || !c.announced[EncXvpPseudo] {
+			return nil
+		}
+		err := fmt.Errorf("not a xvp operation")
+		if msg.Code == XvpShutdown || msg.Code == XvpReboot || msg.Code == XvpReset {
+			err = c.cfg.Xvp(c, msg.Code)
+		}
+		if err != nil {
+			connLogger(c).Errorf("xvp %s failed: %v", msg.Code, err)
+			return c.SendMessage(&ServerXvp{Version: xvpVersion, Code: XvpFail})
+		}
+	case *ClientCutText:
+		var data *ClipboardData
+		if msg.Extended != nil {
+			var reply *ExtendedClipboard
+			reply, data = c.clipboard.receive(msg.Extended, false)
+			if reply != nil {
+				if err := c.SendMessage(&ServerCutText{Extended: reply}); err != nil {
+					return err
+				}
+			}
+		} else {
+			data = latin1ToClipboardData(msg.Text)
+		}
+		if data != nil && c.cfg.ClipboardCh != nil {
+			c.cfg.ClipboardCh <- data
+		}
+	}
+	return nil
 }
 
 var (
@@ -212,6 +475,20 @@ type ServerConfig struct {
 	Height           uint16
 	Width            uint16
 	ErrorCh          chan error
+	// ClipboardCh receives the client clipboard contents, it is optional
+	ClipboardCh chan *ClipboardData
+	// Xvp performs the xvp power operations asked by the clients, xvp is
+	// announced to the clients only when it is set and XvpPseudoEncoding
+	// is in Encodings. A failed operation is reported to the client.
+	Xvp func(c Conn, code XvpCode) error
+	// MinVersion and MaxVersion bound the protocol version spoken with the
+	// clients, one of ProtoVersion33, ProtoVersion37 and ProtoVersion38, 3.3
+	// and 3.8 when not set. MaxVersion is the version announced.
+	MinVersion string
+	MaxVersion string
+	// Logger is the logger of the session, by default the logger package's
+	// default logger is used
+	Logger logger.Logger
 }
 
 // NewServerConn returns new  Server connection fron net.Conn
@@ -227,6 +504,9 @@ func NewServerConn(c net.Conn, cfg *ServerConfig) (*ServerConn, error) {
 		fbWidth:     cfg.Width,
 		fbHeight:    cfg.Height,
 		quit:        make(chan struct{}),
+
+		qualityLevel:     -1,
+		compressionLevel: -1,
 	}, nil
 }
 
@@ -236,7 +516,11 @@ func Serve(ctx context.Context, ln net.Listener, cfg *ServerConfig) error {
 
 		c, err := ln.Accept()
 		if err != nil {
-			continue
+			// a closed listener would spin here forever
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
 		}
 
 		conn, err := NewServerConn(c, cfg)
@@ -268,7 +552,6 @@ type DefaultServerMessageHandler struct{}
 // Handle handles messages from clients
 func (*DefaultServerMessageHandler) Handle(c Conn) error {
 	cfg := c.Config().(*ServerConfig)
-	var err error
 	var wg sync.WaitGroup
 
 	defer c.Close()
@@ -279,6 +562,10 @@ func (*DefaultServerMessageHandler) Handle(c Conn) error {
 	wg.Add(2)
 
 	quit := make(chan struct{})
+	var quitOnce sync.Once
+	stop := func() {
+		quitOnce.Do(func() { close(quit) })
+	}
 
 	// server
 	go func() {
@@ -288,12 +575,9 @@ func (*DefaultServerMessageHandler) Handle(c Conn) error {
 			case <-quit:
 				return
 			case msg := <-cfg.ServerMessageCh:
-				if err = msg.Write(c); err != nil {
+				if err := c.(*ServerConn).SendMessage(msg); err != nil {
 					cfg.ErrorCh <- err
-					if quit != nil {
-						close(quit)
-						quit = nil
-					}
+					stop()
 					return
 				}
 			}
@@ -311,25 +595,22 @@ func (*DefaultServerMessageHandler) Handle(c Conn) error {
 				var messageType ClientMessageType
 				if err := binary.Read(c, binary.BigEndian, &messageType); err != nil {
 					cfg.ErrorCh <- err
-					if quit != nil {
-						close(quit)
-						quit = nil
-					}
+					stop()
 					return
 				}
 				msg, ok := clientMessages[messageType]
 				if !ok {
 					cfg.ErrorCh <- fmt.Errorf("unsupported message-type: %v", messageType)
-					close(quit)
+					stop()
 					return
 				}
 				parsedMsg, err := msg.Read(c)
+				if err == nil {
+					err = c.(*ServerConn).handleClientMessage(parsedMsg)
+				}
 				if err != nil {
 					cfg.ErrorCh <- err
-					if quit != nil {
-						close(quit)
-						quit = nil
-					}
+					stop()
 					return
 				}
 				cfg.ClientMessageCh <- parsedMsg
@@ -0,0 +1,280 @@
+package vnc2video
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"image/color"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amitbet/vnc2video/logger"
+)
+
+// encodedRect writes pre-encoded rectangle data, standing in for server
+// side encoders
+type encodedRect struct {
+	typ  EncodingType
+	data []byte
+}
+
+func (e *encodedRect) Type() EncodingType          { return e.typ }
+func (e *encodedRect) Supported(Conn) bool         { return true }
+func (e *encodedRect) Reset() error                { return nil }
+func (e *encodedRect) Read(Conn, *Rectangle) error { return nil }
+func (e *encodedRect) Write(c Conn, rect *Rectangle) error {
+	_, err := c.Write(e.data)
+	return err
+}
+
+func tightCompactLength(l int) []byte {
+	b := []byte{byte(l & 0x7F)}
+	if l > 0x7F {
+		b[0] |= 0x80
+		b = append(b, byte((l>>7)&0x7F))
+		if l > 0x3FFF {
+			b[1] |= 0x80
+			b = append(b, byte(l>>14))
+		}
+	}
+	return b
+}
+
+// tightUpdate returns a FramebufferUpdate with a tight fill rect and a
+// zlib compressed tight rect, both of color col
+func tightUpdate(t *testing.T, zw *zlib.Writer, zbuf *bytes.Buffer, col color.RGBA) *FramebufferUpdate {
+	fill := []byte{TightCompressionFill << 4, col.R, col.G, col.B}
+
+	pixels := make([]byte, 0, 8*8*3)
+	for i := 0; i < 8*8; i++ {
+		pixels = append(pixels, col.R, col.G, col.B)
+	}
+	zbuf.Reset()
+	if _, err := zw.Write(pixels); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	basic := append([]byte{0}, tightCompactLength(zbuf.Len())...)
+	basic = append(basic, zbuf.Bytes()...)
+
+	return &FramebufferUpdate{
+		NumRect: 2,
+		Rects: []*Rectangle{
+			{X: 0, Y: 0, Width: 8, Height: 8, EncType: EncTight, Enc: &encodedRect{EncTight, fill}},
+			{X: 8, Y: 8, Width: 8, Height: 8, EncType: EncTight, Enc: &encodedRect{EncTight, basic}},
+		},
+	}
+}
+
+// authSession connects a client and a server using the given security
+// handlers, then sends a message to check the connection is usable
+func authSession(t *testing.T, server, client SecurityHandler) error {
+	return versionSession(t, server, client, ProtoVersionUnknown, ProtoVersionUnknown)
+}
+
+// versionSession is authSession with the highest version the server and
+// the client speak
+func versionSession(t *testing.T, server, client SecurityHandler, serverVersion, clientVersion string) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	scfg := &ServerConfig{
+		SecurityHandlers: []SecurityHandler{server},
+		Encodings:        []Encoding{&RawEncoding{}},
+		PixelFormat:      PixelFormat32bit,
+		ClientMessageCh:  make(chan ClientMessage, 16),
+		ServerMessageCh:  make(chan ServerMessage, 16),
+		Messages:         DefaultClientMessages,
+		Width:            16,
+		Height:           16,
+		ErrorCh:          make(chan error, 4),
+		MaxVersion:       serverVersion,
+	}
+	go Serve(context.Background(), ln, scfg)
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return err
+	}
+	ccfg := &ClientConfig{
+		SecurityHandlers: []SecurityHandler{client},
+		PixelFormat:      PixelFormat32bit,
+		ClientMessageCh:  make(chan ClientMessage, 16),
+		ServerMessageCh:  make(chan ServerMessage, 16),
+		Messages:         DefaultServerMessages,
+		Encodings:        []Encoding{&RawEncoding{}},
+		ErrorCh:          make(chan error, 4),
+		MaxVersion:       clientVersion,
+	}
+	cc, err := Connect(context.Background(), nc, ccfg)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	if cc.Width() != 16 || cc.Height() != 16 {
+		return fmt.Errorf("server init is %dx%d", cc.Width(), cc.Height())
+	}
+
+	scfg.ServerMessageCh <- &Bell{}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-ccfg.ServerMessageCh:
+			if _, ok := msg.(*Bell); ok {
+				return nil
+			}
+		case err := <-ccfg.ErrorCh:
+			return err
+		case <-timeout:
+			return fmt.Errorf("no bell received")
+		}
+	}
+}
+
+func runSession(t *testing.T, id int) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	scfg := &ServerConfig{
+		SecurityHandlers: []SecurityHandler{&ServerAuthNone{}},
+		Encodings:        []Encoding{&RawEncoding{}, &TightEncoding{}},
+		PixelFormat:      PixelFormat32bit,
+		ClientMessageCh:  make(chan ClientMessage, 16),
+		ServerMessageCh:  make(chan ServerMessage, 16),
+		Messages:         DefaultClientMessages,
+		Width:            32,
+		Height:           32,
+		ErrorCh:          make(chan error, 4),
+		Logger:           logger.NewSimpleLogger(logger.LogLevelError, fmt.Sprintf("server %d", id)),
+	}
+	go Serve(context.Background(), ln, scfg)
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return err
+	}
+	ccfg := &ClientConfig{
+		SecurityHandlers: []SecurityHandler{&ClientAuthNone{}},
+		PixelFormat:      PixelFormat32bit,
+		ClientMessageCh:  make(chan ClientMessage, 16),
+		ServerMessageCh:  make(chan ServerMessage, 16),
+		Messages:         DefaultServerMessages,
+		Encodings:        []Encoding{&RawEncoding{}, &TightEncoding{}},
+		ErrorCh:          make(chan error, 4),
+		AutoUpdates:      true,
+		Logger:           logger.NewSimpleLogger(logger.LogLevelError, fmt.Sprintf("client %d", id)),
+	}
+	cc, err := Connect(context.Background(), nc, ccfg)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	for _, enc := range ccfg.Encodings {
+		enc.(Renderer).SetTargetImage(cc.Canvas)
+	}
+
+	// every session draws its own colors, one update per request, all
+	// through the same zlib stream
+	zbuf := &bytes.Buffer{}
+	zw := zlib.NewWriter(zbuf)
+	colors := []color.RGBA{
+		{R: uint8(id), G: 10, B: 20, A: 1},
+		{R: uint8(id), G: 30, B: 40, A: 1},
+		{R: uint8(id), G: 50, B: 60, A: 1},
+	}
+	sent, received := 0, 0
+	timeout := time.After(10 * time.Second)
+	for received < len(colors) {
+		select {
+		case msg := <-scfg.ClientMessageCh:
+			if _, ok := msg.(*FramebufferUpdateRequest); ok && sent < len(colors) {
+				scfg.ServerMessageCh <- tightUpdate(t, zw, zbuf, colors[sent])
+				sent++
+			}
+		case msg := <-ccfg.ServerMessageCh:
+			if _, ok := msg.(*FramebufferUpdate); !ok {
+				continue
+			}
+			want := colors[received]
+			for _, p := range [][2]int{{0, 0}, {7, 7}, {8, 8}, {15, 15}} {
+				r, g, b, _ := cc.Canvas.At(p[0], p[1]).RGBA()
+				if uint8(r) != want.R || uint8(g) != want.G || uint8(b) != want.B {
+					return fmt.Errorf("session %d update %d: pixel %v is %d,%d,%d want %v", id, received, p, r, g, b, want)
+				}
+			}
+			received++
+		case err := <-ccfg.ErrorCh:
+			return err
+		case err := <-scfg.ErrorCh:
+			return err
+		case <-timeout:
+			return fmt.Errorf("session %d timed out after %d updates", id, received)
+		}
+	}
+	return nil
+}
+
+// TestParallelSessions runs sessions concurrently, go test -race verifies
+// that they share no state
+func TestParallelSessions(t *testing.T) {
+	const sessions = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, sessions)
+	for i := 0; i < sessions; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			if err := runSession(t, id); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// countLogger counts the debug messages logged through it
+type countLogger struct {
+	logger.Logger
+	mu     sync.Mutex
+	debugs int
+}
+
+func (l *countLogger) Debug(v ...interface{}) {
+	l.mu.Lock()
+	l.debugs++
+	l.mu.Unlock()
+}
+
+func (l *countLogger) Debugf(format string, v ...interface{}) { l.Debug() }
+
+func TestEncodingsLogToConnLogger(t *testing.T) {
+	log := &countLogger{Logger: logger.NewSimpleLogger(logger.LogLevelError, "test")}
+	c, err := NewClientConn(nil, &ClientConfig{Encodings: []Encoding{&RawEncoding{}}, Logger: log})
+	if err != nil {
+		t.Fatal(err)
+	}
+	(&QEMUExtendedKeyEventPseudoEncoding{}).Read(c, &Rectangle{})
+	(&QEMUPointerMotionChangePseudoEncoding{}).Read(c, &Rectangle{})
+	if log.debugs != 2 {
+		t.Errorf("%d messages logged to the connection logger, want 2", log.debugs)
+	}
+
+	enc := &TightEncoding{}
+	if enc.GetInstance() == enc || enc.GetInstance() == enc.GetInstance() {
+		t.Error("GetInstance shares a TightEncoding")
+	}
+}
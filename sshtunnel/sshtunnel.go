@@ -0,0 +1,270 @@
+// Package sshtunnel reaches VNC servers through SSH port forwarding,
+// optionally over jump hosts, so that vnc2video clients need no tunnel
+// set up outside the process.
+package sshtunnel
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Config describes the SSH hosts to go through and how to authenticate
+type Config struct {
+	// Hops are the SSH hosts as [user@]host[:port], the jump hosts first
+	// and the host forwarding to the VNC server last
+	Hops []string
+	// User is the user of the hops without one, the current user when empty
+	User string
+	// KeyFiles are the private keys to authenticate with, Passphrase
+	// decrypts the encrypted ones and is not used for the others
+	KeyFiles   []string
+	Passphrase []byte
+	// Signers are keys to authenticate with in addition to KeyFiles
+	Signers []ssh.Signer
+	// Agent authenticates with the keys of the agent at SSH_AUTH_SOCK
+	Agent bool
+	// KnownHostsFiles verify the host keys, ~/.ssh/known_hosts when empty
+	KnownHostsFiles []string
+	// HostKeyCallback verifies the host keys instead of KnownHostsFiles
+	HostKeyCallback ssh.HostKeyCallback
+	// Timeout limits the TCP connection and the handshake of every hop,
+	// 30 seconds when not set
+	Timeout time.Duration
+}
+
+// Dialer opens connections on the far side of the SSH hops, its Dial
+// method fits vnc2video.ClientConfig.Dial
+type Dialer struct {
+	mu      sync.Mutex
+	clients []*ssh.Client
+	closers []func() error
+}
+
+// NewDialer connects to the hops of cfg, every one through the previous one
+func NewDialer(cfg *Config) (*Dialer, error) {
+	if len(cfg.Hops) == 0 {
+		return nil, fmt.Errorf("sshtunnel: no SSH host")
+	}
+	d := &Dialer{}
+	auth, err := cfg.authMethods(d)
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	hostKeys := cfg.HostKeyCallback
+	if hostKeys == nil {
+		if hostKeys, err = cfg.knownHosts(); err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	for _, hop := range cfg.Hops {
+		user, addr := cfg.splitHop(hop)
+		sshCfg := &ssh.ClientConfig{
+			User:            user,
+			Auth:            auth,
+			HostKeyCallback: hostKeys,
+			Timeout:         timeout,
+		}
+		if cfg.HostKeyCallback == nil {
+			sshCfg.HostKeyAlgorithms = hostKeyAlgorithms(hostKeys, addr)
+		}
+		var nc net.Conn
+		if len(d.clients) == 0 {
+			nc, err = net.DialTimeout("tcp", addr, timeout)
+		} else {
+			nc, err = d.clients[len(d.clients)-1].Dial("tcp", addr)
+		}
+		if err != nil {
+			d.Close()
+			return nil, fmt.Errorf("sshtunnel: %s: %v", addr, err)
+		}
+		nc.SetDeadline(time.Now().Add(timeout))
+		conn, chans, reqs, err := ssh.NewClientConn(nc, addr, sshCfg)
+		if err != nil {
+			nc.Close()
+			d.Close()
+			return nil, fmt.Errorf("sshtunnel: %s: %v", addr, err)
+		}
+		nc.SetDeadline(time.Time{})
+		d.clients = append(d.clients, ssh.NewClient(conn, chans, reqs))
+	}
+	return d, nil
+}
+
+// Dial connects to address from the last hop, network must be tcp
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.clients) == 0 {
+		return nil, fmt.Errorf("sshtunnel: dialer closed")
+	}
+	return d.clients[len(d.clients)-1].Dial(network, address)
+}
+
+// Close closes the SSH connections, and with them the connections dialed
+func (d *Dialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var err error
+	// the last hop goes through the previous ones
+	for i := len(d.clients) - 1; i >= 0; i-- {
+		if e := d.clients[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	d.clients = nil
+	for _, c := range d.closers {
+		c()
+	}
+	d.closers = nil
+	return err
+}
+
+// Dial connects to address through the hops of cfg, the SSH connections
+// are closed with the returned connection
+func Dial(cfg *Config, address string) (net.Conn, error) {
+	d, err := NewDialer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c, err := d.Dial("tcp", address)
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	return &tunnelConn{Conn: c, d: d}, nil
+}
+
+// tunnelConn closes its dialer along with the connection
+type tunnelConn struct {
+	net.Conn
+	d *Dialer
+}
+
+func (c *tunnelConn) Close() error {
+	err := c.Conn.Close()
+	c.d.Close()
+	return err
+}
+
+// splitHop returns the user and the host:port of a hop
+func (cfg *Config) splitHop(hop string) (string, string) {
+	user := cfg.User
+	for i := len(hop) - 1; i >= 0; i-- {
+		if hop[i] == '@' {
+			user, hop = hop[:i], hop[i+1:]
+			break
+		}
+	}
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	if _, _, err := net.SplitHostPort(hop); err != nil {
+		hop = net.JoinHostPort(hop, "22")
+	}
+	return user, hop
+}
+
+// authMethods returns the public key authentication of the key files,
+// signers and agent, the agent connection is closed with d
+func (cfg *Config) authMethods(d *Dialer) ([]ssh.AuthMethod, error) {
+	signers := append([]ssh.Signer(nil), cfg.Signers...)
+	for _, file := range cfg.KeyFiles {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("sshtunnel: %v", err)
+		}
+		// keys without a passphrase are refused by
+		// ParsePrivateKeyWithPassphrase
+		signer, err := ssh.ParsePrivateKey(pem)
+		if _, ok := err.(*ssh.PassphraseMissingError); ok && len(cfg.Passphrase) > 0 {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, cfg.Passphrase)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("sshtunnel: %s: %v", file, err)
+		}
+		signers = append(signers, signer)
+	}
+	var auth []ssh.AuthMethod
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	if cfg.Agent {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil, fmt.Errorf("sshtunnel: no SSH agent, SSH_AUTH_SOCK is not set")
+		}
+		ac, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, fmt.Errorf("sshtunnel: agent: %v", err)
+		}
+		d.closers = append(d.closers, ac.Close)
+		auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(ac).Signers))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("sshtunnel: no key file, signer or agent to authenticate with")
+	}
+	return auth, nil
+}
+
+// probeKey is a host key no known hosts file holds
+type probeKey struct{}
+
+func (probeKey) Type() string                        { return "probe" }
+func (probeKey) Marshal() []byte                     { return []byte("probe") }
+func (probeKey) Verify([]byte, *ssh.Signature) error { return errors.New("probe key") }
+
+// hostKeyAlgorithms returns the algorithms of the host keys known for
+// addr, so that a server holding keys of several types offers one that
+// can be verified. It returns nil for unknown hosts, leaving the choice to
+// the server.
+func hostKeyAlgorithms(hostKeys ssh.HostKeyCallback, addr string) []string {
+	err := hostKeys(addr, &net.TCPAddr{IP: net.IPv4zero}, probeKey{})
+	keyErr, ok := err.(*knownhosts.KeyError)
+	if !ok {
+		return nil
+	}
+	var algos []string
+	for _, k := range keyErr.Want {
+		switch typ := k.Key.Type(); typ {
+		case ssh.KeyAlgoRSA:
+			algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algos = append(algos, typ)
+		}
+	}
+	return algos
+}
+
+// knownHosts returns the host key verification of the known hosts files
+func (cfg *Config) knownHosts() (ssh.HostKeyCallback, error) {
+	files := cfg.KnownHostsFiles
+	if len(files) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("sshtunnel: %v", err)
+		}
+		files = []string{filepath.Join(home, ".ssh", "known_hosts")}
+	}
+	cb, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, fmt.Errorf("sshtunnel: %v", err)
+	}
+	return cb, nil
+}
@@ -0,0 +1,278 @@
+package sshtunnel
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	vnc "github.com/amitbet/vnc2video"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newSigner(t *testing.T) (ssh.Signer, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, key
+}
+
+// sshServer is an in-process SSH server accepting the client key and
+// forwarding direct-tcpip channels. It has an RSA host key, which is
+// returned, and the extra host keys.
+func sshServer(t *testing.T, clientKey ssh.PublicKey, extra ...ssh.Signer) (net.Listener, ssh.PublicKey) {
+	hostKey, _ := newSigner(t)
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if meta.User() == "vnc" && string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	cfg.AddHostKey(hostKey)
+	for _, k := range extra {
+		cfg.AddHostKey(k)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(nc, cfg)
+				if err != nil {
+					nc.Close()
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for nch := range chans {
+					if nch.ChannelType() != "direct-tcpip" {
+						nch.Reject(ssh.UnknownChannelType, "")
+						continue
+					}
+					// host, port, origin host, origin port
+					data := nch.ExtraData()
+					l := binary.BigEndian.Uint32(data)
+					host := string(data[4 : 4+l])
+					port := binary.BigEndian.Uint32(data[4+l:])
+					target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+					if err != nil {
+						nch.Reject(ssh.ConnectionFailed, err.Error())
+						continue
+					}
+					ch, creqs, err := nch.Accept()
+					if err != nil {
+						target.Close()
+						continue
+					}
+					go ssh.DiscardRequests(creqs)
+					go func() {
+						io.Copy(ch, target)
+						ch.Close()
+					}()
+					go func() {
+						io.Copy(target, ch)
+						target.Close()
+					}()
+				}
+			}()
+		}
+	}()
+	return ln, hostKey.PublicKey()
+}
+
+// vncServer serves a 24x16 desktop
+func vncServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go vnc.Serve(context.Background(), ln, &vnc.ServerConfig{
+		SecurityHandlers: []vnc.SecurityHandler{&vnc.ServerAuthNone{}},
+		Encodings:        []vnc.Encoding{&vnc.RawEncoding{}},
+		PixelFormat:      vnc.PixelFormat32bit,
+		ClientMessageCh:  make(chan vnc.ClientMessage, 16),
+		ServerMessageCh:  make(chan vnc.ServerMessage, 16),
+		Messages:         vnc.DefaultClientMessages,
+		Width:            24,
+		Height:           16,
+		ErrorCh:          make(chan error, 16),
+	})
+	return ln
+}
+
+func TestDialJumpHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshtunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clientKey, key := newSigner(t)
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_rsa")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	jumpLn, jumpKey := sshServer(t, clientKey.PublicKey())
+	defer jumpLn.Close()
+	bastionLn, bastionKey := sshServer(t, clientKey.PublicKey())
+	defer bastionLn.Close()
+	vncLn := vncServer(t)
+	defer vncLn.Close()
+	jump, bastion := jumpLn.Addr().String(), bastionLn.Addr().String()
+	knownHosts := filepath.Join(dir, "known_hosts")
+	lines := knownhosts.Line([]string{jump}, jumpKey) + "\n" + knownhosts.Line([]string{bastion}, bastionKey) + "\n"
+	if err := ioutil.WriteFile(knownHosts, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{
+		Hops:            []string{jump, "vnc@" + bastion},
+		User:            "vnc",
+		KeyFiles:        []string{keyFile},
+		KnownHostsFiles: []string{knownHosts},
+	}
+	nc, err := Dial(cfg, vncLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := vnc.Connect(context.Background(), nc, &vnc.ClientConfig{
+		SecurityHandlers: []vnc.SecurityHandler{&vnc.ClientAuthNone{}},
+		PixelFormat:      vnc.PixelFormat32bit,
+		ClientMessageCh:  make(chan vnc.ClientMessage, 16),
+		ServerMessageCh:  make(chan vnc.ServerMessage, 16),
+		Messages:         vnc.DefaultServerMessages,
+		Encodings:        []vnc.Encoding{&vnc.RawEncoding{}},
+		ErrorCh:          make(chan error, 16),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	if cc.Width() != 24 || cc.Height() != 16 {
+		t.Errorf("server init through the tunnel is %dx%d", cc.Width(), cc.Height())
+	}
+
+	// a host key missing from known_hosts is refused
+	cfg.KnownHostsFiles = []string{filepath.Join(dir, "empty")}
+	ioutil.WriteFile(cfg.KnownHostsFiles[0], nil, 0600)
+	if _, err := NewDialer(cfg); err == nil {
+		t.Error("unknown host key accepted")
+	}
+	// so is a key the server does not know
+	other, _ := newSigner(t)
+	cfg.KnownHostsFiles, cfg.KeyFiles, cfg.Signers = []string{knownHosts}, nil, []ssh.Signer{other}
+	if _, err := NewDialer(cfg); err == nil {
+		t.Error("unknown client key accepted")
+	}
+}
+
+func TestKeyFilesPassphrase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshtunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// one key file is encrypted, the other one is not
+	clientKey, key := newSigner(t)
+	_, other := newSigner(t)
+	encrypted, err := ssh.MarshalPrivateKeyWithPassphrase(other, "", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for name, block := range map[string]*pem.Block{"id_encrypted": encrypted, "id_plain": plain} {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	ln, hostKey := sshServer(t, clientKey.PublicKey())
+	defer ln.Close()
+	cfg := &Config{
+		Hops:            []string{"vnc@" + ln.Addr().String()},
+		KeyFiles:        files,
+		Passphrase:      []byte("secret"),
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+	}
+	d, err := NewDialer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	// the encrypted key needs the passphrase
+	cfg.Passphrase = nil
+	if _, err := NewDialer(cfg); err == nil {
+		t.Error("encrypted key read without a passphrase")
+	}
+}
+
+func TestKnownHostKeyAlgorithms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshtunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clientKey, _ := newSigner(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server prefers its ECDSA key, the RSA one is the only one known
+	ln, rsaKey := sshServer(t, clientKey.PublicKey(), ecdsaKey)
+	defer ln.Close()
+	addr := ln.Addr().String()
+	for _, known := range []ssh.PublicKey{rsaKey, ecdsaKey.PublicKey()} {
+		knownHosts := filepath.Join(dir, "known_hosts")
+		if err := ioutil.WriteFile(knownHosts, []byte(knownhosts.Line([]string{addr}, known)+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		d, err := NewDialer(&Config{
+			Hops:            []string{"vnc@" + addr},
+			Signers:         []ssh.Signer{clientKey},
+			KnownHostsFiles: []string{knownHosts},
+		})
+		if err != nil {
+			t.Fatalf("known %s key: %v", known.Type(), err)
+		}
+		d.Close()
+	}
+}
@@ -0,0 +1,433 @@
+#!/usr/bin/env python3
+# Generates the TRLE, ZlibHex and ZYWRLE reference streams in testdata and
+# the pixels they decode to. The encoders here are written after RFC 6143
+# (TRLE), the UltraVNC ZlibHex format and libvncserver's zywrleTemplate.c
+# (ZYWRLE), independently of the Go decoders, and compress with the C zlib
+# library. The ZYWRLE analysis leaves out the server's coefficient
+# quantization, which decoders can't tell from a smoother image.
+#
+# Pixel format: 32 bpp, depth 24, little endian, R at 16, G at 8, B at 0.
+import os, struct, zlib, collections
+
+OUT = os.path.dirname(os.path.abspath(__file__))
+
+def ppm(path, w, h, px):
+    with open(path, 'wb') as f:
+        f.write(b'P6\n%d %d\n255\n' % (w, h))
+        for y in range(h):
+            for x in range(w):
+                f.write(bytes(px[y][x]))
+
+def pixel32(c):
+    r, g, b = c
+    return bytes([b, g, r, 0])
+
+def cpixel(c):
+    r, g, b = c
+    return bytes([b, g, r])
+
+def runlength(n):
+    # ZRLE/TRLE run length: n-1 as 255s and a remainder
+    n -= 1
+    out = b''
+    while n >= 255:
+        out += b'\xff'
+        n -= 255
+    return out + bytes([n])
+
+def image(w, h, f):
+    return [[f(x, y) for x in range(w)] for y in range(h)]
+
+def sub(img, x0, y0, w, h):
+    return [row[x0:x0 + w] for row in img[y0:y0 + h]]
+
+# ---- TRLE / ZRLE tiles (RFC 6143 7.7.5, 7.7.6) ----
+
+class RLETileEncoder:
+    def __init__(self, trle):
+        self.trle = trle
+        self.palette = None
+        self.used = collections.Counter()
+
+    def tile(self, t):
+        h, w = len(t), len(t[0])
+        flat = [c for row in t for c in row]
+        colors = []
+        for c in flat:
+            if c not in colors:
+                colors.append(c)
+        if len(colors) == 1:
+            self.used['solid'] += 1
+            return b'\x01' + cpixel(colors[0])
+        runs = []
+        for c in flat:
+            if runs and runs[-1][0] == c:
+                runs[-1][1] += 1
+            else:
+                runs.append([c, 1])
+        cands = []
+        if len(colors) <= 16:
+            reuse = self.trle and self.palette is not None and set(colors) <= set(self.palette)
+            pal = self.palette if reuse else sorted(colors)
+            bits = 1 if len(pal) <= 2 else 2 if len(pal) <= 4 else 4
+            packed = b''
+            for row in t:
+                acc, n = 0, 0
+                for c in row:
+                    acc = acc << bits | pal.index(c)
+                    n += bits
+                    if n == 8:
+                        packed += bytes([acc]); acc, n = 0, 0
+                if n:
+                    packed += bytes([acc << (8 - n)])
+            prle = b''
+            for c, n in runs:
+                i = pal.index(c)
+                prle += bytes([i]) if n == 1 else bytes([i | 128]) + runlength(n)
+            paldata = b''.join(cpixel(c) for c in pal)
+            if reuse:
+                cands.append(('reused packed palette', b'\x7f' + packed, None))
+                cands.append(('reused palette RLE', b'\x81' + prle, None))
+            if len(pal) < 128 and not reuse:
+                cands.append(('packed palette', bytes([len(pal)]) + paldata + packed, pal))
+                cands.append(('palette RLE', bytes([128 + len(pal)]) + paldata + prle, pal))
+        plain = b''.join(cpixel(c) + runlength(n) for c, n in runs)
+        cands.append(('plain RLE', b'\x80' + plain, None))
+        cands.append(('raw', b'\x00' + b''.join(cpixel(c) for c in flat), None))
+        name, data, pal = min(cands, key=lambda c: len(c[1]))
+        if pal is not None:
+            self.palette = pal
+        self.used[name] += 1
+        return data
+
+    def rect(self, img, x0, y0, w, h, size):
+        out = b''
+        for ty in range(y0, y0 + h, size):
+            for tx in range(x0, x0 + w, size):
+                tw, th = min(size, x0 + w - tx), min(size, y0 + h - ty)
+                out += self.tile(sub(img, tx, ty, tw, th))
+        return out
+
+def trle_image():
+    # the tiles of a 40x20 rect at 0,0 and a 40x16 rect at 0,20
+    stripes = [(255, 0, 0), (0, 255, 0), (0, 0, 255), (255, 255, 255), (0, 0, 0)]
+    blocks = [(200, 10, 10), (10, 200, 10), (10, 10, 200)]
+    def f(x, y):
+        if y < 16:
+            if x < 16:   # checker, packed palette
+                return (0x10, 0x80, 0xf0) if (x + y) % 2 == 0 else (0xff, 0xff, 0x00)
+            if x < 32:   # solid
+                return (0x20, 0x40, 0x60)
+            return stripes[x % 5]   # packed palette of 5 colors
+        if y < 20:
+            if x < 16:   # the stripe colors in runs, reusing the palette
+                return stripes[(x // 8 + y) % 5]
+            if x < 32:   # gradient, raw
+                return (x * 13 % 256, y * 7 % 256, (x * y) % 256)
+            return ((y * 37) % 256, (y * 11) % 256, 200 if x < 36 else 50)  # plain RLE
+        if x < 16:       # large blocks, palette RLE
+            return blocks[(x // 8 + (y - 20) // 8) % 3]
+        if x < 32:       # the block colors packed, reusing the palette
+            return blocks[(x + y) % 3]
+        return blocks[(y - 20) // 6 % 3]   # runs, reusing the palette
+    return image(40, 36, f)
+
+def gen_trle():
+    os.makedirs(OUT + '/trle', exist_ok=True)
+    img = trle_image()
+    enc = RLETileEncoder(True)
+    # two rects, the second continues with the palette of the first
+    stream = enc.rect(img, 0, 0, 40, 20, 16) + enc.rect(img, 0, 20, 40, 16, 16)
+    open(OUT + '/trle/tiles.stream', 'wb').write(stream)
+    ppm(OUT + '/trle/tiles.ppm', 40, 36, img)
+    print('trle', dict(enc.used))
+
+# ---- ZlibHex (UltraVNC) ----
+
+RAW, BG, FG, ANY, COLOURED, ZRAW, ZHEX = 1, 2, 4, 8, 16, 32, 64
+MIN_COMP = 17  # tiles smaller than this are sent uncompressed
+
+def hextile_subrects(t, bg):
+    h, w = len(t), len(t[0])
+    done = [[t[y][x] == bg for x in range(w)] for y in range(h)]
+    rects = []
+    for y in range(h):
+        for x in range(w):
+            if done[y][x]:
+                continue
+            c = t[y][x]
+            x1 = x
+            while x1 + 1 < w and not done[y][x1 + 1] and t[y][x1 + 1] == c:
+                x1 += 1
+            y1 = y
+            while y1 + 1 < h and all(not done[y1 + 1][i] and t[y1 + 1][i] == c for i in range(x, x1 + 1)):
+                y1 += 1
+            for yy in range(y, y1 + 1):
+                for xx in range(x, x1 + 1):
+                    done[yy][xx] = True
+            rects.append((c, x, y, x1 - x + 1, y1 - y + 1))
+    return rects
+
+class ZlibHexEncoder:
+    def __init__(self):
+        self.raw = zlib.compressobj(6)
+        self.hex = zlib.compressobj(6)
+        self.bg = None
+        self.used = collections.Counter()
+
+    def chunk(self, z, data):
+        c = z.compress(data) + z.flush(zlib.Z_SYNC_FLUSH)
+        return struct.pack('>H', len(c)) + c
+
+    def tile(self, t):
+        flat = [c for row in t for c in row]
+        rawdata = b''.join(pixel32(c) for c in flat)
+        bg = collections.Counter(flat).most_common(1)[0][0]
+        rects = hextile_subrects(t, bg)
+        sub, body = 0, b''
+        if bg != self.bg:
+            sub |= BG
+            body += pixel32(bg)
+        if rects:
+            sub |= ANY
+            cols = set(r[0] for r in rects)
+            if len(cols) == 1:
+                sub |= FG
+                body += pixel32(rects[0][0])
+                body += bytes([len(rects)])
+                for c, x, y, w, h in rects:
+                    body += bytes([x << 4 | y, (w - 1) << 4 | (h - 1)])
+            else:
+                sub |= COLOURED
+                body += bytes([len(rects)])
+                for c, x, y, w, h in rects:
+                    body += pixel32(c) + bytes([x << 4 | y, (w - 1) << 4 | (h - 1)])
+        if len(body) >= len(rawdata):
+            self.bg = None
+            if len(rawdata) > MIN_COMP:
+                self.used['zlib raw'] += 1
+                return bytes([ZRAW]) + self.chunk(self.raw, rawdata)
+            self.used['raw'] += 1
+            return bytes([RAW]) + rawdata
+        self.bg = bg
+        if len(body) > MIN_COMP:
+            self.used['zlib hex'] += 1
+            return bytes([sub | ZHEX]) + self.chunk(self.hex, body)
+        self.used['hex'] += 1
+        return bytes([sub]) + body
+
+    def rect(self, img, x0, y0, w, h):
+        # the background carries over between the tiles of a rect only
+        self.bg = None
+        out = b''
+        for ty in range(y0, y0 + h, 16):
+            for tx in range(x0, x0 + w, 16):
+                tw, th = min(16, x0 + w - tx), min(16, y0 + h - ty)
+                out += self.tile(sub(img, tx, ty, tw, th))
+        return out
+
+def zlibhex_image():
+    def f(x, y):
+        tx, ty = x // 16, y // 16
+        n = tx + 3 * ty
+        if n == 0:   # gradient
+            return (x * 16 % 256, y * 16 % 256, (x + y) * 8 % 256)
+        if n == 1:   # checker, one foreground color
+            return (0x10, 0x80, 0xf0) if (x + y) % 2 == 0 else (0xff, 0xff, 0x00)
+        if n == 2:   # colored blocks on a background
+            if 2 <= x % 16 < 6 and y < 8:
+                return (255, 0, 0)
+            if y >= 10 and x % 16 >= 4:
+                return (0, 0, 255)
+            return (0x20, 0x40, 0x60)
+        if n in (3, 4):  # solid, the second keeps the background
+            return (0x20, 0x40, 0x60)
+        if n == 5:   # a single small subrect
+            return (0, 255, 0) if x % 16 < 2 and y % 16 < 2 else (0x20, 0x40, 0x60)
+        return (0xff, 0xff, 0x00) if x % 3 == 0 else (0x10, 0x80, 0xf0)
+    return image(40, 36, f)
+
+def gen_zlibhex():
+    os.makedirs(OUT + '/zlibhex', exist_ok=True)
+    img = zlibhex_image()
+    enc = ZlibHexEncoder()
+    # two rects, the second continues both zlib streams
+    stream = enc.rect(img, 0, 0, 40, 20) + enc.rect(img, 0, 20, 40, 16)
+    open(OUT + '/zlibhex/tiles.stream', 'wb').write(stream)
+    ppm(OUT + '/zlibhex/tiles.ppm', 40, 36, img)
+    print('zlibhex', dict(enc.used))
+
+# ---- ZYWRLE, after libvncserver's zywrleTemplate.c ----
+# A coefficient buffer entry is the 3 signed bytes of an int, [V, Y, U].
+
+def s8(v):
+    v &= 0xff
+    return v - 256 if v & 0x80 else v
+
+def harr(buf, i0, i1, ch):
+    X0, X1 = buf[i0][ch], buf[i1][ch]
+    orgX0, orgX1 = X0, X1
+    if (X0 ^ X1) & 0x80:
+        X1 += X0
+        if ((X1 ^ orgX1) & 0x80) == 0:
+            X0 -= X1
+    else:
+        X0 -= X1
+        if ((X0 ^ orgX0) & 0x80) == 0:
+            X1 += X0
+    buf[i0][ch] = s8(X1)
+    buf[i1][ch] = s8(X0)
+
+def wavelet_level(buf, top, size, l, skip):
+    # the C code walks signed char pointers over ints: s and ofs are in
+    # bytes there, in ints here
+    s = (2 << l) * skip
+    ofs = (1 << l) * skip
+    end = top + (size >> (l + 1)) * s
+    p = top
+    while p < end:
+        for ch in range(3):
+            harr(buf, p, p + ofs, ch)
+        p += s
+
+def wavelet(buf, w, h, level):
+    for l in range(level):
+        top, end, s = 0, h * w, w << l
+        while top < end:
+            wavelet_level(buf, top, w, l, 1)
+            top += s
+        top, end, s = 0, w, 1 << l
+        while top < end:
+            wavelet_level(buf, top, h, l, w)
+            top += s
+
+def inv_wavelet(buf, w, h, level):
+    for l in range(level - 1, -1, -1):
+        top, end, s = 0, w, 1 << l
+        while top < end:
+            wavelet_level(buf, top, h, l, w)
+            top += s
+        top, end, s = 0, h * w, w << l
+        while top < end:
+            wavelet_level(buf, top, w, l, 1)
+            top += s
+
+def coeff_walk(w, h, t, l):
+    # ZYWRLE_PACK_COEFF/ZYWRLE_UNPACK_COEFF: the buffer positions of the
+    # coefficients of subband t at level l
+    s = 2 << l
+    pH = 0
+    if t & 1:
+        pH += s >> 1
+    if t & 2:
+        pH += (s >> 1) * w
+    pEnd = pH + h * w
+    pLine = pH + w
+    while pH < pEnd:
+        while pH < pLine:
+            yield pH
+            pH += s
+        pH += (s - 1) * w
+        pLine += s * w
+
+def subbands(level):
+    for l in range(level):
+        for t in (3, 2, 1):
+            yield t, l
+        if l == level - 1:
+            yield 0, l
+
+def zywrle_analyze(t, level):
+    uh, uw = len(t), len(t[0])
+    mask = (1 << level) - 1
+    w, h = uw & ~mask, uh & ~mask
+    if not w or not h:
+        return None
+    buf = []
+    for y in range(h):
+        for x in range(w):
+            R, G, B = t[y][x]
+            Y = ((R + (G << 1) + B) >> 2) - 128
+            U = (B - G) >> 1
+            V = (R - G) >> 1
+            # 32 bpp masks keep all bits, -128 is moved to -127
+            if Y == -128:
+                Y += 1
+            if U == -128:
+                U += 1
+            if V == -128:
+                V += 1
+            buf.append([s8(V), s8(Y), s8(U)])
+    wavelet(buf, w, h, level)
+    out = [row[:] for row in t]
+    # ZYWRLE_INC_PTR fills the aligned w x h part row by row, the unaligned
+    # strips keep their pixels
+    k = 0
+    for tt, l in subbands(level):
+        for pos in coeff_walk(w, h, tt, l):
+            V, Y, U = buf[pos]
+            out[k // w][k % w] = (V & 0xff, Y & 0xff, U & 0xff)
+            k += 1
+    return out
+
+def clamp(v):
+    return 0 if v < 0 else 255 if v > 255 else v
+
+def zywrle_synthesize(t, level):
+    uh, uw = len(t), len(t[0])
+    mask = (1 << level) - 1
+    w, h = uw & ~mask, uh & ~mask
+    if not w or not h:
+        return t
+    buf = [None] * (w * h)
+    k = 0
+    for tt, l in subbands(level):
+        for pos in coeff_walk(w, h, tt, l):
+            R, G, B = t[k // w][k % w]
+            buf[pos] = [s8(R), s8(G), s8(B)]
+            k += 1
+    inv_wavelet(buf, w, h, level)
+    out = [row[:] for row in t]
+    for i, (V, Y, U) in enumerate(buf):
+        Y += 128
+        U <<= 1
+        V <<= 1
+        G = Y - ((U + V) >> 2)
+        B = U + G
+        R = V + G
+        out[i // w][i % w] = (clamp(R), clamp(G), clamp(B))
+    return out
+
+def zywrle_image():
+    def f(x, y):
+        return ((x * 5 + y * 2) % 256, (y * 6) % 256, (x * 3 + 40) % 256)
+    return image(70, 37, f)
+
+def gen_zywrle():
+    os.makedirs(OUT + '/zywrle', exist_ok=True)
+    img = zywrle_image()
+    h, w = len(img), len(img[0])
+    for level in (1, 2, 3):
+        z = zlib.compressobj(6)
+        data = b''
+        decoded = [row[:] for row in img]
+        worst = 0
+        for ty in range(0, h, 64):
+            for tx in range(0, w, 64):
+                tw, th = min(64, w - tx), min(64, h - ty)
+                t = sub(img, tx, ty, tw, th)
+                a = zywrle_analyze(t, level) or t
+                data += b'\x00' + b''.join(cpixel(c) for row in a for c in row)
+                d = zywrle_synthesize(a, level)
+                for y in range(th):
+                    for x in range(tw):
+                        decoded[ty + y][tx + x] = d[y][x]
+                        worst = max(worst, max(abs(p - q) for p, q in zip(d[y][x], t[y][x])))
+        zipped = z.compress(data) + z.flush(zlib.Z_SYNC_FLUSH)
+        open(OUT + '/zywrle/level%d.stream' % level, 'wb').write(struct.pack('>I', len(zipped)) + zipped)
+        ppm(OUT + '/zywrle/level%d.ppm' % level, w, h, decoded)
+        print('zywrle level', level, 'max error', worst)
+
+gen_trle()
+gen_zlibhex()
+gen_zywrle()
@@ -0,0 +1,431 @@
+package vnc2video
+
+import (
+	"bytes"
+	"image"
+	"sync"
+	"time"
+)
+
+// fenceWindow is the number of streamed updates left unanswered by the
+// fences following them before continuous updates are suspended
+const fenceWindow = 4
+
+// flowFencePayload marks the fences sent for flow control
+var flowFencePayload = []byte("vnc2video flow")
+
+// roundGrace is how long a round of requests for several regions waits for
+// the updates of the regions left out of the first update answering it
+const roundGrace = 20 * time.Millisecond
+
+// updatePacer decides when ClientConn sends FramebufferUpdateRequest
+// messages. A round of requests (one per region of interest) is in flight
+// until a FramebufferUpdate arrives, at most maxInFlight rounds are sent
+// ahead and rounds are spaced at least 1/fps apart.
+//
+// Servers usually combine the pending requests into one update, but they
+// may also answer the requests of a round one by one. So a round answered
+// by an update that left regions out waits roundGrace for updates of those
+// regions before it is done, instead of having them answer the next rounds.
+//
+// While the server streams continuous updates, a fence follows every
+// update received. The server answers fences in order with the updates it
+// sends, so unanswered fences are updates queued on the way to the client.
+// Beyond fenceWindow of them the stream is disabled, and enabled again
+// once the EndOfContinuousUpdates confirming it arrives, which is after
+// everything queued before it.
+type updatePacer struct {
+	mu          sync.Mutex
+	fps         int
+	maxInFlight int
+	regions     []image.Rectangle
+	rounds      []*updateRound
+	paused      bool
+	refresh     bool
+	lastSent    time.Time
+	fences      int
+	throttled   bool
+	wake        chan struct{}
+}
+
+func newUpdatePacer(cfg *ClientConfig) *updatePacer {
+	p := &updatePacer{
+		fps:         cfg.UpdateFPS,
+		maxInFlight: cfg.MaxInFlight,
+		regions:     append([]image.Rectangle(nil), cfg.Regions...),
+		refresh:     true,
+		wake:        make(chan struct{}, 1),
+	}
+	if p.maxInFlight <= 0 {
+		p.maxInFlight = 1
+	}
+	if len(p.regions) == 0 && !cfg.CaptureRegion.Empty() {
+		p.regions = []image.Rectangle{cfg.CaptureRegion}
+	}
+	return p
+}
+
+// notify wakes up the request loop, it never blocks
+func (p *updatePacer) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// updateRound is a round of requests in flight, pending holds the regions
+// no update was received for, answered is when the first update arrived
+type updateRound struct {
+	pending  []image.Rectangle
+	answered time.Time
+}
+
+// answer removes the regions touched by rects from the pending ones, it
+// reports whether any was
+func (r *updateRound) answer(rects []*Rectangle) bool {
+	pending := r.pending[:0]
+	for _, region := range r.pending {
+		touched := false
+		for _, rect := range rects {
+			if rect.EncType >= 0 && region.Overlaps(MakeRectFromVncRect(rect)) {
+				touched = true
+				break
+			}
+		}
+		if !touched {
+			pending = append(pending, region)
+		}
+	}
+	answered := len(pending) < len(r.pending)
+	r.pending = pending
+	return answered
+}
+
+// done records the arrival of a FramebufferUpdate with rects
+func (p *updatePacer) done(now time.Time, rects []*Rectangle) {
+	p.mu.Lock()
+	for len(p.rounds) > 0 {
+		r := p.rounds[0]
+		if r.answered.IsZero() {
+			// the first update answers the round, all of it when it
+			// holds no pixels of the regions
+			r.answered = now
+			if !r.answer(rects) {
+				r.pending = nil
+			}
+		} else if !r.answer(rects) {
+			// not one of the round's, it answers the next one
+			p.rounds = p.rounds[1:]
+			continue
+		}
+		if len(r.pending) == 0 {
+			p.rounds = p.rounds[1:]
+		}
+		break
+	}
+	p.mu.Unlock()
+	p.notify()
+}
+
+func (p *updatePacer) setPaused(paused bool) {
+	p.mu.Lock()
+	p.paused = paused
+	p.mu.Unlock()
+	p.notify()
+}
+
+func (p *updatePacer) setFPS(fps int) {
+	p.mu.Lock()
+	p.fps = fps
+	p.mu.Unlock()
+	p.notify()
+}
+
+func (p *updatePacer) setMaxInFlight(n int) {
+	if n <= 0 {
+		n = 1
+	}
+	p.mu.Lock()
+	p.maxInFlight = n
+	p.mu.Unlock()
+	p.notify()
+}
+
+// setRegions replaces the regions of interest, the next round is a full
+// refresh since the server only tracks changes inside requested areas
+func (p *updatePacer) setRegions(regions []image.Rectangle) {
+	p.mu.Lock()
+	p.regions = append([]image.Rectangle(nil), regions...)
+	p.refresh = true
+	p.mu.Unlock()
+	p.notify()
+}
+
+// fenceSent records a flow control fence sent after a streamed update, it
+// reports whether the stream has to be suspended
+func (p *updatePacer) fenceSent() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fences++
+	if p.fences > fenceWindow && !p.throttled {
+		p.throttled = true
+		return true
+	}
+	return false
+}
+
+// fenceAnswered records the answer to a flow control fence
+func (p *updatePacer) fenceAnswered() {
+	p.mu.Lock()
+	if p.fences > 0 {
+		p.fences--
+	}
+	p.mu.Unlock()
+}
+
+// streamEnded records the end of continuous updates, it reports whether
+// the stream was suspended by flow control and may be resumed
+func (p *updatePacer) streamEnded() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	throttled := p.throttled
+	p.throttled, p.fences = false, 0
+	return throttled && !p.paused
+}
+
+// isThrottled reports whether the stream is suspended by flow control
+func (p *updatePacer) isThrottled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.throttled
+}
+
+// restart forgets the rounds in flight and makes the next one a full
+// refresh, as for a new connection
+func (p *updatePacer) restart() {
+	p.mu.Lock()
+	p.rounds = nil
+	p.fences, p.throttled = 0, false
+	p.refresh = true
+	p.mu.Unlock()
+	p.notify()
+}
+
+// requestRefresh makes the next round non-incremental
+func (p *updatePacer) requestRefresh() {
+	p.mu.Lock()
+	p.refresh = true
+	p.mu.Unlock()
+	p.notify()
+}
+
+// areas returns the regions of interest clipped to the framebuffer, or
+// the whole framebuffer if there are none
+func (p *updatePacer) areas(fb image.Rectangle) []image.Rectangle {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return clipRegions(p.regions, fb)
+}
+
+func clipRegions(regions []image.Rectangle, fb image.Rectangle) []image.Rectangle {
+	if len(regions) == 0 {
+		return []image.Rectangle{fb}
+	}
+	var areas []image.Rectangle
+	for _, r := range regions {
+		if r = r.Intersect(fb); !r.Empty() {
+			areas = append(areas, r)
+		}
+	}
+	return areas
+}
+
+// next returns the requests to send now, or the time to wait before
+// asking again, a negative wait means until notified
+func (p *updatePacer) next(now time.Time, fb image.Rectangle, streaming bool) ([]*FramebufferUpdateRequest, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused || (streaming && !p.refresh) {
+		return nil, -1
+	}
+	var wait time.Duration = -1
+	if len(p.rounds) > 0 && !p.rounds[0].answered.IsZero() {
+		// the rest of the answered round is not coming
+		if wait = p.rounds[0].answered.Add(roundGrace).Sub(now); wait <= 0 {
+			p.rounds = p.rounds[1:]
+			wait = -1
+		}
+	}
+	if len(p.rounds) >= p.maxInFlight {
+		return nil, wait
+	}
+	if p.fps > 0 {
+		if wait := p.lastSent.Add(time.Second / time.Duration(p.fps)).Sub(now); wait > 0 {
+			return nil, wait
+		}
+	}
+	var inc uint8 = 1
+	if p.refresh {
+		inc = 0
+	}
+	var reqs []*FramebufferUpdateRequest
+	areas := clipRegions(p.regions, fb)
+	for _, r := range areas {
+		reqs = append(reqs, &FramebufferUpdateRequest{
+			Inc:    inc,
+			X:      uint16(r.Min.X),
+			Y:      uint16(r.Min.Y),
+			Width:  uint16(r.Dx()),
+			Height: uint16(r.Dy()),
+		})
+	}
+	if len(reqs) == 0 {
+		return nil, -1
+	}
+	p.refresh = false
+	p.rounds = append(p.rounds, &updateRound{pending: areas})
+	p.lastSent = now
+	return reqs, 0
+}
+
+// requestUpdates sends FramebufferUpdateRequest messages paced by c.updates
+// until the connection is closed
+func (c *ClientConn) requestUpdates(quit chan struct{}) {
+	p := c.updates
+	for {
+		fb := image.Rect(0, 0, int(c.Width()), int(c.Height()))
+		reqs, wait := p.next(time.Now(), fb, c.ContinuousUpdates())
+		for _, req := range reqs {
+			if err := c.SendMessage(req); err != nil {
+				c.errorCh <- err
+				return
+			}
+		}
+		if reqs != nil {
+			continue
+		}
+		var timeout <-chan time.Time
+		if wait >= 0 {
+			timeout = time.After(wait)
+		}
+		select {
+		case <-p.wake:
+		case <-timeout:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// PauseUpdates stops requesting framebuffer updates, continuous updates
+// are disabled until ResumeUpdates is called. The update methods have no
+// effect unless ClientConfig.AutoUpdates is set.
+func (c *ClientConn) PauseUpdates() error {
+	if c.updates == nil {
+		return nil
+	}
+	c.updates.setPaused(true)
+	if c.ContinuousUpdates() {
+		return c.EnableContinuousUpdates(false)
+	}
+	return nil
+}
+
+// ResumeUpdates resumes requesting framebuffer updates after PauseUpdates
+func (c *ClientConn) ResumeUpdates() error {
+	if c.updates == nil {
+		return nil
+	}
+	c.updates.setPaused(false)
+	if c.cfg.ContinuousUpdates && c.ServerSupports(EncContinuousUpdatesPseudo) {
+		return c.EnableContinuousUpdates(true)
+	}
+	return nil
+}
+
+// SetUpdateFPS changes the maximum rate of update requests, 0 requests
+// the next update as soon as the previous one arrived
+func (c *ClientConn) SetUpdateFPS(fps int) {
+	if c.updates != nil {
+		c.updates.setFPS(fps)
+	}
+}
+
+// SetMaxInFlight changes the number of update requests sent ahead of the
+// updates answering them
+func (c *ClientConn) SetMaxInFlight(n int) {
+	if c.updates != nil {
+		c.updates.setMaxInFlight(n)
+	}
+}
+
+// SetRegions limits update requests to the given regions of interest, no
+// regions means the whole framebuffer. The regions are refreshed in full.
+func (c *ClientConn) SetRegions(regions ...image.Rectangle) error {
+	if c.updates == nil {
+		return nil
+	}
+	c.updates.setRegions(regions)
+	if c.ContinuousUpdates() {
+		return c.EnableContinuousUpdates(true)
+	}
+	return nil
+}
+
+// SetCaptureRegion changes the region recorded by VncCanvas.Frame and
+// requests updates only for it, an empty rectangle captures the whole
+// framebuffer again. Video encoders expect a constant frame size, so a
+// region changed while recording should keep its size.
+func (c *ClientConn) SetCaptureRegion(r image.Rectangle) error {
+	if c.Canvas != nil {
+		c.Canvas.SetCrop(r)
+	}
+	if r.Empty() {
+		return c.SetRegions()
+	}
+	return c.SetRegions(r)
+}
+
+// RequestRefresh asks for a non-incremental update of the regions of
+// interest, without AutoUpdates it sends the request right away
+func (c *ClientConn) RequestRefresh() error {
+	if c.updates != nil {
+		c.updates.requestRefresh()
+		return nil
+	}
+	return c.SendMessage(&FramebufferUpdateRequest{Inc: 0, Width: c.Width(), Height: c.Height()})
+}
+
+// flowControl follows an update streamed by the server with a fence, and
+// suspends the stream when too many of them are unanswered
+func (c *ClientConn) flowControl() error {
+	if !c.ContinuousUpdates() || !c.ServerSupports(EncFencePseudo) || c.updates.isThrottled() {
+		return nil
+	}
+	if err := c.SendFence(FenceFlagBlockBefore, flowFencePayload); err != nil {
+		return err
+	}
+	if c.updates.fenceSent() {
+		connLogger(c).Debugf("suspending continuous updates, %d updates unanswered", fenceWindow+1)
+		return c.EnableContinuousUpdates(false)
+	}
+	return nil
+}
+
+// isFlowFence reports whether msg answers a flow control fence
+func isFlowFence(msg *ServerFence) bool {
+	return msg.Flags&FenceFlagRequest == 0 && bytes.Equal(msg.Payload, flowFencePayload)
+}
+
+// updateArea returns the bounds of the regions of interest
+func (c *ClientConn) updateArea() image.Rectangle {
+	fb := image.Rect(0, 0, int(c.Width()), int(c.Height()))
+	if c.updates == nil {
+		return fb
+	}
+	var area image.Rectangle
+	for _, r := range c.updates.areas(fb) {
+		area = area.Union(r)
+	}
+	return area
+}
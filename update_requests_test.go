@@ -0,0 +1,210 @@
+package vnc2video
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUpdatePacer(t *testing.T) {
+	fb := image.Rect(0, 0, 100, 100)
+	left, right := image.Rect(0, 0, 10, 10), image.Rect(90, 0, 100, 10)
+	start := time.Now()
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+	// in returns an update with a pixel rect in region
+	in := func(region image.Rectangle) []*Rectangle {
+		return []*Rectangle{{X: uint16(region.Min.X), Y: uint16(region.Min.Y), Width: 1, Height: 1, EncType: EncRaw}}
+	}
+	expect := func(p *updatePacer, now time.Time, n int, inc uint8) {
+		t.Helper()
+		reqs, wait := p.next(now, fb, false)
+		if len(reqs) != n {
+			t.Fatalf("%d requests, waiting %v, want %d", len(reqs), wait, n)
+		}
+		for _, req := range reqs {
+			if req.Inc != inc {
+				t.Errorf("request %+v, want incremental %d", req, inc)
+			}
+		}
+	}
+
+	// one region, one update per round
+	p := newUpdatePacer(&ClientConfig{})
+	expect(p, at(0), 1, 0)
+	expect(p, at(0), 0, 0)
+	p.done(at(1), in(left))
+	expect(p, at(1), 1, 1)
+	// an update without pixels answers the round too
+	p.done(at(2), []*Rectangle{{EncType: EncCursorPseudo}})
+	expect(p, at(2), 1, 1)
+
+	// rounds are spaced by the frame rate
+	p = newUpdatePacer(&ClientConfig{UpdateFPS: 10})
+	expect(p, at(0), 1, 0)
+	p.done(at(1), nil)
+	if reqs, wait := p.next(at(1), fb, false); reqs != nil || wait != 99*time.Millisecond {
+		t.Errorf("%d requests, waiting %v", len(reqs), wait)
+	}
+	expect(p, at(100), 1, 1)
+
+	// a server answering the requests of a round one by one
+	p = newUpdatePacer(&ClientConfig{Regions: []image.Rectangle{left, right}})
+	expect(p, at(0), 2, 0)
+	p.done(at(1), in(left))
+	if reqs, wait := p.next(at(1), fb, false); reqs != nil || wait != roundGrace {
+		t.Fatalf("%d requests, waiting %v for the rest of the round", len(reqs), wait)
+	}
+	p.done(at(2), in(right))
+	expect(p, at(2), 2, 1)
+	// a server combining them, the right region did not change
+	p.done(at(3), in(left))
+	expect(p, at(4), 0, 1)
+	expect(p, at(3).Add(roundGrace), 2, 1)
+	// another update of the left region is not one of the round's
+	p.done(at(30), in(left))
+	p.done(at(31), in(left))
+	if len(p.rounds) != 0 {
+		t.Errorf("%d rounds in flight", len(p.rounds))
+	}
+
+	// rounds sent ahead
+	p = newUpdatePacer(&ClientConfig{MaxInFlight: 2})
+	expect(p, at(0), 1, 0)
+	expect(p, at(0), 1, 1)
+	expect(p, at(0), 0, 1)
+	p.done(at(1), in(left))
+	expect(p, at(1), 1, 1)
+
+	// paused and streaming
+	p.setPaused(true)
+	p.done(at(2), nil)
+	expect(p, at(2), 0, 1)
+	p.setPaused(false)
+	if reqs, _ := p.next(at(2), fb, true); reqs != nil {
+		t.Error("incremental update requested while streaming")
+	}
+	p.requestRefresh()
+	if reqs, _ := p.next(at(2), fb, true); len(reqs) != 1 || reqs[0].Inc != 0 {
+		t.Error("no refresh requested while streaming")
+	}
+}
+
+func TestAutoUpdatesOptIn(t *testing.T) {
+	for _, auto := range []bool{false, true} {
+		c, err := NewClientConn(nil, &ClientConfig{Encodings: []Encoding{&RawEncoding{}}, AutoUpdates: auto})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (c.updates != nil) != auto {
+			t.Errorf("auto updates %v: pacer %v", auto, c.updates)
+		}
+	}
+}
+
+func TestFenceFlowControl(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// the server answers fences as it reads them, and the test lets it
+	// read one message at a time
+	scfg := &ServerConfig{
+		SecurityHandlers: []SecurityHandler{&ServerAuthNone{}},
+		Encodings:        []Encoding{&RawEncoding{}, &ContinuousUpdatesPseudoEncoding{}, &FencePseudoEncoding{}},
+		PixelFormat:      PixelFormat32bit,
+		ClientMessageCh:  make(chan ClientMessage),
+		ServerMessageCh:  make(chan ServerMessage, 16),
+		Messages:         DefaultClientMessages,
+		Width:            16,
+		Height:           16,
+		ErrorCh:          make(chan error, 4),
+	}
+	go Serve(context.Background(), ln, scfg)
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ccfg := &ClientConfig{
+		SecurityHandlers:  []SecurityHandler{&ClientAuthNone{}},
+		PixelFormat:       PixelFormat32bit,
+		ClientMessageCh:   make(chan ClientMessage, 16),
+		ServerMessageCh:   make(chan ServerMessage, 16),
+		Messages:          DefaultServerMessages,
+		Encodings:         []Encoding{&RawEncoding{}, &ContinuousUpdatesPseudoEncoding{}, &FencePseudoEncoding{}},
+		ErrorCh:           make(chan error, 4),
+		ContinuousUpdates: true,
+		AutoUpdates:       true,
+	}
+	cc, err := Connect(context.Background(), nc, ccfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	go func() {
+		for range ccfg.ServerMessageCh {
+		}
+	}()
+
+	next := func() ClientMessage {
+		select {
+		case msg := <-scfg.ClientMessageCh:
+			return msg
+		case err := <-ccfg.ErrorCh:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no client message received")
+		}
+		return nil
+	}
+	// enable waits for the client to enable or disable the stream, and
+	// returns the flow control fences and update requests sent before
+	enable := func(on uint8) (fences, requests int) {
+		for {
+			switch msg := next().(type) {
+			case *EnableContinuousUpdates:
+				if msg.Enable == on {
+					return
+				}
+			case *ClientFence:
+				if bytes.Equal(msg.Payload, flowFencePayload) {
+					fences++
+				}
+			case *FramebufferUpdateRequest:
+				requests++
+			}
+		}
+	}
+	enable(1)
+	if !cc.ContinuousUpdates() || !cc.ServerSupports(EncFencePseudo) {
+		t.Fatal("stream not enabled")
+	}
+
+	// the server keeps streaming while the fences are not answered
+	for i := 0; i < 2*fenceWindow; i++ {
+		scfg.ServerMessageCh <- &FramebufferUpdate{}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !cc.updates.isThrottled() {
+		if time.Now().After(deadline) {
+			t.Fatal("stream not suspended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fences, _ := enable(0); fences > fenceWindow+1 {
+		t.Errorf("%d fences sent before suspending the stream", fences)
+	}
+	// resumed once the queued updates arrived, without requesting any
+	if _, requests := enable(1); requests != 0 {
+		t.Errorf("%d updates requested while suspended", requests)
+	}
+	if cc.updates.isThrottled() || !cc.ContinuousUpdates() {
+		t.Error("stream not resumed")
+	}
+}
@@ -0,0 +1,157 @@
+package vnc2video
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"time"
+)
+
+// OverlayAnchor is the corner or edge of the frame an overlay sticks to
+type OverlayAnchor int
+
+const (
+	AnchorTopLeft OverlayAnchor = iota
+	AnchorTop
+	AnchorTopRight
+	AnchorBottomLeft
+	AnchorBottom
+	AnchorBottomRight
+	AnchorCenter
+)
+
+// place returns the top left corner of a box of the given size anchored in
+// frame, margin pixels away from its edges
+func (a OverlayAnchor) place(frame image.Rectangle, size image.Point, margin int) image.Point {
+	p := frame.Min.Add(image.Point{margin, margin})
+	switch a {
+	case AnchorTop, AnchorBottom, AnchorCenter:
+		p.X = frame.Min.X + (frame.Dx()-size.X)/2
+	case AnchorTopRight, AnchorBottomRight:
+		p.X = frame.Max.X - margin - size.X
+	}
+	switch a {
+	case AnchorCenter:
+		p.Y = frame.Min.Y + (frame.Dy()-size.Y)/2
+	case AnchorBottomLeft, AnchorBottom, AnchorBottomRight:
+		p.Y = frame.Max.Y - margin - size.Y
+	}
+	return p
+}
+
+// withOpacity scales the alpha of col by opacity, zero leaves it unchanged
+func withOpacity(col color.NRGBA, opacity float64) color.NRGBA {
+	if opacity > 0 && opacity < 1 {
+		col.A = uint8(float64(col.A) * opacity)
+	}
+	return col
+}
+
+// DefaultOverlayTimeFormat is the format of the {time} placeholder
+const DefaultOverlayTimeFormat = "2006-01-02 15:04:05 MST"
+
+// TextOverlay draws a line of text with the bundled bitmap font over the
+// exported frames
+type TextOverlay struct {
+	// Text is drawn with its placeholders replaced: {time} by the frame time
+	// formatted with TimeFormat, {desktop} by the desktop name of Desktop and
+	// {name} by Vars["name"]
+	Text       string
+	Vars       map[string]string
+	Desktop    Conn
+	TimeFormat string
+	// Location is the time zone of {time}, local time when nil
+	Location *time.Location
+
+	Anchor OverlayAnchor
+	Margin int
+	// Scale is the size of a font pixel, 2 when zero
+	Scale int
+	// Color is white and Background transparent when zero
+	Color      color.NRGBA
+	Background color.NRGBA
+	// Opacity from 0 to 1 scales the alpha of the colors, zero leaves them
+	// unchanged
+	Opacity float64
+}
+
+// NewStampOverlay returns the text overlay stamping the frames with the
+// time, the desktop name of c and the user in the bottom right corner
+func NewStampOverlay(c Conn, user string) *TextOverlay {
+	return &TextOverlay{
+		Text:       "{time} {desktop} {user}",
+		Vars:       map[string]string{"user": user},
+		Desktop:    c,
+		Anchor:     AnchorBottomRight,
+		Margin:     8,
+		Background: color.NRGBA{A: 0xa0},
+	}
+}
+
+// expand returns the text with its placeholders replaced
+func (o *TextOverlay) expand(now time.Time) string {
+	format := o.TimeFormat
+	if format == "" {
+		format = DefaultOverlayTimeFormat
+	}
+	loc := o.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	pairs := []string{"{time}", now.In(loc).Format(format)}
+	if o.Desktop != nil {
+		pairs = append(pairs, "{desktop}", string(o.Desktop.DesktopName()))
+	}
+	for name, value := range o.Vars {
+		pairs = append(pairs, "{"+name+"}", value)
+	}
+	return strings.NewReplacer(pairs...).Replace(o.Text)
+}
+
+// DrawOverlay implements FrameOverlay
+func (o *TextOverlay) DrawOverlay(dst draw.Image, now time.Time) {
+	text := o.expand(now)
+	if text == "" {
+		return
+	}
+	scale := o.Scale
+	if scale <= 0 {
+		scale = 2
+	}
+	col := o.Color
+	if col == (color.NRGBA{}) {
+		col = color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	}
+	pad := scale
+	size := textSize(text, scale)
+	p := o.Anchor.place(dst.Bounds(), size.Add(image.Point{2 * pad, 2 * pad}), o.Margin).Add(image.Point{pad, pad})
+	fillRectAlpha(dst, image.Rectangle{Min: p, Max: p.Add(size)}.Inset(-pad), withOpacity(o.Background, o.Opacity))
+	drawText(dst, p, text, scale, withOpacity(col, o.Opacity))
+}
+
+// ImageOverlay draws an image, such as a logo, over the exported frames
+type ImageOverlay struct {
+	Image  image.Image
+	Anchor OverlayAnchor
+	Margin int
+	// Opacity from 0 to 1 scales the alpha of the image, zero leaves it
+	// unchanged
+	Opacity float64
+}
+
+// DrawOverlay implements FrameOverlay
+func (o *ImageOverlay) DrawOverlay(dst draw.Image, now time.Time) {
+	if o.Image == nil {
+		return
+	}
+	src := o.Image.Bounds()
+	p := o.Anchor.place(dst.Bounds(), src.Size(), o.Margin)
+	r := image.Rectangle{Min: p, Max: p.Add(src.Size())}.Intersect(dst.Bounds())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			col := color.NRGBAModel.Convert(o.Image.At(src.Min.X+x-p.X, src.Min.Y+y-p.Y)).(color.NRGBA)
+			blendPixel(dst, x, y, withOpacity(col, o.Opacity))
+		}
+	}
+}
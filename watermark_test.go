@@ -0,0 +1,53 @@
+package vnc2video
+
+import (
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+func TestTextOverlay(t *testing.T) {
+	o := NewStampOverlay(&FbsConn{desktopName: "host1"}, "alice")
+	o.Location = time.UTC
+	now := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	if got, want := o.expand(now), "2020-03-04 05:06:07 UTC host1 alice"; got != want {
+		t.Errorf("stamp is %q, want %q", got, want)
+	}
+
+	canvas := NewVncCanvas(400, 60)
+	canvas.AddOverlay(o)
+	frame := canvas.FrameAt(now)
+	size := textSize(o.expand(now), 2)
+	// the text box sits in the bottom right corner, the margin stays clear
+	if changedPixels(frame.(*RGBImage).SubImage(image.Rect(400-8-size.X, 60-8-size.Y, 400-8, 60-8))) == 0 {
+		t.Error("no stamp in the bottom right corner")
+	}
+	if changedPixels(frame.(*RGBImage).SubImage(image.Rect(0, 0, 400-8-size.X-4, 60))) != 0 {
+		t.Error("stamp drawn outside its box")
+	}
+	if changedPixels(frame.(*RGBImage).SubImage(image.Rect(0, 52, 400, 60))) != 0 {
+		t.Error("stamp drawn over the margin")
+	}
+}
+
+func TestImageOverlay(t *testing.T) {
+	logo := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	for i := range logo.Pix {
+		logo.Pix[i] = 0xff
+	}
+	canvas := NewVncCanvas(10, 10)
+	canvas.AddOverlay(&ImageOverlay{Image: logo, Anchor: AnchorTopRight, Margin: 1, Opacity: 0.5})
+	frame := canvas.Frame()
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			want := color.RGBA{}
+			if x >= 5 && x < 9 && y >= 1 && y < 3 {
+				want = color.RGBA{R: 0x7f, G: 0x7f, B: 0x7f}
+			}
+			if got := rgbAt(frame, x, y); got != want {
+				t.Fatalf("pixel (%d,%d) is %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}